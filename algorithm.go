@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"strconv"
+)
+
+// Algorithm selects the hash function, matching git's "object format" repository setting.
+//
+// Hashes are always returned as [32]byte values.
+// When the algorithm produces shorter digests (as SHA1 does), only the leading bytes are used,
+// and the remainder are zero.
+type Algorithm uint8
+
+const (
+	SHA256 Algorithm = iota // The default, and git's "sha256" object format.
+	SHA1                    // Git's original (and still most common) "sha1" object format.
+)
+
+// Size returns the length of the algorithm's digests, in bytes.
+func (a Algorithm) Size() int {
+	switch a {
+	case SHA1:
+		return sha1.Size
+	default:
+		return sha256.Size
+	}
+}
+
+// New returns a fresh hash.Hash for the algorithm.
+func (a Algorithm) New() hash.Hash {
+	switch a {
+	case SHA1:
+		return sha1.New()
+	default:
+		return sha256.New()
+	}
+}
+
+// String returns the name git uses for the algorithm's object format.
+func (a Algorithm) String() string {
+	switch a {
+	case SHA1:
+		return "sha1"
+	default:
+		return "sha256"
+	}
+}
+
+// appendObjectPreamble appends the header git puts before the body of an object when hashing it: "<type> <len>\x00".
+func appendObjectPreamble(dst []byte, objectType string, size int64) []byte {
+	dst = append(dst, objectType...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, size, 10)
+	return append(dst, 0)
+}
+
+// hashObject hashes a git object whose body is already entirely in memory.
+func (a Algorithm) hashObject(objectType string, body []byte) (hash [32]byte) {
+	digester := a.New()
+	var preamble [32]byte // Enough for any sensible type name and any length.  (If not, append just allocates.)
+	digester.Write(appendObjectPreamble(preamble[:0], objectType, int64(len(body))))
+	digester.Write(body)
+	digester.Sum(hash[:0])
+	return hash
+}
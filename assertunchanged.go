@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const ErrInvalidStoredHash = "gittreehash-error-invalid-stored-hash"
+
+// hashAffectingFlags are the flags that change what hash a path has, as opposed to how it's read or how the result is shown;
+// those set to anything but their default make up the options fingerprint recorded with an --assert-unchanged hash.
+// (--algorithm does too, but is recorded on its own.)
+var hashAffectingFlags = map[string]bool{
+	"case-fold": true, "emit-null-hash": true, "exclude-suffix": true, "fail-on-unknown": true, "gitconfig": true,
+	"hash-names-only": true, "ignore-dot-git": true, "ignore-filemode": true, "lfs": true, "min-size": true,
+	"no-resolve-root": true, "paths0-as-tree": true, "prepend-path": true, "read-pipes": true, "allow-pipes": true,
+	"respect-export-ignore": true, "respect-gitattributes-eol": true, "seed": true, "skip-permission-errors": true,
+	"symlinks-as-text": true, "symlinks-as-text-from-index": true, "tracked-only": true, "unicode-normalization": true,
+}
+
+// optionsFingerprint describes the options that affect the hash, as the flags that set them, sorted,
+// leaving out any that are at their defaults: for example, "--exclude-suffix=.o --ignore-dot-git", or "" for none.
+func optionsFingerprint(fset *flag.FlagSet) string {
+	var opts []string
+	fset.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		if !hashAffectingFlags[f.Name] || value == f.DefValue {
+			return
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() && value == "true" {
+			opts = append(opts, "--"+f.Name)
+		} else {
+			opts = append(opts, "--"+f.Name+"="+value)
+		}
+	})
+	sort.Strings(opts)
+	return strings.Join(opts, " ")
+}
+
+// storedHash is what an --assert-unchanged file holds: a tree's hash, with the algorithm and options it was made with,
+// so that a hash made differently can be told apart from a tree that's changed.
+type storedHash struct {
+	Algorithm string
+	Options   string // As optionsFingerprint gives it.
+	Hash      string // In hex.
+}
+
+// marshal gives the content of an --assert-unchanged file: a comment, then a line for each field.
+func (s storedHash) marshal() []byte {
+	return []byte(fmt.Sprintf("# Written by gittreehash --assert-unchanged --update; checked by gittreehash --assert-unchanged.\nalgorithm %s\noptions %s\nhash %s\n", s.Algorithm, s.Options, s.Hash))
+}
+
+// parseStoredHash reads the content of an --assert-unchanged file, as written by storedHash.marshal.
+// Blank lines, and lines beginning with "#", are ignored.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-stored-hash -- if a line isn't one of the fields, or the algorithm or hash is missing.
+func parseStoredHash(filename string, data []byte) (storedHash, error) {
+	invalid := func(line int, reason string) error {
+		return serum.Error(ErrInvalidStoredHash,
+			serum.WithMessageTemplate("{{file}} isn't an --assert-unchanged file: line {{line}}: {{reason}}"),
+			serum.WithDetail("file", filename),
+			serum.WithDetail("line", fmt.Sprint(line)),
+			serum.WithDetail("reason", reason),
+		)
+	}
+	var s storedHash
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), " \r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, _ := strings.Cut(text, " ")
+		switch key {
+		case "algorithm":
+			s.Algorithm = value
+		case "options":
+			s.Options = value
+		case "hash":
+			s.Hash = value
+		default:
+			return storedHash{}, invalid(line, fmt.Sprintf("unknown field %q", key))
+		}
+	}
+	if s.Algorithm == "" || s.Hash == "" {
+		return storedHash{}, invalid(line, "the algorithm or hash is missing")
+	}
+	return s, nil
+}
+
+// assertUnchanged checks a hash against the one stored in an --assert-unchanged file, explaining any difference on stderr:
+// a different hash, but also a hash made with a different algorithm or options (which can't be compared), or no file at all.
+// It returns the process exit code: 0 if the hash is unchanged, 2 if not, or as per exitCode if an error occurs.
+func assertUnchanged(filename string, current storedHash) int {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if isVanished(err) {
+			fmt.Fprintf(os.Stderr, "%s doesn't exist, so there's no stored hash to compare with; run again with --update to store this one\n", filename)
+			return 2
+		}
+		err = newErrIO(err)
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	stored, err := parseStoredHash(filename, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	if stored.Algorithm != current.Algorithm || stored.Options != current.Options {
+		fmt.Fprintf(os.Stderr, "the hash in %s was made differently, so it can't be compared: hash it as it was, or run again with --update to replace it\n", filename)
+		fmt.Fprintf(os.Stderr, "  stored with:   --algorithm=%s %s\n  this run uses: --algorithm=%s %s\n", stored.Algorithm, stored.Options, current.Algorithm, current.Options)
+		return 2
+	}
+	if stored.Hash != current.Hash {
+		fmt.Fprintf(os.Stderr, "the tree has changed since its hash was stored in %s; if that's expected, run again with --update to store the new one\n", filename)
+		fmt.Fprintf(os.Stderr, "  stored: %s\n  now:    %s\n", stored.Hash, current.Hash)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+
+	"github.com/warptools/gittreehash/gitattributes"
+)
+
+const ErrGitattributes = "gittreehash-error-gitattributes"
+
+// wantsAttributes reports whether any enabled option needs .gitattributes files to be read.
+func (h *hasher) wantsAttributes() bool {
+	return h.opts.RespectGitattributesEOL || h.opts.AutoCRLF || h.opts.RespectExportIgnore || h.opts.LFS == LFSPointers || h.opts.GitIndexDigests != nil
+}
+
+// loadAttributes reads the .gitattributes file in a directory, if there is one.
+// It returns nil (and no error) if there isn't.
+//
+// Errors:
+//
+//   - gittreehash-error-gitattributes -- if the file can't be parsed.
+//   - gittreehash-error-io -- if reading the file fails.
+//   - gittreehash-error-permission -- if reading the file fails due to permissions.
+func (h *hasher) loadAttributes(dir string) (*gitattributes.File, error) {
+	body, err := fsx.ReadFile(h.fsys, filepath.Join(dir, ".gitattributes"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, newErrIO(err)
+	}
+	if dir == "." {
+		dir = ""
+	}
+	f, err := gitattributes.Parse(bytes.NewReader(body), filepath.ToSlash(dir))
+	if err != nil {
+		return nil, serum.Error(ErrGitattributes,
+			serum.WithMessageTemplate("failed to parse .gitattributes in {{dir}}: {{cause}}"),
+			serum.WithDetail("dir", dir),
+			withPathBytes("dir", dir),
+			serum.WithDetail("cause", err.Error()),
+			serum.WithCause(err),
+		)
+	}
+	return f, nil
+}
+
+// attributesFor looks up attributes for a path inside the directory described by anc.
+func (h *hasher) attributesFor(anc *ancestry, pth string, isDir bool, names ...string) map[string]gitattributes.Attr {
+	var stack gitattributes.Stack
+	for a := anc; a != nil; a = a.parent {
+		if a.attrs != nil {
+			stack = append(stack, a.attrs)
+		}
+	}
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return stack.Lookup(filepath.ToSlash(pth), isDir, names...)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+// auditLog records what the main pass saw of every entry, so that the audit pass can look again and compare.
+// See Options.Audit.
+type auditLog struct {
+	seen    map[string]auditRecord
+	skipped map[string]struct{} // Entries the ErrorHandler chose to skip.  They're not examined again.
+}
+
+type auditRecord struct {
+	mode  fs.FileMode
+	size  int64
+	mtime time.Time
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{seen: map[string]auditRecord{}, skipped: map[string]struct{}{}}
+}
+
+// auditNote records what Lstat said about a path, if auditing is enabled.
+// If the same path is noted more than once (as when a file is re-read), the last one counts.
+func (h *hasher) auditNote(pth string, fi fs.FileInfo) {
+	if h.audit == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.audit.seen[pth] = auditRecord{fi.Mode(), fi.Size(), fi.ModTime()}
+}
+
+// auditSkip records that a path was skipped, if auditing is enabled,
+// forgetting anything that was noted about it or its contents before it was abandoned.
+func (h *hasher) auditSkip(pth string) {
+	if h.audit == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.audit.skipped[pth] = struct{}{}
+	delete(h.audit.seen, pth)
+	prefix := pth + string(filepath.Separator)
+	for p := range h.audit.seen {
+		if strings.HasPrefix(p, prefix) {
+			delete(h.audit.seen, p)
+		}
+	}
+}
+
+// auditPass walks the tree again, stat-ing everything without reading any content,
+// and compares what it finds against what was noted during the main pass.
+// It applies the same filters as the main pass, so it examines exactly the same set of entries.
+//
+// Errors:
+//
+//   - gittreehash-error-concurrent-io -- if anything appeared, vanished, or changed mode, size, or modification time.
+//   - gittreehash-error-io -- if any raw IO barfs during the walk.
+//   - gittreehash-error-permission -- if IO failed due to permissions.
+//   - gittreehash-error-gitattributes -- if a .gitattributes file needed for filtering can't be parsed.
+func (h *hasher) auditPass(pth string) error {
+	var changed []string
+	if err := h.auditWalk(pth, nil, &changed); err != nil {
+		return err
+	}
+	// Anything not visited again must have vanished.
+	var vanished []string
+	for p := range h.audit.seen {
+		vanished = append(vanished, p)
+	}
+	sort.Strings(vanished)
+	changed = append(changed, vanished...)
+	if len(changed) > 0 {
+		return NewErrTreeChanged(changed)
+	}
+	return nil
+}
+
+func (h *hasher) auditWalk(pth string, anc *ancestry, changed *[]string) error {
+	if _, ok := h.audit.skipped[pth]; ok {
+		return nil
+	}
+	fi, err := fsx.Lstat(h.fsys, pth)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // Will be reported as vanished, since it's left in the log.
+		}
+		return newErrIO(err)
+	}
+	was, ok := h.audit.seen[pth]
+	delete(h.audit.seen, pth)
+	switch {
+	case !ok: // Appeared since the main pass looked.
+		*changed = append(*changed, pth)
+		return nil
+	case fi.Mode() != was.mode:
+		*changed = append(*changed, pth)
+		return nil
+	case fi.Mode()&fs.ModeNamedPipe != 0:
+		return nil // Reading a pipe is itself a change to its size and mtime, so there's nothing more to compare.
+	case fi.Size() != was.size || !fi.ModTime().Equal(was.mtime):
+		*changed = append(*changed, pth)
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	anc, err = h.descend(anc, pth, fi)
+	if err != nil {
+		return err
+	}
+	dirEnts, err := fsx.ReadDir(h.fsys, pth)
+	if err != nil {
+		return newErrIO(err)
+	}
+	for _, dirEnt := range dirEnts {
+		childPath := filepath.Join(pth, dirEnt.Name())
+		if h.excluded(anc, childPath, dirEnt) {
+			continue
+		}
+		if err := h.auditWalk(childPath, anc, changed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewErrTreeChanged(paths []string) error {
+	return serum.Error(
+		ErrConcurrentIO,
+		serum.WithMessageTemplate("the tree changed while it was being hashed: {{count}} paths differ on a second look"),
+		serum.WithDetail("count", strconv.Itoa(len(paths))),
+		serum.WithDetail("paths", strings.Join(paths, "\n")),
+	)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// runBenchmark calls hash the given number of times, one after another, printing to w how long each run took,
+// its throughput (counting the blobs hashed, and their bytes, from stats, which is reset before each run),
+// and how many heap allocations, and bytes of them, it made per blob, which is what the buffer pools are there to keep down;
+// then the shortest, longest, average, and 99th percentile times.
+// It returns the result of the last run, or the error of the first to fail.
+// A run whose hash isn't the first's is warned about, since the path must have changed in between.
+func runBenchmark(w io.Writer, runs int, stats *Stats, hash func() ([32]byte, error)) ([32]byte, error) {
+	var first, result [32]byte
+	times := make([]time.Duration, 0, runs)
+	for i := 1; i <= runs; i++ {
+		*stats = Stats{}
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		mallocs, allocBytes := mem.Mallocs, mem.TotalAlloc
+		start := time.Now()
+		var err error
+		if result, err = hash(); err != nil {
+			return [32]byte{}, err
+		}
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&mem)
+		mallocs, allocBytes = mem.Mallocs-mallocs, mem.TotalAlloc-allocBytes
+		perBlob := 1 / math.Max(float64(stats.Blobs), 1)
+		times = append(times, elapsed)
+		seconds := elapsed.Seconds()
+		fmt.Fprintf(w, "run %d/%d: %s, %.1f MB/s, %.0f files/s, %.1f allocs/file, %.1f KB/file\n", i, runs, elapsed.Round(time.Microsecond),
+			float64(stats.BlobBytes)/1e6/seconds, float64(stats.Blobs)/seconds, float64(mallocs)*perBlob, float64(allocBytes)/1e3*perBlob)
+		if i == 1 {
+			first = result
+		} else if result != first {
+			fmt.Fprintf(w, "warning: run %d gave a different hash from the first; the path changed during the benchmark\n", i)
+		}
+	}
+
+	var total time.Duration
+	for _, t := range times {
+		total += t
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	p99 := times[(len(times)*99+99)/100-1] // The nearest rank: the smallest time at least 99% of runs took no longer than.
+	fmt.Fprintf(w, "latency: min=%s max=%s avg=%s p99=%s\n", times[0].Round(time.Microsecond), times[len(times)-1].Round(time.Microsecond),
+		(total / time.Duration(len(times))).Round(time.Microsecond), p99.Round(time.Microsecond))
+	return result, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers used to feed file content into digests.
+// It's larger than io.Copy's default of 32KiB, which makes for fewer read calls on big files,
+// and since the buffers are pooled, small files don't pay for allocating it.
+const copyBufferSize = 256 << 10
+
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// treeBufferPool holds buffers for accumulating tree bodies, so that each directory doesn't grow a new one from nothing.
+var treeBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getTreeBuffer() *bytes.Buffer {
+	buf := treeBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putTreeBuffer returns a buffer to the pool.  Nothing may use it, or anything obtained from its Bytes method, afterwards.
+func putTreeBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > 1<<20 {
+		return // Let unusually large ones go, rather than pinning the memory forever.
+	}
+	treeBufferPool.Put(buf)
+}
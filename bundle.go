@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const ErrInvalidBundle = "gittreehash-error-invalid-bundle"
+
+// Object type numbers for the pack entries that aren't whole objects, but deltas against another object.
+const (
+	packObjCommit   = 1
+	packObjTag      = 4
+	packObjOfsDelta = 6
+	packObjRefDelta = 7
+)
+
+// bundleCacheLimit bounds how many bytes of objects are kept in memory as delta bases while a bundle is read.
+const bundleCacheLimit = 256 << 20
+
+// HashBundle computes the hash of a tree stored in a git bundle file (as made by `git bundle create`), without any repository:
+// the bundle's pack is read directly, the ref is resolved to a commit (peeling any tags) and then to its tree,
+// and the objects the tree reaches are hashed again with Options.Algorithm.
+// As with HashGitTree, that gives the tree's own id when the algorithm is the bundle's object format,
+// and otherwise the id the tree would have in a repository of the other format.
+//
+// The ref is a name the bundle lists, either in full (like "refs/heads/main") or abbreviated as git would (like "main", or "v1.0"),
+// or the full hex id of an object in the bundle.  A ref naming a tree or blob directly is hashed as it is.
+//
+// Bundles of both version 2 and 3 are read, in either object format, and deltified objects are resolved.
+// An incremental bundle (one with prerequisites) only contains the objects that are new since its prerequisites,
+// so a tree in it may refer to objects that aren't there; that's reported as not found.
+// Options.OnEntry is called for each entry, as by HashGitTree; other options have no effect.
+//
+// Errors:
+//
+//   - gittreehash-error-not-found -- if the bundle doesn't exist, or has no such ref, or lacks an object the tree refers to.
+//   - gittreehash-error-invalid-bundle -- if the bundle, or its pack, is malformed.
+//   - gittreehash-error-invalid-tree -- if a tree in the bundle is malformed.
+//   - gittreehash-error-unsupported-file-type -- if there's a submodule, and the algorithm isn't the bundle's.
+//   - gittreehash-error-io -- if reading the file fails.
+//   - gittreehash-error-permission -- if the file can't be read due to permissions.
+func HashBundle(bundlePath string, ref string, opts Options) ([32]byte, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		if isVanished(err) {
+			return [32]byte{}, NewErrNotFound(bundlePath)
+		}
+		return [32]byte{}, newErrIO(err)
+	}
+	defer f.Close()
+	p, refs, err := openBundle(f)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	id, err := p.resolveRef(refs, ref)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	b := &bundleReader{p: p, h: newHasher(nil, opts), hashes: map[string]gitObjectHash{}}
+
+	// Peel tags to what they point at, and commits to their trees.
+	for {
+		i, ok := p.byID[string(id)]
+		if !ok {
+			return [32]byte{}, newErrBundleObjectMissing(hex.EncodeToString(id))
+		}
+		typ, body, err := p.read(i)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		var field string
+		switch typ {
+		case packObjTag:
+			field = "object"
+		case packObjCommit:
+			field = "tree"
+		case packObjTree:
+			return b.hashObject(".", i, fs.ModeDir)
+		default:
+			return b.hashObject(".", i, 0o644)
+		}
+		if id, err = headerObjectID(body, field, p.algorithm); err != nil {
+			return [32]byte{}, err
+		}
+	}
+}
+
+// bundlePack is the pack within a bundle file, indexed so that objects can be read by id.
+type bundlePack struct {
+	f         io.ReaderAt
+	algorithm Algorithm
+	objects   []packEntry
+	byOffset  map[int64]int
+	byID      map[string]int // By the raw bytes of the id.
+	cache     map[int64]cachedObject
+	cacheSize int64
+}
+
+// packEntry is an entry in a pack, which is either a whole object or a delta against another.
+type packEntry struct {
+	offset     int64 // Of the entry's header, from the start of the pack.
+	dataOffset int64 // Of the compressed data, from the start of the file.
+	typ        int   // As stored; a delta's resolved type is known only once it's been read.
+	size       int64 // Of the data as stored (for a delta, that's the size of the delta, not of the object).
+	baseOffset int64 // For an ofs-delta, the offset of the base entry.
+	baseID     []byte
+	id         []byte // Once known.
+}
+
+type cachedObject struct {
+	typ  int
+	data []byte
+}
+
+// openBundle reads a bundle's header, and indexes its pack, returning the pack and the refs the header lists (by name).
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-bundle -- if the bundle, or its pack, is malformed.
+//   - gittreehash-error-io -- if reading the file fails.
+func openBundle(f *os.File) (*bundlePack, map[string][]byte, error) {
+	br := bufio.NewReader(f)
+	var headerLen int64
+	readLine := func() (string, error) {
+		line, err := br.ReadString('\n')
+		headerLen += int64(len(line))
+		if err == io.EOF {
+			return "", newErrInvalidBundle("the header isn't terminated by an empty line")
+		} else if err != nil {
+			return "", newErrIO(err)
+		}
+		return strings.TrimSuffix(line, "\n"), nil
+	}
+	signature, err := readLine()
+	if err != nil {
+		return nil, nil, err
+	}
+	if signature != "# v2 git bundle" && signature != "# v3 git bundle" {
+		return nil, nil, newErrInvalidBundle(fmt.Sprintf("unrecognized signature %q", signature))
+	}
+	algorithm := SHA1
+	refs := map[string][]byte{}
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, nil, err
+		}
+		if line == "" {
+			break
+		}
+		switch {
+		case strings.HasPrefix(line, "@"):
+			if signature != "# v3 git bundle" {
+				return nil, nil, newErrInvalidBundle("a version 2 bundle has a capability line")
+			}
+			switch capability := line[1:]; {
+			case capability == "object-format=sha1":
+				algorithm = SHA1
+			case capability == "object-format=sha256":
+				algorithm = SHA256
+			case strings.HasPrefix(capability, "filter="):
+				// The bundle may lack some objects; any the tree needs are reported as missing when they're looked for.
+			default:
+				return nil, nil, newErrInvalidBundle(fmt.Sprintf("unsupported capability %q", capability))
+			}
+		case strings.HasPrefix(line, "-"):
+			// A prerequisite: an object the bundle's objects may refer to, without including it.
+		default:
+			idHex, name, _ := strings.Cut(line, " ")
+			id, err := hex.DecodeString(idHex)
+			if err != nil || len(id) != algorithm.Size() || name == "" {
+				return nil, nil, newErrInvalidBundle(fmt.Sprintf("malformed ref line %q", line))
+			}
+			refs[name] = id
+		}
+	}
+	p := &bundlePack{f: f, algorithm: algorithm, byOffset: map[int64]int{}, byID: map[string]int{}, cache: map[int64]cachedObject{}}
+	if err := p.index(br, headerLen); err != nil {
+		return nil, nil, err
+	}
+	return p, refs, nil
+}
+
+// packScanner reads a pack sequentially, keeping track of the position and the checksum.
+// It's an io.ByteReader, so that zlib reads no further than the end of each entry's data.
+type packScanner struct {
+	r      *bufio.Reader
+	pos    int64
+	digest hash.Hash
+}
+
+func (s *packScanner) ReadByte() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err == nil {
+		s.pos++
+		s.digest.Write([]byte{c})
+	}
+	return c, err
+}
+
+func (s *packScanner) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	s.pos += int64(n)
+	s.digest.Write(b[:n])
+	return n, err
+}
+
+// index reads through the pack, which starts at the given offset in the file, recording where each entry is,
+// and the id of each whole object; then resolves the deltas, to find the rest of the ids.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-bundle -- if the pack is malformed, or its checksum is wrong.
+//   - gittreehash-error-io -- if reading the file fails.
+func (p *bundlePack) index(r *bufio.Reader, packStart int64) error {
+	s := &packScanner{r: r, digest: p.algorithm.New()}
+	var header [12]byte
+	if _, err := io.ReadFull(s, header[:]); err != nil {
+		return newErrPackRead(err)
+	}
+	if string(header[:4]) != "PACK" {
+		return newErrInvalidBundle("the pack doesn't start with \"PACK\"")
+	}
+	if version := binary.BigEndian.Uint32(header[4:]); version != 2 && version != 3 {
+		return newErrInvalidBundle(fmt.Sprintf("unsupported pack version %d", version))
+	}
+	count := binary.BigEndian.Uint32(header[8:])
+	zr, _ := zlib.NewReader(bytes.NewReader(emptyZlib))
+	for n := uint32(0); n < count; n++ {
+		e := packEntry{offset: s.pos}
+		c, err := s.ReadByte()
+		if err != nil {
+			return newErrPackRead(err)
+		}
+		e.typ = int(c>>4) & 7
+		e.size = int64(c & 0x0f)
+		for shift := 4; c&0x80 != 0; shift += 7 {
+			if c, err = s.ReadByte(); err != nil {
+				return newErrPackRead(err)
+			}
+			if shift > 56 {
+				return newErrInvalidBundle(fmt.Sprintf("the size of the entry at offset %d is too large", e.offset))
+			}
+			e.size |= int64(c&0x7f) << shift
+		}
+		switch e.typ {
+		case packObjCommit, packObjTree, packObjBlob, packObjTag:
+		case packObjOfsDelta:
+			c, err := s.ReadByte()
+			if err != nil {
+				return newErrPackRead(err)
+			}
+			rel := int64(c & 0x7f)
+			for c&0x80 != 0 {
+				if c, err = s.ReadByte(); err != nil {
+					return newErrPackRead(err)
+				}
+				if rel >= 1<<55 {
+					return newErrInvalidBundle(fmt.Sprintf("the base offset of the entry at offset %d is too large", e.offset))
+				}
+				rel = (rel+1)<<7 | int64(c&0x7f)
+			}
+			e.baseOffset = e.offset - rel
+			if rel <= 0 || e.baseOffset < 0 {
+				return newErrInvalidBundle(fmt.Sprintf("the entry at offset %d is a delta against an entry outside the pack", e.offset))
+			}
+		case packObjRefDelta:
+			e.baseID = make([]byte, p.algorithm.Size())
+			if _, err := io.ReadFull(s, e.baseID); err != nil {
+				return newErrPackRead(err)
+			}
+		default:
+			return newErrInvalidBundle(fmt.Sprintf("the entry at offset %d has unknown type %d", e.offset, e.typ))
+		}
+		e.dataOffset = packStart + s.pos
+
+		// Inflate the data, to find where the next entry starts; for a whole object, hash it on the way.
+		if err := zr.(zlib.Resetter).Reset(s, nil); err != nil {
+			return newErrPackData(e.offset, err)
+		}
+		var sink io.Writer = io.Discard
+		var digester hash.Hash
+		if e.typ < packObjOfsDelta {
+			digester = p.algorithm.New()
+			digester.Write(appendObjectPreamble(nil, packTypeName(e.typ), e.size))
+			sink = digester
+		}
+		inflated, err := io.Copy(sink, zr)
+		if err != nil {
+			return newErrPackData(e.offset, err)
+		}
+		if inflated != e.size {
+			return newErrPackData(e.offset, fmt.Errorf("inflated to %d bytes, rather than %d", inflated, e.size))
+		}
+		if digester != nil {
+			e.id = digester.Sum(nil)
+			p.byID[string(e.id)] = len(p.objects)
+		}
+		p.byOffset[e.offset] = len(p.objects)
+		p.objects = append(p.objects, e)
+	}
+	sum := p.algorithm.New().Sum(nil)[:0]
+	sum = s.digest.Sum(sum)
+	trailer := make([]byte, len(sum))
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return newErrPackRead(err)
+	}
+	if !bytes.Equal(sum, trailer) {
+		return newErrInvalidBundle("the pack's checksum is wrong")
+	}
+
+	// Deltas against objects in the pack can now all be resolved.  Those whose bases are ref-deltas may take a few rounds,
+	// since a base's id isn't known until it's been resolved itself; any left at the end are against objects that aren't here.
+	for progress := true; progress; {
+		progress = false
+		for i := range p.objects {
+			e := &p.objects[i]
+			if e.id != nil {
+				continue
+			}
+			if e.typ == packObjRefDelta {
+				if _, ok := p.byID[string(e.baseID)]; !ok {
+					continue
+				}
+			}
+			typ, data, err := p.read(i)
+			if err != nil {
+				return err
+			}
+			id := p.algorithm.hashObject(packTypeName(typ), data)
+			e.id = id[:p.algorithm.Size()]
+			p.byID[string(e.id)] = i
+			progress = true
+		}
+	}
+	return nil
+}
+
+// emptyZlib is a complete zlib stream of no data, which a zlib reader can be created with, to be Reset for each entry.
+var emptyZlib = []byte{0x78, 0x9c, 0x03, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+// read returns the type and content of an object, resolving deltas if need be.
+//
+// Errors:
+//
+//   - gittreehash-error-not-found -- if the object is a delta against an object that isn't in the bundle.
+//   - gittreehash-error-invalid-bundle -- if the object's data, or a delta, is malformed.
+func (p *bundlePack) read(i int) (int, []byte, error) {
+	e := p.objects[i]
+	if cached, ok := p.cache[e.offset]; ok {
+		return cached.typ, cached.data, nil
+	}
+	data, err := p.inflate(e)
+	if err != nil {
+		return 0, nil, err
+	}
+	typ := e.typ
+	var base int
+	switch e.typ {
+	case packObjOfsDelta:
+		var ok bool
+		if base, ok = p.byOffset[e.baseOffset]; !ok {
+			return 0, nil, newErrInvalidBundle(fmt.Sprintf("the entry at offset %d is a delta against offset %d, where no entry starts", e.offset, e.baseOffset))
+		}
+	case packObjRefDelta:
+		var ok bool
+		if base, ok = p.byID[string(e.baseID)]; !ok {
+			return 0, nil, newErrBundleObjectMissing(hex.EncodeToString(e.baseID))
+		}
+	default:
+		return typ, data, nil
+	}
+	baseType, baseData, err := p.read(base)
+	if err != nil {
+		return 0, nil, err
+	}
+	// The base may well be the base of other deltas too, so it's kept, within reason.
+	if _, ok := p.cache[p.objects[base].offset]; !ok {
+		if p.cacheSize+int64(len(baseData)) > bundleCacheLimit {
+			p.cache, p.cacheSize = map[int64]cachedObject{}, 0
+		}
+		p.cache[p.objects[base].offset] = cachedObject{baseType, baseData}
+		p.cacheSize += int64(len(baseData))
+	}
+	if data, err = applyDelta(baseData, data); err != nil {
+		return 0, nil, newErrPackData(e.offset, err)
+	}
+	return baseType, data, nil
+}
+
+// inflate reads and decompresses an entry's data.
+func (p *bundlePack) inflate(e packEntry) ([]byte, error) {
+	zr, err := zlib.NewReader(io.NewSectionReader(p.f, e.dataOffset, 1<<62))
+	if err != nil {
+		return nil, newErrPackData(e.offset, err)
+	}
+	defer zr.Close()
+	data := make([]byte, e.size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, newErrPackData(e.offset, err)
+	}
+	return data, nil
+}
+
+// applyDelta reconstructs an object from its base and a delta, as git's pack format describes them:
+// the sizes of the base and the result, then instructions to either copy a range of the base, or insert literal bytes.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	varint := func() (int64, error) {
+		var n int64
+		for shift := 0; ; shift += 7 {
+			if len(delta) == 0 || shift > 56 {
+				return 0, fmt.Errorf("malformed delta header")
+			}
+			c := delta[0]
+			delta = delta[1:]
+			n |= int64(c&0x7f) << shift
+			if c&0x80 == 0 {
+				return n, nil
+			}
+		}
+	}
+	baseSize, err := varint()
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != int64(len(base)) {
+		return nil, fmt.Errorf("delta expects a base of %d bytes, but it has %d", baseSize, len(base))
+	}
+	resultSize, err := varint()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, 0, resultSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0:
+			var offset, size int64
+			for bit := 0; bit < 7; bit++ {
+				if op&(1<<bit) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, fmt.Errorf("truncated copy instruction")
+				}
+				if bit < 4 {
+					offset |= int64(delta[0]) << (8 * bit)
+				} else {
+					size |= int64(delta[0]) << (8 * (bit - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > int64(len(base)) {
+				return nil, fmt.Errorf("copy instruction reaches beyond the base")
+			}
+			result = append(result, base[offset:offset+size]...)
+		case op != 0:
+			if int(op) > len(delta) {
+				return nil, fmt.Errorf("truncated insert instruction")
+			}
+			result = append(result, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, fmt.Errorf("reserved instruction 0")
+		}
+		if int64(len(result)) > resultSize {
+			return nil, fmt.Errorf("result is larger than the %d bytes expected", resultSize)
+		}
+	}
+	if int64(len(result)) != resultSize {
+		return nil, fmt.Errorf("result is %d bytes, rather than the %d expected", len(result), resultSize)
+	}
+	return result, nil
+}
+
+// resolveRef finds the object a ref names, trying the abbreviations git does, or taking it as a hex id.
+//
+// Errors:
+//
+//   - gittreehash-error-not-found -- if the bundle lists no such ref, and it's not the id of an object in the bundle.
+func (p *bundlePack) resolveRef(refs map[string][]byte, ref string) ([]byte, error) {
+	for _, format := range []string{"%s", "refs/%s", "refs/tags/%s", "refs/heads/%s", "refs/remotes/%s", "refs/remotes/%s/HEAD"} {
+		if id, ok := refs[fmt.Sprintf(format, ref)]; ok {
+			return id, nil
+		}
+	}
+	if id, err := hex.DecodeString(ref); err == nil && len(id) == p.algorithm.Size() {
+		if _, ok := p.byID[string(id)]; ok {
+			return id, nil
+		}
+	}
+	return nil, serum.Error(ErrNotFound,
+		serum.WithMessageTemplate("the bundle has no ref {{ref}}"),
+		serum.WithDetail("ref", ref),
+	)
+}
+
+// headerObjectID finds a header line of a commit or tag, like "tree <id>", and decodes the id.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-bundle -- if there's no such header, or the id isn't valid.
+func headerObjectID(body []byte, field string, algorithm Algorithm) ([]byte, error) {
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" {
+			break // The end of the headers.
+		}
+		if strings.HasPrefix(line, field+" ") {
+			id, err := hex.DecodeString(line[len(field)+1:])
+			if err != nil || len(id) != algorithm.Size() {
+				break
+			}
+			return id, nil
+		}
+	}
+	return nil, newErrInvalidBundle(fmt.Sprintf("an object has no valid %q header", field))
+}
+
+func packTypeName(typ int) string {
+	switch typ {
+	case packObjCommit:
+		return "commit"
+	case packObjTree:
+		return "tree"
+	case packObjBlob:
+		return "blob"
+	case packObjTag:
+		return "tag"
+	}
+	return "unknown"
+}
+
+// bundleReader hashes the objects in a bundle's pack again.
+type bundleReader struct {
+	p      *bundlePack
+	h      *hasher
+	hashes map[string]gitObjectHash // Each object already hashed, by the raw bytes of its id in the bundle.
+}
+
+// hashObject hashes a tree or blob in the pack, and everything a tree refers to.
+// Blobs that are stored whole are streamed, rather than read into memory.
+//
+// Errors:
+//
+//   - gittreehash-error-not-found -- if a tree refers to an object that isn't in the bundle.
+//   - gittreehash-error-invalid-bundle -- if an object's data is malformed, or isn't of the type the tree says.
+//   - gittreehash-error-invalid-tree -- if a tree is malformed.
+//   - gittreehash-error-unsupported-file-type -- if a tree contains a submodule, and the algorithm isn't the bundle's.
+func (b *bundleReader) hashObject(pth string, i int, mode fs.FileMode) ([32]byte, error) {
+	key := string(b.p.objects[i].id)
+	if done, ok := b.hashes[key]; ok {
+		if mode.IsDir() {
+			done.size = 0
+		}
+		b.h.emit(pth, done.hash, mode, done.size)
+		return done.hash, nil
+	}
+	e := b.p.objects[i]
+	var hash [32]byte
+	var size int64
+	if e.typ == packObjBlob {
+		if mode.IsDir() {
+			return [32]byte{}, newErrInvalidBundle(fmt.Sprintf("%s is a blob, but a tree refers to it as a tree", hex.EncodeToString(e.id)))
+		}
+		zr, err := zlib.NewReader(io.NewSectionReader(b.p.f, e.dataOffset, 1<<62))
+		if err != nil {
+			return [32]byte{}, newErrPackData(e.offset, err)
+		}
+		defer zr.Close()
+		var n int64
+		if hash, n, err = b.h.hashObjectStream("blob", e.size, io.LimitReader(zr, e.size)); err != nil {
+			return [32]byte{}, newErrPackData(e.offset, err)
+		}
+		if n != e.size {
+			return [32]byte{}, newErrPackData(e.offset, fmt.Errorf("inflated to %d bytes, rather than %d", n, e.size))
+		}
+		size = e.size
+		b.h.emit(pth, hash, mode, size)
+	} else {
+		typ, data, err := b.p.read(i)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		want := packObjBlob
+		if mode.IsDir() {
+			want = packObjTree
+		}
+		if typ != want {
+			return [32]byte{}, newErrInvalidBundle(fmt.Sprintf("%s is a %s, but a tree refers to it as a %s", hex.EncodeToString(e.id), packTypeName(typ), packTypeName(want)))
+		}
+		if typ == packObjBlob {
+			hash, size = b.h.hashBlobBytes(data), int64(len(data))
+			b.h.emit(pth, hash, mode, size)
+		} else if hash, err = b.hashTree(pth, data, mode); err != nil {
+			return [32]byte{}, err
+		}
+	}
+	b.hashes[key] = gitObjectHash{hash, size}
+	return hash, nil
+}
+
+// hashTree hashes each entry of a tree's body, and then the tree.
+func (b *bundleReader) hashTree(pth string, body []byte, mode fs.FileMode) ([32]byte, error) {
+	entries, err := parseTreeBody(body, b.p.algorithm)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	buf := getTreeBuffer()
+	defer putTreeBuffer(buf)
+	for _, e := range entries {
+		childPath := path.Join(pth, e.Name)
+		if e.Type() == "commit" {
+			// A submodule's commit isn't in the bundle; all that can be done is to record its id as it is.
+			if b.h.opts.Algorithm != b.p.algorithm {
+				return [32]byte{}, NewErrUnsupportedFileType("submodule", childPath)
+			}
+			buf.WriteString(e.Mode + " " + e.Name + "\x00")
+			buf.Write(e.Hash)
+			continue
+		}
+		childMode, err := gitModeToFileMode(e.Mode)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		i, ok := b.p.byID[string(e.Hash)]
+		if !ok {
+			return [32]byte{}, newErrBundleObjectMissing(hex.EncodeToString(e.Hash))
+		}
+		childHash, err := b.hashObject(childPath, i, childMode)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		b.h.writeTreeEntry(buf, e.Name, childMode, childHash)
+	}
+	hash := b.h.hashTreeBody(pth, buf)
+	b.h.emit(pth, hash, mode, 0)
+	return hash, nil
+}
+
+func newErrInvalidBundle(reason string) error {
+	return serum.Error(ErrInvalidBundle,
+		serum.WithMessageTemplate("bundle is invalid: {{reason}}"),
+		serum.WithDetail("reason", reason),
+	)
+}
+
+// newErrPackRead reports a failure to read the pack, which, if the file simply ended, is because the bundle is truncated.
+func newErrPackRead(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return newErrInvalidBundle("the pack is truncated")
+	}
+	return newErrIO(err)
+}
+
+func newErrPackData(offset int64, err error) error {
+	return newErrInvalidBundle(fmt.Sprintf("the entry at offset %d in the pack is corrupt: %s", offset, err))
+}
+
+func newErrBundleObjectMissing(id string) error {
+	return serum.Error(ErrNotFound,
+		serum.WithMessageTemplate("the bundle has no object {{object}} (it may be one of the bundle's prerequisites)"),
+		serum.WithDetail("object", id),
+	)
+}
+
+// mainBundle implements the bundle subcommand, which prints the hash of a tree stored in a git bundle file.
+func mainBundle(args []string) int {
+	fset := flag.NewFlagSet("bundle", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s bundle [flags] <bundle-file> <ref>\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nthe ref is one the bundle lists (like \"main\", \"refs/heads/main\", \"v1.0\", or \"HEAD\"), or the hex id of an object in it.\n")
+		fmt.Fprintf(fset.Output(), "prints the hash its tree has with --algorithm, reading the bundle directly, with no repository.\n\n")
+		fset.PrintDefaults()
+	}
+	algorithm := fset.String("algorithm", "sha256", "hash function to use, matching git's object format: \"sha256\" or \"sha1\"")
+	fset.Parse(args)
+	if fset.NArg() != 2 {
+		fset.Usage()
+		return 2
+	}
+	var opts Options
+	switch *algorithm {
+	case "sha256":
+		opts.Algorithm = SHA256
+	case "sha1":
+		opts.Algorithm = SHA1
+	default:
+		fmt.Fprintf(os.Stderr, "unknown algorithm %q\n", *algorithm)
+		return 2
+	}
+
+	hash, err := HashBundle(fset.Arg(0), fset.Arg(1), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	fmt.Printf("%s\n", hex.EncodeToString(hash[:opts.Algorithm.Size()]))
+	return 0
+}
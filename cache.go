@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const ErrCacheCorrupt = "gittreehash-error-cache-corrupt"
+
+// digestCacheMagic starts every cache file, followed by a version number.
+// The version must be bumped whenever the layout changes; files with any other version are treated as corrupt.
+const (
+	digestCacheMagic   = "gittreehash-cache\n"
+	digestCacheVersion = 1
+)
+
+// DigestCache remembers the digests of regular files from one run to the next,
+// so that files which haven't changed since don't have to be read again.  See Options.Cache.
+//
+// A file is considered unchanged if its path, size, modification time (to the nanosecond), inode number,
+// and mode are all the same as when it was hashed.  That's the same trust git places in its index.
+// Paths are recorded as they're given to the hasher, so a cache only helps when the same path is hashed again
+// (from the same working directory, for relative paths).
+//
+// As git does, a file modified around the time the cache was saved (within the same second, or later) isn't trusted,
+// since it could have been changed again without its modification time changing,
+// on filesystems whose timestamps are coarser than the system clock.
+//
+// A DigestCache may be used by several hashing runs at once.
+type DigestCache struct {
+	algorithm Algorithm
+	savedAt   int64 // Nanoseconds.  Entries modified in the same second or later are "racy", and not trusted.
+
+	mu      sync.Mutex
+	entries map[string]digestCacheEntry // As loaded.
+	fresh   map[string]digestCacheEntry // Everything hashed (or confirmed) since; this is what's saved.
+}
+
+type digestCacheEntry struct {
+	size   int64
+	mtime  int64 // Nanoseconds.
+	ino    uint64
+	mode   fs.FileMode
+	digest [32]byte
+}
+
+// NewDigestCache returns an empty cache, for digests made with the given algorithm.
+func NewDigestCache(algorithm Algorithm) *DigestCache {
+	return &DigestCache{
+		algorithm: algorithm,
+		entries:   map[string]digestCacheEntry{},
+		fresh:     map[string]digestCacheEntry{},
+	}
+}
+
+// LoadDigestCache reads a cache file written by DigestCache.Save.
+// If the file doesn't exist, or was written for a different algorithm, an empty cache is returned.
+//
+// If the file is corrupt, an empty cache is returned along with the error, so that the caller
+// can warn about it and carry on: a cache is only ever an optimization, and losing it just costs time.
+//
+// Errors:
+//
+//   - gittreehash-error-cache-corrupt -- if the file isn't a cache file, is of an unknown version, or fails its checksum.
+//   - gittreehash-error-io -- if the file can't be read.
+//   - gittreehash-error-permission -- if the file can't be read due to permissions.
+func LoadDigestCache(filename string, algorithm Algorithm) (*DigestCache, error) {
+	c := NewDigestCache(algorithm)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return c, nil
+		}
+		return c, newErrIO(err)
+	}
+	if err := c.decode(data); err != nil {
+		c.entries = map[string]digestCacheEntry{}
+		return c, serum.Error(ErrCacheCorrupt,
+			serum.WithMessageTemplate("cache file {{filename}} is unusable: {{reason}}"),
+			serum.WithDetail("filename", filename),
+			serum.WithDetail("reason", err.Error()),
+		)
+	}
+	return c, nil
+}
+
+// Save writes out the digests of every file hashed using the cache since it was loaded.
+// Files which weren't seen (because they've been removed, or weren't part of the tree hashed this time) are dropped.
+//
+// The file is replaced atomically, so a crash while saving leaves the previous cache in place.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the file can't be written.
+//   - gittreehash-error-permission -- if the file can't be written due to permissions.
+func (c *DigestCache) Save(filename string) error {
+	c.mu.Lock()
+	data := c.encode(time.Now().UnixNano())
+	c.mu.Unlock()
+	return writeFileAtomic(filename, data)
+}
+
+// lookup returns the cached digest for a file, if its stat identity is unchanged.
+// A hit is also carried forward to be saved again.
+func (c *DigestCache) lookup(pth string, fi fs.FileInfo) ([32]byte, bool) {
+	want := cacheEntryFor(fi)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ent, ok := c.entries[pth]
+	if !ok || ent.mtime >= c.savedAt-c.savedAt%int64(time.Second) {
+		return [32]byte{}, false
+	}
+	ent.digest = [32]byte{}
+	if ent != want {
+		return [32]byte{}, false
+	}
+	ent = c.entries[pth]
+	c.fresh[pth] = ent
+	return ent.digest, true
+}
+
+// has reports whether lookup would find a digest for a file, without carrying it forward.
+func (c *DigestCache) has(pth string, fi fs.FileInfo) bool {
+	want := cacheEntryFor(fi)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ent, ok := c.entries[pth]
+	if !ok || ent.mtime >= c.savedAt-c.savedAt%int64(time.Second) {
+		return false
+	}
+	ent.digest = [32]byte{}
+	return ent == want
+}
+
+// store records the digest of a file that has just been hashed.
+func (c *DigestCache) store(pth string, fi fs.FileInfo, digest [32]byte) {
+	ent := cacheEntryFor(fi)
+	ent.digest = digest
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fresh[pth] = ent
+}
+
+func cacheEntryFor(fi fs.FileInfo) digestCacheEntry {
+	_, ino, _ := fileIdentity(fi)
+	return digestCacheEntry{
+		size:  fi.Size(),
+		mtime: fi.ModTime().UnixNano(),
+		ino:   ino,
+		mode:  fi.Mode(),
+	}
+}
+
+// encode lays out the cache file:
+// the magic string and version; the algorithm name and the time of saving;
+// each entry (path, size, mtime, inode, mode, digest); and finally a SHA-256 checksum of everything before it.
+// Numbers are varints, and strings are length-prefixed.
+func (c *DigestCache) encode(savedAt int64) []byte {
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) { buf.Write(scratch[:binary.PutUvarint(scratch[:], v)]) }
+	putVarint := func(v int64) { buf.Write(scratch[:binary.PutVarint(scratch[:], v)]) }
+	putString := func(s string) { putUvarint(uint64(len(s))); buf.WriteString(s) }
+
+	buf.WriteString(digestCacheMagic)
+	putUvarint(digestCacheVersion)
+	putString(c.algorithm.String())
+	putVarint(savedAt)
+	putUvarint(uint64(len(c.fresh)))
+	for pth, ent := range c.fresh {
+		putString(pth)
+		putVarint(ent.size)
+		putVarint(ent.mtime)
+		putUvarint(ent.ino)
+		putUvarint(uint64(ent.mode))
+		buf.Write(ent.digest[:c.algorithm.Size()])
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+// decode parses a cache file, as laid out by encode, into c.entries.
+// If the file was written for another algorithm, nothing is loaded, but that's not an error.
+func (c *DigestCache) decode(data []byte) error {
+	if len(data) < len(digestCacheMagic)+sha256.Size || string(data[:len(digestCacheMagic)]) != digestCacheMagic {
+		return errors.New("not a cache file")
+	}
+	body, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if want := sha256.Sum256(body); !bytes.Equal(sum, want[:]) {
+		return errors.New("checksum mismatch")
+	}
+	r := bytes.NewReader(body[len(digestCacheMagic):])
+	var err error
+	getUvarint := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = binary.ReadUvarint(r)
+		return v
+	}
+	getVarint := func() int64 {
+		if err != nil {
+			return 0
+		}
+		var v int64
+		v, err = binary.ReadVarint(r)
+		return v
+	}
+	getBytes := func(n uint64) []byte {
+		if err != nil {
+			return nil
+		}
+		if n > uint64(r.Len()) {
+			err = errors.New("truncated")
+			return nil
+		}
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+
+	if v := getUvarint(); err == nil && v != digestCacheVersion {
+		return errors.New("unknown version")
+	}
+	algorithm := string(getBytes(getUvarint()))
+	savedAt := getVarint()
+	count := getUvarint()
+	if err != nil {
+		return err
+	}
+	if algorithm != c.algorithm.String() {
+		return nil
+	}
+	entries := map[string]digestCacheEntry{}
+	for i := uint64(0); i < count && err == nil; i++ {
+		pth := string(getBytes(getUvarint()))
+		var ent digestCacheEntry
+		ent.size = getVarint()
+		ent.mtime = getVarint()
+		ent.ino = getUvarint()
+		ent.mode = fs.FileMode(getUvarint())
+		copy(ent.digest[:], getBytes(uint64(c.algorithm.Size())))
+		entries[pth] = ent
+	}
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return errors.New("trailing data")
+	}
+	c.entries, c.savedAt = entries, savedAt
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const ErrInvalidChain = "gittreehash-error-invalid-chain"
+
+// chainLink is one record in a hash chain file: a claim that the path had the hash at the time.
+type chainLink struct {
+	Timestamp time.Time `json:"timestamp"`
+	Path      string    `json:"path"`
+	Hash      string    `json:"hash"`
+}
+
+// mainChainVerify implements the chain-verify subcommand,
+// which re-hashes each path recorded in a chain file, checks that each still has its recorded hash,
+// and checks that the records are in time order.
+// It prints a line for each record, and returns the process exit code:
+// 0 if everything checks out, 1 if anything doesn't, or as per exitCode if an error occurs.
+func mainChainVerify(args []string) int {
+	fset := flag.NewFlagSet("chain-verify", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s chain-verify --chain=<file>\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nthe chain file is a JSON array of {\"timestamp\": <RFC 3339>, \"path\": ..., \"hash\": <hex>} objects.\n")
+		fmt.Fprintf(fset.Output(), "prints \"ok\", \"differs\", or \"missing\", then a tab and the path, for each;\nthen checks that the timestamps never go backwards.\n")
+		fmt.Fprintf(fset.Output(), "the length of each hash selects the algorithm it's checked with (sha1 or sha256).\n\n")
+		fset.PrintDefaults()
+	}
+	chainPath := fset.String("chain", "", "path of the chain file to verify")
+	fset.Parse(args)
+	if *chainPath == "" || fset.NArg() > 0 {
+		fset.Usage()
+		return 2
+	}
+
+	links, err := readChain(*chainPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	valid := true
+	for _, link := range links {
+		status, err := verifyChainLink(link)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			return exitCode(err)
+		}
+		if status != "ok" {
+			valid = false
+		}
+		fmt.Printf("%s\t%s\n", status, link.Path)
+	}
+	if !valid {
+		return 1
+	}
+	for i := 1; i < len(links); i++ {
+		if links[i].Timestamp.Before(links[i-1].Timestamp) {
+			fmt.Printf("out of order\t%s (%s) comes after %s (%s)\n",
+				links[i].Path, links[i].Timestamp.Format(time.RFC3339Nano), links[i-1].Path, links[i-1].Timestamp.Format(time.RFC3339Nano))
+			return 1
+		}
+	}
+	return 0
+}
+
+// readChain loads and sanity-checks a chain file.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-chain -- if the file isn't a JSON array of chain records,
+//     or a record has no path, or its hash isn't a sha1 or sha256 hex digest.
+//   - gittreehash-error-io -- if the file can't be read.
+//   - gittreehash-error-permission -- if the file can't be read due to permissions.
+func readChain(pth string) ([]chainLink, error) {
+	body, err := os.ReadFile(pth)
+	if err != nil {
+		return nil, newErrIO(err)
+	}
+	var links []chainLink
+	if err := json.Unmarshal(body, &links); err != nil {
+		return nil, serum.Error(ErrInvalidChain,
+			serum.WithMessageTemplate("chain file {{path}} is not valid: {{cause}}"),
+			serum.WithDetail("path", pth),
+			serum.WithDetail("cause", err.Error()),
+		)
+	}
+	for i, link := range links {
+		if link.Path == "" {
+			return nil, serum.Error(ErrInvalidChain,
+				serum.WithMessageTemplate("chain file {{path}} record {{index}} has no path"),
+				serum.WithDetail("path", pth),
+				serum.WithDetail("index", strconv.Itoa(i)),
+			)
+		}
+		if _, err := hex.DecodeString(link.Hash); err != nil || (len(link.Hash) != 2*SHA1.Size() && len(link.Hash) != 2*SHA256.Size()) {
+			return nil, serum.Error(ErrInvalidChain,
+				serum.WithMessageTemplate("chain file {{path}} record {{index}} has hash {{hash}}, which is not a sha1 or sha256 hex digest"),
+				serum.WithDetail("path", pth),
+				serum.WithDetail("index", strconv.Itoa(i)),
+				serum.WithDetail("hash", link.Hash),
+			)
+		}
+	}
+	return links, nil
+}
+
+// verifyChainLink re-hashes the path in a chain record, and returns "ok" if it matches, or else "differs" or "missing".
+//
+// Errors:
+//
+//   - any error HashPath may return, other than gittreehash-error-not-found.
+func verifyChainLink(link chainLink) (string, error) {
+	var opts Options
+	if len(link.Hash) == 2*SHA1.Size() {
+		opts.Algorithm = SHA1
+	}
+	hash, err := HashPath(rawDirFS("."), filepath.Clean(link.Path), opts)
+	switch {
+	case serum.Code(err) == ErrNotFound:
+		return "missing", nil
+	case err != nil:
+		return "", err
+	}
+	if want, _ := hex.DecodeString(link.Hash); !bytes.Equal(hash[:opts.Algorithm.Size()], want) {
+		return "differs", nil
+	}
+	return "ok", nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/warpfork/go-fsx"
+)
+
+// collisionReporter watches every entry hashed, and warns about any two that have the same hash but different content.
+// Entries that are simply copies of each other (the same type, size, and content) aren't collisions, and pass silently.
+//
+// With prefixDigits set, only that many leading hex digits of each hash are compared, so that collisions can be
+// provoked deliberately, to test what relies on hashes being distinct.
+type collisionReporter struct {
+	fsys         fsx.FS
+	w            io.Writer
+	prefixDigits int
+	reread       bool             // Whether files can be read again and compared: not if their content is converted, or they're pipes.
+	seen         map[string]Entry // The first entry found with each hash (or hash prefix).
+}
+
+func newCollisionReporter(fsys fsx.FS, w io.Writer, prefixDigits int, opts Options) *collisionReporter {
+	reread := checkObjectOptions(opts, "") == nil
+	return &collisionReporter{fsys: fsys, w: w, prefixDigits: prefixDigits, reread: reread, seen: map[string]Entry{}}
+}
+
+// OnEntry is for Options.OnEntry.
+func (c *collisionReporter) OnEntry(e Entry) {
+	key := fmt.Sprintf("%x", e.Hash)
+	if c.prefixDigits > 0 && c.prefixDigits < len(key) {
+		key = key[:c.prefixDigits]
+	}
+	first, ok := c.seen[key]
+	if !ok {
+		c.seen[key] = e
+		return
+	}
+	if !c.differ(first, e) {
+		return
+	}
+	fmt.Fprintf(c.w, "warning: hash collision: %q (%s, %d bytes) and %q (%s, %d bytes) both hash to %s\n",
+		first.Path, first.Type, first.Size, e.Path, e.Type, e.Size, key)
+}
+
+// differ reports whether two entries with the same hash (or hash prefix) have different content.
+// Entries whose whole hashes differ certainly do, as do entries of different types or sizes;
+// two blobs are otherwise read again and compared, since that's the only way to catch a genuine collision of the algorithm
+// (unless their content was converted before hashing, or they're pipes, in which case they're taken to be the same).
+// (Two trees are taken to be the same, since their bodies are gone by now;
+// but a tree's body is made of its entries' hashes, so a collision between trees implies one among their contents.)
+func (c *collisionReporter) differ(a, b Entry) bool {
+	if !bytes.Equal(a.Hash, b.Hash) || a.Type != b.Type || a.Size != b.Size {
+		return true
+	}
+	if a.Type != "blob" || !c.reread {
+		return false
+	}
+	ra, err := openBlob(c.fsys, a)
+	if err != nil {
+		return false // Gone since; nothing can be said.
+	}
+	defer ra.Close()
+	rb, err := openBlob(c.fsys, b)
+	if err != nil {
+		return false
+	}
+	defer rb.Close()
+	return !sameContent(ra, rb)
+}
+
+// sameContent reports whether two readers give the same bytes.
+func sameContent(a, b io.Reader) bool {
+	bufA, bufB := make([]byte, 1<<15), make([]byte, 1<<15)
+	for {
+		na, errA := io.ReadFull(a, bufA)
+		nb, errB := io.ReadFull(b, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false
+		}
+		if errA != nil || errB != nil {
+			return (errA == io.EOF || errA == io.ErrUnexpectedEOF) && (errB == io.EOF || errB == io.ErrUnexpectedEOF)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Commit describes a commit object made of a tree, for CommitHash.
+type Commit struct {
+	Parents   []string  // The hex ids of the parent commits, if any.
+	Author    string    // As "Name <email>".
+	Committer string    // As "Name <email>"; if empty, the same as the author.
+	Date      time.Time // The author and committer date; the time zone is kept, as git records it.
+	Message   string    // Given a final newline if it has none, as `git commit-tree -m` does.
+}
+
+// CommitHash returns the id git gives the commit of a tree: given the same identities, dates, parents, and message,
+// it's what `git commit-tree` makes, with GIT_AUTHOR_DATE and GIT_COMMITTER_DATE set.
+func CommitHash(tree [32]byte, c Commit, algorithm Algorithm) [32]byte {
+	return algorithm.hashObject("commit", commitBody(tree[:algorithm.Size()], c))
+}
+
+// commitBody returns the content of a commit object: its headers, a blank line, and its message.
+func commitBody(tree []byte, c Commit) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "tree %x\n", tree)
+	for _, parent := range c.Parents {
+		fmt.Fprintf(&b, "parent %s\n", parent)
+	}
+	committer := c.Committer
+	if committer == "" {
+		committer = c.Author
+	}
+	fmt.Fprintf(&b, "author %s\ncommitter %s\n\n%s", gitSignature(c.Author, c.Date), gitSignature(committer, c.Date), withFinalNewline(c.Message))
+	return []byte(b.String())
+}
+
+// gitSignature formats an identity and a time as git records them in commits and tags:
+// the identity, the seconds since the epoch, and the time zone as a signed four-digit offset, like "+0530".
+func gitSignature(ident string, t time.Time) string {
+	return fmt.Sprintf("%s %d %s", ident, t.Unix(), t.Format("-0700"))
+}
+
+// withFinalNewline adds a newline to the end of a non-empty message that doesn't have one.
+func withFinalNewline(message string) string {
+	if message != "" && !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+	return message
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/serum-errors/go-serum"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression names a compression format that a tar stream may be wrapped in.
+type Compression uint8
+
+const (
+	CompressionAuto  Compression = iota // Recognize the format by its magic bytes; anything unrecognized is taken to be uncompressed.
+	CompressionNone                     // Not compressed.
+	CompressionGzip                     // gzip, as made by `tar -z`.
+	CompressionZstd                     // Zstandard, as made by `tar --zstd`.
+	CompressionBzip2                    // bzip2, as made by `tar -j`.
+	CompressionXz                       // xz, as made by `tar -J`.
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionBzip2:
+		return "bzip2"
+	case CompressionXz:
+		return "xz"
+	default:
+		return "auto"
+	}
+}
+
+// compressionMagic is the bytes each format's streams begin with.
+var compressionMagic = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressionBzip2, []byte("BZh")},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// sniffCompression recognizes the compression of a stream by its first few bytes, which are left unread.
+// A plain tar stream starts with the name of its first entry, which could in principle look like magic bytes;
+// that's what giving the compression explicitly is for.
+func sniffCompression(br *bufio.Reader) Compression {
+	head, _ := br.Peek(6) // Any error will come up again when the stream is read.
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression
+		}
+	}
+	return CompressionNone
+}
+
+// HashCompressedTar is HashTar for a tar stream that may be compressed, with any of the formats Compression names.
+// With CompressionAuto, the format is recognized by the stream's magic bytes.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the stream is corrupt, so decompressing it fails;
+//     the error then has a "layer" detail of "decompression", and a "compression" detail naming the format.
+//   - any error HashTar may return.
+func HashCompressedTar(r io.Reader, compression Compression, opts Options) ([32]byte, error) {
+	d, err := newDecompressor(r, compression)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer d.Close()
+	hash, err := HashTar(d, opts)
+	return hash, d.explain(err)
+}
+
+// decompressor reads a stream that may be compressed, decompressing it as it goes.
+// It keeps track of where reading fails, so that a corrupt stream can be told apart from a failure to read it.
+type decompressor struct {
+	compression Compression
+	src         *erroredReader // The stream as given.
+	out         *erroredReader // The decompressed stream.
+	close       func()
+}
+
+// newDecompressor prepares to decompress a stream.  With CompressionAuto, the format is recognized by the stream's magic bytes.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the start of the stream can't be read, or is corrupt.
+func newDecompressor(r io.Reader, compression Compression) (*decompressor, error) {
+	d := &decompressor{src: &erroredReader{r: r}, close: func() {}}
+	br := bufio.NewReaderSize(d.src, 1<<20)
+	if compression == CompressionAuto {
+		compression = sniffCompression(br)
+	}
+	d.compression = compression
+	var decompressed io.Reader
+	var err error
+	switch compression {
+	case CompressionGzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(br); err == nil {
+			d.close = func() { zr.Close() }
+			decompressed = zr
+		}
+	case CompressionZstd:
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(br); err == nil {
+			d.close = zr.Close
+			decompressed = zr
+		}
+	case CompressionBzip2:
+		decompressed = bzip2.NewReader(br)
+	case CompressionXz:
+		decompressed, err = xz.NewReader(br)
+	default:
+		decompressed = br
+	}
+	if err != nil {
+		return nil, d.newErr(err)
+	}
+	d.out = &erroredReader{r: decompressed}
+	return d, nil
+}
+
+func (d *decompressor) Read(p []byte) (int, error) {
+	return d.out.Read(p)
+}
+
+// Close releases the decompressor's resources.  It doesn't close the stream it reads from.
+func (d *decompressor) Close() {
+	d.close()
+}
+
+// explain replaces an error that arose from reading the decompressed stream with one that says what went wrong:
+// either the compressed stream couldn't be read, or it was corrupt.  Any other error is returned as it is.
+func (d *decompressor) explain(err error) error {
+	if err == nil || d.out.err == nil {
+		return err
+	}
+	return d.newErr(d.out.err)
+}
+
+// newErr reports a failure to decompress, unless it was really a failure to read the compressed stream,
+// which is reported as a plain IO error.
+func (d *decompressor) newErr(err error) error {
+	if d.src.err != nil {
+		return newErrIO(d.src.err)
+	}
+	if d.compression == CompressionNone {
+		return newErrIO(err)
+	}
+	return serum.Error(ErrIO,
+		serum.WithMessageTemplate("the archive is corrupt: decompressing {{compression}} failed: {{cause}}"),
+		serum.WithDetail("layer", "decompression"),
+		serum.WithDetail("compression", d.compression.String()),
+		serum.WithDetail("cause", err.Error()),
+	)
+}
+
+// erroredReader remembers the first error (other than EOF) that reading returned,
+// so that after the fact, it can be told which layer of a stack of readers failed.
+type erroredReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *erroredReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
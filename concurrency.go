@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"sync"
+)
+
+// childResult holds the outcome of hashing one entry of a directory,
+// so that entries hashed concurrently can be put back in order afterwards.
+type childResult struct {
+	name string // The name to record in the tree; empty if the entry is left out.
+	hash [32]byte
+	mode fs.FileMode
+}
+
+// spawn runs fn on another goroutine if a worker slot is free (see Options.Concurrency), and otherwise runs it right away.
+// It never waits for a slot: a directory whose children can't be handed off just hashes them itself,
+// which keeps the number of goroutines (and so of open files, and of tree bodies being accumulated) bounded
+// without any risk of deadlock between parents waiting on children.
+func (h *hasher) spawn(wg *sync.WaitGroup, fn func()) {
+	select {
+	case h.workers <- struct{}{}: // Never ready if workers is nil, which is the case unless Concurrency > 1.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-h.workers }()
+			fn()
+		}()
+	default:
+		fn()
+	}
+}
+
+// abort records the error that's halting hashing, if it's the first, and cancels any work that hasn't started yet.
+func (h *hasher) abort(err error) {
+	h.abortOnce.Do(func() {
+		h.abortErr = err
+		h.cancel()
+	})
+}
+
+// aborted returns the error that halted hashing, or nil if nothing has.
+func (h *hasher) aborted() error {
+	if h.ctx.Err() == nil {
+		return nil
+	}
+	return h.abortErr
+}
+
+// initConcurrency sets up the worker and open file slots, and cancellation.
+func (h *hasher) initConcurrency() {
+	if h.opts.Concurrency > 1 {
+		h.workers = make(chan struct{}, h.opts.Concurrency-1) // The calling goroutine is a worker too.
+	}
+	h.openFiles = make(chan struct{}, h.opts.MaxOpenFiles)
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+}
+
+// concurrencyState is embedded in hasher; it's everything needed to coordinate goroutines during a run.
+type concurrencyState struct {
+	workers   chan struct{} // Semaphore of extra goroutines.  Nil unless Options.Concurrency > 1.
+	openFiles chan struct{} // Semaphore of open files and directories; see Options.MaxOpenFiles.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	abortOnce sync.Once
+	abortErr  error
+
+	// mu serializes callbacks, and updates to Stats and the audit log, which may happen from any goroutine.
+	mu sync.Mutex
+}
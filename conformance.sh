@@ -0,0 +1,312 @@
+#!/bin/bash
+# Checks that gittreehash agrees with git itself, byte for byte,
+# by building fixture trees, having git compute their tree hashes with `git write-tree`,
+# and comparing against gittreehash's output under the matching flags.
+# Both the sha1 and sha256 object formats are checked.
+#
+# When something disagrees, the first divergent object is reported,
+# along with both tree preimages if it's a tree, to ease debugging.
+#
+# Skips (successfully) if git isn't available.
+set -euo pipefail
+
+if ! command -v git >/dev/null; then
+	>&2 echo "git not found on PATH; skipping conformance checks"
+	exit 0
+fi
+
+export GIT_CONFIG_NOSYSTEM=1 GIT_CONFIG_GLOBAL=/dev/null
+tmp="$(mktemp -d)"
+trap 'rm -rf "$tmp"' EXIT
+go build -o "$tmp/gittreehash" .
+
+# Plain fixture: exec bits, symlinks, nesting, tricky sort order, empty files, and non-ascii names
+# (including some that aren't valid UTF-8, like legacy Latin-1 names, which must be kept byte for byte).
+# (Empty directories are deliberately absent: git can't record them, so they're a known difference.)
+mkfixture_plain() {
+	local d="$1"
+	mkdir -p "$d"
+	(cd "$d"
+		echo "a file" > a_file
+		printf '#!/bin/sh\necho hi\n' > exec_file
+		chmod +x exec_file
+		: > empty_file
+		ln -s "target string" a_symlink
+		ln -s ../nowhere/at/all dangling
+		mkdir -p a_dir/deeper/deepest
+		echo "second file" > a_dir/other_file
+		echo "more file" > a_dir/deeper/samefile
+		echo "more file" > a_dir/deeper/deepest/samefile
+		# Directories sort as if they had a trailing slash, so these interleave in a way bytewise order doesn't.
+		mkdir foo
+		echo x > foo/inner
+		echo x > foo.txt
+		echo x > foo-bar
+		echo x > foo0
+		mkdir foo.d
+		echo x > foo.d/inner
+		echo x > "a name with spaces"
+		echo x > "héllo"
+		echo x > "日本語"
+		mkdir "ünïcödé dir"
+		echo x > "ünïcödé dir/file"
+		echo x > $'caf\xe9'
+		mkdir $'r\xe9sum\xe9s'
+		echo x > $'r\xe9sum\xe9s/\xff\xfe'
+	)
+}
+
+# EOL fixture: exercises --respect-gitattributes-eol.
+mkfixture_eol() {
+	local d="$1"
+	mkdir -p "$d/sub"
+	(cd "$d"
+		printf '* text=auto\n*.bin -text\n' > .gitattributes
+		printf 'a\r\nb\r\n' > crlf.txt
+		printf 'a\r\n\0b\r\n' > nul.dat
+		printf 'x\r\ny\r\n' > keep.bin
+		printf 'lf\nonly\n' > lf.txt
+		printf '*.txt text\n*.crlf eol=crlf\n' > sub/.gitattributes
+		printf 'lone\rcr\r\n' > sub/lone.txt
+		printf 'lone\rcr\r\n' > sub/auto.c
+		printf 'q\r\n' > sub/x.crlf
+	)
+}
+
+# Export fixture: exercises --respect-export-ignore, with patterns of every kind, including ones that unset export-ignore
+# deeper down, and a .gitattributes that leaves itself out.
+mkfixture_export() {
+	local d="$1"
+	mkdir -p "$d/src/fixtures/deep" "$d/tests/unit" "$d/docs/api" "$d/lib/fixtures" "$d/Tmp-stuff"
+	(cd "$d"
+		printf '*.log export-ignore\n/tests/ export-ignore\n/docs/*.md export-ignore\n**/fixtures export-ignore\n[Tt]mp* export-ignore\nsrc/*.o export-ignore\n' > .gitattributes
+		printf 'keep.log -export-ignore\n.gitattributes export-ignore\n' > src/.gitattributes
+		echo x > main.c; echo x > build.log; echo x > src/keep.log; echo x > src/drop.log; echo x > src/a.o; echo x > src/a.c
+		echo x > src/fixtures/deep/f; echo x > lib/fixtures/f; echo x > lib/fixtures.c
+		echo x > tests/unit/t.c; echo x > docs/intro.md; echo x > docs/api/ref.md; echo x > docs/index.html
+		echo x > Tmp-stuff/x; echo x > tmpfile; echo x > atmp
+	)
+}
+
+failures=0
+
+# check <fixture-name> <algorithm> [gittreehash flags...]
+check() {
+	local name="$1" algo="$2"
+	shift 2
+	local gitdir="$tmp/git-$name-$algo"
+	git init -q --object-format="$algo" "$gitdir"
+	export GIT_DIR="$gitdir/.git" GIT_WORK_TREE="$tmp/$name"
+	git -c core.autocrlf=false add -A
+	local want got
+	want="$(git write-tree)"
+	got="$(cd "$tmp" && ./gittreehash --algorithm="$algo" "$@" "$name")"
+	if [ "$want" == "$got" ]; then
+		echo "ok    $name ($algo): $got"
+	else
+		echo "FAIL  $name ($algo): git says $want, gittreehash says $got"
+		failures=$((failures+1))
+		report_divergence "$name" "$algo" "$want" "$@"
+	fi
+	unset GIT_DIR GIT_WORK_TREE
+}
+
+# report_divergence finds the first object whose hash differs, in git's ls-tree order
+# (or the root tree itself, if all of its contents agree), and prints both preimages if it's a tree.
+report_divergence() {
+	local name="$1" algo="$2" want="$3"
+	shift 3
+	local ours="$tmp/ours.csv"
+	(cd "$tmp" && ./gittreehash --algorithm="$algo" --report-format=csv "$@" "$name") > "$ours"
+	local typ="tree" hash="$want" pth=""
+	local meta p
+	while IFS=$'\t' read -r meta p; do
+		set -- $meta
+		if ! grep -q "^$3," "$ours"; then
+			typ="$2" hash="$3" pth="$p"
+			break
+		fi
+	done < <(git ls-tree -r -t "$want")
+	echo "      first divergent object: $typ ${pth:-(root)} (git: $hash)"
+	if [ "$typ" == "tree" ]; then
+		echo "      git preimage:          $(git cat-file tree "$hash" | xxd -p | tr -d '\n')"
+		echo "      gittreehash preimage:  $(cd "$tmp" && ./gittreehash dump-tree --algorithm="$algo" "$name${pth:+/$pth}")"
+	fi
+}
+
+# check_tracked <algorithm> <index-version>
+# Checks --tracked-only against a repository with untracked junk lying around, for each index format version.
+# The working tree matches the index, so the hash should equal what git write-tree says.
+check_tracked() {
+	local algo="$1" version="$2"
+	local d="$tmp/tracked-$algo-v$version"
+	mkfixture_plain "$d"
+	git -C "$d" init -q --object-format="$algo"
+	git -C "$d" -c core.autocrlf=false add -A
+	git -C "$d" update-index --index-version "$version"
+	(cd "$d"
+		echo junk > .a_file.swp
+		mkdir -p build/out
+		echo junk > build/out/binary
+		echo junk > a_dir/deeper/untracked
+	)
+	local want got
+	want="$(git -C "$d" write-tree)"
+	got="$(cd "$tmp" && ./gittreehash --algorithm="$algo" --tracked-only "$(basename "$d")/a_dir")"
+	want="$(git -C "$d" rev-parse "$want:a_dir")"
+	if [ "$want" == "$got" ]; then
+		echo "ok    tracked-only, index v$version ($algo): $got"
+	else
+		echo "FAIL  tracked-only, index v$version ($algo): git says $want, gittreehash says $got"
+		failures=$((failures+1))
+	fi
+	got="$(cd "$d" && ../gittreehash --algorithm="$algo" --tracked-only)"
+	want="$(git -C "$d" write-tree)"
+	if [ "$want" == "$got" ]; then
+		echo "ok    tracked-only, index v$version, from the root ($algo): $got"
+	else
+		echo "FAIL  tracked-only, index v$version, from the root ($algo): git says $want, gittreehash says $got"
+		failures=$((failures+1))
+	fi
+}
+
+# check_sparse <algorithm> [sparse-checkout set flags...]
+# Checks --tracked-only against a sparse checkout, where the paths outside the sparse-checkout cone are marked skip-worktree,
+# and aren't hashed, nor is untracked junk in the directories they leave.  The hash should equal git's tree of the entries that aren't skip-worktree.
+check_sparse() {
+	local algo="$1"
+	shift
+	local d="$tmp/sparse-$algo$*"
+	mkfixture_plain "$d"
+	git -C "$d" init -q --object-format="$algo"
+	git -C "$d" -c core.autocrlf=false add -A
+	git -C "$d" -c user.email=t@t -c user.name=t commit -qm sparse
+	git -C "$d" sparse-checkout set "$@" a_dir
+	mkdir -p "$d/foo"
+	echo junk > "$d/foo/junk"
+	local want got
+	want="$(git -C "$d" ls-files -s -t | sed -n 's/^H //p' | (export GIT_INDEX_FILE="$tmp/sparse-index-$algo$*" && git -C "$d" update-index --index-info && git -C "$d" write-tree))"
+	got="$(cd "$d" && ../gittreehash --algorithm="$algo" --tracked-only)"
+	if [ "$want" == "$got" ]; then
+		echo "ok    tracked-only, sparse checkout${*:+ $*} ($algo): $got"
+	else
+		echo "FAIL  tracked-only, sparse checkout${*:+ $*} ($algo): git says $want, gittreehash says $got"
+		failures=$((failures+1))
+	fi
+}
+
+# check_archive <algorithm>
+# Checks --respect-export-ignore against git archive: the files it hashes are those `git archive | tar t` lists,
+# and the hash is git's tree of what the archive extracts to.
+check_archive() {
+	local algo="$1"
+	local gitdir="$tmp/git-archive-$algo" out="$tmp/archive-out-$algo"
+	git init -q --bare --object-format="$algo" "$gitdir"
+	local tree
+	tree="$(git --git-dir="$gitdir" --work-tree="$tmp/export" add -A && git --git-dir="$gitdir" write-tree)"
+	local want got
+	want="$(git --git-dir="$gitdir" archive "$tree" | tar t | grep -v '/$' | sort)"
+	got="$(cd "$tmp" && ./gittreehash --algorithm="$algo" --respect-export-ignore --report-format=csv export | awk -F, '$3 == "blob" { sub(/^export\//, "", $5); print $5 }' | sort)"
+	if [ "$want" == "$got" ]; then
+		echo "ok    export-ignore, files listed ($algo)"
+	else
+		echo "FAIL  export-ignore, files listed ($algo): git archive | tar t lists:"
+		echo "$want" | sed 's/^/        /'
+		echo "      but gittreehash hashes:"
+		echo "$got" | sed 's/^/        /'
+		failures=$((failures+1))
+	fi
+	mkdir -p "$out"
+	git --git-dir="$gitdir" archive "$tree" | tar x -C "$out"
+	want="$(export GIT_INDEX_FILE="$tmp/archive-index-$algo" && git --git-dir="$gitdir" --work-tree="$out" add -A && git --git-dir="$gitdir" write-tree)"
+	got="$(cd "$tmp" && ./gittreehash --algorithm="$algo" --respect-export-ignore export)"
+	if [ "$want" == "$got" ]; then
+		echo "ok    export-ignore ($algo): $got"
+	else
+		echo "FAIL  export-ignore ($algo): git says $want, gittreehash says $got"
+		failures=$((failures+1))
+	fi
+}
+
+# check_blobs <algorithm>
+# Checks that the hash of each single file is git's blob hash for it: the same as `git hash-object <file>` (for sha1),
+# and that --pipe-to-git (which asks git the same question) agrees.
+check_blobs() {
+	local algo="$1" before="$failures" f want got
+	while IFS= read -r -d '' f; do
+		got="$(cd "$tmp" && ./gittreehash --algorithm="$algo" --pipe-to-git "$f")" || {
+			echo "FAIL  blob $f ($algo): --pipe-to-git says git disagrees"
+			failures=$((failures+1))
+			continue
+		}
+		if [ "$algo" == "sha1" ]; then
+			want="$(git hash-object "$tmp/$f")"
+			if [ "$want" != "$got" ]; then
+				echo "FAIL  blob $f ($algo): git hash-object says $want, gittreehash says $got"
+				failures=$((failures+1))
+				continue
+			fi
+		fi
+	done < <(cd "$tmp" && find plain -type f -print0)
+	if [ "$failures" == "$before" ]; then
+		echo "ok    blobs ($algo)"
+	fi
+}
+
+# check_reuse_git <algorithm>
+# Checks --reuse-git against a clean checkout (where nothing should need reading, except empty files, which never are),
+# and after files are changed behind git's back (where those must be read), comparing against git write-tree.
+# The fixture's timestamps are set in the past, so that no index entries are racily clean.
+check_reuse_git() {
+	local algo="$1"
+	local d="$tmp/reuse-$algo"
+	mkfixture_plain "$d"
+	find "$d" -exec touch -h -d '1 hour ago' {} +
+	git -C "$d" init -q --object-format="$algo"
+	git -C "$d" -c core.autocrlf=false add -A
+	local want got stats
+	want="$(git -C "$d" write-tree)"
+	got="$(cd "$d" && ../gittreehash --algorithm="$algo" --reuse-git --ignore-dot-git --stats 2>"$tmp/stats")"
+	stats="$(cat "$tmp/stats")"
+	if [ "$want" == "$got" ] && [[ "$stats" == *"index_hits=$(find "$d" -path "$d/.git" -prune -o -type f -size +0c -print | wc -l)"* ]]; then
+		echo "ok    reuse-git, clean ($algo): $got"
+	else
+		echo "FAIL  reuse-git, clean ($algo): git says $want, gittreehash says $got ($stats)"
+		failures=$((failures+1))
+	fi
+	# Change files without telling git, including one whose size and mtime stay the same, so only its ctime gives it away.
+	echo "changed" > "$d/a_file"
+	touch -r "$d/a_dir/other_file" "$tmp/reftime"
+	echo "SECOND FILE" > "$d/a_dir/other_file"
+	touch -r "$tmp/reftime" "$d/a_dir/other_file"
+	chmod -x "$d/exec_file"
+	want="$(export GIT_INDEX_FILE="$tmp/fresh-index-$algo" && git -C "$d" -c core.autocrlf=false add -A && git -C "$d" write-tree)"
+	got="$(cd "$d" && ../gittreehash --algorithm="$algo" --reuse-git --ignore-dot-git)"
+	if [ "$want" == "$got" ]; then
+		echo "ok    reuse-git, modified ($algo): $got"
+	else
+		echo "FAIL  reuse-git, modified ($algo): git says $want, gittreehash says $got"
+		failures=$((failures+1))
+	fi
+}
+
+mkfixture_plain "$tmp/plain"
+mkfixture_eol "$tmp/eol"
+mkfixture_export "$tmp/export"
+for algo in sha1 sha256; do
+	check plain "$algo"
+	check eol "$algo" --respect-gitattributes-eol
+	check_blobs "$algo"
+	check_archive "$algo"
+	check_reuse_git "$algo"
+	for version in 2 3 4; do
+		check_tracked "$algo" "$version"
+	done
+	check_sparse "$algo"
+	check_sparse "$algo" --sparse-index
+done
+
+if [ "$failures" -gt 0 ]; then
+	echo "$failures conformance check(s) failed"
+	exit 1
+fi
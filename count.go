@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+
+	"github.com/warpfork/go-fsx"
+)
+
+// Counts is the result of CountPath: how many of each kind of entry a hash would cover.
+type Counts struct {
+	Files    int
+	Dirs     int
+	Symlinks int
+}
+
+// CountPath walks the filesystem exactly as HashPath would, applying the same options,
+// but only counts the entries it finds rather than reading any file contents.
+// This requires only ReadDir calls (and Lstat, where a listing doesn't bring each entry's FileInfo along), so it's much cheaper than hashing.
+//
+// Errors:
+//
+//   - gittreehash-error-unsupported-file-type -- if the filesystem contains
+//     files that git doesn't have a description of: sockets, device nodes, etc.
+//   - gittreehash-error-io -- if any raw IO barfs while we're scanning the filesystem.
+//   - gittreehash-error-permission -- if IO failed due to permissions.
+//   - gittreehash-error-concurrent-io -- if an entry vanishes while we're scanning the filesystem.
+//   - gittreehash-error-symlink-cycle -- if a directory contains itself.
+//   - gittreehash-error-too-deep -- if the hierarchy is deeper than Options.MaxDepth.
+//   - gittreehash-error-not-found -- if there's nothing at the starting path.
+//   - any error returned by Options.ErrorHandler.
+func CountPath(fsys fsx.FS, pth string, opts Options) (Counts, error) {
+	h := newHasher(fsys, opts)
+	var counts Counts
+	err := h.count(pth, nil, &counts)
+	if aborted, ok := err.(abortError); ok {
+		err = aborted.error
+	}
+	return counts, err
+}
+
+// count is the counterpart of hashSomething for CountPath.
+// Counts are only added to the accumulator once a whole subtree has been counted successfully,
+// so that any entries skipped by the ErrorHandler aren't partially counted.
+func (h *hasher) count(pth string, anc *ancestry, counts *Counts) error {
+	fi, err := fsx.Lstat(h.fsys, pth)
+	if err != nil {
+		if isVanished(err) {
+			if anc == nil {
+				return NewErrNotFound(pth)
+			}
+			return NewErrVanished(pth)
+		}
+		return newErrIO(err)
+	}
+	return h.countEntry(pth, fi, anc, counts)
+}
+
+// countEntry is the body of count, given the FileInfo (as from Lstat) of what's at the path.
+// Entries in a directory are counted using the FileInfo from its listing, as hashChild does.
+func (h *hasher) countEntry(pth string, fi fs.FileInfo, anc *ancestry, counts *Counts) error {
+	switch fi.Mode() & fs.ModeType {
+	case 0:
+		counts.Files++
+	case fs.ModeSymlink:
+		counts.Symlinks++
+	case fs.ModeDir:
+		anc, err := h.descend(anc, pth, fi)
+		if err != nil {
+			return err
+		}
+		dirEnts, err := fsx.ReadDir(h.fsys, pth)
+		if err != nil {
+			if isVanished(err) {
+				return NewErrVanished(pth)
+			}
+			return newErrIO(err)
+		}
+		var sub Counts
+		sub.Dirs++
+		for _, dirEnt := range dirEnts {
+			dirEnt := &infoOnceDirEntry{DirEntry: dirEnt}
+			childPath := filepath.Join(pth, dirEnt.Name())
+			if h.excluded(anc, childPath, dirEnt) {
+				continue
+			}
+			var child Counts
+			if err := h.countChild(childPath, dirEnt, anc, &child); err != nil {
+				if err := h.handleChildError(childPath, err); err != nil {
+					return err
+				}
+				continue
+			}
+			sub.Files += child.Files
+			sub.Dirs += child.Dirs
+			sub.Symlinks += child.Symlinks
+		}
+		counts.Files += sub.Files
+		counts.Dirs += sub.Dirs
+		counts.Symlinks += sub.Symlinks
+	case fs.ModeNamedPipe:
+		if !h.opts.AllowPipes {
+			return NewErrUnsupportedFileType("pipe", pth)
+		}
+		counts.Files++
+	case fs.ModeSocket:
+		return NewErrUnsupportedFileType("socket", pth)
+	case fs.ModeDevice, fs.ModeCharDevice:
+		return NewErrUnsupportedFileType("device", pth)
+	default:
+		if _, err := fsx.Readlink(h.fsys, pth); err == nil {
+			counts.Symlinks++ // A reparse point, hashed as a symlink, as hashEntry does.
+			break
+		}
+		return NewErrUnsupportedFileType("irregular", pth)
+	}
+	return nil
+}
+
+// countChild is count for an entry in a directory listing, using the FileInfo the listing gave.
+func (h *hasher) countChild(pth string, dirEnt fs.DirEntry, anc *ancestry, counts *Counts) error {
+	fi, err := dirEnt.Info()
+	if err != nil {
+		if isVanished(err) {
+			return NewErrVanished(pth)
+		}
+		return newErrIO(err)
+	}
+	return h.countEntry(pth, fi, anc, counts)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"container/list"
+)
+
+// emptyBlobHash and emptyTreeHash hold the hashes of the empty blob and the empty tree for each algorithm.
+// Empty files and directories are common enough that it's worth having these ready, rather than hashing nothing each time.
+var (
+	emptyBlobHash = [...][32]byte{SHA256: SHA256.hashObject("blob", nil), SHA1: SHA1.hashObject("blob", nil)}
+	emptyTreeHash = [...][32]byte{SHA256: SHA256.hashObject("tree", nil), SHA1: SHA1.hashObject("tree", nil)}
+)
+
+// treeMemoLimit bounds the total size of the tree bodies memoizedTree remembers.
+// Past it, the least recently used are forgotten, so that a huge tree of mostly distinct directories can't make the memo grow without bound.
+// (Keying the memo by a digest of the body instead wouldn't help: computing that digest is what the memo is there to save.)
+const treeMemoLimit = 32 << 20
+
+// treeMemo maps tree bodies to their hashes, forgetting the least recently used once their size passes treeMemoLimit.
+type treeMemo struct {
+	entries map[string]*list.Element // Elements hold *treeMemoEntry.
+	lru     list.List                // Most recently used first.
+	size    int                      // The total length of the bodies held.
+}
+
+type treeMemoEntry struct {
+	body string
+	hash [32]byte
+}
+
+// memoizedTree returns the hash of a tree with exactly this body, if one has been hashed during this run (and not since forgotten).
+// Generated trees often contain many identical directories, which then needn't each be hashed.
+func (h *hasher) memoizedTree(body []byte) ([32]byte, bool) {
+	if len(body) == 0 {
+		return emptyTreeHash[h.opts.Algorithm], true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	elem, ok := h.treeMemo.entries[string(body)]
+	if !ok {
+		return [32]byte{}, false
+	}
+	h.treeMemo.lru.MoveToFront(elem)
+	return elem.Value.(*treeMemoEntry).hash, true
+}
+
+func (h *hasher) memoizeTree(body []byte, hash [32]byte) {
+	if len(body) > treeMemoLimit/16 {
+		return // Big enough that it'd push out many others; and big directories are rarely repeated exactly.
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m := &h.treeMemo
+	if _, ok := m.entries[string(body)]; ok {
+		return
+	}
+	if m.entries == nil {
+		m.entries = make(map[string]*list.Element)
+	}
+	e := &treeMemoEntry{string(body), hash}
+	m.entries[e.body] = m.lru.PushFront(e)
+	m.size += len(e.body)
+	for m.size > treeMemoLimit {
+		oldest := m.lru.Remove(m.lru.Back()).(*treeMemoEntry)
+		delete(m.entries, oldest.body)
+		m.size -= len(oldest.body)
+	}
+}
+
+// countObject updates the statistics about how many objects, and how many distinct objects, have been hashed,
+// and how many bytes of blobs.  It must be called with mu held.
+func (h *hasher) countObject(hash [32]byte, isTree bool, size int64) {
+	stats := h.opts.Stats
+	if isTree {
+		stats.Trees++
+	} else {
+		stats.Blobs++
+		stats.BlobBytes += size
+	}
+	if _, ok := h.distinct[hash]; ok {
+		return
+	}
+	if h.distinct == nil {
+		h.distinct = make(map[[32]byte]struct{})
+	}
+	h.distinct[hash] = struct{}{}
+	if isTree {
+		stats.UniqueTrees++
+	} else {
+		stats.UniqueBlobs++
+	}
+}
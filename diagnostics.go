@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof" // Registers its handlers on http.DefaultServeMux, which is what --pprof serves.
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"syscall"
+)
+
+// diagnostics is what --pprof, --cpuprofile, and --memprofile set up, so that the profiles can be written out
+// however the process ends: normally, by exit, or on SIGINT or SIGTERM.
+type diagnostics struct {
+	cpuFile    *os.File
+	memProfile string
+	finishOnce sync.Once
+	listener   net.Listener
+}
+
+var activeDiagnostics *diagnostics
+
+// startDiagnostics starts whichever of the profilers are asked for.
+// The pprof server's address is printed to stderr, since it may have been given with port 0.
+func startDiagnostics(pprofAddr, cpuProfile, memProfile string) error {
+	if pprofAddr == "" && cpuProfile == "" && memProfile == "" {
+		return nil
+	}
+	d := &diagnostics{memProfile: memProfile}
+	if pprofAddr != "" {
+		l, err := net.Listen("tcp", pprofAddr)
+		if err != nil {
+			return err
+		}
+		d.listener = l
+		fmt.Fprintf(os.Stderr, "pprof: serving on http://%s/debug/pprof/\n", l.Addr())
+		go http.Serve(l, nil)
+	}
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			return err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+		d.cpuFile = f
+	}
+	activeDiagnostics = d
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "%s: writing profiles before exiting\n", sig)
+		exit(130)
+	}()
+	return nil
+}
+
+// finish stops the CPU profile and writes the heap profile.  Failures are reported on stderr, but don't change the exit code.
+func (d *diagnostics) finish() {
+	d.finishOnce.Do(func() {
+		if d.cpuFile != nil {
+			pprof.StopCPUProfile()
+			if err := d.cpuFile.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write cpu profile: %s\n", err)
+			}
+		}
+		if d.memProfile != "" {
+			runtime.GC() // So the profile reflects what's live, not what's merely not collected yet.
+			f, err := os.Create(d.memProfile)
+			if err == nil {
+				err = pprof.WriteHeapProfile(f)
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write memory profile: %s\n", err)
+			}
+		}
+		if d.listener != nil {
+			d.listener.Close()
+		}
+	})
+}
+
+// exit finishes any diagnostics, then exits the process.  It's what main uses in place of os.Exit.
+func exit(code int) {
+	if activeDiagnostics != nil {
+		activeDiagnostics.finish()
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/gittreehash/gitindex"
+)
+
+// mainDiffIndex implements the diff-index subcommand,
+// which compares the files tracked in a git index against what's currently in a directory.
+// It prints a line for each file that differs, and returns the process exit code:
+// 0 if nothing differs, 1 if anything does, or as per exitCode if an error occurs.
+func mainDiffIndex(args []string) int {
+	fset := flag.NewFlagSet("diff-index", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s diff-index --index=<.git/index> [path]\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nprints \"M\\t<path>\" for files whose content or mode differs from the index,\nand \"D\\t<path>\" for files that are missing.\n\n")
+		fset.PrintDefaults()
+	}
+	indexPath := fset.String("index", ".git/index", "path of the git index file to compare against")
+	fset.Parse(args)
+	root := "."
+	if fset.NArg() > 0 {
+		root = filepath.Clean(fset.Arg(0))
+	}
+
+	changes, err := diffIndex(*indexPath, root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	for _, line := range changes {
+		fmt.Println(line)
+	}
+	if len(changes) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// diffIndex does the work of the diff-index subcommand, returning the lines to print.
+//
+// Errors:
+//
+//   - gitindex-error-io -- if the index file can't be read.
+//   - gitindex-error-parse -- if the index file isn't valid.
+//   - gittreehash-error-unsupported-file-type -- if a tracked path is now a socket, device, etc.
+//   - gittreehash-error-io -- if hashing a file fails.
+//   - gittreehash-error-permission -- if hashing a file fails due to permissions.
+//   - gittreehash-error-concurrent-io -- if a file changes while it's being hashed.
+func diffIndex(indexPath, root string) ([]string, error) {
+	idx, err := gitindex.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	var opts Options
+	if idx.HashSize == SHA1.Size() {
+		opts.Algorithm = SHA1
+	}
+	h := newHasher(rawDirFS("."), opts)
+	var changes []string
+	for _, ent := range idx.Entries {
+		if ent.Stage != 0 || ent.SkipWorktree {
+			continue // Conflicted and sparse entries don't describe a file in the working tree.
+		}
+		switch ent.Mode & 0o170000 {
+		case 0o100000, 0o120000:
+		default:
+			continue // Submodules and sparse directories aren't files we can hash.
+		}
+		pth := filepath.Join(root, filepath.FromSlash(ent.Path))
+		hash, mode, err := h.hashSomething(pth, nil)
+		if err != nil {
+			if serum.Code(err) == ErrNotFound {
+				changes = append(changes, "D\t"+ent.Path)
+				continue
+			}
+			return nil, err
+		}
+		if !bytes.Equal(hash[:idx.HashSize], ent.Hash) || h.gitMode(mode) != strconv.FormatUint(uint64(ent.Mode), 8) {
+			changes = append(changes, "M\t"+ent.Path)
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/serum-errors/go-serum"
+)
+
+// mainDumpTree implements the dump-tree subcommand,
+// which prints the body of the tree object for a directory (everything after the "tree <len>\0" preamble), hex-encoded.
+// This is the exact preimage that's hashed, so it's mostly useful for debugging disagreements with git,
+// e.g. by comparing it against `git cat-file tree <hash> | xxd -p`.
+func mainDumpTree(args []string) int {
+	fset := flag.NewFlagSet("dump-tree", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s dump-tree [flags] [path]\n", os.Args[0])
+		fset.PrintDefaults()
+	}
+	algorithm := fset.String("algorithm", "sha256", "hash function to use, matching git's object format: \"sha256\" or \"sha1\"")
+	fset.Parse(args)
+	root := "."
+	if fset.NArg() > 0 {
+		root = filepath.Clean(fset.Arg(0))
+	}
+	opts := Options{TreeSpillThreshold: -1} // The body is wanted in memory, to print.
+	switch *algorithm {
+	case "sha256":
+		opts.Algorithm = SHA256
+	case "sha1":
+		opts.Algorithm = SHA1
+	default:
+		fmt.Fprintf(os.Stderr, "unknown algorithm %q\n", *algorithm)
+		return 2
+	}
+
+	h := newHasher(rawDirFS("."), opts)
+	var dump string
+	var found bool
+	h.onTreeBody = func(pth string, body []byte) {
+		if pth == root {
+			dump, found = hex.EncodeToString(body), true
+		}
+	}
+	if _, _, err := h.hashSomething(root, nil); err != nil {
+		if aborted, ok := err.(abortError); ok {
+			err = aborted.error
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "%q is not a directory\n", root)
+		return 2
+	}
+	fmt.Println(dump)
+	return 0
+}
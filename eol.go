@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/warptools/gittreehash/gitattributes"
+)
+
+// eolAction is what should happen to line endings in a file when it's hashed.
+// These correspond to the crlf_action values in git's convert.c, but only from the "clean" direction
+// (working tree to repository), which is the only one that affects hashes.
+type eolAction uint8
+
+const (
+	eolAsIs eolAction = iota // No conversion.
+	eolText                  // The file is text; convert CRLF to LF.
+	eolAuto                  // Convert CRLF to LF, but only if the file doesn't look binary.
+)
+
+// eolActionFor decides, from gitattributes, how line endings of a file should be treated.
+func (h *hasher) eolActionFor(anc *ancestry, pth string) eolAction {
+	if !h.opts.RespectGitattributesEOL && !h.opts.AutoCRLF {
+		return eolAsIs
+	}
+	return h.gitEOLActionFor(anc, pth)
+}
+
+// gitEOLActionFor decides how git would treat the line endings of a file, whether or not the options ask us to.
+func (h *hasher) gitEOLActionFor(anc *ancestry, pth string) eolAction {
+	attrs := h.attributesFor(anc, pth, false, "text", "eol")
+	text, eol := attrs["text"], attrs["eol"]
+	switch text.State {
+	case gitattributes.Set:
+		return eolText
+	case gitattributes.Unset:
+		return eolAsIs
+	case gitattributes.Value:
+		if text.Value == "auto" {
+			return eolAuto
+		}
+		return eolAsIs // Git warns about other values and otherwise ignores them.
+	default:
+		// Setting "eol" implies the file is text, even when "text" isn't mentioned.
+		if eol.State == gitattributes.Value && (eol.Value == "lf" || eol.Value == "crlf") {
+			return eolText
+		}
+		// Without the attribute, git falls back to core.autocrlf, which defaults to off.
+		if h.opts.AutoCRLF {
+			return eolAuto
+		}
+		return eolAsIs
+	}
+}
+
+// convertEOL applies the clean-side line ending conversion.
+// It returns the content unchanged if the conversion doesn't apply.
+func convertEOL(content []byte, action eolAction) []byte {
+	if action == eolAsIs {
+		return content
+	}
+	stats := gatherTextStats(content)
+	if stats.crlf == 0 {
+		return content
+	}
+	if action == eolAuto && stats.isBinary() {
+		return content
+	}
+	// Only CR immediately followed by LF is converted; a lone CR is left alone.
+	return bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+}
+
+// textStats mirrors git's struct text_stat, which drives the binary detection heuristic for text=auto.
+type textStats struct {
+	nul, loneCR, loneLF, crlf int
+	printable, nonPrintable   int
+}
+
+func gatherTextStats(buf []byte) (stats textStats) {
+	for i := 0; i < len(buf); i++ {
+		c := buf[i]
+		switch {
+		case c == '\r':
+			if i+1 < len(buf) && buf[i+1] == '\n' {
+				stats.crlf++
+				i++
+			} else {
+				stats.loneCR++
+			}
+			continue
+		case c == '\n':
+			stats.loneLF++
+			continue
+		case c == 127:
+			stats.nonPrintable++
+		case c < 32:
+			switch c {
+			case '\b', '\t', '\033', '\014': // BS, HT, ESC and FF are considered printable.
+				stats.printable++
+			case 0:
+				stats.nul++
+				stats.nonPrintable++
+			default:
+				stats.nonPrintable++
+			}
+		default:
+			stats.printable++
+		}
+	}
+	// If the file ends with EOF (^Z), don't count that as non-printable.
+	if len(buf) >= 1 && buf[len(buf)-1] == '\032' {
+		stats.nonPrintable--
+	}
+	return
+}
+
+// isBinary is git's convert_is_binary.
+func (stats textStats) isBinary() bool {
+	return stats.loneCR > 0 || stats.nul > 0 || (stats.printable>>7) < stats.nonPrintable
+}
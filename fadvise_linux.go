@@ -0,0 +1,34 @@
+//go:build linux
+
+package main
+
+import (
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// adviseSequential tells the kernel a file is about to be read from start to end, so it can read ahead aggressively.
+// It's only advice; any error is ignored.
+func adviseSequential(f fs.File) {
+	if osf, ok := f.(*os.File); ok {
+		unix.Fadvise(int(osf.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+	}
+}
+
+// adviseDontNeed tells the kernel a range of a file won't be read again, so its pages can be dropped from the page cache.
+// A length of zero means through the end of the file.  It's only advice; any error is ignored.
+func adviseDontNeed(f fs.File, off, length int64) {
+	if osf, ok := f.(*os.File); ok {
+		unix.Fadvise(int(osf.Fd()), off, length, unix.FADV_DONTNEED)
+	}
+}
+
+// adviseWillNeed tells the kernel the start of a file will be read soon, so it can begin reading it in.
+// It's only advice; any error is ignored.
+func adviseWillNeed(f fs.File, length int64) {
+	if osf, ok := f.(*os.File); ok {
+		unix.Fadvise(int(osf.Fd()), 0, length, unix.FADV_WILLNEED)
+	}
+}
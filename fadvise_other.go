@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"io/fs"
+)
+
+// adviseSequential would tell the kernel a file is about to be read sequentially; on this platform it does nothing.
+func adviseSequential(f fs.File) {}
+
+// adviseDontNeed would tell the kernel a range of a file won't be read again; on this platform it does nothing.
+func adviseDontNeed(f fs.File, off, length int64) {}
+
+// adviseWillNeed would tell the kernel a file will be read soon; on this platform it does nothing.
+func adviseWillNeed(f fs.File, length int64) {}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+// FastImportCommit describes the commit made by the stream FastImport writes.
+type FastImportCommit struct {
+	Ref     string    // The ref the commit is made on, e.g. "refs/heads/main".  The commit has no parent, so git only moves an existing ref to it with --force.
+	Author  string    // The author (and committer), as "Name <email>".
+	Date    time.Time // The author (and committer) date; the time zone is kept.
+	Message string
+}
+
+// FastImport hashes a directory as HashPath does, and writes a `git fast-import` stream to w,
+// which makes a commit whose tree is exactly that directory: its id is the hash returned.
+// Every blob is inlined once (files with the same content share it).
+// Git builds the trees itself, and leaves out empty directories, so a directory with any of those below it is refused.
+// The stream declares the "done" feature, so git rejects it if it's cut short.
+//
+// Blobs are read twice, as by PackTree, and the same options can't be used, nor can UnicodeNormalization or CaseFold,
+// since the stream gives the names of files as they're found.
+// Since blobs are written out as they're read the second time, a file that's changed by then leaves w with a partial stream.
+//
+// Errors:
+//
+//   - gittreehash-error-unsupported-option -- if any of the options above are set.
+//   - gittreehash-error-unsupported-file-type -- if the path isn't a directory, or there's an empty directory in it.
+//   - gittreehash-error-concurrent-io -- if a file changes between being hashed and being written.
+//   - gittreehash-error-io -- if writing to w fails.
+//   - any error HashPath may return.
+func FastImport(fsys fsx.FS, rootPath string, w io.Writer, commit FastImportCommit, opts Options) ([32]byte, error) {
+	if err := checkObjectOptions(opts, "a fast-import stream"); err != nil {
+		return [32]byte{}, err
+	}
+	if opts.UnicodeNormalization != NormalizeNone || opts.CaseFold {
+		return [32]byte{}, serum.Error(ErrUnsupportedOption,
+			serum.WithMessageTemplate("can't write {{output}} with the options {{options}}"),
+			serum.WithDetail("output", "a fast-import stream"),
+			serum.WithDetail("options", "UnicodeNormalization or CaseFold"),
+		)
+	}
+
+	var entries []Entry
+	onEntry := opts.OnEntry
+	opts.OnEntry = func(e Entry) {
+		entries = append(entries, e)
+		if onEntry != nil {
+			onEntry(e)
+		}
+	}
+	h := newHasher(fsys, opts)
+	hash, mode, err := h.hashSomething(rootPath, nil)
+	if err = unwrapAbort(err); err != nil {
+		return [32]byte{}, err
+	}
+	if !mode.IsDir() {
+		return [32]byte{}, serum.Error(ErrUnsupportedFileType,
+			serum.WithMessageTemplate("{{path}} is not a directory, so it can't be the tree of a commit"),
+			serum.WithDetail("path", rootPath),
+		)
+	}
+
+	emptyTree := opts.Algorithm.hashObject("tree", nil)
+	root := path.Clean(rootPath)
+	for _, e := range entries {
+		if e.Type == "tree" && e.Path != root && string(e.Hash) == string(emptyTree[:len(e.Hash)]) {
+			return [32]byte{}, serum.Error(ErrUnsupportedFileType,
+				serum.WithMessageTemplate("{{path}} is an empty directory, which git fast-import would leave out"),
+				serum.WithDetail("path", e.Path),
+			)
+		}
+	}
+
+	bw := bufio.NewWriterSize(w, 1<<16)
+	fmt.Fprintf(bw, "feature done\n")
+	marks := map[[32]byte]int{}
+	for _, e := range entries {
+		var blobHash [32]byte
+		copy(blobHash[:], e.Hash)
+		if _, ok := marks[blobHash]; ok || e.Type != "blob" {
+			continue
+		}
+		marks[blobHash] = len(marks) + 1
+		fmt.Fprintf(bw, "blob\nmark :%d\ndata %d\n", marks[blobHash], e.Size)
+		if err := fastImportBlob(bw, fsys, e, blobHash, opts.Algorithm); err != nil {
+			return [32]byte{}, err
+		}
+		bw.WriteString("\n")
+	}
+
+	author := gitSignature(commit.Author, commit.Date)
+	fmt.Fprintf(bw, "commit %s\nauthor %s\ncommitter %s\ndata %d\n%s\n", commit.Ref, author, author, len(commit.Message), commit.Message)
+	bw.WriteString("deleteall\n")
+	for _, e := range entries {
+		if e.Type != "blob" {
+			continue
+		}
+		name := e.Path
+		if root != "." {
+			name = name[len(root)+1:]
+		}
+		var blobHash [32]byte
+		copy(blobHash[:], e.Hash)
+		fmt.Fprintf(bw, "M %s :%d %s\n", e.GitMode, marks[blobHash], fastImportPath(name))
+	}
+	bw.WriteString("\ndone\n")
+	if err := bw.Flush(); err != nil {
+		return [32]byte{}, newErrIO(err)
+	}
+	return hash, nil
+}
+
+// writeFastImport is FastImport, writing the stream to a file, which is removed if anything goes wrong, or to stdout if the filename is "-".
+func writeFastImport(filename string, fsys fsx.FS, rootPath string, commit FastImportCommit, opts Options) ([32]byte, error) {
+	if filename == "-" {
+		return FastImport(fsys, rootPath, os.Stdout, commit, opts)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return [32]byte{}, newErrIO(err)
+	}
+	hash, err := FastImport(fsys, rootPath, f, commit, opts)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = newErrIO(cerr)
+	}
+	if err != nil {
+		os.Remove(filename)
+		return [32]byte{}, err
+	}
+	return hash, nil
+}
+
+// fastImportBlob reads a file (or symlink) again, and writes its content, checking that it still has the hash it had.
+//
+// Errors:
+//
+//   - gittreehash-error-concurrent-io -- if the file has vanished or changed.
+//   - gittreehash-error-io -- if reading the file, or writing to w, fails.
+//   - gittreehash-error-permission -- if reading the file fails due to permissions.
+func fastImportBlob(w io.Writer, fsys fsx.FS, e Entry, hash [32]byte, algorithm Algorithm) error {
+	content, err := openBlob(fsys, e)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	digester := algorithm.New()
+	digester.Write(appendObjectPreamble(nil, "blob", e.Size))
+	// Never more than the size already given in the stream, so that if the file has grown, the stream stays in step.
+	counted := &countingReader{r: io.TeeReader(io.LimitReader(content, e.Size), digester)}
+	if _, err := io.Copy(w, counted); err != nil {
+		return newErrIO(err)
+	}
+	var actual [32]byte
+	digester.Sum(actual[:0])
+	if counted.n != e.Size {
+		return NewErrSizeChanged(e.Path, e.Size, counted.n)
+	}
+	if actual != hash {
+		return serum.Errorf(ErrConcurrentIO, "file at %q changed between being hashed and being written", e.Path)
+	}
+	return nil
+}
+
+// fastImportPath gives a path as a fast-import stream needs it: as it is, unless it begins with a double quote
+// or contains a newline or backslash, in which case it's quoted, C-style.
+func fastImportPath(name string) string {
+	if !strings.HasPrefix(name, `"`) && !strings.ContainsAny(name, "\n\\") {
+		return name
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				b.WriteString(`\` + strconv.FormatInt(int64(c)+0o1000, 8)[1:]) // Three octal digits.
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,34 @@
+package main
+
+const (
+	// fallbackMaxOpenFiles is the default for Options.MaxOpenFiles when the process's limit can't be found.
+	fallbackMaxOpenFiles = 256
+
+	// maxMaxOpenFiles caps the default, for processes with no effective limit.
+	maxMaxOpenFiles = 1 << 16
+)
+
+// maxOpenFilesWithin returns how many files hashing may hold open, given the process's limit on descriptors:
+// a quarter of the limit, but not less than one.  The rest is left for whatever else the process has open,
+// and for any other processes hashing alongside it, as when several are run in parallel by a build tool.
+func maxOpenFilesWithin(limit uint64) int {
+	if limit/4 > maxMaxOpenFiles {
+		return maxMaxOpenFiles
+	}
+	n := int(limit / 4)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// acquireFile waits until hashing may open another file (or directory), per Options.MaxOpenFiles.
+// Every call must be matched by a call to releaseFile once the file is closed.
+func (h *hasher) acquireFile() {
+	h.openFiles <- struct{}{}
+}
+
+// releaseFile gives back what acquireFile took.
+func (h *hasher) releaseFile() {
+	<-h.openFiles
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// defaultMaxOpenFiles derives Options.MaxOpenFiles.  There's no limit to consult on this platform.
+func defaultMaxOpenFiles() int {
+	return fallbackMaxOpenFiles
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// defaultMaxOpenFiles derives Options.MaxOpenFiles from the process's limit on open file descriptors,
+// leaving most of it for whatever else the process has open (stdio, the runtime's own, a cache file, an SSH connection...).
+func defaultMaxOpenFiles() int {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return fallbackMaxOpenFiles
+	}
+	return maxOpenFilesWithin(lim.Cur)
+}
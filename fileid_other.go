@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"io/fs"
+)
+
+// fileIdentity extracts the device and inode numbers from a FileInfo,
+// if the filesystem that produced it exposes them.
+// On this platform, that information is never available.
+func fileIdentity(fi fs.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
+
+// fileLinkCount returns how many hard links a file has, if the filesystem that produced the FileInfo exposes it.
+// On this platform, that information is never available.
+func fileLinkCount(fi fs.FileInfo) (nlink uint64, ok bool) {
+	return 0, false
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileIdentity extracts the device and inode numbers from a FileInfo,
+// if the filesystem that produced it exposes them.
+// The ok return is false if no such information is available.
+func fileIdentity(fi fs.FileInfo) (dev, ino uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), true
+}
+
+// fileLinkCount returns how many hard links a file has, if the filesystem that produced the FileInfo exposes it.
+func fileLinkCount(fi fs.FileInfo) (nlink uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/warptools/gittreehash/gitattributes"
+)
+
+// excluded reports whether a directory entry should be left out of its parent's tree entirely,
+// according to whatever filtering options are enabled.
+// The anc parameter describes the directory containing the entry.
+func (h *hasher) excluded(anc *ancestry, pth string, dirEnt fs.DirEntry) bool {
+	if h.opts.Include != nil && !h.opts.Include(pth, dirEnt.IsDir()) {
+		return true
+	}
+	if h.opts.MinSize > 0 && dirEnt.Type().IsRegular() {
+		// If this fails, the file's probably gone; leave it in, and let hashing it report that properly.
+		if fi, err := dirEnt.Info(); err == nil && fi.Size() < h.opts.MinSize {
+			return true
+		}
+	}
+	if len(h.opts.ExcludeSuffixes) > 0 && !dirEnt.IsDir() {
+		for _, suffix := range h.opts.ExcludeSuffixes {
+			if strings.HasSuffix(dirEnt.Name(), suffix) {
+				return true
+			}
+		}
+	}
+	if h.opts.IgnoreDotGit && dirEnt.Name() == ".git" {
+		return true
+	}
+	if h.opts.RespectExportIgnore {
+		attrs := h.attributesFor(anc, pth, dirEnt.IsDir(), "export-ignore")
+		if attrs["export-ignore"].State == gitattributes.Set {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedFromArchive is the counterpart of excluded for an entry of an archive, given its (cleaned) path within it,
+// its mode, and for regular files, its size.  It applies the filters that don't need a filesystem to read:
+// MinSize, ExcludeSuffixes, and IgnoreDotGit.  Since an archive lists what's beneath a directory as entries of their own,
+// anything beneath a .git directory is left out too, as it would be with the directory itself.
+func (h *hasher) excludedFromArchive(pth string, mode fs.FileMode, size int64) bool {
+	if h.opts.MinSize > 0 && mode.IsRegular() && size < h.opts.MinSize {
+		return true
+	}
+	if !mode.IsDir() {
+		for _, suffix := range h.opts.ExcludeSuffixes {
+			if strings.HasSuffix(path.Base(pth), suffix) {
+				return true
+			}
+		}
+	}
+	if h.opts.IgnoreDotGit {
+		for _, seg := range strings.Split(pth, "/") {
+			if seg == ".git" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stringsFlag is a flag which may be given more than once, collecting each value.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
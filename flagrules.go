@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// flagConflict is a rule that a flag can't be used with any of some others.
+//
+// Flags are named as they're given, like "--tar", and count as used if they've been given a value other than their default
+// (as for optionsFingerprint).  A name can also include a value, like "--format=tree", to mean the flag has that value;
+// or be "a path", to mean a path argument has been given.
+type flagConflict struct {
+	flag string
+	with []string // In the order they're listed when the rule is broken.
+}
+
+// flagConflicts are the combinations of flags that main refuses, checked in this order by checkFlagCombinations.
+var flagConflicts = []flagConflict{
+	{"--template", []string{"--report-format"}},
+	{"--format=tree", []string{"--report-format", "--verbose", "--template", "--go-array", "--var"}},
+	{"--symlinks-as-text", []string{"--symlinks-as-text-from-index"}},
+	{"--ssh", []string{"a path", "--tar", "--zip", "--tracked-only", "--reuse-git", "--pipe-to-git"}},
+	{"--remote", []string{"a path", "--tar", "--zip", "--ssh", "--tracked-only", "--reuse-git", "--pipe-to-git"}},
+	{"--fs-plugin", []string{"--tar", "--zip", "--ssh", "--remote", "--tracked-only", "--reuse-git", "--pipe-to-git"}},
+	{"--normalize-output", []string{"--tar", "--zip", "--tracked-only", "--reuse-git", "--pipe-to-git", "--symlinks-as-text", "--symlinks-as-text-from-index"}},
+	{"--pack", []string{"--tar", "--zip", "--pipe-to-git"}},
+	{"--write", []string{"--tar", "--zip", "--pipe-to-git", "--pack"}},
+	{"--fast-import-out", []string{"--tar", "--zip", "--pipe-to-git", "--pack", "--write", "--prepend-path", "--seed"}},
+	{"--tar", []string{"a path", "--zip", "--count", "--tracked-only", "--reuse-git", "--progress", "--hash-names-only", "--respect-export-ignore"}},
+	{"--zip", []string{"a path", "--count", "--tracked-only", "--reuse-git", "--progress", "--hash-names-only", "--respect-export-ignore"}},
+	{"--paths0-as-tree", []string{"--tar", "--zip", "--tracked-only", "--normalize-output"}},
+	{"--prepend-path", []string{"--report-format", "--verbose", "--template", "--format=tree", "--pipe-to-git"}},
+	{"--commit", []string{"--report-format", "--verbose", "--template", "--format=tree", "--var", "--go-array", "--seed"}},
+	{"--seed", []string{"--report-format", "--verbose", "--template", "--format=tree", "--pipe-to-git"}},
+	{"--verify-with-git", []string{"--tar", "--zip", "--ssh", "--remote", "--fs-plugin", "--normalize-output"}},
+	{"--compare-with-git", []string{"--tar", "--zip", "--ssh", "--remote", "--fs-plugin", "--normalize-output"}},
+	{"--pipe-to-git", []string{"--tar", "--zip", "--respect-gitattributes-eol", "--lfs=pointers", "--symlinks-as-text", "--symlinks-as-text-from-index", "--hash-names-only"}},
+	{"--report-collisions", []string{"--tar", "--zip"}},
+	{"--benchmark", []string{"--tar", "--zip", "--pack", "--write", "--fast-import-out", "--report-format", "--verbose", "--template", "--format=tree", "--progress", "--report-collisions", "--compare-with-git"}},
+}
+
+// flagRequirements pair flags with another that they mean nothing without, checked before flagConflicts.
+var flagRequirements = [][2]string{
+	{"--cache-rewrite", "--cache"},
+	{"--verify-output-file", "--output-file"},
+	{"--update", "--assert-unchanged"},
+	{"--s3-endpoint", "--remote"},
+	{"--fs-plugin-config", "--fs-plugin"},
+	{"--write", "--git-dir"},
+	{"--git-dir", "--write"},
+	{"--strict", "--compare-with-git"},
+}
+
+// checkFlagCombinations returns a message explaining the first of flagRequirements or flagConflicts that the flags parsed by fset break,
+// or "" if they break none.
+func checkFlagCombinations(fset *flag.FlagSet) string {
+	used := func(name string) bool {
+		if name == "a path" {
+			return fset.NArg() > 0
+		}
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(name, "--"), "=")
+		f := fset.Lookup(name)
+		if f == nil {
+			panic("no flag named " + name) // A mistake in the tables.
+		}
+		if hasValue {
+			return f.Value.String() == value
+		}
+		return f.Value.String() != f.DefValue
+	}
+	for _, rule := range flagRequirements {
+		if used(rule[0]) && !used(rule[1]) {
+			return fmt.Sprintf("%s requires %s", rule[0], rule[1])
+		}
+	}
+	for _, rule := range flagConflicts {
+		conflicting := false
+		for _, other := range rule.with {
+			conflicting = used(other) || conflicting // Every name is looked up, so a mistake in the table shows on any run.
+		}
+		if used(rule.flag) && conflicting {
+			return fmt.Sprintf("%s can't be used with %s", rule.flag, listWithOr(rule.with))
+		}
+	}
+	return ""
+}
+
+// listWithOr joins items into a list like "a, b, or c".
+func listWithOr(items []string) string {
+	switch len(items) {
+	case 1:
+		return items[0]
+	case 2:
+		return items[0] + " or " + items[1]
+	default:
+		return strings.Join(items[:len(items)-1], ", ") + ", or " + items[len(items)-1]
+	}
+}
+
+// stdinTarFlag is the --stdin-tar flag, which sets --tar to "-".
+type stdinTarFlag struct{ tar *string }
+
+func (f stdinTarFlag) IsBoolFlag() bool { return true }
+
+func (f stdinTarFlag) String() string { return strconv.FormatBool(f.tar != nil && *f.tar == "-") }
+
+func (f stdinTarFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err == nil && v {
+		*f.tar = "-"
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+const ErrFSPlugin = "gittreehash-error-fs-plugin"
+
+// FSPluginABI names the version of the interface a filesystem plugin (for --fs-plugin) implements.
+// It changes whenever that interface does, so a plugin built for another version is refused, rather than misbehaving.
+//
+// A filesystem plugin is a Go plugin (built with `go build -buildmode=plugin`, against the same versions of Go
+// and of the packages it shares with gittreehash, notably github.com/warpfork/go-fsx) which exports two symbols:
+//
+//	var FSPluginABI = "gittreehash-fs-plugin-v1" // Exactly this value.
+//	func NewFS(config string) (fsx.FS, error)   // Given the --fs-plugin-config string, returns the filesystem to hash.
+//
+// Paths given to gittreehash are then paths within that filesystem, slash-separated, as io/fs requires.
+// The filesystem need only implement fs.FS, in which case it's hashed as HashFS hashes it, taking each symlink as what it points to;
+// implementing fsx's Lstat and Readlink as well lets symlinks be hashed as symlinks.
+const FSPluginABI = "gittreehash-fs-plugin-v1"
+
+// fsPluginFactory is the type of a filesystem plugin's NewFS function.
+type fsPluginFactory = func(config string) (fsx.FS, error)
+
+func newErrFSPlugin(pth, reason string) error {
+	return serum.Error(ErrFSPlugin,
+		serum.WithMessageTemplate("can't use the filesystem plugin {{path}}: {{reason}}"),
+		serum.WithDetail("path", pth),
+		serum.WithDetail("reason", reason),
+	)
+}
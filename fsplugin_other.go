@@ -0,0 +1,16 @@
+//go:build !((linux || darwin || freebsd) && cgo)
+
+package main
+
+import (
+	"github.com/warpfork/go-fsx"
+)
+
+// loadFSPlugin would open a filesystem plugin; Go plugins can't be loaded on this platform, or without cgo.
+//
+// Errors:
+//
+//   - gittreehash-error-fs-plugin -- always.
+func loadFSPlugin(pth, config string) (fsx.FS, error) {
+	return nil, newErrFSPlugin(pth, "plugins aren't supported by this build of gittreehash (they need linux, darwin, or freebsd, and cgo)")
+}
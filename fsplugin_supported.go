@@ -0,0 +1,51 @@
+//go:build (linux || darwin || freebsd) && cgo
+
+package main
+
+import (
+	"fmt"
+	"plugin"
+
+	"github.com/warpfork/go-fsx"
+)
+
+// loadFSPlugin opens a filesystem plugin (see FSPluginABI), checks it implements this version of the interface,
+// and calls its NewFS with the config string.
+//
+// Errors:
+//
+//   - gittreehash-error-fs-plugin -- if the plugin can't be opened, doesn't export the symbols needed,
+//     was built for another version of the interface, or NewFS fails.
+func loadFSPlugin(pth, config string) (fsx.FS, error) {
+	p, err := plugin.Open(pth)
+	if err != nil {
+		return nil, newErrFSPlugin(pth, err.Error())
+	}
+	abiSym, err := p.Lookup("FSPluginABI")
+	if err != nil {
+		return nil, newErrFSPlugin(pth, "it doesn't export FSPluginABI, so it may not be a gittreehash filesystem plugin")
+	}
+	abi, ok := abiSym.(*string)
+	if !ok {
+		return nil, newErrFSPlugin(pth, fmt.Sprintf("its FSPluginABI is a %T, not a string variable", abiSym))
+	}
+	if *abi != FSPluginABI {
+		return nil, newErrFSPlugin(pth, fmt.Sprintf("it implements %q, but this gittreehash needs %q", *abi, FSPluginABI))
+	}
+	newFSSym, err := p.Lookup("NewFS")
+	if err != nil {
+		return nil, newErrFSPlugin(pth, "it doesn't export NewFS")
+	}
+	newFS, ok := newFSSym.(fsPluginFactory)
+	if !ok {
+		return nil, newErrFSPlugin(pth, fmt.Sprintf("its NewFS is a %T, not a func(string) (fsx.FS, error)", newFSSym))
+	}
+	fsys, err := newFS(config)
+	if err != nil {
+		return nil, newErrFSPlugin(pth, "NewFS failed: "+err.Error())
+	}
+	if fsys == nil {
+		return nil, newErrFSPlugin(pth, "NewFS returned no filesystem")
+	}
+	return fsys, nil
+}
@@ -0,0 +1,171 @@
+// Package gitattributes parses .gitattributes files and evaluates which attributes apply to a path,
+// following the same pattern and precedence rules as git.
+//
+// Only the features that affect the content git would store are interesting here;
+// there's no support for $GIT_DIR/info/attributes, or for macro definitions other than the builtin "binary" macro.
+package gitattributes
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const (
+	ErrParse = "gitattributes-error-parse"
+	ErrIO    = "gitattributes-error-io"
+)
+
+// State describes how an attribute is set for a path.
+type State uint8
+
+const (
+	Unspecified State = iota // No rule mentions the attribute (or a rule reset it with "!attr").
+	Set                      // The attribute was given bare, as "attr".
+	Unset                    // The attribute was given negated, as "-attr".
+	Value                    // The attribute was given a value, as "attr=value".
+)
+
+// Attr is a single attribute assignment.
+type Attr struct {
+	Name  string
+	State State
+	Value string // Only meaningful if State is Value.
+}
+
+// Rule is one line of a .gitattributes file.
+type Rule struct {
+	Pattern Pattern
+	Attrs   []Attr
+	Line    int
+}
+
+// File is the parsed content of one .gitattributes file.
+type File struct {
+	// Dir is the slash-separated path of the directory containing the file,
+	// in whatever terms the caller is using for paths.  Empty for the root.
+	Dir   string
+	Rules []Rule
+}
+
+// Parse reads a .gitattributes file.
+// The dir parameter is recorded as the directory the file applies to; see File.Dir.
+//
+// Errors:
+//
+//   - gitattributes-error-parse -- if a line can't be understood.
+//   - gitattributes-error-io -- if reading fails.
+func Parse(r io.Reader, dir string) (*File, error) {
+	f := &File{Dir: strings.Trim(dir, "/")}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var pattern string
+		if line[0] == '"' {
+			// C-style quoted pattern.  Find the closing quote, then let strconv deal with the escapes.
+			end := 1
+			for ; end < len(line); end++ {
+				if line[end] == '\\' {
+					end++
+					continue
+				}
+				if line[end] == '"' {
+					break
+				}
+			}
+			if end >= len(line) {
+				return nil, serum.Errorf(ErrParse, "unterminated quoted pattern on line %d", lineNum)
+			}
+			unquoted, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				return nil, serum.Errorf(ErrParse, "invalid quoted pattern on line %d: %w", lineNum, err)
+			}
+			pattern, line = unquoted, line[end+1:]
+		} else {
+			pattern, line = line, ""
+			if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+				pattern, line = pattern[:i], pattern[i+1:]
+			}
+		}
+		if strings.HasPrefix(pattern, "!") {
+			// Git refuses negative patterns in attributes files, and ignores the line with a warning.
+			continue
+		}
+		rule := Rule{Pattern: ParsePattern(pattern), Line: lineNum}
+		for _, tok := range strings.Fields(line) {
+			rule.Attrs = append(rule.Attrs, parseAttr(tok)...)
+		}
+		f.Rules = append(f.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, serum.Errorf(ErrIO, "%w", err)
+	}
+	return f, nil
+}
+
+func parseAttr(tok string) []Attr {
+	switch {
+	case strings.HasPrefix(tok, "-"):
+		return []Attr{{Name: tok[1:], State: Unset}}
+	case strings.HasPrefix(tok, "!"):
+		return []Attr{{Name: tok[1:], State: Unspecified}}
+	case strings.Contains(tok, "="):
+		i := strings.IndexByte(tok, '=')
+		return []Attr{{Name: tok[:i], State: Value, Value: tok[i+1:]}}
+	case tok == "binary":
+		// The only builtin macro.
+		return []Attr{
+			{Name: "binary", State: Set},
+			{Name: "diff", State: Unset},
+			{Name: "merge", State: Unset},
+			{Name: "text", State: Unset},
+		}
+	default:
+		return []Attr{{Name: tok, State: Set}}
+	}
+}
+
+// Stack is the set of .gitattributes files which apply to some directory,
+// ordered from the outermost directory to the innermost.
+type Stack []*File
+
+// Lookup finds the state of the named attributes for a path.
+// The path must be slash-separated, and in the same terms as the Dir of each File in the stack.
+//
+// As in git, rules in deeper files take precedence over shallower ones,
+// and later lines in a file take precedence over earlier ones.
+// A pattern which matches a directory does not apply to the files within it.
+func (s Stack) Lookup(pth string, isDir bool, names ...string) map[string]Attr {
+	result := make(map[string]Attr, len(names))
+	for _, name := range names {
+		result[name] = Attr{Name: name}
+	}
+	for _, f := range s {
+		rel := pth
+		if f.Dir != "" {
+			if !strings.HasPrefix(pth, f.Dir+"/") {
+				continue
+			}
+			rel = pth[len(f.Dir)+1:]
+		}
+		for _, rule := range f.Rules {
+			if !rule.Pattern.Match(rel, isDir) {
+				continue
+			}
+			for _, attr := range rule.Attrs {
+				if _, wanted := result[attr.Name]; wanted {
+					result[attr.Name] = attr
+				}
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,222 @@
+package gitattributes
+
+import (
+	"strings"
+)
+
+// Pattern is a single path pattern, as found at the start of each line of a .gitattributes file
+// (and, with the addition of negation, of a .gitignore file).
+//
+// Patterns follow git's rules: a pattern with no slash in it (other than a trailing one)
+// matches the name of a file at any depth; otherwise it matches the path relative to
+// the directory of the file it came from.  '*' and '?' don't cross slashes, but '**' does.
+type Pattern struct {
+	raw      string // as written, for error messages.
+	glob     string // the part actually matched, with leading and trailing slashes removed.
+	basename bool   // true if glob should be matched against only the last path segment.
+	dirOnly  bool   // true if the pattern had a trailing slash, meaning it only matches directories.
+}
+
+// ParsePattern prepares a pattern for matching.
+func ParsePattern(s string) Pattern {
+	p := Pattern{raw: s, glob: s}
+	if strings.HasSuffix(p.glob, "/") {
+		p.dirOnly = true
+		p.glob = strings.TrimSuffix(p.glob, "/")
+	}
+	if strings.HasPrefix(p.glob, "/") {
+		p.glob = strings.TrimPrefix(p.glob, "/")
+	} else if !strings.Contains(p.glob, "/") {
+		p.basename = true
+	}
+	return p
+}
+
+// String returns the pattern as it was originally written.
+func (p Pattern) String() string {
+	return p.raw
+}
+
+// Match reports whether the pattern matches a path.
+// The path must be slash-separated and relative to the directory that the pattern came from.
+func (p Pattern) Match(pth string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.basename {
+		if i := strings.LastIndexByte(pth, '/'); i >= 0 {
+			pth = pth[i+1:]
+		}
+	}
+	return Wildmatch(p.glob, pth)
+}
+
+// Wildmatch matches a path against a glob, following the same rules as git's wildmatch with WM_PATHNAME:
+// '*' matches any run of characters except '/', '?' matches any single character except '/',
+// '[...]' matches a character class (with '!' or '^' for negation), '\' escapes the next character,
+// and '**' between slashes (or at either end) matches any number of whole path segments, including none.
+func Wildmatch(glob, pth string) bool {
+	return wildmatch(glob, pth, true)
+}
+
+// wildmatch does the work of Wildmatch.
+// segmentStart tracks whether the glob is at the start of a path segment,
+// since '**' is only special when it occupies a whole segment.
+func wildmatch(glob, pth string, segmentStart bool) bool {
+	for len(glob) > 0 {
+		switch glob[0] {
+		case '*':
+			if segmentStart && strings.HasPrefix(glob, "**") && (len(glob) == 2 || glob[2] == '/') {
+				rest := strings.TrimPrefix(glob[2:], "/")
+				if rest == "" {
+					return true // trailing '**' matches everything inside.
+				}
+				// Try the remainder at the start, and after each slash.
+				for {
+					if wildmatch(rest, pth, true) {
+						return true
+					}
+					i := strings.IndexByte(pth, '/')
+					if i < 0 {
+						return false
+					}
+					pth = pth[i+1:]
+				}
+			}
+			glob = strings.TrimLeft(glob, "*")
+			if glob == "" {
+				return !strings.Contains(pth, "/")
+			}
+			for i := 0; i <= len(pth); i++ {
+				if wildmatch(glob, pth[i:], false) {
+					return true
+				}
+				if i < len(pth) && pth[i] == '/' {
+					return false
+				}
+			}
+			return false
+		case '?':
+			if len(pth) == 0 || pth[0] == '/' {
+				return false
+			}
+			glob, pth = glob[1:], pth[1:]
+			segmentStart = false
+		case '[':
+			if len(pth) == 0 || pth[0] == '/' {
+				return false
+			}
+			matched, rest, ok := matchClass(glob, pth[0])
+			if !ok {
+				// Unterminated class; git treats the bracket literally.
+				if pth[0] != '[' {
+					return false
+				}
+				glob, pth = glob[1:], pth[1:]
+				segmentStart = false
+				continue
+			}
+			if !matched {
+				return false
+			}
+			glob, pth = rest, pth[1:]
+			segmentStart = false
+		case '\\':
+			if len(glob) > 1 {
+				glob = glob[1:]
+			}
+			fallthrough
+		default:
+			if len(pth) == 0 || pth[0] != glob[0] {
+				return false
+			}
+			segmentStart = glob[0] == '/'
+			glob, pth = glob[1:], pth[1:]
+		}
+	}
+	return len(pth) == 0
+}
+
+// matchClass matches a single byte against the bracket expression at the start of glob.
+// As well as characters and ranges, the expression may contain character classes, like "[:alpha:]".
+// It returns whether the byte matched, the remainder of the glob after the class,
+// and ok=false if the class was never terminated.
+func matchClass(glob string, c byte) (matched bool, rest string, ok bool) {
+	i := 1
+	negate := false
+	if i < len(glob) && (glob[i] == '!' || glob[i] == '^') {
+		negate = true
+		i++
+	}
+	first := true
+	for ; i < len(glob); i++ {
+		if glob[i] == ']' && !first {
+			return matched != negate, glob[i+1:], true
+		}
+		first = false
+		if glob[i] == '[' && i+1 < len(glob) && glob[i+1] == ':' {
+			// A character class like "[:digit:]", if the next ']' closes it; otherwise the '[' is just a character.
+			if end := strings.IndexByte(glob[i+2:], ']'); end > 0 && glob[i+2+end-1] == ':' {
+				in, known := inCharClass(glob[i+2:i+2+end-1], c)
+				if !known {
+					return false, "", true // As in git, a pattern naming an unknown class matches nothing.
+				}
+				matched = matched || in
+				i += 2 + end
+				continue
+			}
+		}
+		lo := glob[i]
+		if lo == '\\' && i+1 < len(glob) {
+			i++
+			lo = glob[i]
+		}
+		hi := lo
+		if i+2 < len(glob) && glob[i+1] == '-' && glob[i+2] != ']' {
+			hi = glob[i+2]
+			if hi == '\\' && i+3 < len(glob) {
+				i++
+				hi = glob[i+2]
+			}
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	return false, "", false
+}
+
+// inCharClass reports whether a byte is in the named character class (such as "digit", in "[:digit:]"),
+// and whether the class is one git knows.  Only ASCII characters are in any class, as in git.
+func inCharClass(name string, c byte) (in bool, known bool) {
+	isUpper, isLower, isDigit := 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9'
+	isPunct := '!' <= c && c <= '~' && !isUpper && !isLower && !isDigit
+	switch name {
+	case "alnum":
+		return isUpper || isLower || isDigit, true
+	case "alpha":
+		return isUpper || isLower, true
+	case "blank":
+		return c == ' ' || c == '\t', true
+	case "cntrl":
+		return c < ' ' || c == 0x7f, true
+	case "digit":
+		return isDigit, true
+	case "graph":
+		return '!' <= c && c <= '~', true
+	case "lower":
+		return isLower, true
+	case "print":
+		return ' ' <= c && c <= '~', true
+	case "punct":
+		return isPunct, true
+	case "space":
+		return c == ' ' || ('\t' <= c && c <= '\r'), true
+	case "upper":
+		return isUpper, true
+	case "xdigit":
+		return isDigit || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F'), true
+	}
+	return false, false
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+const ErrGit = "gittreehash-error-git"
+
+// gitHashObject has git itself hash the content of a file as a blob, by piping it to `git hash-object --stdin -t blob`,
+// as an independent check on our own hashing.  The result is the hex hash git printed.
+//
+// Outside of a repository, git hash-object always uses SHA-1;
+// for SHA-256 it's run against a scratch repository of that object format.
+//
+// Errors:
+//
+//   - gittreehash-error-git -- if git can't be run, or fails.
+//   - gittreehash-error-io -- if the file can't be read.
+//   - gittreehash-error-permission -- if the file can't be read due to permissions.
+func gitHashObject(pth string, algorithm Algorithm) (string, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return "", newErrIO(err)
+	}
+	defer f.Close()
+	cmd := exec.Command("git", "hash-object", "--stdin", "-t", "blob")
+	cmd.Stdin = f
+	cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL="+os.DevNull)
+	if algorithm != SHA1 {
+		scratch, err := os.MkdirTemp("", "gittreehash-git-check-")
+		if err != nil {
+			return "", newErrIO(err)
+		}
+		defer os.RemoveAll(scratch)
+		if out, err := exec.Command("git", "init", "-q", "--bare", "--object-format="+algorithm.String(), scratch).CombinedOutput(); err != nil {
+			return "", newErrGit(err, out)
+		}
+		cmd.Env = append(cmd.Env, "GIT_DIR="+scratch)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", newErrGit(err, stderr.Bytes())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitCheckout is a directory in a git working tree with nothing uncommitted, as found by findCleanCheckout.
+type gitCheckout struct {
+	root      string    // The root of the working tree.
+	prefix    string    // The directory's path within the working tree, slash-separated; "." for the root itself.
+	algorithm Algorithm // The repository's object format.
+}
+
+// findCleanCheckout finds the git working tree containing a directory, and checks, with git status,
+// that nothing in the directory differs from HEAD, or is untracked or ignored.
+// If something does, or if git isn't on the PATH, or the directory isn't in a working tree, no checkout is returned,
+// but a reason why git can't be compared with.
+//
+// Errors:
+//
+//   - gittreehash-error-git -- if git fails.
+//   - gittreehash-error-io -- if locating the repository fails.
+//   - gittreehash-error-permission -- if locating the repository fails due to permissions.
+func findCleanCheckout(dir string, ignoreDotGit bool) (c gitCheckout, unverifiable string, err error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return c, "git isn't on the PATH", nil
+	}
+	root, _, err := findGitDir(dir)
+	if err != nil {
+		if serum.Code(err) == ErrNoRepository {
+			return c, "the path isn't in a git working tree", nil
+		}
+		return c, "", err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return c, "", newErrIO(err)
+	}
+	prefix, err := filepath.Rel(root, abs)
+	if err != nil {
+		return c, "", newErrIO(err)
+	}
+	c = gitCheckout{root: root, prefix: filepath.ToSlash(prefix)}
+	if c.prefix == "." && !ignoreDotGit {
+		return gitCheckout{}, "the path is the root of the working tree, so it contains .git, which git doesn't record; use --ignore-dot-git", nil
+	}
+
+	status, err := c.git(nil, nil, "status", "--porcelain", "--untracked-files=all", "--ignored", "--", c.prefix)
+	if err != nil {
+		return gitCheckout{}, "", err
+	}
+	if status != "" {
+		return gitCheckout{}, "there are uncommitted changes, or untracked or ignored files, in the path", nil
+	}
+	format, err := c.git(nil, nil, "rev-parse", "--show-object-format")
+	if err != nil {
+		return gitCheckout{}, "", err
+	}
+	switch format {
+	case "sha1":
+		c.algorithm = SHA1
+	case "sha256":
+		c.algorithm = SHA256
+	default:
+		return gitCheckout{}, "the repository's object format is " + format + ", which isn't supported", nil
+	}
+	return c, "", nil
+}
+
+// git runs git at the root of the working tree, with pathspecs taken literally, and the given environment variables added,
+// returning what it prints, trimmed.
+//
+// Errors:
+//
+//   - gittreehash-error-git -- if git fails.
+func (c gitCheckout) git(env []string, stdin io.Reader, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"--literal-pathspecs", "-C", c.root}, args...)...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", newErrGit(err, stderr.Bytes())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// writeTreeArgs returns the arguments to `git write-tree` for the tree of the directory, rather than the whole working tree.
+func (c gitCheckout) writeTreeArgs() []string {
+	if c.prefix == "." {
+		return []string{"write-tree"}
+	}
+	return []string{"write-tree", "--prefix=" + c.prefix + "/"}
+}
+
+// gitWriteTree has git compute the tree hash of a directory in a working tree, as an independent check on our own hashing,
+// by running `git write-tree` (with --prefix, for a subdirectory).  It returns the hex hash git printed,
+// and the repository's object format.
+//
+// What git writes is the tree of the index, which is only what's in the directory if nothing in it is uncommitted;
+// so the directory must be a clean checkout (see findCleanCheckout).  If it isn't, no hash is returned,
+// but a reason why it can't be compared.
+//
+// Errors:
+//
+//   - gittreehash-error-git -- if git fails.
+//   - gittreehash-error-io -- if locating the repository fails.
+//   - gittreehash-error-permission -- if locating the repository fails due to permissions.
+func gitWriteTree(dir string, ignoreDotGit bool) (hash string, algorithm Algorithm, unverifiable string, err error) {
+	c, unverifiable, err := findCleanCheckout(dir, ignoreDotGit)
+	if err != nil || unverifiable != "" {
+		return "", 0, unverifiable, err
+	}
+	if hash, err = c.git(nil, nil, c.writeTreeArgs()...); err != nil {
+		return "", 0, "", err
+	}
+	return hash, c.algorithm, "", nil
+}
+
+// gitWriteTreeOf has git compute the tree hash of a set of files in a directory in a working tree (as given by their paths
+// within the directory), by adding them to a temporary index with `git update-index --add`, and running `git write-tree`
+// against that.  Git reads the files itself, applying the repository's attributes and configuration as `git add` would.
+// The repository's own index is never touched, and the objects git writes go into a temporary directory, not the repository.
+//
+// Errors:
+//
+//   - gittreehash-error-git -- if git fails.
+//   - gittreehash-error-io -- if the temporary directory can't be made.
+func gitWriteTreeOf(c gitCheckout, names []string) (string, error) {
+	scratch, err := os.MkdirTemp("", "gittreehash-git-index-")
+	if err != nil {
+		return "", newErrIO(err)
+	}
+	defer os.RemoveAll(scratch)
+	objects := filepath.Join(scratch, "objects")
+	if err := os.Mkdir(objects, 0o700); err != nil {
+		return "", newErrIO(err)
+	}
+	env := []string{"GIT_INDEX_FILE=" + filepath.Join(scratch, "index"), "GIT_OBJECT_DIRECTORY=" + objects}
+	var list bytes.Buffer
+	for _, name := range names {
+		if c.prefix != "." {
+			name = c.prefix + "/" + name
+		}
+		list.WriteString(name)
+		list.WriteByte(0)
+	}
+	if _, err := c.git(env, &list, "update-index", "--add", "-z", "--stdin"); err != nil {
+		return "", err
+	}
+	return c.git(env, nil, c.writeTreeArgs()...)
+}
+
+// verifyWithGit compares a tree hash with the one git computes for the same directory (see gitWriteTree),
+// printing "MATCH" or "MISMATCH: got <ours>, want <git's>" to stderr, and returning false on a mismatch.
+// If the repository's object format isn't the algorithm of the hash, the directory is hashed again with git's, to compare that.
+// If git's hash can't be had, that's noted on stderr, and true is returned, since nothing was found to differ.
+//
+// Errors:
+//
+//   - gittreehash-error-git -- if git fails.
+//   - any error HashPath may return, if hashing again.
+func verifyWithGit(fsys fsx.FS, startPath string, hash [32]byte, opts Options) (bool, error) {
+	want, algorithm, unverifiable, err := gitWriteTree(startPath, opts.IgnoreDotGit)
+	if err != nil {
+		return false, err
+	}
+	if unverifiable != "" {
+		fmt.Fprintf(os.Stderr, "not verified with git: %s\n", unverifiable)
+		return true, nil
+	}
+	if hash, err = hashInFormat(fsys, startPath, hash, algorithm, opts); err != nil {
+		return false, err
+	}
+	got := hex.EncodeToString(hash[:algorithm.Size()])
+	if got != want {
+		fmt.Fprintf(os.Stderr, "MISMATCH: got %s, want %s\n", got, want)
+		return false, nil
+	}
+	fmt.Fprintf(os.Stderr, "MATCH\n")
+	return true, nil
+}
+
+// compareWithGit is a self-check on a directory's tree hash: it has git hash the very same files (see gitWriteTreeOf),
+// given as the entries reported while hashing, and compares the two.  On a mismatch it warns on stderr, and returns false.
+// If git can't be compared with, because the directory isn't a clean checkout (see findCleanCheckout),
+// or because it has empty directories in it, which git can't record, that's noted on stderr, and true is returned.
+// If the repository's object format isn't the algorithm of the hash, the directory is hashed again with git's, to compare that.
+//
+// Errors:
+//
+//   - gittreehash-error-git -- if git fails.
+//   - gittreehash-error-io -- if the temporary index can't be made.
+//   - any error HashPath may return, if hashing again.
+func compareWithGit(fsys fsx.FS, startPath string, hash [32]byte, entries []Entry, opts Options) (bool, error) {
+	unverifiable := ""
+	if fi, err := os.Stat(startPath); err != nil || !fi.IsDir() {
+		unverifiable = "the path isn't a directory"
+	}
+	root := path.Clean(startPath)
+	emptyTree := opts.Algorithm.hashObject("tree", nil)
+	var names []string
+	for _, e := range entries {
+		switch {
+		case e.Type != "tree":
+			names = append(names, strings.TrimPrefix(e.Path, root+"/"))
+		case e.Path != root && string(e.Hash) == string(emptyTree[:len(e.Hash)]):
+			unverifiable = "there are empty directories in the path, which git can't record"
+		}
+	}
+	var c gitCheckout
+	var err error
+	if unverifiable == "" {
+		if c, unverifiable, err = findCleanCheckout(startPath, opts.IgnoreDotGit); err != nil {
+			return false, err
+		}
+	}
+	if unverifiable != "" {
+		fmt.Fprintf(os.Stderr, "not compared with git: %s\n", unverifiable)
+		return true, nil
+	}
+	want, err := gitWriteTreeOf(c, names)
+	if err != nil {
+		return false, err
+	}
+	if hash, err = hashInFormat(fsys, startPath, hash, c.algorithm, opts); err != nil {
+		return false, err
+	}
+	if got := hex.EncodeToString(hash[:c.algorithm.Size()]); got != want {
+		fmt.Fprintf(os.Stderr, "WARNING: git hashes the same files differently: got %s, but git write-tree gives %s\n", got, want)
+		return false, nil
+	}
+	return true, nil
+}
+
+// hashInFormat returns a hash of a path in the given algorithm: the hash given, if that's its algorithm already,
+// or else a hash of the path made again.
+//
+// Errors:
+//
+//   - any error HashPath may return, if hashing again.
+func hashInFormat(fsys fsx.FS, startPath string, hash [32]byte, algorithm Algorithm, opts Options) ([32]byte, error) {
+	if algorithm == opts.Algorithm {
+		return hash, nil
+	}
+	opts.Algorithm = algorithm
+	opts.OnEntry, opts.Stats, opts.Cache, opts.GitIndexDigests = nil, nil, nil, nil
+	return HashPath(fsys, startPath, opts)
+}
+
+func newErrGit(err error, output []byte) error {
+	return serum.Error(
+		ErrGit,
+		serum.WithMessageTemplate("running git failed: {{cause}}: {{output}}"),
+		serum.WithDetail("cause", err.Error()),
+		serum.WithDetail("output", strings.TrimSpace(string(output))),
+	)
+}
@@ -0,0 +1,284 @@
+// Package gitconfig parses git configuration files, enough to find the settings that affect the content git stores.
+//
+// Sections, subsections (both `[section "sub"]` and the legacy `[section.sub]`), quoting and escapes,
+// line continuations, comments, and include.path directives are all supported.
+// Conditional includes (includeIf) are not, and includes are only followed one level deep:
+// include.path directives within an included file are ignored.
+package gitconfig
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const (
+	ErrParse = "gitconfig-error-parse"
+	ErrIO    = "gitconfig-error-io"
+)
+
+// Config is the parsed content of a configuration file, including anything it includes.
+type Config struct {
+	// vars holds each variable's values, in the order they were found.
+	// Keys are "section.key" or "section.subsection.key", with the section and key lowercased
+	// (they're case-insensitive) and the subsection as written (it's case-sensitive).
+	vars map[string][]value
+}
+
+type value struct {
+	s       string
+	present bool // False for a key given without "=", which means true for booleans.
+}
+
+// Load reads a configuration file, following its include.path directives (one level deep).
+// Relative include paths are relative to the directory containing the file; a leading "~/" means the home directory.
+// Included files that don't exist are ignored, as git ignores them.
+//
+// Errors:
+//
+//   - gitconfig-error-parse -- if a line of the file, or of an included file, can't be understood.
+//   - gitconfig-error-io -- if the file, or an included file, can't be read.
+func Load(filename string) (*Config, error) {
+	cfg := &Config{vars: map[string][]value{}}
+	if err := cfg.load(filename, true); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) load(filename string, followIncludes bool) error {
+	body, err := os.ReadFile(filename)
+	if err != nil {
+		if !followIncludes && os.IsNotExist(err) {
+			return nil
+		}
+		return serum.Errorf(ErrIO, "%w", err)
+	}
+	return cfg.parse(body, filename, func(pth string) error {
+		if !followIncludes {
+			return nil
+		}
+		if strings.HasPrefix(pth, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return serum.Errorf(ErrIO, "can't expand include path %q: %w", pth, err)
+			}
+			pth = filepath.Join(home, pth[2:])
+		} else if !filepath.IsAbs(pth) {
+			pth = filepath.Join(filepath.Dir(filename), pth)
+		}
+		return cfg.load(pth, false)
+	})
+}
+
+// parse reads the variables in a file's body into the config,
+// calling include for each include.path directive at the point it's found, so that later settings override what it brings in.
+func (cfg *Config) parse(body []byte, filename string, include func(pth string) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	section := ""
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		// A backslash at the very end of a line continues it onto the next.
+		for continued(line) && scanner.Scan() {
+			lineNum++
+			line = line[:len(line)-1] + scanner.Text()
+		}
+		rest := strings.TrimSpace(line)
+		if strings.HasPrefix(rest, "[") {
+			var err error
+			if section, rest, err = parseSectionHeader(rest); err != nil {
+				return serum.Errorf(ErrParse, "%s line %d: %w", filename, lineNum, err)
+			}
+			rest = strings.TrimSpace(rest)
+		}
+		if rest == "" || rest[0] == '#' || rest[0] == ';' {
+			continue
+		}
+		if section == "" {
+			return serum.Errorf(ErrParse, "%s line %d: variable outside of any section", filename, lineNum)
+		}
+		name, val, err := parseVariable(rest)
+		if err != nil {
+			return serum.Errorf(ErrParse, "%s line %d: %w", filename, lineNum, err)
+		}
+		key := section + "." + name
+		cfg.vars[key] = append(cfg.vars[key], val)
+		if key == "include.path" && val.present {
+			if err := include(val.s); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return serum.Errorf(ErrIO, "%w", err)
+	}
+	return nil
+}
+
+// parseSectionHeader parses a "[section]", `[section "subsection"]`, or "[section.subsection]" header,
+// returning the section's name as it's used in keys, and anything following the header on the line.
+func parseSectionHeader(line string) (section, rest string, err error) {
+	end := strings.IndexByte(line, ']')
+	if sp := strings.IndexAny(line, " \t"); sp >= 0 && sp < end {
+		// Quoted subsection: everything between the quotes, with only \" and \\ escaped.  A ']' may appear inside.
+		name := strings.ToLower(strings.TrimSpace(line[1:sp]))
+		q := strings.TrimLeft(line[sp:], " \t")
+		if !strings.HasPrefix(q, "\"") {
+			return "", "", errSyntax("bad section header")
+		}
+		var sub strings.Builder
+		i := 1
+		for ; i < len(q) && q[i] != '"'; i++ {
+			if q[i] == '\\' && i+1 < len(q) {
+				i++
+			}
+			sub.WriteByte(q[i])
+		}
+		if i+1 >= len(q) || q[i+1] != ']' {
+			return "", "", errSyntax("bad section header")
+		}
+		return name + "." + sub.String(), q[i+2:], nil
+	}
+	if end < 0 {
+		return "", "", errSyntax("unterminated section header")
+	}
+	name := line[1:end]
+	if name == "" {
+		return "", "", errSyntax("empty section name")
+	}
+	// This also covers the legacy "[section.subsection]" form, whose subsection git lowercases.
+	return strings.ToLower(name), line[end+1:], nil
+}
+
+// parseVariable parses a "key = value" or bare "key" line.
+// Values may be partly or wholly quoted; outside quotes, whitespace is collapsed and a '#' or ';' starts a comment.
+func parseVariable(line string) (string, value, error) {
+	i := 0
+	for i < len(line) && (isAlnum(line[i]) || line[i] == '-') {
+		i++
+	}
+	name := strings.ToLower(line[:i])
+	if name == "" || !isAlpha(name[0]) {
+		return "", value{}, errSyntax("bad variable name")
+	}
+	rest := strings.TrimLeft(line[i:], " \t")
+	if rest == "" || rest[0] == '#' || rest[0] == ';' {
+		return name, value{}, nil
+	}
+	if rest[0] != '=' {
+		return "", value{}, errSyntax("expected '=' after variable name")
+	}
+	rest = strings.TrimLeft(rest[1:], " \t")
+
+	var val strings.Builder
+	inQuote := false
+	pendingSpace := false
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		if !inQuote && (c == ' ' || c == '\t') {
+			pendingSpace = true
+			continue
+		}
+		if !inQuote && (c == '#' || c == ';') {
+			break
+		}
+		if pendingSpace {
+			val.WriteByte(' ')
+			pendingSpace = false
+		}
+		switch c {
+		case '"':
+			inQuote = !inQuote
+		case '\\':
+			i++
+			if i >= len(rest) {
+				return "", value{}, errSyntax("trailing backslash")
+			}
+			switch rest[i] {
+			case 'n':
+				val.WriteByte('\n')
+			case 't':
+				val.WriteByte('\t')
+			case 'b':
+				val.WriteByte('\b')
+			case '"', '\\':
+				val.WriteByte(rest[i])
+			default:
+				return "", value{}, errSyntax("unknown escape \\" + string(rest[i]))
+			}
+		default:
+			val.WriteByte(c)
+		}
+	}
+	if inQuote {
+		return "", value{}, errSyntax("unterminated quote")
+	}
+	return name, value{s: val.String(), present: true}, nil
+}
+
+// continued reports whether a line ends with an unescaped backslash.
+func continued(line string) bool {
+	n := 0
+	for n < len(line) && line[len(line)-1-n] == '\\' {
+		n++
+	}
+	return n%2 == 1
+}
+
+func isAlpha(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isAlnum(c byte) bool { return isAlpha(c) || c >= '0' && c <= '9' }
+
+type errSyntax string
+
+func (e errSyntax) Error() string { return string(e) }
+
+// Get returns the last value set for a variable, as git does for single-valued variables.
+// The key is "section.key" or "section.subsection.key"; the section and key are matched case-insensitively.
+// A variable given without "=" has the empty string as its value.
+func (cfg *Config) Get(key string) (string, bool) {
+	vals := cfg.vars[normalizeKey(key)]
+	if len(vals) == 0 {
+		return "", false
+	}
+	return vals[len(vals)-1].s, true
+}
+
+// Bool returns the last value set for a boolean variable, interpreted as git does:
+// "true", "yes", "on", "1", or no value at all (a key without "=") are true;
+// "false", "no", "off", "0", or the empty string are false.
+//
+// Errors:
+//
+//   - gitconfig-error-parse -- if the value isn't one of those.
+func (cfg *Config) Bool(key string) (val bool, ok bool, err error) {
+	vals := cfg.vars[normalizeKey(key)]
+	if len(vals) == 0 {
+		return false, false, nil
+	}
+	last := vals[len(vals)-1]
+	if !last.present {
+		return true, true, nil
+	}
+	switch strings.ToLower(last.s) {
+	case "true", "yes", "on", "1":
+		return true, true, nil
+	case "false", "no", "off", "0", "":
+		return false, true, nil
+	}
+	return false, true, serum.Errorf(ErrParse, "bad boolean value %q for %s", last.s, key)
+}
+
+// normalizeKey lowercases the section and key of a "section[.subsection].key" name, leaving any subsection alone.
+func normalizeKey(key string) string {
+	first, last := strings.IndexByte(key, '.'), strings.LastIndexByte(key, '.')
+	if first < 0 {
+		return strings.ToLower(key)
+	}
+	return strings.ToLower(key[:first]) + key[first:last] + strings.ToLower(key[last:])
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/gittreehash/gitconfig"
+)
+
+// applyGitConfig reads a git configuration file, and sets the options that correspond to the settings in it
+// which affect what git stores:
+//
+//   - core.fileMode=false sets IgnoreFileMode.
+//   - core.autocrlf=true or core.autocrlf=input sets AutoCRLF.
+//   - core.symlinks=false means regular files which the index records as symlinks are recorded as symlinks,
+//     so if there's an index beside the configuration file (as there is for a repository's .git/config),
+//     its path is returned, to be used as for --symlinks-as-text-from-index.
+//   - core.eol is checked, but has no effect: it only controls the line endings git writes out, not what it stores.
+//
+// Errors:
+//
+//   - gitconfig-error-parse -- if the file can't be parsed, or one of those settings has a value git wouldn't accept.
+//   - gitconfig-error-io -- if the file can't be read.
+func applyGitConfig(filename string, opts *Options) (symlinksIndex string, err error) {
+	cfg, err := gitconfig.Load(filename)
+	if err != nil {
+		return "", err
+	}
+	if fileMode, ok, err := cfg.Bool("core.fileMode"); err != nil {
+		return "", err
+	} else if ok && !fileMode {
+		opts.IgnoreFileMode = true
+	}
+	if autocrlf, ok := cfg.Get("core.autocrlf"); ok && autocrlf == "input" {
+		opts.AutoCRLF = true
+	} else if autocrlf, _, err := cfg.Bool("core.autocrlf"); err != nil {
+		return "", err
+	} else if autocrlf {
+		opts.AutoCRLF = true
+	}
+	if eol, ok := cfg.Get("core.eol"); ok && eol != "lf" && eol != "crlf" && eol != "native" {
+		return "", serum.Errorf(gitconfig.ErrParse, "bad value %q for core.eol", eol)
+	}
+	if symlinks, ok, err := cfg.Bool("core.symlinks"); err != nil {
+		return "", err
+	} else if ok && !symlinks {
+		index := filepath.Join(filepath.Dir(filename), "index")
+		if _, err := os.Stat(index); err == nil {
+			return index, nil
+		}
+	}
+	return "", nil
+}
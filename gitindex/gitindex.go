@@ -0,0 +1,246 @@
+// Package gitindex parses git's index file (the "staging area", usually found at .git/index).
+//
+// Versions 2, 3, and 4 of the format are supported, with either SHA-1 or SHA-256 object ids.
+// Extensions are skipped over; their contents aren't interpreted.
+// See https://git-scm.com/docs/index-format for the format description.
+package gitindex
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const (
+	ErrParse = "gitindex-error-parse"
+	ErrIO    = "gitindex-error-io"
+)
+
+// Index is the parsed content of an index file.
+type Index struct {
+	Version  uint32
+	HashSize int // Either 20 (for SHA-1 repositories) or 32 (for SHA-256 repositories).
+	Entries  []Entry
+}
+
+// Entry is one path recorded in the index.
+type Entry struct {
+	CtimeSec, CtimeNsec uint32
+	MtimeSec, MtimeNsec uint32
+	Dev, Ino            uint32
+	Mode                uint32 // The git mode, e.g. 0o100644.  Sparse directory entries have mode 0o40000.
+	UID, GID            uint32
+	Size                uint32 // The file size, truncated to 32 bits.
+	Hash                []byte
+	Path                string // Slash-separated, relative to the root of the working tree.
+	Stage               int    // Zero, unless the entry is part of an unresolved merge conflict.
+	AssumeValid         bool
+	SkipWorktree        bool // Set for paths excluded by sparse-checkout.
+	IntentToAdd         bool
+}
+
+// ReadFile reads and parses an index file.
+//
+// Errors:
+//
+//   - gitindex-error-io -- if the file can't be read.
+//   - gitindex-error-parse -- if the file isn't a valid index.
+func ReadFile(pth string) (*Index, error) {
+	data, err := os.ReadFile(pth)
+	if err != nil {
+		return nil, serum.Errorf(ErrIO, "%w", err)
+	}
+	return Parse(data)
+}
+
+// Parse parses the content of an index file.
+// The object id length is determined by which hash function's checksum matches the file's trailer.
+// Git leaves the trailer zeroed when index.skipHash is set (as feature.manyFiles does),
+// in which case the length is the one that the entries and extensions parse cleanly with.
+//
+// Errors:
+//
+//   - gitindex-error-parse -- if the data isn't a valid index.
+func Parse(data []byte) (*Index, error) {
+	switch {
+	case len(data) >= 12+sha256.Size && checksumMatches(data, sha256.Size):
+		return parse(data, sha256.Size)
+	case len(data) >= 12+sha1.Size && checksumMatches(data, sha1.Size):
+		return parse(data, sha1.Size)
+	}
+	var found *Index
+	for _, hashSize := range []int{sha1.Size, sha256.Size} {
+		if len(data) < 12+hashSize || !bytes.Equal(data[len(data)-hashSize:], make([]byte, hashSize)) {
+			continue
+		}
+		idx, err := parse(data, hashSize)
+		if err != nil {
+			continue
+		}
+		if found != nil {
+			return nil, serum.Errorf(ErrParse, "index has no checksum, and parses as either sha1 or sha256")
+		}
+		found = idx
+	}
+	if found == nil {
+		return nil, serum.Errorf(ErrParse, "index checksum does not match for either sha1 or sha256; file is truncated or corrupt")
+	}
+	return found, nil
+}
+
+// parse parses the content of an index file whose object ids are hashSize bytes long, ignoring the trailer.
+func parse(data []byte, hashSize int) (*Index, error) {
+	if !bytes.Equal(data[0:4], []byte("DIRC")) {
+		return nil, serum.Errorf(ErrParse, "index does not start with the DIRC signature")
+	}
+	idx := &Index{
+		Version:  binary.BigEndian.Uint32(data[4:8]),
+		HashSize: hashSize,
+	}
+	if idx.Version < 2 || idx.Version > 4 {
+		return nil, serum.Errorf(ErrParse, "unsupported index version %d", idx.Version)
+	}
+	count := binary.BigEndian.Uint32(data[8:12])
+	body := data[:len(data)-hashSize]
+	off := 12
+	prevPath := ""
+	for i := uint32(0); i < count; i++ {
+		ent, next, err := parseEntry(body, off, idx.Version, hashSize, prevPath)
+		if err != nil {
+			return nil, serum.Errorf(ErrParse, "entry %d: %w", i, err)
+		}
+		idx.Entries = append(idx.Entries, ent)
+		prevPath = ent.Path
+		off = next
+	}
+	// Whatever remains is extensions: a 4-byte signature, a 4-byte length, and then that many bytes.
+	for off < len(body) {
+		if off+8 > len(body) {
+			return nil, serum.Errorf(ErrParse, "truncated extension header at offset %d", off)
+		}
+		size := int(binary.BigEndian.Uint32(body[off+4 : off+8]))
+		if off+8+size > len(body) {
+			return nil, serum.Errorf(ErrParse, "truncated extension %q at offset %d", body[off:off+4], off)
+		}
+		off += 8 + size
+	}
+	return idx, nil
+}
+
+func checksumMatches(data []byte, hashSize int) bool {
+	body, trailer := data[:len(data)-hashSize], data[len(data)-hashSize:]
+	switch hashSize {
+	case sha1.Size:
+		sum := sha1.Sum(body)
+		return bytes.Equal(sum[:], trailer)
+	case sha256.Size:
+		sum := sha256.Sum256(body)
+		return bytes.Equal(sum[:], trailer)
+	}
+	return false
+}
+
+const (
+	flagAssumeValid   = 0x8000
+	flagExtended      = 0x4000
+	flagStageMask     = 0x3000
+	flagStageShift    = 12
+	flagNameMask      = 0x0fff
+	xflagSkipWorktree = 0x4000
+	xflagIntentToAdd  = 0x2000
+)
+
+func parseEntry(data []byte, off int, version uint32, hashSize int, prevPath string) (Entry, int, error) {
+	start := off
+	fixed := 40 + hashSize + 2
+	if off+fixed > len(data) {
+		return Entry{}, 0, serum.Errorf(ErrParse, "truncated at offset %d", off)
+	}
+	u32 := func(i int) uint32 { return binary.BigEndian.Uint32(data[off+i*4:]) }
+	ent := Entry{
+		CtimeSec: u32(0), CtimeNsec: u32(1),
+		MtimeSec: u32(2), MtimeNsec: u32(3),
+		Dev: u32(4), Ino: u32(5),
+		Mode: u32(6),
+		UID:  u32(7), GID: u32(8),
+		Size: u32(9),
+	}
+	off += 40
+	ent.Hash = append([]byte(nil), data[off:off+hashSize]...)
+	off += hashSize
+	flags := binary.BigEndian.Uint16(data[off:])
+	off += 2
+	ent.AssumeValid = flags&flagAssumeValid != 0
+	ent.Stage = int(flags&flagStageMask) >> flagStageShift
+	if flags&flagExtended != 0 {
+		if version < 3 {
+			return Entry{}, 0, serum.Errorf(ErrParse, "extended flags are not allowed in index version %d", version)
+		}
+		if off+2 > len(data) {
+			return Entry{}, 0, serum.Errorf(ErrParse, "truncated at offset %d", off)
+		}
+		xflags := binary.BigEndian.Uint16(data[off:])
+		off += 2
+		ent.SkipWorktree = xflags&xflagSkipWorktree != 0
+		ent.IntentToAdd = xflags&xflagIntentToAdd != 0
+	}
+	if version == 4 {
+		// Paths are prefix-compressed against the previous entry: a varint of how many bytes to strip from its end,
+		// then a NUL-terminated suffix.  There's no padding.
+		strip, n := decodeVarint(data[off:])
+		if n == 0 || strip > uint64(len(prevPath)) {
+			return Entry{}, 0, serum.Errorf(ErrParse, "invalid path prefix length at offset %d", off)
+		}
+		off += n
+		end := bytes.IndexByte(data[off:], 0)
+		if end < 0 {
+			return Entry{}, 0, serum.Errorf(ErrParse, "unterminated path at offset %d", off)
+		}
+		ent.Path = prevPath[:len(prevPath)-int(strip)] + string(data[off:off+end])
+		return ent, off + end + 1, nil
+	}
+	end := bytes.IndexByte(data[off:], 0)
+	if end < 0 {
+		return Entry{}, 0, serum.Errorf(ErrParse, "unterminated path at offset %d", off)
+	}
+	if nameLen := int(flags & flagNameMask); nameLen != flagNameMask && nameLen != end {
+		return Entry{}, 0, serum.Errorf(ErrParse, "path length %d does not match flags (%d) at offset %d", end, nameLen, off)
+	}
+	ent.Path = string(data[off : off+end])
+	// The entry is padded with 1 to 8 NULs, to a multiple of 8 bytes.
+	entLen := (off - start + end + 8) &^ 7
+	if start+entLen > len(data) {
+		return Entry{}, 0, serum.Errorf(ErrParse, "truncated padding at offset %d", off+end)
+	}
+	return ent, start + entLen, nil
+}
+
+// decodeVarint decodes git's offset varint encoding (as used in index v4 and pack files),
+// which differs from the encoding in encoding/binary.
+// It returns the value and the number of bytes consumed,
+// or zero bytes consumed if the data was truncated, or encodes a value too large for a uint64.
+func decodeVarint(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	c := data[0]
+	val := uint64(c & 127)
+	i := 1
+	for c&128 != 0 {
+		if i >= len(data) || i >= 9 {
+			return 0, 0
+		}
+		val++
+		if val == 0 || val>>57 != 0 {
+			return 0, 0 // Shifting would lose bits.
+		}
+		c = data[i]
+		i++
+		val = (val << 7) | uint64(c&127)
+	}
+	return val, i
+}
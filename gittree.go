@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+// HashGitTree computes the hash of a tree (or blob) stored in a git repository, without any working tree:
+// the tree-ish (e.g. "HEAD", "v1.0^{tree}", or "main:some/dir") is resolved by git, and the objects it reaches
+// are read with `git cat-file --batch`, and hashed again with Options.Algorithm.
+// If that's the repository's own object format, the result is git's own id for the tree;
+// otherwise, it's the id the tree would have in a repository of the other format,
+// which makes it possible to fingerprint SHA-1 history with SHA-256, and vice versa.
+//
+// Blobs are streamed from git, never held in memory whole, and each distinct object is only hashed once.
+// Options.OnEntry is called for each entry, as by HashPath, with slash-separated paths starting at ".".
+// Other options have no effect: content is hashed exactly as git stored it.
+//
+// Submodules (gitlinks) are recorded as they are, if the algorithm is the repository's;
+// otherwise there's no way to know the commit's other id, so they're an error.
+//
+// Errors:
+//
+//   - gittreehash-error-not-found -- if the repository has no object the tree-ish names.
+//   - gittreehash-error-unsupported-file-type -- if there's a submodule, and the algorithm isn't the repository's.
+//   - gittreehash-error-git -- if git can't be run, or fails, or its output isn't as expected.
+func HashGitTree(repoPath, treeish string, opts Options) ([32]byte, error) {
+	g, err := startGitObjectReader(repoPath, opts)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer g.close()
+	id, objType, size, err := g.requestPeeled(treeish)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	mode := fs.ModeDir
+	if objType == "blob" {
+		mode = 0o644
+	}
+	return g.hashObject(".", id, objType, size, mode)
+}
+
+// gitObjectReader reads objects from a running `git cat-file --batch`, and hashes them again.
+// Requests are made one at a time, each response being read entirely before the next request.
+type gitObjectReader struct {
+	h             *hasher
+	repoAlgorithm Algorithm
+	w             *bufio.Writer
+	r             *bufio.Reader
+	hashes        map[string]gitObjectHash // Each object already hashed, by its id in the repository.
+	close         func()                   // Ends git cat-file.
+}
+
+// startGitObjectReader finds a repository's object format, and starts `git cat-file --batch` in it.
+// The reader's close function must be called when it's done with.
+//
+// Errors:
+//
+//   - gittreehash-error-git -- if git can't be run, or fails, or doesn't know the repository's object format.
+func startGitObjectReader(repoPath string, opts Options) (*gitObjectReader, error) {
+	out, err := exec.Command("git", "-C", repoPath, "rev-parse", "--show-object-format").Output()
+	if err != nil {
+		return nil, newErrGit(err, exitStderr(err))
+	}
+	var repoAlgorithm Algorithm
+	switch format := strings.TrimSpace(string(out)); format {
+	case "sha1":
+		repoAlgorithm = SHA1
+	case "sha256":
+		repoAlgorithm = SHA256
+	default:
+		return nil, newErrGit(fmt.Errorf("unknown object format %q", format), nil)
+	}
+
+	cmd := exec.Command("git", "-C", repoPath, "cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, newErrGit(err, nil)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, newErrGit(err, nil)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, newErrGit(err, nil)
+	}
+	return &gitObjectReader{
+		h:             newHasher(nil, opts),
+		repoAlgorithm: repoAlgorithm,
+		w:             bufio.NewWriter(stdin),
+		r:             bufio.NewReaderSize(stdout, 1<<16),
+		hashes:        map[string]gitObjectHash{},
+		close: func() {
+			stdin.Close()
+			io.Copy(io.Discard, stdout)
+			cmd.Wait()
+		},
+	}, nil
+}
+
+// requestPeeled is request, peeling commits and tags to their trees; anything else is left as it is.
+//
+// Errors:
+//
+//   - gittreehash-error-not-found -- if there's no such object, or it's a commit or tag without a tree.
+//   - gittreehash-error-git -- if git's response isn't as expected.
+func (g *gitObjectReader) requestPeeled(name string) (id, objType string, size int64, err error) {
+	id, objType, size, err = g.request(name)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if objType == "commit" || objType == "tag" {
+		if _, err := io.Copy(io.Discard, io.LimitReader(g.r, size+1)); err != nil {
+			return "", "", 0, newErrGit(err, nil)
+		}
+		return g.request(name + "^{tree}")
+	}
+	return id, objType, size, nil
+}
+
+type gitObjectHash struct {
+	hash [32]byte
+	size int64
+}
+
+// request asks git for an object, and reads the header of the response, leaving the content to be read.
+//
+// Errors:
+//
+//   - gittreehash-error-not-found -- if there's no such object.
+//   - gittreehash-error-git -- if git's response isn't as expected.
+func (g *gitObjectReader) request(name string) (id, objType string, size int64, err error) {
+	if strings.ContainsAny(name, "\n") {
+		return "", "", 0, newErrGitObjectNotFound(name)
+	}
+	if _, err := g.w.WriteString(name + "\n"); err != nil {
+		return "", "", 0, newErrGit(err, nil)
+	}
+	if err := g.w.Flush(); err != nil {
+		return "", "", 0, newErrGit(err, nil)
+	}
+	header, err := g.r.ReadString('\n')
+	if err != nil {
+		return "", "", 0, newErrGit(fmt.Errorf("reading from git cat-file: %w", err), nil)
+	}
+	fields := strings.Fields(header)
+	if len(fields) == 2 && (fields[1] == "missing" || fields[1] == "ambiguous") {
+		return "", "", 0, newErrGitObjectNotFound(name)
+	}
+	if len(fields) != 3 {
+		return "", "", 0, newErrGit(fmt.Errorf("unexpected response from git cat-file: %q", header), nil)
+	}
+	if size, err = strconv.ParseInt(fields[2], 10, 64); err != nil || size < 0 {
+		return "", "", 0, newErrGit(fmt.Errorf("unexpected response from git cat-file: %q", header), nil)
+	}
+	return fields[0], fields[1], size, nil
+}
+
+// hashObject hashes an object whose header has just been read, reading its content, and then any objects a tree refers to.
+//
+// Errors:
+//
+//   - gittreehash-error-unsupported-file-type -- if a tree contains a submodule, and the algorithm isn't the repository's.
+//   - gittreehash-error-not-found -- if a tree refers to a missing object.
+//   - gittreehash-error-git -- if git's output isn't as expected.
+func (g *gitObjectReader) hashObject(pth, id, objType string, size int64, mode fs.FileMode) ([32]byte, error) {
+	var hash [32]byte
+	switch objType {
+	case "blob":
+		var n int64
+		var err error
+		hash, n, err = g.h.hashObjectStream("blob", size, io.LimitReader(g.r, size))
+		if err != nil {
+			return [32]byte{}, newErrGit(err, nil)
+		}
+		if n != size {
+			return [32]byte{}, newErrGit(fmt.Errorf("git cat-file gave %d bytes of %s, rather than %d", n, id, size), nil)
+		}
+		if _, err := g.r.Discard(1); err != nil { // The newline after the content.
+			return [32]byte{}, newErrGit(err, nil)
+		}
+		g.h.emit(pth, hash, mode, size)
+	case "tree":
+		body := make([]byte, size+1)
+		if _, err := io.ReadFull(g.r, body); err != nil {
+			return [32]byte{}, newErrGit(fmt.Errorf("reading tree %s from git cat-file: %w", id, err), nil)
+		}
+		entries, err := parseTreeBody(body[:size], g.repoAlgorithm)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		buf := getTreeBuffer()
+		defer putTreeBuffer(buf)
+		for _, e := range entries {
+			childPath := path.Join(pth, e.Name)
+			if e.Type() == "commit" {
+				// A submodule's commit isn't in this repository; all that can be done is to record its id as it is.
+				if g.h.opts.Algorithm != g.repoAlgorithm {
+					return [32]byte{}, NewErrUnsupportedFileType("submodule", childPath)
+				}
+				buf.WriteString(e.Mode + " " + e.Name + "\x00")
+				buf.Write(e.Hash)
+				continue
+			}
+			childMode, err := gitModeToFileMode(e.Mode)
+			if err != nil {
+				return [32]byte{}, err
+			}
+			childHash, err := g.child(childPath, hex.EncodeToString(e.Hash), childMode)
+			if err != nil {
+				return [32]byte{}, err
+			}
+			g.h.writeTreeEntry(buf, e.Name, childMode, childHash)
+		}
+		hash = g.h.hashTreeBody(pth, buf)
+		g.h.emit(pth, hash, mode, 0)
+	default:
+		return [32]byte{}, newErrGit(fmt.Errorf("%s is a %s, not a tree or blob", id, objType), nil)
+	}
+	g.hashes[id] = gitObjectHash{hash, size}
+	return hash, nil
+}
+
+// child hashes an object a tree refers to, unless it's been hashed already.
+func (g *gitObjectReader) child(pth, id string, mode fs.FileMode) ([32]byte, error) {
+	if done, ok := g.hashes[id]; ok {
+		// Still reported, as HashPath reports every copy of a file.  (Only the tree itself is, not what's in it.)
+		if mode.IsDir() {
+			done.size = 0
+		}
+		g.h.emit(pth, done.hash, mode, done.size)
+		return done.hash, nil
+	}
+	id, objType, size, err := g.request(id)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return g.hashObject(pth, id, objType, size, mode)
+}
+
+// gitModeToFileMode converts the mode of a tree entry (other than a submodule), as git writes it, to a FileMode.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-tree -- if the mode isn't one git uses.
+func gitModeToFileMode(mode string) (fs.FileMode, error) {
+	switch mode {
+	case "40000":
+		return fs.ModeDir, nil
+	case "120000":
+		return fs.ModeSymlink, nil
+	case "100755":
+		return 0o755, nil
+	case "100644", "100664", "100600":
+		return 0o644, nil // The others are from old versions of git, which git now reads as 100644.
+	}
+	return 0, serum.Error(ErrInvalidTree,
+		serum.WithMessageTemplate("tree entry mode {{mode}} is not one git uses"),
+		serum.WithDetail("mode", mode),
+	)
+}
+
+// exitStderr returns what a command that exited unsuccessfully wrote to stderr, if it was captured.
+func exitStderr(err error) []byte {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.Stderr
+	}
+	return nil
+}
+
+func newErrGitObjectNotFound(name string) error {
+	return serum.Error(ErrNotFound,
+		serum.WithMessageTemplate("the repository has no object {{object}}"),
+		serum.WithDetail("object", name),
+	)
+}
+
+// mainGitTree implements the git-tree subcommand, which prints the hash of a tree stored in a git repository.
+func mainGitTree(args []string) int {
+	fset := flag.NewFlagSet("git-tree", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s git-tree [flags] <repo-path> <tree-ish>\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nthe tree-ish is anything git can resolve to a tree (or blob), like \"HEAD\", \"v1.0\", or \"main:some/dir\".\n")
+		fmt.Fprintf(fset.Output(), "prints the hash the tree has with --algorithm; from a repository of the other object format, this converts git's id.\n\n")
+		fset.PrintDefaults()
+	}
+	algorithm := fset.String("algorithm", "sha256", "hash function to use, matching git's object format: \"sha256\" or \"sha1\"")
+	fset.Parse(args)
+	if fset.NArg() != 2 {
+		fset.Usage()
+		return 2
+	}
+	var opts Options
+	switch *algorithm {
+	case "sha256":
+		opts.Algorithm = SHA256
+	case "sha1":
+		opts.Algorithm = SHA1
+	default:
+		fmt.Fprintf(os.Stderr, "unknown algorithm %q\n", *algorithm)
+		return 2
+	}
+
+	hash, err := HashGitTree(fset.Arg(0), fset.Arg(1), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	fmt.Printf("%s\n", hex.EncodeToString(hash[:opts.Algorithm.Size()]))
+	return 0
+}
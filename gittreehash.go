@@ -2,47 +2,1176 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
-	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/serum-errors/go-serum"
 	"github.com/warpfork/go-fsx"
-	"github.com/warpfork/go-fsx/osfs"
+
+	"github.com/warptools/gittreehash/gitattributes"
 )
 
 // Note that .gitignore files and other special behaviors of git are not treated here.
 func main() {
-	startPath := "."
 	if len(os.Args) > 1 {
-		startPath = filepath.Clean(os.Args[1])
+		switch os.Args[1] {
+		case "diff-index":
+			exit(mainDiffIndex(os.Args[2:]))
+		case "ls-index":
+			exit(mainLsIndex(os.Args[2:]))
+		case "chain-verify":
+			exit(mainChainVerify(os.Args[2:]))
+		case "diff":
+			exit(mainDiff(os.Args[2:]))
+		case "dump-tree":
+			exit(mainDumpTree(os.Args[2:]))
+		case "read-tree":
+			exit(mainReadTree(os.Args[2:]))
+		case "oci":
+			exit(mainOCI(os.Args[2:]))
+		case "from-manifest":
+			exit(mainFromManifest(os.Args[2:]))
+		case "apply-stash":
+			exit(mainApplyStash(os.Args[2:]))
+		case "git-tree":
+			exit(mainGitTree(os.Args[2:]))
+		case "verify-against-git":
+			exit(mainVerifyAgainstGit(os.Args[2:]))
+		case "bundle":
+			exit(mainBundle(os.Args[2:]))
+		case "tag-release":
+			exit(mainTagRelease(os.Args[2:]))
+		case "merge-trees":
+			exit(mainMergeTrees(os.Args[2:]))
+		}
+	}
+
+	var opts Options
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [path]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nif the path is a symlink to a directory, the directory is hashed.\n(this is a change: previously the symlink itself was hashed; use --no-resolve-root for that.)\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "\nthe hash of a single file is the blob hash git gives it, so with --algorithm=sha1 it matches `git hash-object <file>`.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "\nexit codes: 0 on success; 2 for usage errors, or if --pipe-to-git, --verify-with-git, --compare-with-git with --strict, --assert-unchanged, or --verify-output-file finds a difference; 4 if the path does not exist; 9 for any other error.\n")
+	}
+	skipPermissionErrors := flag.Bool("skip-permission-errors", false, "omit files and directories that can't be read due to permissions, instead of halting")
+	failOnUnknown := flag.Bool("fail-on-unknown", true, "halt on sockets, device nodes, and other types of file git can't record (the default); with --fail-on-unknown=false, omit them instead, noting each on stderr")
+	flag.IntVar(&opts.MaxDepth, "max-depth", DefaultMaxDepth, "maximum directory depth to descend before halting with an error")
+	reportFormat := flag.String("report-format", "", "instead of only the root hash, report every entry that's hashed; either \"csv\", or \"jsonlines\" (a JSON object per line)")
+	flag.StringVar(reportFormat, "output", "", "the same as --report-format")
+	verbose := flag.Bool("verbose", false, "report every entry that's hashed, as --report-format=csv does, unless --report-format (or --output) or --template picks another way")
+	lineTemplate := flag.String("template", "", "instead of only the root hash, report every entry that's hashed, each as a line formatted by this Go text/template, e.g. '{{.Hash}} {{.Path}}'; the fields are .Hash, .Path, .Mode, .Type, .Size, and .Algorithm")
+	lfsMode := flag.String("lfs", "content", "how to hash files managed by Git LFS: \"content\" hashes them as found; \"pointers\" hashes the LFS pointer git would store")
+	symlinksAsText := flag.String("symlinks-as-text", "", "path of a file listing (one per line, relative to the starting path) regular files to be recorded as symlinks, with their content as the target, as git does with core.symlinks=false")
+	gitConfig := flag.String("gitconfig", "", "path of a git config file (such as a repository's .git/config) whose core.fileMode, core.autocrlf, and core.symlinks settings should be applied as git would (core.symlinks=false needs the repository's index beside the file)")
+	symlinksAsTextIndex := flag.String("symlinks-as-text-from-index", "", "path of a git index; any regular files which it records as symlinks are recorded as symlinks, with their content as the target")
+	format := flag.String("format", "hex", "how to print the result: \"hex\" prints the root hash; \"tree\" draws the directory structure with an abbreviated hash after each name")
+	prependPath := flag.String("prepend-path", "", "print the hash of a tree holding the result at this slash-separated path (e.g. \"a/b\"), as if the path were hashed from within parent directories containing nothing else")
+	seedHex := flag.String("seed", "", "XOR this hex value, the same length as the hash, into the result, to keep hashes made for different purposes apart (NOT a security measure: it's trivially undone, and is no substitute for an HMAC)")
+	goArray := flag.Bool("go-array", false, "print the hash as a Go array literal, like [32]byte{0x4a, 0x82, ...}")
+	goVar := flag.String("var", "", "print the hash as a Go variable declaration with this name (implies --go-array)")
+	readPipes := flag.Bool("read-pipes", false, "read named pipes, giving up after --pipe-timeout, and hash their content as regular files (unix only)")
+	pipeTimeout := flag.Duration("pipe-timeout", 10*time.Second, "how long --read-pipes may wait for each pipe to be written and closed")
+	flag.IntVar(&opts.Concurrency, "concurrency", 1, "how many files and directories may be hashed at once")
+	flag.IntVar(&opts.MaxOpenFiles, "max-open-files", 0, "how many files and directories may be open at once; when reached, hashing waits rather than failing (default: a quarter of the open file limit)")
+	flag.IntVar(&opts.MaxOpenFiles, "parallel-io", 0, "the same as --max-open-files")
+	flag.IntVar(&opts.RereadChanged, "reread-changed", 0, "how many times to re-read a file that changes size while being hashed, before giving up")
+	outputFile := flag.String("output-file", "", "write the output to this file instead of stdout, replacing the file atomically once hashing succeeds, so no reader sees it partly written")
+	assertFile := flag.String("assert-unchanged", "", "read the hash stored in this file (with the algorithm and options it was made with), and exit 2, explaining why, unless this run's hash is the same, made the same way")
+	update := flag.Bool("update", false, "with --assert-unchanged, store this run's hash (with its algorithm and options) in the file instead, replacing it atomically")
+	verifyOutputFile := flag.Bool("verify-output-file", false, "with --output-file, if the file exists, only check that it already holds the output; if it doesn't, exit 2 and leave it unchanged")
+	reportCollisions := flag.Bool("report-collisions", false, "warn on stderr about any two entries with the same hash but different content (copies of the same content aren't collisions); files with the same hash are read again to compare them")
+	collisionPrefix := flag.Int("collision-prefix", 0, "with --report-collisions, compare only this many leading hex digits of each hash, to provoke collisions for testing")
+	histogram := flag.Bool("histogram", false, "after hashing, also print a histogram of the sizes of the regular files hashed")
+	printStats := flag.Bool("stats", false, "print counters about the work done to stderr after hashing")
+	unicodeNormalization := flag.String("unicode-normalization", "none", "normalize filenames before recording them in trees: \"nfc\", \"nfd\", or \"none\" (hashes then match across systems, but may not match git's)")
+	flag.BoolVar(&opts.CaseFold, "case-fold", false, "record filenames in lower case, as for a case-insensitive filesystem; names that are then the same as another's in their directory are skipped, with a warning (hashes then match across differently capitalized copies, but may not match git's)")
+	algorithm := flag.String("algorithm", "sha256", "hash function to use, matching git's object format: \"sha256\" or \"sha1\"")
+	packFile := flag.String("pack", "", "also write every blob and tree object into a git pack file at this path, and its index beside it (with \".idx\" in place of \".pack\"), ready to copy into a repository's objects/pack directory (not usable with options that change content)")
+	flag.StringVar(packFile, "pack-out", "", "the same as --pack")
+	fastImportOut := flag.String("fast-import-out", "", "also write a `git fast-import` stream to this file (or \"-\" for stdout, in which case the hash goes to stderr), making one commit whose tree is the directory (not usable with options that change content, nor --unicode-normalization or --case-fold)")
+	fastImportRef := flag.String("fast-import-ref", "refs/heads/main", "with --fast-import-out, the ref to make the commit on (the commit has no parent, so `git fast-import --force` is needed to move a ref that exists)")
+	fastImportAuthor := flag.String("fast-import-author", "gittreehash <gittreehash@localhost>", "with --fast-import-out, the commit's author and committer, as \"Name <email>\"")
+	fastImportDate := flag.String("fast-import-date", "", "with --fast-import-out, the commit's date, in RFC 3339 format, like \"2006-01-02T15:04:05Z\" (default: now)")
+	fastImportMessage := flag.String("fast-import-message", "Snapshot made by gittreehash\n", "with --fast-import-out, the commit message")
+	commit := flag.Bool("commit", false, "after the tree's hash, also print the id of a commit of the tree, as `git commit-tree` would make it, with --author, --date, --parent, and --commit-message")
+	commitAuthor := flag.String("author", "", "with --commit, the author and committer, as \"Name <email>\" (required)")
+	commitDate := flag.String("date", "", "with --commit, the author and committer date, in RFC 3339 format, like \"2006-01-02T15:04:05+02:00\"; the time zone is recorded as given (required)")
+	var commitParents []string
+	flag.Var((*stringsFlag)(&commitParents), "parent", "with --commit, the hex id of a parent commit (may be given more than once)")
+	commitMessage := flag.String("commit-message", "", "with --commit, the commit message")
+	writeObjects := flag.Bool("write", false, "also store every blob and tree object as a loose object in the repository given by --git-dir, so git can read the tree by its hash (not usable with options that change content)")
+	gitDirFlag := flag.String("git-dir", "", "with --write, the repository's \".git\" directory (or a bare repository); its object format must be --algorithm")
+	pipeToGit := flag.Bool("pipe-to-git", false, "for a single file, also pipe its content to \"git hash-object --stdin -t blob\" and exit 2 if git's hash differs (not usable with options that change content)")
+	verifyGit := flag.Bool("verify-with-git", false, "if the path is a directory in a git working tree with nothing uncommitted, also have `git write-tree` hash it (hashing again in the repository's object format, if that's not --algorithm), print MATCH or MISMATCH to stderr, and exit 2 on a mismatch")
+	compareGit := flag.Bool("compare-with-git", false, "if the path is a directory in a git working tree with nothing uncommitted, also have git hash the same files, through `git update-index` into a temporary index (never the repository's own) and `git write-tree`, and warn on stderr if its hash differs (hashing again in the repository's object format, if that's not --algorithm)")
+	strict := flag.Bool("strict", false, "with --compare-with-git, exit 2 if git's hash differs, rather than only warning")
+	benchmarkRuns := flag.Int("benchmark", 0, "hash the path this many times in turn, printing how long each run takes and its throughput, in MB/s and files/s, and its heap allocations per file, to stderr, then the minimum, maximum, average, and 99th percentile times; the output is the last run's")
+	progress := flag.Bool("progress", false, "show a progress bar on stderr (or, if stderr isn't a terminal, occasional progress lines); this costs an extra pass over the tree to count entries")
+	countOnly := flag.Bool("count", false, "instead of hashing, only count the files, directories, and symlinks that would be hashed")
+	flag.BoolVar(&opts.RespectGitattributesEOL, "respect-gitattributes-eol", false, "apply the text and eol attributes from .gitattributes files, converting CRLF to LF as git would")
+	flag.BoolVar(&opts.RespectExportIgnore, "respect-export-ignore", false, "leave out anything with the export-ignore attribute in .gitattributes files, as git archive would")
+	noResolveRoot := flag.Bool("no-resolve-root", false, "if the path is a symlink, hash the symlink itself, even if it points to a directory")
+	sshTarget := flag.String("ssh", "", "instead of a local path, hash a directory on another host, given as \"user@host:path\", read over SFTP (credentials come from the SSH agent or ~/.ssh/id_* files; the host must be in ~/.ssh/known_hosts)")
+	remote := flag.String("remote", "", "instead of a local path, hash the objects in an S3 bucket under a prefix, given as \"s3://bucket/prefix\", taking the slashes in their keys as directories (credentials and region come from the AWS SDK's usual sources: environment variables, ~/.aws, or an instance role); every object is recorded as 100644")
+	s3Endpoint := flag.String("s3-endpoint", "", "with --remote, the URL of an S3-compatible service (such as MinIO) to use instead of AWS")
+	fsPlugin := flag.String("fs-plugin", "", "instead of the local filesystem, hash a path within the filesystem provided by this Go plugin (a .so file exporting FSPluginABI and NewFS, as documented with FSPluginABI; linux, darwin, and freebsd only)")
+	fsPluginConfig := flag.String("fs-plugin-config", "", "with --fs-plugin, the string passed to the plugin's NewFS, such as a URL or a path to its own configuration")
+	normalizeOutput := flag.String("normalize-output", "", "first copy the tree to this (new) directory, with every mtime set to the Unix epoch and permissions normalized to 0644 or 0755, then hash the copy (which hashes the same, since git records neither)")
+	tarFile := flag.String("tar", "", "instead of a path, hash the contents of this tar archive (\"-\" for stdin), giving the same hash as the directory it was made from or extracts to")
+	flag.Var(stdinTarFlag{tarFile}, "stdin-tar", "the same as --tar=-")
+	compression := flag.String("compression", "auto", "with --tar, how the archive is compressed: \"auto\" recognizes gzip, zstd, bzip2, and xz by their magic bytes; or one of \"none\", \"gzip\", \"zstd\", \"bzip2\", or \"xz\"")
+	zipFile := flag.String("zip", "", "instead of a path, hash the contents of this zip archive, giving the same hash as the directory it extracts to")
+	reuseGit := flag.Bool("reuse-git", false, "skip reading files which the index of the git repository containing the path shows to be unchanged, using the blob ids it records (only when the repository uses the same --algorithm)")
+	paths0AsTree := flag.Bool("paths0-as-tree", false, "hash only the paths listed on stdin, NUL-terminated as by `find <path> -print0`, and the directories leading to them; a listed directory brings everything beneath it")
+	trackedOnly := flag.Bool("tracked-only", false, "hash only the files tracked in the index of the git repository containing the path (still reading their content from the working tree)")
+	flag.BoolVar(&opts.Audit, "audit", false, "after hashing, stat everything again, and fail if anything changed while it was being hashed")
+	cacheFile := flag.String("cache", "", "load file digests from this file, skip reading files whose size, mtime, inode, and mode are unchanged, and save the updated digests back to it afterwards")
+	flag.BoolVar(&opts.CacheRewrite, "cache-rewrite", false, "with --cache, read every file anyway, and rewrite the cache with what's found")
+	flag.Var((*stringsFlag)(&opts.ExcludeSuffixes), "exclude-suffix", "leave out files (and symlinks) whose names end with this suffix, like \".tmp\" (may be given more than once)")
+	flag.Int64Var(&opts.MinSize, "min-size", 0, "leave out regular files smaller than this many bytes")
+	flag.BoolVar(&opts.IgnoreDotGit, "ignore-dot-git", false, "leave out anything named .git, at any depth, as git does")
+	flag.BoolVar(&opts.NamesOnly, "hash-names-only", false, "ignore the content of files and symlinks, hashing each as its path instead, so the result only changes when the structure does (renames, moves, additions, removals, and mode changes)")
+	flag.BoolVar(&opts.IgnoreFileMode, "ignore-filemode", false, "record all regular files as 100644, ignoring executable bits, as git does with core.fileMode=false")
+	flag.BoolVar(&opts.DropCache, "drop-cache", false, "advise the kernel to drop files from the page cache once they're hashed, to spare other processes' cached data (Linux only; elsewhere it has no effect)")
+	emitNullHash := flag.Bool("emit-null-hash", false, "record files that vanish while hashing with an all-zeros hash (noting each on stderr), rather than failing")
+	flag.BoolVar(&opts.NoAtime, "noatime", false, "don't update files' access times by reading them, where the kernel allows it (Linux only, for files the user owns; elsewhere it has no effect)")
+	flag.BoolVar(&opts.Sparse, "sparse", false, "skip reading the holes in sparse files, hashing zeros for them directly (Linux only)")
+	useMmap := flag.Bool("mmap", false, "memory-map large files (see --mmap-threshold) instead of reading them, where the platform supports it")
+	mmapThreshold := flag.Int64("mmap-threshold", DefaultMmapThreshold, "with --mmap, the size in bytes from which files are memory-mapped")
+	flag.Int64Var(&opts.ReadRate, "limit-rate", 0, "read file content at no more than this many bytes per second, in total (hashes are unaffected; --mmap and --sparse are then ignored)")
+	flag.Int64Var(&opts.ReadBurst, "limit-rate-burst", 0, "with --limit-rate, how many bytes may be read in a burst after a pause (default: one second's worth)")
+	flag.IntVar(&opts.Prefetch, "prefetch", DefaultPrefetch, "how many entries ahead of hashing to stat, and start reading in, in the background (negative: none)")
+	flag.Int64Var(&opts.TreeSpillThreshold, "tree-spill-threshold", DefaultTreeSpillThreshold, "the size in bytes beyond which a directory's tree object is assembled in a temporary file rather than in memory (negative: never)")
+	pprofAddr := flag.String("pprof", "", "serve net/http/pprof on this address (e.g. \"localhost:6060\", or \"localhost:0\" to pick a port, which is printed to stderr) while hashing")
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile to this file on exit (including on interrupt)")
+	memProfile := flag.String("memprofile", "", "write a heap profile to this file on exit (including on interrupt)")
+	flag.BoolVar(&opts.AllowPipes, "allow-pipes", false, "read named pipes until EOF and hash their content as regular files (the hash is then only as deterministic as the pipe's writer); each pipe is waited on indefinitely, for a writer to open it and then to close it, so use --read-pipes to give up after --pipe-timeout")
+	flag.Parse()
+	if problem := checkFlagCombinations(flag.CommandLine); problem != "" {
+		fmt.Fprintf(os.Stderr, "%s\n", problem)
+		exit(2)
+	}
+	if *verbose && *reportFormat == "" && *lineTemplate == "" {
+		*reportFormat = "csv"
+	}
+	if err := startDiagnostics(*pprofAddr, *cpuProfile, *memProfile); err != nil {
+		fmt.Fprintf(os.Stderr, "can't start diagnostics: %s\n", err)
+		exit(2)
+	}
+	tarInput := *tarFile
+	var tarCompression Compression
+	switch *compression {
+	case "auto":
+		tarCompression = CompressionAuto
+	case "none":
+		tarCompression = CompressionNone
+	case "gzip":
+		tarCompression = CompressionGzip
+	case "zstd":
+		tarCompression = CompressionZstd
+	case "bzip2":
+		tarCompression = CompressionBzip2
+	case "xz":
+		tarCompression = CompressionXz
+	default:
+		fmt.Fprintf(os.Stderr, "unknown compression %q\n", *compression)
+		exit(2)
+	}
+	switch {
+	case *skipPermissionErrors && !*failOnUnknown:
+		opts.ErrorHandler = func(pth string, err error) error {
+			return SkipUnsupportedFileTypes(pth, SkipPermissionErrors(pth, err))
+		}
+	case *skipPermissionErrors:
+		opts.ErrorHandler = SkipPermissionErrors
+	case !*failOnUnknown:
+		opts.ErrorHandler = SkipUnsupportedFileTypes
+	}
+	if opts.CaseFold {
+		if handler := opts.ErrorHandler; handler != nil {
+			opts.ErrorHandler = func(pth string, err error) error { return SkipNameCollisions(pth, handler(pth, err)) }
+		} else {
+			opts.ErrorHandler = SkipNameCollisions
+		}
+	}
+	if opts.Sparse && !sparseSupported {
+		fmt.Fprintf(os.Stderr, "--sparse is not supported on this platform\n")
+		exit(2)
+	}
+	if *useMmap {
+		if !mmapSupported {
+			fmt.Fprintf(os.Stderr, "--mmap is not supported on this platform\n")
+			exit(2)
+		}
+		opts.MmapThreshold = *mmapThreshold
+	}
+	if *readPipes {
+		if !pipeTimeoutSupported {
+			fmt.Fprintf(os.Stderr, "--read-pipes is not supported on this platform\n")
+			exit(2)
+		}
+		opts.AllowPipes = true
+		opts.PipeTimeout = *pipeTimeout
+	}
+	switch *algorithm {
+	case "sha256":
+		opts.Algorithm = SHA256
+	case "sha1":
+		opts.Algorithm = SHA1
+	default:
+		fmt.Fprintf(os.Stderr, "unknown algorithm %q\n", *algorithm)
+		exit(2)
+	}
+	if *cacheFile != "" {
+		var err error
+		opts.Cache, err = LoadDigestCache(*cacheFile, opts.Algorithm)
+		switch serum.Code(err) {
+		case "":
+		case ErrCacheCorrupt:
+			// The cache only saves time; a bad one is discarded, and will be replaced when this run saves.
+			fmt.Fprintf(os.Stderr, "warning: ignoring cache: %s\n", serum.ToJSONString(err))
+		default:
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+	}
+	switch *unicodeNormalization {
+	case "none":
+		opts.UnicodeNormalization = NormalizeNone
+	case "nfc":
+		opts.UnicodeNormalization = NormalizeNFC
+	case "nfd":
+		opts.UnicodeNormalization = NormalizeNFD
+	default:
+		fmt.Fprintf(os.Stderr, "unknown unicode normalization %q\n", *unicodeNormalization)
+		exit(2)
+	}
+	switch *lfsMode {
+	case "content":
+		opts.LFS = LFSContent
+	case "pointers":
+		opts.LFS = LFSPointers
+	default:
+		fmt.Fprintf(os.Stderr, "unknown lfs mode %q\n", *lfsMode)
+		exit(2)
+	}
+	var out io.Writer = os.Stdout
+	var outBuf bytes.Buffer // With --output-file, everything is gathered here, and only written out once it's all there.
+	if *outputFile != "" {
+		out = &outBuf
+	} else if *fastImportOut == "-" {
+		out = os.Stderr // Stdout has the stream.
+	}
+	switch *reportFormat {
+	case "":
+	case "csv":
+		opts.OnEntry = csvReporter(out)
+	case "jsonlines":
+		opts.OnEntry = jsonLinesReporter(out, func(err error) {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		})
+	default:
+		fmt.Fprintf(os.Stderr, "unknown report format %q\n", *reportFormat)
+		exit(2)
+	}
+	if *lineTemplate != "" {
+		reporter, err := templateReporter(out, *lineTemplate, opts.Algorithm)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bad --template: %s\n", err)
+			exit(2)
+		}
+		opts.OnEntry = reporter
+	}
+	if *emitNullHash {
+		opts.OnVanished = func(pth string) {
+			fmt.Fprintf(os.Stderr, "warning: %q vanished while hashing; recording it with a null hash\n", pth)
+		}
+	}
+	reporting := opts.OnEntry != nil // Whether every entry, including the root, is reported as it's hashed.
+	var tree *treeReporter
+	switch *format {
+	case "hex":
+	case "tree":
+		tree = newTreeReporter()
+		opts.OnEntry = tree.OnEntry
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		exit(2)
+	}
+
+	startPath := "."
+	if flag.NArg() > 0 {
+		startPath = filepath.Clean(flag.Arg(0))
+	}
+	var fsys fsx.FS = rawDirFS(".")
+	if *sshTarget != "" {
+		userName, addr, pth, ok := parseSSHTarget(*sshTarget)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "--ssh must be of the form \"user@host:path\"\n")
+			exit(2)
+		}
+		client, closeSSH, err := dialSFTP(userName, addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		defer closeSSH()
+		fsys, startPath = sftpFS{client}, filepath.Clean(pth)
+	}
+	if *remote != "" {
+		bucket, prefix, ok := parseS3URL(*remote)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "--remote must be of the form \"s3://bucket/prefix\"\n")
+			exit(2)
+		}
+		s3fs, err := newS3FS(context.Background(), bucket, prefix, *s3Endpoint)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		fsys, startPath = s3fs, "."
+	}
+	if *fsPlugin != "" {
+		pluginFS, err := loadFSPlugin(*fsPlugin, *fsPluginConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		if _, ok := pluginFS.(fsx.FSSupportingReadlink); !ok {
+			pluginFS = stdFS{pluginFS} // Hashed as HashFS would hash it.
+		}
+		fsys = pluginFS
+	}
+	if !*noResolveRoot {
+		startPath = resolveRoot(fsys, startPath)
+	}
+	if *normalizeOutput != "" {
+		dst := filepath.Clean(*normalizeOutput)
+		if err := NormalizeCopy(fsys, startPath, dst); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		fsys, startPath = rawDirFS("."), dst
+	}
+	fastImportCommit := FastImportCommit{Ref: *fastImportRef, Author: *fastImportAuthor, Date: time.Now(), Message: *fastImportMessage}
+	if *fastImportOut != "" && *fastImportDate != "" {
+		date, err := time.Parse(time.RFC3339, *fastImportDate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--fast-import-date must be in RFC 3339 format, like \"2006-01-02T15:04:05Z\"\n")
+			exit(2)
+		}
+		fastImportCommit.Date = date
 	}
-	fsys := osfs.DirFS(".")
 
-	hash, _, err := hashSomething(fsys, startPath)
+	if *gitConfig != "" {
+		index, err := applyGitConfig(*gitConfig, &opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		if index != "" && *symlinksAsText == "" && *symlinksAsTextIndex == "" {
+			*symlinksAsTextIndex = index
+		}
+	}
+	switch {
+	case *symlinksAsText != "":
+		var err error
+		if opts.SymlinksAsText, err = symlinksAsTextFromList(*symlinksAsText, startPath); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+	case *symlinksAsTextIndex != "":
+		var err error
+		if opts.SymlinksAsText, err = symlinksAsTextFromIndex(*symlinksAsTextIndex, startPath); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+	}
+
+	if *trackedOnly {
+		var err error
+		if opts.Include, err = trackedFromIndex(startPath); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+	}
+
+	if *paths0AsTree {
+		paths, err := readPaths0(os.Stdin)
+		if err == nil {
+			opts.Include, err = includePathList(fsys, startPath, paths)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+	}
+
+	if *reuseGit {
+		var err error
+		if opts.GitIndexDigests, err = digestsFromIndex(startPath, opts.Algorithm); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		if opts.GitIndexDigests == nil {
+			fmt.Fprintf(os.Stderr, "warning: the repository's object format isn't %s, so --reuse-git has no effect\n", opts.Algorithm)
+		}
+	}
+
+	if *countOnly {
+		counts, err := CountPath(fsys, startPath, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		fmt.Fprintf(out, "files=%d dirs=%d symlinks=%d\n", counts.Files, counts.Dirs, counts.Symlinks)
+		if *outputFile != "" {
+			exit(finishOutputFile(*outputFile, outBuf.Bytes(), *verifyOutputFile))
+		}
+		return
+	}
+
+	var commitSpec Commit
+	if *commit {
+		date, err := time.Parse(time.RFC3339, *commitDate)
+		if *commitAuthor == "" || err != nil {
+			fmt.Fprintf(os.Stderr, "--commit requires --author, as \"Name <email>\", and --date, in RFC 3339 format, like \"2006-01-02T15:04:05+02:00\"\n")
+			exit(2)
+		}
+		for _, parent := range commitParents {
+			if _, err := hex.DecodeString(parent); err != nil || len(parent) != 2*opts.Algorithm.Size() {
+				fmt.Fprintf(os.Stderr, "--parent must be %d hex digits, the length of a %s hash\n", 2*opts.Algorithm.Size(), opts.Algorithm)
+				exit(2)
+			}
+		}
+		if *prependPath == "" && tarInput == "" && *zipFile == "" {
+			if fi, err := fsx.Stat(fsys, startPath); err == nil && !fi.IsDir() {
+				fmt.Fprintf(os.Stderr, "--commit needs a directory (or --prepend-path), since a commit's tree can't be a file\n")
+				exit(2)
+			}
+		}
+		commitSpec = Commit{Parents: commitParents, Author: *commitAuthor, Date: date, Message: *commitMessage}
+	}
+
+	var seed []byte
+	if *seedHex != "" {
+		var err error
+		if seed, err = hex.DecodeString(*seedHex); err != nil || len(seed) != opts.Algorithm.Size() {
+			fmt.Fprintf(os.Stderr, "--seed must be %d hex digits, the length of a %s hash\n", 2*opts.Algorithm.Size(), opts.Algorithm)
+			exit(2)
+		}
+	}
+
+	if *pipeToGit {
+		if opts.AutoCRLF || opts.SymlinksAsText != nil {
+			fmt.Fprintf(os.Stderr, "--pipe-to-git can't be used with a --gitconfig whose settings change file content (core.autocrlf, core.eol, or core.symlinks=false)\n")
+			exit(2)
+		}
+		fi, err := os.Lstat(startPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = NewErrNotFound(startPath)
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		if err != nil || !fi.Mode().IsRegular() {
+			fmt.Fprintf(os.Stderr, "--pipe-to-git requires the path to be a regular file\n")
+			exit(2)
+		}
+	}
+
+	var bar *progressBar
+	if *progress {
+		counts, err := CountPath(fsys, startPath, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		bar = newProgressBar(os.Stderr, counts.Files+counts.Dirs+counts.Symlinks)
+		if report := opts.OnEntry; report != nil {
+			opts.OnEntry = func(e Entry) { bar.OnEntry(e); report(e) }
+		} else {
+			opts.OnEntry = bar.OnEntry
+		}
+	}
+	if *reportCollisions {
+		collisions := newCollisionReporter(fsys, os.Stderr, *collisionPrefix, opts)
+		if report := opts.OnEntry; report != nil {
+			opts.OnEntry = func(e Entry) { collisions.OnEntry(e); report(e) }
+		} else {
+			opts.OnEntry = collisions.OnEntry
+		}
+	}
+
+	var hashedEntries []Entry
+	if *compareGit {
+		if report := opts.OnEntry; report != nil {
+			opts.OnEntry = func(e Entry) { hashedEntries = append(hashedEntries, e); report(e) }
+		} else {
+			opts.OnEntry = func(e Entry) { hashedEntries = append(hashedEntries, e) }
+		}
+	}
+
+	if *benchmarkRuns < 0 {
+		fmt.Fprintf(os.Stderr, "--benchmark must be a number of runs\n")
+		exit(2)
+	}
+
+	var stats Stats
+	opts.Stats = &stats
+	var hash [32]byte
+	var err error
+	switch {
+	case tarInput != "":
+		hash, err = hashTarInput(tarInput, tarCompression, opts)
+	case *zipFile != "":
+		hash, err = hashZipFile(*zipFile, opts)
+	case *packFile != "":
+		hash, err = writePackFile(*packFile, fsys, startPath, opts)
+	case *writeObjects:
+		hash, err = WriteObjects(fsys, startPath, *gitDirFlag, opts)
+	case *fastImportOut != "":
+		hash, err = writeFastImport(*fastImportOut, fsys, startPath, fastImportCommit, opts)
+	case *benchmarkRuns > 0:
+		hash, err = runBenchmark(os.Stderr, *benchmarkRuns, &stats, func() ([32]byte, error) { return HashPath(fsys, startPath, opts) })
+	default:
+		hash, err = HashPath(fsys, startPath, opts)
+	}
+	if bar != nil {
+		bar.Finish()
+	}
+	if *printStats {
+		fmt.Fprintf(os.Stderr, "rereads=%d hardlink_hits=%d cache_hits=%d index_hits=%d blobs=%d unique_blobs=%d trees=%d unique_trees=%d\n",
+			stats.Rereads, stats.HardLinkHits, stats.CacheHits, stats.IndexHits, stats.Blobs, stats.UniqueBlobs, stats.Trees, stats.UniqueTrees)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
-		os.Exit(9)
+		exit(exitCode(err))
+	}
+	if *verifyGit {
+		match, err := verifyWithGit(fsys, startPath, hash, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		if !match {
+			exit(2)
+		}
+	}
+	if *compareGit {
+		match, err := compareWithGit(fsys, startPath, hash, hashedEntries, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		if !match && *strict {
+			exit(2)
+		}
+	}
+	if opts.Cache != nil {
+		if err := opts.Cache.Save(*cacheFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+	}
+	if *prependPath != "" {
+		rootMode := fs.ModeDir
+		if tarInput == "" && *zipFile == "" {
+			if fi, err := fsx.Lstat(fsys, startPath); err == nil {
+				rootMode = fi.Mode()
+			}
+		}
+		if hash, err = PrependPath(hash, rootMode, *prependPath, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(2)
+		}
+	}
+	if seed != nil {
+		hash = SeedHash(hash, seed)
+	}
+	digest := hash[:opts.Algorithm.Size()]
+	if *pipeToGit {
+		gitHash, err := gitHashObject(startPath, opts.Algorithm)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			exit(exitCode(err))
+		}
+		if gitHash != hex.EncodeToString(digest) {
+			fmt.Fprintf(os.Stderr, "hash differs from git's: git hash-object says %s, but we say %x\n", gitHash, digest)
+			exit(2)
+		}
+	}
+	if *assertFile != "" {
+		current := storedHash{Algorithm: opts.Algorithm.String(), Options: optionsFingerprint(flag.CommandLine), Hash: hex.EncodeToString(digest)}
+		if *update {
+			if err := writeFileAtomic(*assertFile, current.marshal()); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+				exit(exitCode(err))
+			}
+		} else if code := assertUnchanged(*assertFile, current); code != 0 {
+			exit(code)
+		}
+	}
+	switch {
+	case tree != nil:
+		if err := tree.Render(out, localeGlyphs()); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			exit(9)
+		}
+	case reporting:
+		// The root was already reported along with everything else.
+	case *goVar != "":
+		fmt.Fprintf(out, "var %s = %s\n", *goVar, goArrayLiteral(digest))
+	case *goArray:
+		fmt.Fprintf(out, "%s\n", goArrayLiteral(digest))
+	default:
+		fmt.Fprintf(out, "%s\n", hex.EncodeToString(digest))
+	}
+	if *commit {
+		commitHash := CommitHash(hash, commitSpec, opts.Algorithm)
+		fmt.Fprintf(out, "%s\n", hex.EncodeToString(commitHash[:opts.Algorithm.Size()]))
+	}
+	if *histogram {
+		if err := stats.FileSizes.Write(out); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			exit(9)
+		}
+	}
+	if *outputFile != "" {
+		exit(finishOutputFile(*outputFile, outBuf.Bytes(), *verifyOutputFile))
+	}
+	exit(0)
+}
+
+// maxRootSymlinkHops bounds how many symlinks resolveRoot will follow, so that a cycle can't loop forever.
+// It matches the limit Linux places on path resolution.
+const maxRootSymlinkHops = 40
+
+// resolveRoot follows the starting path, if it's a symlink, to the directory it refers to,
+// since "the tree hash of what this path refers to" is nearly always what's wanted.
+// Links to links are followed, up to maxRootSymlinkHops.
+// If the path isn't a symlink, or doesn't lead to a directory (because it leads to a file, or dangles),
+// it's returned unchanged, and so will be hashed as a symlink.
+func resolveRoot(fsys fsx.FS, pth string) string {
+	resolved := pth
+	for i := 0; i < maxRootSymlinkHops; i++ {
+		fi, err := fsx.Lstat(fsys, resolved)
+		if err != nil {
+			return pth
+		}
+		switch {
+		case fi.IsDir():
+			return resolved
+		case fi.Mode()&fs.ModeSymlink == 0:
+			return pth
+		}
+		target, err := fsx.Readlink(fsys, resolved)
+		if err != nil {
+			return pth
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(resolved), target)
+		}
+		resolved = filepath.Clean(target)
+	}
+	return pth
+}
+
+// exitCode picks the process exit code for an error.
+// Most errors exit with 9; a few are given their own codes so that scripts can tell them apart.
+func exitCode(err error) int {
+	switch serum.Code(err) {
+	case ErrNotFound:
+		return 4
+	default:
+		return 9
 	}
-	var hashHex [64]byte
-	hex.Encode(hashHex[:], hash[:])
-	fmt.Printf("%s\n", hashHex)
 }
 
 const (
 	ErrUnsupportedFileType = "gittreehash-error-unsupported-file-type"
 	ErrIO                  = "gittreehash-error-io"
 	ErrConcurrentIO        = "gittreehash-error-concurrent-io"
+	ErrPermission          = "gittreehash-error-permission"
+	ErrSymlinkCycle        = "gittreehash-error-symlink-cycle"
+	ErrTooDeep             = "gittreehash-error-too-deep"
+	ErrNotFound            = "gittreehash-error-not-found"
+	ErrPipeTimeout         = "gittreehash-error-pipe-timeout"
 )
 
+// DefaultMmapThreshold is the file size from which the --mmap flag memory-maps files.
+// Below this, the cost of setting up a mapping isn't repaid.
+const DefaultMmapThreshold = 16 << 20
+
+// DefaultMaxDepth is the directory depth limit used when Options.MaxDepth is zero.
+// Each level of directories costs a little stack and a tree buffer while it's being hashed,
+// so the limit also keeps pathologically deep trees (as made by fuzzers, or hostile archives) from using unbounded memory.
+const DefaultMaxDepth = 512
+
+// Options configures a hashing run.
+// The zero value is ready to use, and hashes the filesystem exactly as it is found.
+type Options struct {
+	// ErrorHandler, if set, is consulted whenever hashing any entry below the starting path fails.
+	// If it returns nil, the entry is omitted from its parent tree and hashing continues;
+	// otherwise, the error it returns halts the whole operation.
+	//
+	// If unset, any error halts the whole operation.
+	ErrorHandler ErrorHandler
+
+	// MaxDepth limits how many directories deep hashing will descend.
+	// This guards against filesystems which fabricate infinitely deep hierarchies.
+	// If zero, DefaultMaxDepth is used.
+	MaxDepth int
+
+	// AllowPipes causes named pipes to be opened and read until EOF, and their content hashed as a regular file,
+	// instead of being rejected as an unsupported file type.
+	// Note that this makes the resulting hash only as deterministic as whatever is writing into the pipe!
+	// Reading a pipe blocks until some other process opens it for writing, and then until it's closed,
+	// for as long as that takes unless PipeTimeout is set.
+	AllowPipes bool
+
+	// PipeTimeout, if nonzero, limits how long reading each named pipe may take when AllowPipes is set,
+	// including the time spent waiting for a writer to open the other end.
+	// This is only supported on unix platforms.
+	PipeTimeout time.Duration
+
+	// RereadChanged is how many times to retry hashing a file which changed size while it was being read,
+	// before giving up and returning an error.  (Each retry is counted in Stats.Rereads.)
+	// Zero means fail on the first inconsistency.
+	RereadChanged int
+
+	// Include, if set, is asked about every directory entry, and only those for which it returns true are hashed.
+	// (A directory that's left out is not descended into, so Include must admit the directories leading to anything it wants.)
+	Include func(pth string, isDir bool) bool
+
+	// MinSize, if positive, leaves out regular files smaller than this many bytes, as if they weren't there.
+	// (Other kinds of entry are unaffected.)
+	MinSize int64
+
+	// ExcludeSuffixes leaves out anything other than a directory whose name ends with one of these suffixes,
+	// such as the ".tmp" or ".part" files build systems leave behind while writing their outputs.
+	ExcludeSuffixes []string
+
+	// RespectGitattributesEOL causes .gitattributes files to be read, and the "text" and "eol" attributes
+	// to be applied to files as git would when adding them: converting CRLF line endings to LF.
+	// This includes git's heuristic for detecting binary files when "text=auto" is used.
+	// Without this, files are hashed exactly as their bytes are found.
+	RespectGitattributesEOL bool
+
+	// AutoCRLF treats files which gitattributes says nothing about (neither "text" nor "eol") as if they had "text=auto",
+	// as git does when core.autocrlf is true or "input".  Other files are treated as RespectGitattributesEOL would,
+	// so .gitattributes files are read even if that isn't set.
+	// (Git also declines to convert a file whose content in the index already has CRLF line endings; that's not considered here.)
+	AutoCRLF bool
+
+	// RespectExportIgnore causes .gitattributes files to be read, and anything with the "export-ignore" attribute
+	// to be left out, as "git archive" would.
+	RespectExportIgnore bool
+
+	// IgnoreDotGit causes anything named ".git" to be left out, at any depth.
+	// That's usually a repository's own directory, but can also be the ".git" file of a submodule or linked worktree.
+	// Git never records such entries in trees, so this is needed to match `git write-tree` when hashing a working tree.
+	IgnoreDotGit bool
+
+	// IgnoreFileMode causes all regular files to be recorded with mode 100644, regardless of their executable bits,
+	// as git does when core.fileMode is false.  This makes hashes portable to filesystems that don't track executability.
+	IgnoreFileMode bool
+
+	// NamesOnly causes the content of files and symlinks to be ignored: each one's blob hash is replaced
+	// by the digest of "path:" and its path relative to the starting path.
+	// The tree hash then changes when anything is added, removed, renamed, moved, or has its mode changed,
+	// but not when content changes.  Such hashes mean nothing to git, of course.
+	NamesOnly bool
+
+	// ReadRate, if positive, caps how many bytes of file content are read per second, in total across all goroutines,
+	// so that hashing doesn't starve other work of IO.  Hashes are unaffected.
+	// Files are then always read as streams, even if Sparse or MmapThreshold would have them read otherwise.
+	ReadRate int64
+
+	// ReadBurst is how many bytes may be read at once, beyond ReadRate, after a pause in reading.
+	// If zero, it's one second's worth.  Only used if ReadRate is set.
+	ReadBurst int64
+
+	// LFS selects how files managed by Git LFS (those with "filter=lfs" in .gitattributes) are hashed.
+	// With LFSPointers, the hash is the same whether or not the LFS content has been smudged into the working tree.
+	LFS LFSMode
+
+	// SymlinksAsText, if set, is asked about every regular file.
+	// Those for which it returns true are recorded as symlinks, with the file's content as the link target.
+	// This is how git checks out symlinks when core.symlinks is false (as is typical on Windows),
+	// so this allows such a checkout to hash the same as it would on a system that supports symlinks.
+	SymlinksAsText func(pth string) bool
+
+	// OnVanished, if set, makes entries that vanish after their directory is listed (as happens on live systems)
+	// part of the tree anyway, with an all-zeros hash, rather than an error (gittreehash-error-concurrent-io);
+	// and it's called with the path of each.  The tree hashes that result match no real tree,
+	// but let the rest of the tree still be compared.
+	OnVanished func(pth string)
+
+	// OnEntry, if set, is called with a description of every file and directory after it has been hashed.
+	// Since a directory's hash depends on its contents, directories are reported after everything inside them.
+	OnEntry func(Entry)
+
+	// UnicodeNormalization, if set, normalizes each filename before it's recorded in a tree (and sorted),
+	// so that e.g. the same files on macOS (which has tended to produce NFD names) and Linux (where NFC is usual)
+	// can hash the same.  Paths reported in errors and to OnEntry are still exactly as found on the filesystem.
+	//
+	// The trade-off is that the hash no longer necessarily matches what git would record:
+	// git records names byte for byte, except on macOS, where core.precomposeUnicode (on by default) has it use NFC.
+	// Also, two names in one directory which differ only in their normalization can't both be recorded,
+	// so that's an error (gittreehash-error-name-collision), given to the ErrorHandler for the second of them.
+	UnicodeNormalization UnicodeNormalization
+
+	// CaseFold maps each filename to lower case before it's recorded in a tree (and sorted), after any UnicodeNormalization,
+	// so that trees from case-insensitive filesystems (like macOS's) hash the same however the names happen to be capitalized.
+	// As with UnicodeNormalization, paths reported in errors and to OnEntry are as found,
+	// and two names in one directory that differ only in case are a gittreehash-error-name-collision.
+	CaseFold bool
+
+	// Algorithm selects the hash function.  The default is SHA256.
+	Algorithm Algorithm
+
+	// Audit causes a second pass over the tree once the hash is computed, stat-ing (but not reading) everything again,
+	// and failing with gittreehash-error-concurrent-io, listing the paths that differ, if anything appeared, vanished,
+	// or changed mode, size, or modification time since it was hashed.
+	// This is evidence that the tree didn't change while it was being hashed, beyond the checks made on each file.
+	Audit bool
+
+	// Concurrency is how many goroutines may hash at once.  Zero or one means everything is done on the calling goroutine.
+	// With more, the children of directories are hashed concurrently; the results are exactly the same as hashing serially.
+	// The number of files open at once is bounded by this too, and by MaxOpenFiles.
+	//
+	// When this is more than one, the callbacks given in other options may be called from several goroutines:
+	// OnEntry, OnVanished, and ErrorHandler are never called concurrently, but SymlinksAsText and Include may be,
+	// and entries are reported to OnEntry in no particular order (though still with each directory after its contents).
+	// Once an error halts hashing, work that hasn't started yet is cancelled.
+	Concurrency int
+
+	// MaxOpenFiles limits how many files and directories hashing may hold open at once.
+	// Once the limit is reached, hashing waits for one to be closed before opening another,
+	// so a high Concurrency never turns into running out of file descriptors.
+	// If zero, it's a quarter of the process's limit on open files (RLIMIT_NOFILE).
+	MaxOpenFiles int
+
+	// Cache, if set, is consulted for the digests of regular files before reading them,
+	// and is updated with the digests of every regular file hashed, so it can be saved for next time.
+	// It's not used for files whose content is converted (by RespectGitattributesEOL or LFS).
+	// The cache must have been made for the same Algorithm.
+	Cache *DigestCache
+
+	// CacheRewrite causes every file to be read even if Cache has a digest for it, while still updating the cache.
+	// This refreshes a cache that's suspected of being wrong (e.g. because of a filesystem with coarse timestamps).
+	CacheRewrite bool
+
+	// MmapThreshold, if positive, causes regular files of at least this many bytes to be memory-mapped, rather than read,
+	// which can be faster for very large files on local disks.  If a file can't be mapped, it's read as usual.
+	// If a mapped file is truncated while it's being hashed, that's reported as gittreehash-error-concurrent-io,
+	// as it would be when reading.  This has no effect on platforms without mmap.
+	MmapThreshold int64
+
+	// Sparse causes the holes in sparse regular files to be skipped rather than read, hashing zeros for them directly,
+	// which saves reading e.g. gigabytes of zeros in VM images.  The hash is the same either way.
+	// Files without holes are read as usual.  This relies on the filesystem reporting holes (with SEEK_HOLE and SEEK_DATA),
+	// which not all do, and so has no effect on filesystems that don't, nor on platforms other than Linux.
+	Sparse bool
+
+	// DropCache advises the kernel (on Linux; elsewhere it does nothing) that files are read sequentially,
+	// and that their pages won't be needed again once they've been hashed, so hashing a huge tree doesn't evict
+	// everything else from the page cache.  The cost is that hashing the same files again has to read them from disk again.
+	// The advice is best-effort: if the kernel doesn't take it, nothing is different.
+	DropCache bool
+
+	// NoAtime opens files with O_NOATIME (on Linux; elsewhere it does nothing), so that hashing doesn't update their access times,
+	// which costs writes, and makes every file look freshly used to anything that goes by atime.
+	// The kernel only allows this for files the process owns (or with CAP_FOWNER); any other file is opened as usual.
+	NoAtime bool
+
+	// OpenFlags are added to the flags files are opened with to read their content, e.g. to pass platform-specific flags through.
+	// They're only used on filesystems with an OpenFile method (like os.OpenFile), which the local filesystem has.
+	// The flags must leave the file readable; O_RDONLY is always given.
+	OpenFlags int
+
+	// GitIndexDigests, if set, is asked for the blob id git has recorded in its index for each regular file, before it's read.
+	// It should only answer if it's sure the file hasn't changed since git recorded it (as git status would be sure).
+	// Since git records content after its clean filters, the answer is only used where we'd hash the content the same way;
+	// see the LFS, RespectGitattributesEOL, and AutoCRLF options.  (Git's core.autocrlf setting is assumed to be as AutoCRLF says.)
+	GitIndexDigests func(pth string, fi fs.FileInfo) ([32]byte, bool)
+
+	// Prefetch is how many entries of a directory, ahead of the one being hashed, are fetched in the background:
+	// their FileInfo is read, and for regular files, the kernel is asked to start reading their content (on Linux).
+	// This overlaps waiting on the filesystem with hashing, which helps most on slow disks and network filesystems.
+	// If zero, DefaultPrefetch is used; if negative, nothing is prefetched.
+	Prefetch int
+
+	// TreeSpillThreshold is the size beyond which the body of a tree object being assembled is moved out of memory,
+	// into a temporary file, so that directories with millions of entries don't need hundreds of megabytes for it.
+	// If zero, DefaultTreeSpillThreshold is used; if negative, tree bodies are always kept in memory.
+	TreeSpillThreshold int64
+
+	// Stats, if set, is filled in with counters about the work done.
+	Stats *Stats
+}
+
+// Stats records counters about the work done during hashing.  See Options.Stats.
+type Stats struct {
+	Rereads      int           // How many times a file was hashed again because it changed size while being read.
+	FileSizes    SizeHistogram // The sizes of the regular files hashed, as reported by Lstat.
+	HardLinkHits int           // How many files weren't read, because another hard link to the same file had already been hashed.
+	CacheHits    int           // How many files weren't read, because Options.Cache had their digest.
+	IndexHits    int           // How many files weren't read, because Options.GitIndexDigests had their digest.
+	Blobs        int           // How many blobs (files and symlinks) were hashed.
+	BlobBytes    int64         // The total size of those blobs, in bytes.
+	UniqueBlobs  int           // How many of those were distinct.
+	Trees        int           // How many trees (directories) were hashed.
+	UniqueTrees  int           // How many of those were distinct.  Identical trees are only hashed once.
+}
+
+// Entry describes one object that was hashed, for Options.OnEntry.
+type Entry struct {
+	Path    string      // The path as found on the filesystem; its bytes are preserved exactly, so it may not be valid UTF-8.
+	Hash    []byte      // The digest, with length according to Options.Algorithm.
+	Mode    fs.FileMode // The mode as found on the filesystem (after any normalization).
+	GitMode string      // The mode as git would show it, e.g. "100644" or "040000".
+	Type    string      // Either "blob" or "tree".
+	Size    int64       // The length of the object's body, in bytes.
+}
+
+// ErrorHandler is the signature for Options.ErrorHandler.
+// It receives the path of the entry which could not be hashed, and the error encountered.
+type ErrorHandler func(pth string, err error) error
+
+// SkipPermissionErrors is an ErrorHandler which omits any files that can't be read
+// due to EACCES or EPERM (noting each on stderr), and halts on any other kind of error.
+func SkipPermissionErrors(pth string, err error) error {
+	if serum.Code(err) != ErrPermission {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "skipping %q: %s\n", pth, err)
+	return nil
+}
+
+// SkipUnsupportedFileTypes is an ErrorHandler which omits any sockets, device nodes, and other files
+// that git has no way to record (noting each on stderr), and halts on any other kind of error.
+// A nil error is passed through, so this can be applied after another handler.
+func SkipUnsupportedFileTypes(pth string, err error) error {
+	if serum.Code(err) != ErrUnsupportedFileType {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "skipping %q: %s\n", pth, err)
+	return nil
+}
+
+// HashPath computes the git hash of whatever is at the given path in the filesystem:
+// a tree hash if it's a directory, or a blob hash if it's a file or symlink.
+//
+// Errors:
+//
+//   - gittreehash-error-unsupported-file-type -- if the filesystem contains
+//     files that git doesn't have a description of: sockets, device nodes, etc.
+//   - gittreehash-error-io -- if any raw IO barfs while we're scanning the filesystem.
+//   - gittreehash-error-permission -- if IO failed due to permissions.
+//   - gittreehash-error-concurrent-io -- if any inconsistencies are detected which
+//     likely arose from concurrent filesystem changes during the hashing.
+//   - gittreehash-error-symlink-cycle -- if a directory turns out to contain itself,
+//     which can happen if the filesystem resolves symlinks implicitly.
+//   - gittreehash-error-too-deep -- if the hierarchy is deeper than Options.MaxDepth.
+//   - gittreehash-error-not-found -- if there's nothing at the starting path.
+//   - gittreehash-error-pipe-timeout -- if reading a named pipe takes longer than Options.PipeTimeout.
+//   - any error returned by Options.ErrorHandler.
+func HashPath(fsys fsx.FS, pth string, opts Options) ([32]byte, error) {
+	h := newHasher(fsys, opts)
+	hash, _, err := h.hashSomething(pth, nil)
+	err = unwrapAbort(err)
+	if err == nil && h.audit != nil {
+		if err := h.auditPass(pth); err != nil {
+			return [32]byte{}, err
+		}
+	}
+	return hash, err
+}
+
+// HashDir is HashPath for a path on the local filesystem, given as a plain string, and hashed as the command line does:
+// a relative path is relative to the working directory, and if the path is a symlink to a directory, the directory is hashed.
+// Names are passed to the operating system byte for byte, so they needn't be valid UTF-8.
+//
+// Errors:
+//
+//   - any error HashPath may return.
+func HashDir(pth string, opts Options) ([32]byte, error) {
+	fsys := rawDirFS(".")
+	return HashPath(fsys, resolveRoot(fsys, filepath.Clean(pth)), opts)
+}
+
+// HashGitObject computes the SHA-256 hash git would give an object of the given type ("blob", "tree", "commit", "tag", ...)
+// with the given body: that is, the hash of "<type> <len>\x00" followed by the body.
+// This is the primitive underlying all the other hashing here; it's exposed so that any other kind of object can be hashed too.
+func HashGitObject(objectType string, body []byte) [32]byte {
+	return SHA256.hashObject(objectType, body)
+}
+
+// HashString computes the SHA-256 hash git would give a blob with the given content: the hash of "blob <len>\x00" followed by s.
+// It's the same as `printf %s "$s" | git hash-object --stdin` in a repository with the sha256 object format.
+func HashString(s string) [32]byte {
+	return SHA256.hashObject("blob", []byte(s))
+}
+
+// hasher holds the configuration and any state used during a single hashing run.
+type hasher struct {
+	fsys fsx.FS
+	opts Options
+
+	// onTreeBody, if set, is called with the body of every tree object after it's hashed (except any spilled to disk; see Options.TreeSpillThreshold).
+	// The body must not be retained after the call returns.
+	onTreeBody func(pth string, body []byte)
+
+	audit *auditLog    // Only set if Options.Audit is.
+	rate  *rateLimiter // Only set if Options.ReadRate is.
+
+	blobMemo map[blobMemoKey][32]byte // Digests of files with several hard links, so that each is only read once.  Guarded by mu.
+	treeMemo treeMemo                 // Digests of tree bodies already hashed, keyed by the body.  Guarded by mu.
+	distinct map[[32]byte]struct{}    // Every digest emitted, for counting distinct objects in Stats.  Guarded by mu.
+
+	concurrencyState
+}
+
+// newHasher prepares a hasher, filling in defaults for any unset options.
+func newHasher(fsys fsx.FS, opts Options) *hasher {
+	if opts.MaxDepth == 0 {
+		opts.MaxDepth = DefaultMaxDepth
+	}
+	if opts.Stats == nil {
+		opts.Stats = &Stats{}
+	}
+	if opts.Prefetch == 0 {
+		opts.Prefetch = DefaultPrefetch
+	}
+	if opts.TreeSpillThreshold == 0 {
+		opts.TreeSpillThreshold = DefaultTreeSpillThreshold
+	}
+	if opts.MaxOpenFiles <= 0 {
+		opts.MaxOpenFiles = defaultMaxOpenFiles()
+	}
+	h := &hasher{fsys: fsys, opts: opts}
+	if opts.Audit {
+		h.audit = newAuditLog()
+	}
+	if opts.ReadRate > 0 {
+		h.rate = newRateLimiter(opts.ReadRate, opts.ReadBurst)
+	}
+	h.initConcurrency()
+	return h
+}
+
+// ancestry records the directories above the one currently being hashed,
+// so that cycles can be detected and depth can be limited.
+// Each directory links to its parent, so siblings can share their ancestry without copying.
+type ancestry struct {
+	parent   *ancestry
+	path     string
+	depth    int
+	dev, ino uint64
+	hasIdent bool
+	attrs    *gitattributes.File // The .gitattributes file in this directory, if any, and if any options need it.
+}
+
+// descend returns the ancestry for the contents of the directory at pth,
+// or an error if entering that directory would cycle or exceed the depth limit.
+// If any options need them, it also loads the directory's .gitattributes file.
+//
+// Errors:
+//
+//   - gittreehash-error-symlink-cycle -- if the directory is the same as one of its ancestors.
+//   - gittreehash-error-too-deep -- if the directory is deeper than Options.MaxDepth.
+//   - gittreehash-error-gitattributes -- if the directory's .gitattributes file can't be parsed.
+//   - gittreehash-error-io -- if reading the directory's .gitattributes file fails.
+//   - gittreehash-error-permission -- if reading the directory's .gitattributes file fails due to permissions.
+func (h *hasher) descend(anc *ancestry, pth string, fi fs.FileInfo) (*ancestry, error) {
+	next := &ancestry{parent: anc, path: pth}
+	if anc != nil {
+		next.depth = anc.depth + 1
+	}
+	if next.depth > h.opts.MaxDepth {
+		return nil, serum.Error(
+			ErrTooDeep,
+			serum.WithMessageTemplate("directory at {{path}} exceeds the maximum depth of {{limit}}"),
+			serum.WithDetail("path", pth),
+			withPathBytes("path", pth),
+			serum.WithDetail("limit", strconv.Itoa(h.opts.MaxDepth)),
+		)
+	}
+	next.dev, next.ino, next.hasIdent = fileIdentity(fi)
+	for a := anc; a != nil && next.hasIdent; a = a.parent {
+		if a.hasIdent && a.dev == next.dev && a.ino == next.ino {
+			return nil, serum.Error(
+				ErrSymlinkCycle,
+				serum.WithMessageTemplate("directory at {{path}} is the same directory as its ancestor {{ancestor}}"),
+				serum.WithDetail("path", pth),
+				withPathBytes("path", pth),
+				serum.WithDetail("ancestor", a.path),
+				withPathBytes("ancestor", a.path),
+			)
+		}
+	}
+	if h.wantsAttributes() {
+		var err error
+		if next.attrs, err = h.loadAttributes(pth); err != nil {
+			return nil, err
+		}
+	}
+	return next, nil
+}
+
+// abortError marks an error which has already been given to the ErrorHandler
+// (and which it decided should halt everything), so that it isn't offered again
+// as it propagates up through each parent directory.
+type abortError struct {
+	error
+}
+
+// unwrapAbort returns the error inside an abortError, or any other error as it is.
+func unwrapAbort(err error) error {
+	if aborted, ok := err.(abortError); ok {
+		return aborted.error
+	}
+	return err
+}
+
+// handleChildError consults the ErrorHandler about an error that occurred while hashing a directory entry.
+// It returns nil if the entry should be skipped, or the error that should halt hashing.
+func (h *hasher) handleChildError(pth string, err error) error {
+	if _, ok := err.(abortError); ok {
+		return err
+	}
+	if h.opts.ErrorHandler == nil {
+		return abortError{err}
+	}
+	h.mu.Lock()
+	err = h.opts.ErrorHandler(pth, err)
+	h.mu.Unlock()
+	if err != nil {
+		return abortError{err}
+	}
+	h.auditSkip(pth)
+	return nil
+}
+
 // hashSomething figures out what kind of file the given parameters point to,
-// hashes it appropriately, and writes the raw hash bytes to the given writer.
+// hashes it appropriately, and returns the raw hash bytes.
 //
 // It returns the filemode of what was encountered, because the caller tends to
 // need that information again when composing tree objects.
@@ -52,135 +1181,678 @@ const (
 //   - gittreehash-error-unsupported-file-type -- if the filesystem contains
 //       files that git doesn't have a description of: sockets, device nodes, etc.
 //   - gittreehash-error-io -- if any raw IO barfs while we're scanning the filesystem.
+//   - gittreehash-error-permission -- if IO failed due to permissions.
 //   - gittreehash-error-concurrent-io -- if any inconsistencies are detected which
 //       likely arose from concurrent filesystem changes during the hashing.
 //       May also be triggered if a filesystem incorrectly reports file size.
+//   - gittreehash-error-symlink-cycle -- if a directory contains itself.
+//   - gittreehash-error-too-deep -- if the hierarchy is deeper than Options.MaxDepth.
+//   - gittreehash-error-not-found -- if there's nothing at the starting path.
+//       (Entries which vanish after being listed in their parent directory are reported as concurrent-io instead.)
+//   - any error returned by Options.ErrorHandler (wrapped in abortError).
+func (h *hasher) hashSomething(pth string, anc *ancestry) ([32]byte, fs.FileMode, error) {
+	fi, err := fsx.Lstat(h.fsys, pth)
+	if err != nil {
+		if isVanished(err) {
+			if anc == nil {
+				return [32]byte{}, 0, NewErrNotFound(pth)
+			}
+			return [32]byte{}, 0, NewErrVanished(pth)
+		}
+		return [32]byte{}, 0, newErrIO(err)
+	}
+	return h.hashEntry(pth, fi, anc)
+}
+
+// hashChild is hashSomething for an entry listed by listTree.
+// The FileInfo the directory listing gave is used, rather than asking the filesystem again,
+// which saves a call per entry on filesystems that return it along with the listing.
+// An entry that has vanished since is given a null hash instead, if Options.OnVanished is set.
+//
+// Errors:
 //
-func hashSomething(fsys fsx.FS, pth string) ([32]byte, fs.FileMode, error) {
-	fi, err := fsx.Lstat(fsys, pth)
+//   - as for hashSomething, except gittreehash-error-not-found.
+func (h *hasher) hashChild(child treeChild, anc *ancestry) ([32]byte, fs.FileMode, error) {
+	fi, err := child.dirEnt.Info()
 	if err != nil {
-		return [32]byte{}, 0, serum.Errorf(ErrIO, "%w", err)
+		if isVanished(err) {
+			err = NewErrVanished(child.path)
+		} else {
+			return [32]byte{}, 0, newErrIO(err)
+		}
+	} else {
+		var hash [32]byte
+		var mode fs.FileMode
+		if hash, mode, err = h.hashEntry(child.path, fi, anc); err == nil {
+			return hash, mode, nil
+		}
+	}
+	if h.opts.OnVanished != nil && isVanishedEntry(err, child.path) {
+		hash, mode := h.nullHashVanished(child)
+		return hash, mode, nil
 	}
+	return [32]byte{}, 0, err
+}
+
+// hashEntry is the body of hashSomething, given the FileInfo (as from Lstat) of what's at the path.
+func (h *hasher) hashEntry(pth string, fi fs.FileInfo, anc *ancestry) ([32]byte, fs.FileMode, error) {
+	fsys := h.fsys
+	h.auditNote(pth, fi)
 	mode := fi.Mode()
+	if h.opts.NamesOnly && (mode.IsRegular() || mode&fs.ModeType == fs.ModeSymlink) {
+		hash, mode := h.hashName(pth, fi, anc)
+		return hash, mode, nil
+	}
 	switch mode & fs.ModeType {
 	case 0: // https://git-scm.com/book/en/v2/Git-Internals-Git-Objects
-		claimedSize := fi.Size()
-		var preamble bytes.Buffer
-		preamble.WriteString("blob ")
-		preamble.WriteString(strconv.Itoa(int(claimedSize)))
-		preamble.WriteByte(0)
-		preambleLen := preamble.Len()
-
-		f, err2 := fsys.Open(pth)
-		if err2 != nil {
-			return [32]byte{}, mode, serum.Errorf(ErrIO, "%w", err2)
-		}
-		defer f.Close()
-		hash, coveredSize, err := hashStream(io.MultiReader(&preamble, f))
-		if err != nil {
-			return [32]byte{}, mode, err
+		hash, mode, err := h.hashFile(pth, fi, anc)
+		for attempt := 0; attempt < h.opts.RereadChanged && isSizeChanged(err); attempt++ {
+			// The file changed size while we read it.  If it's still a file, it might settle down if we try again.
+			h.mu.Lock()
+			h.opts.Stats.Rereads++
+			h.mu.Unlock()
+			if fi, err = fsx.Lstat(fsys, pth); err != nil {
+				return [32]byte{}, mode, NewErrVanished(pth)
+			}
+			if !fi.Mode().IsRegular() {
+				return [32]byte{}, mode, NewErrFileChanged(pth, "a regular file", describeFileInfo(fi))
+			}
+			h.auditNote(pth, fi)
+			hash, mode, err = h.hashFile(pth, fi, anc)
 		}
-
-		contentSize := coveredSize - int64(preambleLen)
-		if contentSize != claimedSize {
-			return hash, mode, serum.Errorf(ErrConcurrentIO, "expected file size %d but read %d bytes at path %q", claimedSize, contentSize, pth)
+		if err == nil {
+			h.mu.Lock()
+			h.opts.Stats.FileSizes.Add(fi.Size())
+			h.mu.Unlock()
 		}
-
-		return hash, mode, nil
+		return hash, mode, err
 	case fs.ModeSymlink: // the target is treated as a blob; only the way they're written into the parent tree differs.
 		claimedSize := fi.Size()
-		var preamble bytes.Buffer
-		preamble.WriteString("blob ")
-		preamble.WriteString(strconv.Itoa(int(claimedSize)))
-		preamble.WriteByte(0)
-		preambleLen := preamble.Len()
-
 		target, err := fsx.Readlink(fsys, pth)
 		if err != nil {
+			if isVanished(err) {
+				return [32]byte{}, mode, NewErrVanished(pth)
+			}
 			return [32]byte{}, mode, serum.Errorf(ErrConcurrentIO, "found symlink at path %q but readlink failed: %w", pth, err)
 		}
-		hash, coveredSize, err := hashStream(io.MultiReader(&preamble, strings.NewReader(target)))
-		if err != nil {
-			panic("unreachable; all data already in memory")
-		}
+		hash := h.opts.Algorithm.hashObject("blob", []byte(target))
 
-		contentSize := coveredSize - int64(preambleLen)
+		contentSize := int64(len(target))
 		if contentSize != claimedSize {
 			return hash, mode, serum.Errorf(ErrConcurrentIO, "expected file size %d but read %d bytes at path %q", claimedSize, contentSize, pth)
 		}
 
+		h.emit(pth, hash, mode, contentSize)
 		return hash, mode, nil
 	case fs.ModeDir: // https://stackoverflow.com/questions/14790681/what-is-the-internal-format-of-a-git-tree-object
-		dirEnts, err := fsx.ReadDir(fsys, pth)
+		anc, children, err := h.listTree(anc, pth, fi)
 		if err != nil {
-			return [32]byte{}, mode, serum.Errorf(ErrIO, "%w", err)
+			return [32]byte{}, mode, err
 		}
-		// TODO: check if the sorting is correct, here.
-		var buf bytes.Buffer // Buffer to accumulate all the child object info and hashes, first.  Need this so we can compute the length of the whole tree object body.
-		for _, dirEnt := range dirEnts {
-			hash, dirEntMode, err := hashSomething(fsys, filepath.Join(pth, dirEnt.Name()))
-			if err != nil {
-				return [32]byte{}, mode, err
+		// Children may be hashed concurrently, so results are gathered by index, and the tree is assembled in order afterwards.
+		results := make([]childResult, len(children))
+		advance, stopPrefetch := h.prefetch(anc, children)
+		var wg sync.WaitGroup
+		for i, child := range children {
+			if h.aborted() != nil {
+				break
 			}
-			switch dirEntMode & fs.ModeType {
-			case 0:
-				if dirEntMode&0o111 != 0 {
-					buf.Write([]byte("100755 "))
-				} else {
-					buf.Write([]byte("100644 "))
+			advance()
+			child, result := child, &results[i]
+			h.spawn(&wg, func() {
+				hash, dirEntMode, err := h.hashChild(child, anc)
+				if err != nil {
+					if err := h.handleChildError(child.path, err); err != nil {
+						h.abort(err)
+					}
+					return
+				}
+				*result = childResult{child.name, hash, dirEntMode}
+			})
+		}
+		wg.Wait()
+		stopPrefetch()
+		if err := h.aborted(); err != nil {
+			return [32]byte{}, mode, err
+		}
+		buf := getTreeBuffer() // Buffer to accumulate all the child object info and hashes, first.  Need this so we can compute the length of the whole tree object body.
+		defer putTreeBuffer(buf)
+		var spill *treeSpill // Only if the body grows beyond Options.TreeSpillThreshold.
+		defer func() {
+			if spill != nil {
+				spill.close()
+			}
+		}()
+		for _, result := range results {
+			if result.name != "" {
+				h.writeTreeEntry(buf, result.name, result.mode, result.hash)
+				if spill, err = h.spillTreeBody(spill, buf); err != nil {
+					return [32]byte{}, mode, err
 				}
-			case fs.ModeSymlink:
-				buf.Write([]byte("120000 "))
-			case fs.ModeDir:
-				buf.Write([]byte("40000 ")) // This certainly looks like a typo, doesn't it!  But, indeed... this is exactly how git encodes this.
-			default:
-				panic("unreachable?  other types should've error earlier")
 			}
-			buf.Write([]byte(dirEnt.Name()))
-			buf.Write([]byte{0})
-			buf.Write(hash[:])
-			// Somewhat shockingly, there's no delimiter here.  The hash length is necessary hardcoded by this absense.
 		}
-
-		var preamble bytes.Buffer
-		preamble.WriteString("tree ")
-		preamble.WriteString(strconv.Itoa(buf.Len()))
-		preamble.WriteByte(0)
-		hash, _, err := hashStream(io.MultiReader(&preamble, &buf))
-		if err != nil {
-			panic("unreachable; all data already in memory")
+		if spill != nil {
+			hash, bodyLen, err := h.hashSpilledTree(spill, buf)
+			if err != nil {
+				return [32]byte{}, mode, err
+			}
+			h.emit(pth, hash, mode, bodyLen)
+			return hash, mode, nil
 		}
 
+		bodyLen := buf.Len()
+		hash := h.hashTreeBody(pth, buf)
+		h.emit(pth, hash, mode, int64(bodyLen))
 		return hash, mode, nil
 	case fs.ModeNamedPipe:
-		return [32]byte{}, mode, NewErrUnsupportedFileType("pipe", pth)
+		if !h.opts.AllowPipes {
+			return [32]byte{}, mode, NewErrUnsupportedFileType("pipe", pth)
+		}
+		// There's no size to put in the preamble until we've read everything, so we have to buffer it all first.
+		content, err := h.readPipe(pth)
+		if err != nil {
+			return [32]byte{}, mode, err
+		}
+		mode &^= fs.ModeType // Report it as a regular file, since that's what it becomes in the tree.
+		hash := h.hashBlobBytes(content)
+		h.emit(pth, hash, mode, int64(len(content)))
+		return hash, mode, nil
 	case fs.ModeSocket:
 		return [32]byte{}, mode, NewErrUnsupportedFileType("socket", pth)
 	case fs.ModeDevice, fs.ModeCharDevice:
 		return [32]byte{}, mode, NewErrUnsupportedFileType("device", pth)
 	case fs.ModeIrregular:
+		// Windows reports some reparse points (such as junctions) as irregular files, as may the filesystem of an --fs-plugin,
+		// but they can still be read like symlinks.
+		if target, err := fsx.Readlink(fsys, pth); err == nil {
+			mode = fs.ModeSymlink | mode.Perm()
+			hash := h.hashBlobBytes([]byte(filepath.ToSlash(target)))
+			h.emit(pth, hash, mode, int64(len(target)))
+			return hash, mode, nil
+		}
 		return [32]byte{}, mode, NewErrUnsupportedFileType("irregular", pth)
 	default:
 		panic("unreachable?  'irregular' should be the catch-all here")
 	}
 }
 
-func hashStream(data io.Reader) (hash [32]byte, contentSize int64, err error) {
-	h := sha256.New()
-	contentSize, err2 := io.Copy(h, data)
+// treeChild is a directory entry which belongs in the directory's tree object.
+type treeChild struct {
+	name   string // As recorded in the tree, after any normalization.
+	path   string
+	dirEnt fs.DirEntry
+}
+
+// listTree reads the directory at pth (as described by the given FileInfo from Lstat),
+// and returns the ancestry for its contents, and the entries which belong in its tree, in tree order.
+// Excluded entries are left out.
+//
+// Errors:
+//
+//   - gittreehash-error-name-collision -- if two entries have the same name after normalization,
+//       and the ErrorHandler doesn't skip the second (in which case, it's wrapped in abortError).
+//   - gittreehash-error-concurrent-io -- if the directory vanishes before it can be read.
+//   - gittreehash-error-io -- if reading the directory fails.
+//   - gittreehash-error-permission -- if reading the directory fails due to permissions.
+//   - any error descend may return.
+func (h *hasher) listTree(anc *ancestry, pth string, fi fs.FileInfo) (*ancestry, []treeChild, error) {
+	anc, err := h.descend(anc, pth, fi)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.acquireFile()
+	dirEnts, err := fsx.ReadDir(h.fsys, pth)
+	h.releaseFile()
+	if err != nil {
+		if isVanished(err) {
+			return nil, nil, NewErrVanished(pth)
+		}
+		return nil, nil, newErrIO(err)
+	}
+	h.sortTreeEntries(dirEnts)
+	var seen map[string]string // Only needed to catch collisions when names are normalized.
+	if h.opts.UnicodeNormalization != NormalizeNone || h.opts.CaseFold {
+		seen = make(map[string]string, len(dirEnts))
+	}
+	children := make([]treeChild, 0, len(dirEnts))
+	for _, dirEnt := range dirEnts {
+		dirEnt := &infoOnceDirEntry{DirEntry: dirEnt}
+		childPath := filepath.Join(pth, dirEnt.Name())
+		if h.excluded(anc, childPath, dirEnt) {
+			continue
+		}
+		name := h.treeName(dirEnt.Name())
+		if seen != nil {
+			if other, ok := seen[name]; ok {
+				if err := h.handleChildError(childPath, NewErrNameCollision(pth, other, dirEnt.Name())); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			seen[name] = dirEnt.Name()
+		}
+		children = append(children, treeChild{name, childPath, dirEnt})
+	}
+	return anc, children, nil
+}
+
+// infoOnceDirEntry remembers the result of Info, so that filters and hashing can both consult it
+// without the filesystem being asked twice.  (os.ReadDir's entries, for one, call Lstat every time.)
+type infoOnceDirEntry struct {
+	fs.DirEntry
+	once sync.Once
+	fi   fs.FileInfo
+	err  error
+}
+
+func (e *infoOnceDirEntry) Info() (fs.FileInfo, error) {
+	e.once.Do(func() { e.fi, e.err = e.DirEntry.Info() })
+	return e.fi, e.err
+}
+
+// hashFile hashes a regular file (as described by the given FileInfo from Lstat) as a blob,
+// applying any content conversions the options call for.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if any raw IO barfs while reading the file.
+//   - gittreehash-error-permission -- if IO failed due to permissions.
+//   - gittreehash-error-concurrent-io -- if the file vanishes, is swapped for another, or changes size while being read.
+func (h *hasher) hashFile(pth string, fi fs.FileInfo, anc *ancestry) ([32]byte, fs.FileMode, error) {
+	mode := fi.Mode()
+	if h.opts.SymlinksAsText != nil && h.opts.SymlinksAsText(pth) {
+		return h.hashTextSymlink(pth, fi)
+	}
+	claimedSize := fi.Size()
+	if mode.IsRegular() && claimedSize == 0 {
+		// Every conversion leaves empty content empty, so there's no need to open anything.
+		hash := emptyBlobHash[h.opts.Algorithm]
+		h.emit(pth, hash, mode, 0)
+		return hash, mode, nil
+	}
+	lfs, action := h.isLFS(anc, pth), h.eolActionFor(anc, pth)
+	if mode.IsRegular() {
+		if hash, ok := h.indexDigest(anc, pth, fi, lfs, action); ok {
+			h.mu.Lock()
+			h.opts.Stats.IndexHits++
+			h.mu.Unlock()
+			h.emit(pth, hash, mode, claimedSize)
+			return hash, mode, nil
+		}
+	}
+	// When content is hashed as-is, another hard link to the same file may already have been hashed,
+	// or the file may be unchanged since a previous run.
+	asIs := !lfs && action == eolAsIs
+	var memoKey blobMemoKey
+	var memoOK bool
+	if asIs {
+		if memoKey, memoOK = blobMemoKeyFor(fi); memoOK {
+			if hash, ok := h.memoizedBlob(memoKey); ok {
+				h.emit(pth, hash, mode, claimedSize)
+				return hash, mode, nil
+			}
+		}
+	}
+	useCache := asIs && h.opts.Cache != nil && mode.IsRegular()
+	if useCache && !h.opts.CacheRewrite {
+		if hash, ok := h.opts.Cache.lookup(pth, fi); ok {
+			h.mu.Lock()
+			h.opts.Stats.CacheHits++
+			h.mu.Unlock()
+			if memoOK {
+				h.memoizeBlob(memoKey, hash)
+			}
+			h.emit(pth, hash, mode, claimedSize)
+			return hash, mode, nil
+		}
+	}
+	h.acquireFile()
+	defer h.releaseFile() // Deferred before the Close, so it runs after it.
+	f, err2 := h.openFile(pth)
+	if err2 != nil {
+		if isVanished(err2) {
+			return [32]byte{}, mode, NewErrVanished(pth)
+		}
+		return [32]byte{}, mode, newErrIO(err2)
+	}
+	defer f.Close()
+	if err := checkSameFile(pth, fi, f); err != nil {
+		return [32]byte{}, mode, err
+	}
+	var body io.Reader = f
+	if h.opts.DropCache {
+		adviseSequential(f)
+		defer adviseDontNeed(f, 0, 0) // Whatever the drop-behind reader didn't get to, or other paths read.
+		body = &dropBehindReader{f: f}
+	}
+	if h.rate != nil {
+		body = &rateLimitedReader{r: body, l: h.rate}
+	}
+	if lfs {
+		hash, size, err := h.hashLFSPointer(pth, body, claimedSize)
+		if err != nil {
+			return [32]byte{}, mode, err
+		}
+		h.emit(pth, hash, mode, size)
+		return hash, mode, nil
+	}
+	if action != eolAsIs {
+		// Conversion may change the size, so the whole file has to be read before the preamble can be written.
+		content, err := io.ReadAll(body)
+		if err != nil {
+			return [32]byte{}, mode, newErrIO(err)
+		}
+		if int64(len(content)) != claimedSize {
+			return [32]byte{}, mode, NewErrSizeChanged(pth, claimedSize, int64(len(content)))
+		}
+		content = convertEOL(content, action)
+		hash := h.hashBlobBytes(content)
+		h.emit(pth, hash, mode, int64(len(content)))
+		return hash, mode, nil
+	}
+	var hash [32]byte
+	var contentSize int64
+	var err error
+	mapped := false
+	if h.opts.Sparse && mode.IsRegular() && h.rate == nil {
+		if hash, mapped, err = h.hashSparse(pth, f, fi, claimedSize); err != nil {
+			return [32]byte{}, mode, err
+		}
+		contentSize = claimedSize
+	}
+	if !mapped && h.opts.MmapThreshold > 0 && claimedSize >= h.opts.MmapThreshold && mode.IsRegular() && h.rate == nil {
+		if hash, mapped, err = h.hashMmap(pth, f, claimedSize); err != nil {
+			return [32]byte{}, mode, err
+		}
+		contentSize = claimedSize
+	}
+	if !mapped {
+		if hash, contentSize, err = h.hashObjectStream("blob", claimedSize, body); err != nil {
+			return [32]byte{}, mode, err
+		}
+	}
+
+	if contentSize != claimedSize {
+		return hash, mode, NewErrSizeChanged(pth, claimedSize, contentSize)
+	}
+	if memoOK {
+		h.memoizeBlob(memoKey, hash)
+	}
+	if useCache {
+		h.opts.Cache.store(pth, fi, hash)
+	}
+
+	h.emit(pth, hash, mode, contentSize)
+	return hash, mode, nil
+}
+
+// writeTreeEntry appends one entry to the body of a tree object.
+func (h *hasher) writeTreeEntry(buf *bytes.Buffer, name string, mode fs.FileMode, hash [32]byte) {
+	buf.WriteString(h.gitMode(mode))
+	buf.WriteByte(' ')
+	buf.WriteString(name)
+	buf.WriteByte(0)
+	buf.Write(hash[:h.opts.Algorithm.Size()])
+	// Somewhat shockingly, there's no delimiter here.  The hash length is necessary hardcoded by this absense.
+}
+
+// hashTreeBody hashes a tree object, given its body (as accumulated by writeTreeEntry).
+// The buffer is consumed.
+func (h *hasher) hashTreeBody(pth string, buf *bytes.Buffer) [32]byte {
+	if h.onTreeBody != nil {
+		h.mu.Lock()
+		h.onTreeBody(pth, buf.Bytes())
+		h.mu.Unlock()
+	}
+	if hash, ok := h.memoizedTree(buf.Bytes()); ok {
+		return hash
+	}
+	hash := h.opts.Algorithm.hashObject("tree", buf.Bytes())
+	h.memoizeTree(buf.Bytes(), hash)
+	return hash
+}
+
+// readPipe reads all the content from a named pipe, with a timeout if PipeTimeout is set.
+//
+// Errors:
+//
+//   - gittreehash-error-pipe-timeout -- if PipeTimeout elapses.
+//   - gittreehash-error-io -- if opening or reading the pipe fails.
+//   - gittreehash-error-permission -- if opening or reading the pipe fails due to permissions.
+//   - gittreehash-error-concurrent-io -- if the pipe vanishes before it can be opened.
+func (h *hasher) readPipe(pth string) ([]byte, error) {
+	h.acquireFile()
+	defer h.releaseFile()
+	if h.opts.PipeTimeout > 0 {
+		return h.readPipeWithTimeout(pth, h.opts.PipeTimeout)
+	}
+	f, err := h.fsys.Open(pth)
+	if err != nil {
+		if isVanished(err) {
+			return nil, NewErrVanished(pth)
+		}
+		return nil, newErrIO(err)
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, newErrIO(err)
+	}
+	return content, nil
+}
+
+// sortTreeEntries sorts directory entries into the order git requires in tree objects.
+// This is almost bytewise order of the names (which is what ReadDir gives us),
+// except that git compares directory names as if they had a trailing slash:
+// so, for example, "foo.txt" sorts before a directory named "foo", because '.' is less than '/'.
+func (h *hasher) sortTreeEntries(dirEnts []fs.DirEntry) {
+	sort.SliceStable(dirEnts, func(i, j int) bool {
+		return treeEntrySortKey(h.treeName(dirEnts[i].Name()), dirEnts[i].IsDir()) < treeEntrySortKey(h.treeName(dirEnts[j].Name()), dirEnts[j].IsDir())
+	})
+}
+
+func treeEntrySortKey(name string, isDir bool) string {
+	if isDir {
+		return name + "/"
+	}
+	return name
+}
+
+// hashBlobBytes hashes content that's already entirely in memory as a blob.
+func (h *hasher) hashBlobBytes(content []byte) [32]byte {
+	return h.opts.Algorithm.hashObject("blob", content)
+}
+
+// emit reports a freshly hashed object to Options.OnEntry, if it's set.
+func (h *hasher) emit(pth string, hash [32]byte, mode fs.FileMode, size int64) {
+	h.mu.Lock()
+	h.countObject(hash, mode.IsDir(), size)
+	h.mu.Unlock()
+	if h.opts.OnEntry == nil {
+		return
+	}
+	e := Entry{Path: pth, Hash: hash[:h.opts.Algorithm.Size()], Mode: mode, GitMode: h.gitMode(mode), Type: "blob", Size: size}
+	if mode.IsDir() {
+		e.Type = "tree"
+		e.GitMode = "0" + e.GitMode
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.opts.OnEntry(e)
+}
+
+// gitMode returns the mode string that git uses for an entry in a tree object,
+// given the mode that hashSomething reported for it.
+func (h *hasher) gitMode(mode fs.FileMode) string {
+	switch mode & fs.ModeType {
+	case 0:
+		if mode&0o111 != 0 && !h.opts.IgnoreFileMode {
+			return "100755"
+		}
+		return "100644"
+	case fs.ModeSymlink:
+		return "120000"
+	case fs.ModeDir:
+		return "40000" // This certainly looks like a typo, doesn't it!  But, indeed... this is exactly how git encodes this.
+	default:
+		panic("unreachable?  other types should've error earlier")
+	}
+}
+
+// hashObjectStream hashes a git object whose body is read from a stream, which is expected to be of the given size.
+// It's the streaming counterpart of Algorithm.hashObject; since the preamble is written before the body is read,
+// the caller must check the returned contentSize against the expected size, and treat a mismatch as an error.
+func (h *hasher) hashObjectStream(objectType string, size int64, body io.Reader) (hash [32]byte, contentSize int64, err error) {
+	digester := h.opts.Algorithm.New()
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	digester.Write(appendObjectPreamble((*bufp)[:0], objectType, size))
+	// The struct hides any WriterTo method the reader has (as *os.File does), which io.CopyBuffer would use instead of our buffer.
+	contentSize, err2 := io.CopyBuffer(digester, struct{ io.Reader }{body}, *bufp)
 	if err2 != nil {
-		err = serum.Errorf(ErrIO, "%w", err2)
+		err = newErrIO(err2)
 		return
 	}
-	h.Sum(hash[:0])
+	digester.Sum(hash[:0])
 	return
 }
 
+// checkSameFile stats an opened file and checks that it is still the same kind of thing
+// (and, where the platform reports it, the very same inode) that an earlier Lstat saw.
+// If something swapped the path out from under us in between, we'd otherwise hash the wrong thing.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if stat on the open file fails.
+//   - gittreehash-error-concurrent-io -- if the opened file isn't the one we lstat'd.
+func checkSameFile(pth string, lstatFi fs.FileInfo, f fs.File) error {
+	openFi, err := f.Stat()
+	if err != nil {
+		return newErrIO(err)
+	}
+	if lstatFi.Mode().Type() != openFi.Mode().Type() {
+		return NewErrFileChanged(pth, describeFileInfo(lstatFi), describeFileInfo(openFi))
+	}
+	lDev, lIno, ok1 := fileIdentity(lstatFi)
+	oDev, oIno, ok2 := fileIdentity(openFi)
+	if ok1 && ok2 && (lDev != oDev || lIno != oIno) {
+		return NewErrFileChanged(pth, describeFileInfo(lstatFi), describeFileInfo(openFi))
+	}
+	return nil
+}
+
+// describeFileInfo renders the parts of a FileInfo that are interesting when reporting a concurrent change.
+func describeFileInfo(fi fs.FileInfo) string {
+	if dev, ino, ok := fileIdentity(fi); ok {
+		return fmt.Sprintf("mode=%s size=%d dev=%d ino=%d", fi.Mode(), fi.Size(), dev, ino)
+	}
+	return fmt.Sprintf("mode=%s size=%d", fi.Mode(), fi.Size())
+}
+
+// newErrIO wraps an error from the filesystem,
+// picking a more specific error code than gittreehash-error-io if it's recognizable.
+// Errors which already have a code (as some filesystems, like s3FS, return) are returned as they are.
+//
+// Errors:
+//
+//   - gittreehash-error-permission -- if the error was due to EACCES or EPERM.
+//   - gittreehash-error-io -- otherwise.
+func newErrIO(err error) error {
+	if _, ok := err.(serum.ErrorInterface); ok {
+		return err
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return serum.Errorf(ErrPermission, "%w", err)
+	}
+	return serum.Errorf(ErrIO, "%w", err)
+}
+
+// withPathBytes goes alongside a path detail in an error.
+// Error details end up in JSON, which can't carry bytes that aren't valid UTF-8 (they're replaced with U+FFFD);
+// so for a path that isn't valid UTF-8, this adds another detail, named with a "Base64" suffix, holding the exact bytes.
+// For any other path it adds nothing.
+func withPathBytes(key, pth string) serum.WithConstruction {
+	if utf8.ValidString(pth) {
+		return serum.WithConstruction{}
+	}
+	return serum.WithDetail(key+"Base64", base64.StdEncoding.EncodeToString([]byte(pth)))
+}
+
+func NewErrFileChanged(pth string, before, after string) error {
+	return serum.Error(
+		ErrConcurrentIO,
+		serum.WithMessageTemplate("file at {{path}} changed between lstat and open: first saw ({{before}}), then saw ({{after}})"),
+		serum.WithDetail("path", pth),
+		withPathBytes("path", pth),
+		serum.WithDetail("before", before),
+		serum.WithDetail("after", after),
+	)
+}
+
+func NewErrSizeChanged(pth string, expected, actual int64) error {
+	return serum.Error(
+		ErrConcurrentIO,
+		serum.WithMessageTemplate("expected file size {{expectedSize}} but read {{actualSize}} bytes at path {{path}}"),
+		serum.WithDetail("path", pth),
+		withPathBytes("path", pth),
+		serum.WithDetail("expectedSize", strconv.FormatInt(expected, 10)),
+		serum.WithDetail("actualSize", strconv.FormatInt(actual, 10)),
+	)
+}
+
+// isSizeChanged reports whether an error is one produced by NewErrSizeChanged.
+func isSizeChanged(err error) bool {
+	return serum.Code(err) == ErrConcurrentIO && serum.Detail(err, "expectedSize") != ""
+}
+
+func NewErrNotFound(pth string) error {
+	return serum.Error(
+		ErrNotFound,
+		serum.WithMessageTemplate("nothing exists at {{path}}"),
+		serum.WithDetail("path", pth),
+		withPathBytes("path", pth),
+	)
+}
+
+// isVanished reports whether an error means there's nothing at a path:
+// either it doesn't exist, or one of its parents is no longer a directory.
+// Since errors from the walk are about entries that were just listed, either means something changed underfoot.
+func isVanished(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// NewErrVanished reports an entry which was listed in its parent directory but then couldn't be found.
+// The parent directory and the entry's name are given as separate details, as well as the whole path.
+func NewErrVanished(pth string) error {
+	parent, entry := filepath.Dir(pth), filepath.Base(pth)
+	return serum.Error(
+		ErrConcurrentIO,
+		serum.WithMessageTemplate("file at {{path}} disappeared while hashing"),
+		serum.WithDetail("path", pth),
+		withPathBytes("path", pth),
+		serum.WithDetail("parent", parent),
+		withPathBytes("parent", parent),
+		serum.WithDetail("entry", entry),
+		withPathBytes("entry", entry),
+	)
+}
+
+func NewErrPipeTimeout(pth string, timeout time.Duration) error {
+	return serum.Error(
+		ErrPipeTimeout,
+		serum.WithMessageTemplate("timed out after {{timeout}} reading named pipe at {{path}}"),
+		serum.WithDetail("path", pth),
+		withPathBytes("path", pth),
+		serum.WithDetail("timeout", timeout.String()),
+	)
+}
+
 func NewErrUnsupportedFileType(typ string, pth string) error {
 	return serum.Error(
 		ErrUnsupportedFileType,
 		serum.WithMessageTemplate("git hashes can not describe {{type}} files; found one at {{path}}"),
 		serum.WithDetail("type", typ),
 		serum.WithDetail("path", pth),
+		withPathBytes("path", pth),
 	)
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/fs"
+)
+
+// blobMemoKey identifies a file's content well enough to reuse its digest for other hard links to it, within one run.
+// The size and modification time are included so that a file which changed in between can't be mistaken for its old self.
+type blobMemoKey struct {
+	dev, ino uint64
+	size     int64
+	mtime    int64 // Nanoseconds.
+}
+
+// blobMemoKeyFor returns the memoization key for a file, and false if the file can't be memoized:
+// either because the filesystem doesn't expose inode numbers and link counts, or because the file only has one link,
+// in which case there's nothing to gain (and no point filling memory with entries that will never be looked up).
+func blobMemoKeyFor(fi fs.FileInfo) (blobMemoKey, bool) {
+	dev, ino, ok := fileIdentity(fi)
+	if !ok || ino == 0 {
+		return blobMemoKey{}, false
+	}
+	if nlink, ok := fileLinkCount(fi); !ok || nlink < 2 {
+		return blobMemoKey{}, false
+	}
+	return blobMemoKey{dev, ino, fi.Size(), fi.ModTime().UnixNano()}, true
+}
+
+func (h *hasher) memoizedBlob(key blobMemoKey) ([32]byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hash, ok := h.blobMemo[key]
+	if ok {
+		h.opts.Stats.HardLinkHits++
+	}
+	return hash, ok
+}
+
+func (h *hasher) memoizeBlob(key blobMemoKey, hash [32]byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.blobMemo == nil {
+		h.blobMemo = make(map[blobMemoKey][32]byte)
+	}
+	h.blobMemo[key] = hash
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// sizeBucketBounds are the exclusive upper bounds of each bucket of a SizeHistogram but the last,
+// which holds everything larger.  (KB here means 1024 bytes.)
+var sizeBucketBounds = [...]struct {
+	limit int64
+	label string
+}{
+	{1 << 10, "<1KB"},
+	{10 << 10, "1KB-10KB"},
+	{100 << 10, "10KB-100KB"},
+	{1 << 20, "100KB-1MB"},
+	{10 << 20, "1MB-10MB"},
+	{100 << 20, "10MB-100MB"},
+	{1 << 30, "100MB-1GB"},
+}
+
+// SizeHistogram counts files by size, in buckets whose bounds go up by powers of ten:
+// less than 1KB, 1KB to 10KB, and so on, with everything of 1GB or more in the last bucket.
+type SizeHistogram [len(sizeBucketBounds) + 1]int
+
+// Add counts one file of the given size.
+func (hist *SizeHistogram) Add(size int64) {
+	for i, b := range sizeBucketBounds {
+		if size < b.limit {
+			hist[i]++
+			return
+		}
+	}
+	hist[len(sizeBucketBounds)]++
+}
+
+// Write prints the histogram as a fixed-width table, one line per bucket, including empty buckets.
+func (hist *SizeHistogram) Write(w io.Writer) error {
+	for i, n := range hist {
+		label := ">=1GB"
+		if i < len(sizeBucketBounds) {
+			label = sizeBucketBounds[i].label
+		}
+		if _, err := fmt.Fprintf(w, "%-11s %10d files\n", label+":", n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// LFSMode selects how files managed by Git LFS are hashed.  See Options.LFS.
+type LFSMode uint8
+
+const (
+	LFSContent  LFSMode = iota // Hash files as found, whether they're LFS pointers or smudged content.
+	LFSPointers                // Hash LFS-managed files as the pointer git would store, computing it from the content if necessary.
+)
+
+// lfsPointerPrefix is how every LFS pointer file begins.
+// Pointer files are also required to be smaller than lfsPointerMaxSize.
+const (
+	lfsPointerPrefix  = "version https://git-lfs.github.com/spec/v1\n"
+	lfsPointerMaxSize = 1024
+)
+
+// isLFS reports whether a file is managed by Git LFS (and the options ask us to care).
+func (h *hasher) isLFS(anc *ancestry, pth string) bool {
+	if h.opts.LFS != LFSPointers {
+		return false
+	}
+	attrs := h.attributesFor(anc, pth, false, "filter")
+	return attrs["filter"].Value == "lfs"
+}
+
+// hashLFSPointer hashes an LFS-managed file as the pointer that git would store for it.
+// If the file already is a pointer (i.e. it hasn't been smudged), it's hashed as-is;
+// otherwise the whole content is read to compute the pointer's oid.
+// It returns the pointer's hash and length.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if reading the file fails.
+//   - gittreehash-error-concurrent-io -- if the file's length changes while reading.
+func (h *hasher) hashLFSPointer(pth string, r io.Reader, claimedSize int64) ([32]byte, int64, error) {
+	if claimedSize < lfsPointerMaxSize {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return [32]byte{}, 0, newErrIO(err)
+		}
+		if int64(len(content)) != claimedSize {
+			return [32]byte{}, 0, NewErrSizeChanged(pth, claimedSize, int64(len(content)))
+		}
+		if bytes.HasPrefix(content, []byte(lfsPointerPrefix)) {
+			return h.hashBlobBytes(content), int64(len(content)), nil
+		}
+		r = bytes.NewReader(content)
+	}
+	oidHasher := sha256.New() // LFS oids are always sha256, regardless of the repository's object format.
+	n, err := io.Copy(oidHasher, r)
+	if err != nil {
+		return [32]byte{}, 0, newErrIO(err)
+	}
+	if n != claimedSize {
+		return [32]byte{}, 0, NewErrSizeChanged(pth, claimedSize, n)
+	}
+	pointer := fmt.Sprintf("%soid sha256:%s\nsize %d\n", lfsPointerPrefix, hex.EncodeToString(oidHasher.Sum(nil)), n)
+	return h.hashBlobBytes([]byte(pointer)), int64(len(pointer)), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/gittreehash/gitindex"
+)
+
+// mainLsIndex implements the ls-index subcommand, which lists the entries of a git index file as git ls-files --stage does.
+func mainLsIndex(args []string) int {
+	fset := flag.NewFlagSet("ls-index", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s ls-index [flags]\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nprints \"<mode> <hash> <stage>\\t<path>\" for each entry in the index, in the index's order, as git ls-files --stage does.\n\n")
+		fset.PrintDefaults()
+	}
+	indexPath := fset.String("index", ".git/index", "path of the git index file to list")
+	showTags := fset.Bool("t", false, "prefix each entry with a tag, as git ls-files -t does: \"M\" for a conflict stage, \"S\" for skip-worktree, and \"H\" otherwise")
+	showValid := fset.Bool("v", false, "like -t, but with the tag in lowercase for entries marked assume-unchanged, as git ls-files -v does")
+	fset.Parse(args)
+	if fset.NArg() != 0 {
+		fset.Usage()
+		return 2
+	}
+
+	idx, err := gitindex.ReadFile(*indexPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	for _, ent := range idx.Entries {
+		tag := ""
+		if *showTags || *showValid {
+			switch {
+			case ent.Stage != 0:
+				tag = "M "
+			case ent.SkipWorktree:
+				tag = "S "
+			default:
+				tag = "H "
+			}
+			if *showValid && ent.AssumeValid {
+				tag = strings.ToLower(tag)
+			}
+		}
+		fmt.Printf("%s%06o %x %d\t%s\n", tag, ent.Mode, ent.Hash, ent.Stage, ent.Path)
+	}
+	return 0
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"time"
+)
+
+// setSymlinkMtime would set the modification time of a symlink itself, but this platform has no way to,
+// so symlinks keep the time they were created.
+func setSymlinkMtime(pth string, t time.Time) error {
+	return nil
+}
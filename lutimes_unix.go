@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setSymlinkMtime sets the modification (and access) time of a symlink itself, rather than of what it points to.
+func setSymlinkMtime(pth string, t time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(t.UnixNano()), unix.NsecToTimespec(t.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, pth, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return newErrIO(err)
+	}
+	return nil
+}
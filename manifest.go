@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const ErrInvalidManifest = "gittreehash-error-invalid-manifest"
+
+// Manifest describes a tree that needn't exist on disk: a list of files and symlinks, each given by its path in the tree.
+// Directories are implied by the paths beneath them; as in git, there's no way to describe an empty one.
+//
+// In JSON (see ReadManifest), a manifest looks like this:
+//
+//	{"entries": [
+//		{"path": "bin/tool", "source": "build/tool", "mode": "0755"},
+//		{"path": "etc/tool.conf", "content": "verbose = true\n"},
+//		{"path": "bin/t", "symlink": "tool"}
+//	]}
+type Manifest struct {
+	Entries []ManifestEntry
+}
+
+// ManifestEntry is a file or symlink in a Manifest.  Exactly one of Content, Source, and Symlink is given.
+type ManifestEntry struct {
+	Path    string  `json:"path"`              // Slash-separated, relative to the root of the tree.
+	Mode    string  `json:"mode,omitempty"`    // Octal permissions, e.g. "0644" or "0755" (or git's "100644" and "100755"); only whether any exec bits are set matters.  Not allowed for symlinks.
+	Content *string `json:"content,omitempty"` // The file's content, given inline.  Mode defaults to "0644".
+	Source  string  `json:"source,omitempty"`  // A file whose content is used, relative to the source directory given to Hash.  Mode defaults to that file's.
+	Symlink string  `json:"symlink,omitempty"` // The entry is a symlink, with this target.
+	Line    int     `json:"-"`                 // The line of the manifest where the entry begins, for reporting problems with it.
+}
+
+// ReadManifest reads a manifest in JSON: an object with an "entries" array, of objects with the fields of ManifestEntry.
+// Each entry's line is recorded, so that later problems with it can say where it is.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-manifest -- if the manifest isn't valid JSON, or has fields that aren't known.
+//   - gittreehash-error-io -- if reading fails.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, newErrIO(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	// Errors from the decoder carry an offset, at best; turn it into a line.
+	fail := func(err error) error {
+		offset := dec.InputOffset()
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			offset = syntaxErr.Offset
+		case errors.As(err, &typeErr):
+			offset = typeErr.Offset
+		case err == io.EOF:
+			err = io.ErrUnexpectedEOF
+		}
+		return newErrInvalidManifest(lineAt(body, offset), err.Error())
+	}
+	expect := func(delim json.Delim) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return fail(err)
+		}
+		if tok != delim {
+			return newErrInvalidManifest(lineAt(body, dec.InputOffset()), fmt.Sprintf("expected %q, found %v", delim, tok))
+		}
+		return nil
+	}
+
+	m := &Manifest{}
+	if err := expect('{'); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, fail(err)
+		}
+		if key != "entries" {
+			return nil, newErrInvalidManifest(lineAt(body, dec.InputOffset()), fmt.Sprintf("unknown field %q", key))
+		}
+		if err := expect('['); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			line := lineAt(body, dec.InputOffset())
+			var e ManifestEntry
+			if err := dec.Decode(&e); err != nil {
+				return nil, fail(err)
+			}
+			e.Line = line
+			m.Entries = append(m.Entries, e)
+		}
+		if err := expect(']'); err != nil {
+			return nil, err
+		}
+	}
+	if err := expect('}'); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, newErrInvalidManifest(lineAt(body, dec.InputOffset()), "unexpected data after the manifest")
+	}
+	return m, nil
+}
+
+// lineAt returns the line number of the first thing at or after an offset in a JSON document,
+// skipping the whitespace and commas between values.
+func lineAt(body []byte, offset int64) int {
+	i := int(offset)
+	for i < len(body) && strings.IndexByte(" \t\r\n,", body[i]) >= 0 {
+		i++
+	}
+	return 1 + bytes.Count(body[:i], []byte{'\n'})
+}
+
+// Hash computes the hash of the tree the manifest describes, as HashPath would give for it once it's put on disk,
+// by feeding its entries to a TreeBuilder for each directory.
+// Source files are read from sourceDir (unless their paths are absolute); symlinks among them are followed.
+//
+// As with TreeBuilder, only Options.Algorithm and Options.IgnoreFileMode affect the result.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-manifest -- if an entry's path is empty, absolute, or climbs out with "..";
+//     or two entries have the same path, or one is beneath another; or a mode is invalid;
+//     or an entry doesn't have exactly one of content, source, and symlink; or a source file doesn't exist, or isn't a regular file.
+//     The error's "line" detail gives the line of the entry.
+//   - gittreehash-error-io -- if reading a source file fails.
+//   - gittreehash-error-permission -- if reading a source file fails due to permissions.
+func (m *Manifest) Hash(sourceDir string, opts Options) ([32]byte, error) {
+	h := newHasher(nil, opts)
+	builders := map[string]*TreeBuilder{"": NewTreeBuilder(opts)}
+	files := map[string]int{} // The line of each entry, by its path.
+	dirs := map[string]int{}  // The line of the first entry beneath each directory.
+	for _, e := range m.Entries {
+		pth, err := cleanVpath(e.Path)
+		if err != nil || strings.HasPrefix(e.Path, "/") {
+			return [32]byte{}, newErrInvalidManifest(e.Line, fmt.Sprintf("path %q must be relative, and within the tree", e.Path))
+		}
+		if strings.IndexByte(pth, 0) >= 0 {
+			return [32]byte{}, newErrInvalidManifest(e.Line, fmt.Sprintf("path %q contains NUL", e.Path))
+		}
+		if line, dup := files[pth]; dup {
+			return [32]byte{}, newErrInvalidManifest(e.Line, fmt.Sprintf("path %q was already given on line %d", pth, line))
+		}
+		if line, ok := dirs[pth]; ok {
+			return [32]byte{}, newErrInvalidManifest(e.Line, fmt.Sprintf("path %q must be a directory, since the entry on line %d is beneath it", pth, line))
+		}
+		for dir := parentVpath(pth); dir != ""; dir = parentVpath(dir) {
+			if line, ok := files[dir]; ok {
+				return [32]byte{}, newErrInvalidManifest(e.Line, fmt.Sprintf("path %q is beneath %q, which is a file given on line %d", pth, dir, line))
+			}
+		}
+		files[pth] = e.Line
+
+		hash, mode, err := e.hash(h, sourceDir)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		parent := builders[""]
+		for dir := parentVpath(pth); dir != ""; dir = parentVpath(dir) {
+			if _, ok := dirs[dir]; !ok {
+				dirs[dir] = e.Line
+				builders[dir] = NewTreeBuilder(opts)
+			}
+		}
+		if dir := parentVpath(pth); dir != "" {
+			parent = builders[dir]
+		}
+		parent.add(path.Base(pth), mode, hash)
+	}
+
+	// Finish the deepest directories first, so that each is done before the one containing it.
+	dirPaths := make([]string, 0, len(builders))
+	for dir := range builders {
+		if dir != "" {
+			dirPaths = append(dirPaths, dir)
+		}
+	}
+	sort.Slice(dirPaths, func(i, j int) bool { return strings.Count(dirPaths[i], "/") > strings.Count(dirPaths[j], "/") })
+	for _, dir := range dirPaths {
+		hash, err := builders[dir].Finish()
+		if err != nil {
+			return [32]byte{}, err
+		}
+		builders[parentVpath(dir)].AddTree(path.Base(dir), hash)
+	}
+	return builders[""].Finish()
+}
+
+// hash returns the blob hash and mode of an entry.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-manifest -- if the mode is invalid, or the entry doesn't have exactly one of content, source, and symlink,
+//     or the source file doesn't exist, or isn't a regular file.
+//   - gittreehash-error-io -- if reading the source file fails.
+//   - gittreehash-error-permission -- if reading the source file fails due to permissions.
+func (e ManifestEntry) hash(h *hasher, sourceDir string) ([32]byte, fs.FileMode, error) {
+	given := 0
+	for _, set := range []bool{e.Content != nil, e.Source != "", e.Symlink != ""} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 {
+		return [32]byte{}, 0, newErrInvalidManifest(e.Line, fmt.Sprintf("entry for %q must have exactly one of content, source, and symlink", e.Path))
+	}
+	switch {
+	case e.Symlink != "":
+		if e.Mode != "" {
+			return [32]byte{}, 0, newErrInvalidManifest(e.Line, fmt.Sprintf("entry for %q is a symlink, which can't have a mode", e.Path))
+		}
+		return h.hashBlobBytes([]byte(e.Symlink)), fs.ModeSymlink, nil
+	case e.Content != nil:
+		mode, err := e.fileMode(0o644)
+		if err != nil {
+			return [32]byte{}, 0, err
+		}
+		return h.hashBlobBytes([]byte(*e.Content)), mode, nil
+	}
+
+	src := filepath.FromSlash(e.Source)
+	if !filepath.IsAbs(src) {
+		src = filepath.Join(sourceDir, src)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return [32]byte{}, 0, newErrInvalidManifest(e.Line, fmt.Sprintf("source file %q for %q doesn't exist", src, e.Path))
+		}
+		return [32]byte{}, 0, newErrIO(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return [32]byte{}, 0, newErrIO(err)
+	}
+	if !fi.Mode().IsRegular() {
+		return [32]byte{}, 0, newErrInvalidManifest(e.Line, fmt.Sprintf("source file %q for %q is not a regular file", src, e.Path))
+	}
+	mode, err := e.fileMode(fi.Mode().Perm())
+	if err != nil {
+		return [32]byte{}, 0, err
+	}
+	hash, _, err := h.hashBlobStream(src, f, fi.Size())
+	return hash, mode, err
+}
+
+// fileMode parses the entry's mode, or returns the default if it has none.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-manifest -- if the mode isn't octal permissions, or one of git's modes for a regular file.
+func (e ManifestEntry) fileMode(dflt fs.FileMode) (fs.FileMode, error) {
+	if e.Mode == "" {
+		return dflt, nil
+	}
+	n, err := strconv.ParseUint(e.Mode, 8, 32)
+	switch {
+	case err != nil:
+	case n <= 0o777:
+		return fs.FileMode(n), nil
+	case n == 0o100644 || n == 0o100755:
+		return fs.FileMode(n & 0o777), nil
+	}
+	return 0, newErrInvalidManifest(e.Line, fmt.Sprintf("mode %q for %q is not octal permissions, like \"0644\" or \"0755\"", e.Mode, e.Path))
+}
+
+func newErrInvalidManifest(line int, reason string) error {
+	return serum.Error(ErrInvalidManifest,
+		serum.WithMessageTemplate("manifest is invalid at line {{line}}: {{reason}}"),
+		serum.WithDetail("line", strconv.Itoa(line)),
+		serum.WithDetail("reason", reason),
+	)
+}
+
+// mainFromManifest implements the from-manifest subcommand, which prints the hash of the tree a manifest describes.
+func mainFromManifest(args []string) int {
+	fset := flag.NewFlagSet("from-manifest", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s from-manifest [flags] <manifest.json>\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nthe manifest lists files and symlinks, as {\"entries\": [{\"path\": ..., and one of \"content\", \"source\", or \"symlink\"}, ...]}, with an optional \"mode\" for files;\n")
+		fmt.Fprintf(fset.Output(), "give \"-\" to read it from stdin.  prints the hash the tree would have, without putting it on disk.\n\n")
+		fset.PrintDefaults()
+	}
+	algorithm := fset.String("algorithm", "sha256", "hash function to use, matching git's object format: \"sha256\" or \"sha1\"")
+	sourceDir := fset.String("source-dir", "", "directory that source files are relative to (default: the manifest's directory, or the current directory when reading stdin)")
+	var opts Options
+	fset.BoolVar(&opts.IgnoreFileMode, "ignore-filemode", false, "record all regular files as 100644, ignoring modes, as git does with core.fileMode=false")
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return 2
+	}
+	switch *algorithm {
+	case "sha256":
+		opts.Algorithm = SHA256
+	case "sha1":
+		opts.Algorithm = SHA1
+	default:
+		fmt.Fprintf(os.Stderr, "unknown algorithm %q\n", *algorithm)
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	dir := "."
+	if manifestPath := fset.Arg(0); manifestPath != "-" {
+		f, err := os.Open(manifestPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				err = NewErrNotFound(manifestPath)
+			} else {
+				err = newErrIO(err)
+			}
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			return exitCode(err)
+		}
+		defer f.Close()
+		r, dir = f, filepath.Dir(manifestPath)
+	}
+	if *sourceDir != "" {
+		dir = *sourceDir
+	}
+	m, err := ReadManifest(r)
+	if err == nil {
+		var hash [32]byte
+		if hash, err = m.Hash(dir, opts); err == nil {
+			fmt.Printf("%s\n", hex.EncodeToString(hash[:opts.Algorithm.Size()]))
+			return 0
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+	return exitCode(err)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+const ErrMergeConflict = "gittreehash-error-merge-conflict"
+
+// ConflictStrategy selects what MergeTrees does with a path that's in both trees, but not the same in each.
+type ConflictStrategy uint8
+
+const (
+	Error ConflictStrategy = iota // Fail with gittreehash-error-merge-conflict.  The default.
+	TakeA                         // Keep what's in the first tree, whether a file, symlink, or whole directory.
+	TakeB                         // Keep what's in the second tree.
+)
+
+// MergeTrees returns the hash of the union of two trees, as if one directory were copied over the other:
+// the trees are the roots of aFS and bFS, and a and b are their hashes, as HashPath gives them with default Options.
+// A directory that's in both trees is merged in turn (unless both are the same, which are taken as they are, without reading further);
+// any other path that's in both trees, but not the same in each (by hash and mode), is a conflict, resolved as the strategy says.
+// A directory in one tree where the other has a file is a conflict too: TakeA or TakeB keeps the whole of that side's entry.
+// Nothing is copied: the merged tree, and any directories in it made by merging, exist only as hashes.
+//
+// Each tree is hashed again, and must still have the hash it's given with; the trees' hashes need not be distinct.
+//
+// Errors:
+//
+//   - gittreehash-error-merge-conflict -- if a path conflicts, and the strategy is Error.
+//   - gittreehash-error-concurrent-io -- if either tree doesn't have the hash it's given with, having changed since it was hashed.
+//   - gittreehash-error-not-a-tree -- if the root of either filesystem isn't a directory.
+//   - any error HashPath may return.
+func MergeTrees(a, b [32]byte, aFS, bFS fsx.FS, conflict ConflictStrategy) ([32]byte, error) {
+	var opts Options
+	var roots [2]*TreeNode
+	for i, side := range []struct {
+		name string
+		fsys fsx.FS
+		hash [32]byte
+	}{{"first", aFS, a}, {"second", bFS, b}} {
+		root, err := NewTreeNode(side.fsys, ".", opts)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		if !root.IsDir() {
+			return [32]byte{}, serum.Errorf(ErrNotATree, "the root of the %s filesystem isn't a directory", side.name)
+		}
+		hash, err := root.Hash()
+		if err != nil {
+			return [32]byte{}, err
+		}
+		if hash != side.hash {
+			return [32]byte{}, serum.Errorf(ErrConcurrentIO, "the %s tree hashes to %x, not the hash it was given with: it's changed since it was hashed", side.name, hash[:opts.Algorithm.Size()])
+		}
+		roots[i] = root
+	}
+	if a == b {
+		return a, nil
+	}
+	return mergeTreeNodes(roots[0], roots[1], conflict, opts)
+}
+
+// mergeTreeNodes returns the hash of the union of two hashed directories, merging the directories in both, for MergeTrees.
+func mergeTreeNodes(x, y *TreeNode, conflict ConflictStrategy, opts Options) ([32]byte, error) {
+	xChildren, err := x.Children()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	yChildren, err := y.Children()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	inY := make(map[string]*TreeNode, len(yChildren))
+	for _, child := range yChildren {
+		inY[child.name] = child
+	}
+	b := NewTreeBuilder(opts)
+	for _, xChild := range xChildren {
+		yChild, ok := inY[xChild.name]
+		delete(inY, xChild.name)
+		switch {
+		case !ok, xChild.hash == yChild.hash && xChild.gitMode() == yChild.gitMode():
+			b.add(xChild.name, xChild.mode, xChild.hash)
+		case xChild.isDir && yChild.isDir:
+			hash, err := mergeTreeNodes(xChild, yChild, conflict, opts)
+			if err != nil {
+				return [32]byte{}, err
+			}
+			b.add(xChild.name, fs.ModeDir, hash)
+		case conflict == TakeA:
+			b.add(xChild.name, xChild.mode, xChild.hash)
+		case conflict == TakeB:
+			b.add(yChild.name, yChild.mode, yChild.hash)
+		default:
+			return [32]byte{}, serum.Error(ErrMergeConflict,
+				serum.WithMessageTemplate("{{path}} is in both trees, but differs"),
+				serum.WithDetail("path", xChild.Path()),
+				withPathBytes("path", xChild.Path()),
+			)
+		}
+	}
+	for _, yChild := range yChildren {
+		if _, ok := inY[yChild.name]; ok {
+			b.add(yChild.name, yChild.mode, yChild.hash)
+		}
+	}
+	return b.Finish()
+}
+
+// mainMergeTrees implements the merge-trees subcommand, which prints the hash MergeTrees gives for two directories:
+// that of the second copied over the first, with conflicts resolved as --conflict says.
+// It returns the process exit code: 0 on success, or as per exitCode if an error occurs (including a conflict, with --conflict=error).
+func mainMergeTrees(args []string) int {
+	fset := flag.NewFlagSet("merge-trees", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s merge-trees [flags] <dir-a> <dir-b>\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nprints the (sha256) hash of the union of the two directories, as if one were copied over the other, without copying anything.\n")
+		fmt.Fprintf(fset.Output(), "directories in both are merged in turn; anything else in both, but not the same in each, is a conflict.\n\n")
+		fset.PrintDefaults()
+	}
+	conflictFlag := fset.String("conflict", "error", "what to do with a conflict: \"error\" to fail, or \"take-a\" or \"take-b\" to keep what's in that directory (a whole directory, if it has one where the other has a file)")
+	fset.Parse(args)
+	if fset.NArg() != 2 {
+		fset.Usage()
+		return 2
+	}
+	var conflict ConflictStrategy
+	switch *conflictFlag {
+	case "error":
+		conflict = Error
+	case "take-a":
+		conflict = TakeA
+	case "take-b":
+		conflict = TakeB
+	default:
+		fmt.Fprintf(os.Stderr, "unknown --conflict strategy %q\n", *conflictFlag)
+		return 2
+	}
+
+	var hashes [2][32]byte
+	var fss [2]fsx.FS
+	for i := range hashes {
+		fss[i] = rawDirFS(filepath.Clean(fset.Arg(i)))
+		hash, err := HashPath(fss[i], ".", Options{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			return exitCode(err)
+		}
+		hashes[i] = hash
+	}
+	hash, err := MergeTrees(hashes[0], hashes[1], fss[0], fss[1], conflict)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	fmt.Println(hex.EncodeToString(hash[:SHA256.Size()]))
+	return 0
+}
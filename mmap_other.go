@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"io/fs"
+)
+
+// mmapSupported is true on platforms where Options.MmapThreshold has any effect.
+const mmapSupported = false
+
+// hashMmap would hash a file by mapping it into memory, but that's not supported on this platform,
+// so it always reports that the caller should read the file instead.
+func (h *hasher) hashMmap(pth string, f fs.File, size int64) (hash [32]byte, ok bool, err error) {
+	return [32]byte{}, false, nil
+}
@@ -0,0 +1,64 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"runtime/debug"
+	"syscall"
+)
+
+// mmapSupported is true on platforms where Options.MmapThreshold has any effect.
+const mmapSupported = true
+
+// hashMmap hashes the content of a regular file as a blob by mapping it into memory,
+// which saves copying it through a read buffer.
+// The ok result is false if the file couldn't be mapped (which some filesystems don't allow),
+// in which case nothing has been read, and the caller should fall back to reading it.
+//
+// If the file is truncated while it's mapped, touching the pages past its new end raises SIGBUS.
+// That's caught, and reported like any other change of size, rather than crashing the process.
+//
+// Errors:
+//
+//   - gittreehash-error-concurrent-io -- if the file's size changes while it's being hashed.
+//   - gittreehash-error-io -- if the file can't be stat'd afterwards.
+func (h *hasher) hashMmap(pth string, f fs.File, size int64) (hash [32]byte, ok bool, err error) {
+	osf, isOS := f.(*os.File)
+	if !isOS || size <= 0 || int64(int(size)) != size {
+		return [32]byte{}, false, nil // Not a local file, or too large to map whole on this platform.
+	}
+	data, err2 := syscall.Mmap(int(osf.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err2 != nil {
+		return [32]byte{}, false, nil
+	}
+	defer syscall.Munmap(data)
+
+	digester := h.opts.Algorithm.New()
+	var preamble [32]byte
+	digester.Write(appendObjectPreamble(preamble[:0], "blob", size))
+	faulted := func() (faulted bool) {
+		// With this set, a fault on the mapping panics (in this goroutine only) instead of killing the process.
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer func() {
+			if r := recover(); r != nil {
+				if _, isFault := r.(interface{ Addr() uintptr }); !isFault {
+					panic(r)
+				}
+				faulted = true
+			}
+		}()
+		digester.Write(data)
+		return false
+	}()
+	fi, err2 := osf.Stat()
+	if err2 != nil {
+		return [32]byte{}, true, newErrIO(err2)
+	}
+	if faulted || fi.Size() != size {
+		return [32]byte{}, true, NewErrSizeChanged(pth, size, fi.Size())
+	}
+	digester.Sum(hash[:0])
+	return hash, true, nil
+}
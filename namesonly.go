@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+// hashName stands in for hashing the content of a file or symlink, when Options.NamesOnly is set.
+// The "blob hash" is the digest of "path:" followed by the entry's slash-separated path relative to the starting path
+// (or, if the starting path is itself a file, its name).
+func (h *hasher) hashName(pth string, fi fs.FileInfo, anc *ancestry) ([32]byte, fs.FileMode) {
+	mode := fi.Mode()
+	if mode.IsRegular() && h.opts.SymlinksAsText != nil && h.opts.SymlinksAsText(pth) {
+		mode = fs.ModeSymlink | mode.Perm()
+	}
+	rel := filepath.Base(pth)
+	if anc != nil {
+		root := anc
+		for root.parent != nil {
+			root = root.parent
+		}
+		if r, err := filepath.Rel(root.path, pth); err == nil {
+			rel = r
+		}
+	}
+	digester := h.opts.Algorithm.New()
+	digester.Write([]byte("path:" + filepath.ToSlash(rel)))
+	var hash [32]byte
+	digester.Sum(hash[:0])
+	h.emit(pth, hash, mode, fi.Size())
+	return hash, mode
+}
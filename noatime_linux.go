@@ -0,0 +1,18 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// oNoatime is the open flag that keeps reading a file from updating its access time.
+const oNoatime = unix.O_NOATIME
+
+// isNoatimeRefused reports whether an open failed only because O_NOATIME was given for a file the process doesn't own
+// (and it lacks CAP_FOWNER), in which case the kernel says EPERM.
+func isNoatimeRefused(err error) bool {
+	return errors.Is(err, unix.EPERM)
+}
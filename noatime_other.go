@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+// oNoatime is the open flag that keeps reading a file from updating its access time.  There's none on this platform.
+const oNoatime = 0
+
+func isNoatimeRefused(err error) bool {
+	return false
+}
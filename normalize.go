@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/warpfork/go-fsx"
+)
+
+// NormalizedEpoch is the modification time given to everything copied by NormalizeCopy.
+var NormalizedEpoch = time.Unix(0, 0)
+
+// NormalizeCopy copies the tree at src (in fsys) to dst on the local filesystem,
+// normalizing everything which git doesn't record, so that the copy is reproducible down to its metadata:
+// modification times are all set to NormalizedEpoch, and permissions to 0755 for directories and executable files
+// and 0644 for other files.  (Ownership isn't changed; the copy belongs to whoever makes it.)
+// Content, symlink targets, and names are copied exactly, so the copy has the same hash as the original.
+//
+// The destination must not already exist.
+//
+// Errors:
+//
+//   - gittreehash-error-unsupported-file-type -- if the tree contains sockets, device nodes, etc.
+//   - gittreehash-error-not-found -- if there's nothing at src.
+//   - gittreehash-error-io -- if reading the source or writing the copy fails, or the destination already exists.
+//   - gittreehash-error-permission -- if either fails due to permissions.
+func NormalizeCopy(fsys fsx.FS, src, dst string) error {
+	fi, err := fsx.Lstat(fsys, src)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return NewErrNotFound(src)
+		}
+		return newErrIO(err)
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return newErrIO(&fs.PathError{Op: "copy", Path: dst, Err: fs.ErrExist})
+	}
+	return normalizeCopy(fsys, src, dst, fi)
+}
+
+func normalizeCopy(fsys fsx.FS, src, dst string, fi fs.FileInfo) error {
+	switch fi.Mode().Type() {
+	case fs.ModeDir:
+		if err := os.Mkdir(dst, 0o755); err != nil {
+			return newErrIO(err)
+		}
+		dirEnts, err := fsx.ReadDir(fsys, src)
+		if err != nil {
+			return newErrIO(err)
+		}
+		for _, dirEnt := range dirEnts {
+			childFi, err := dirEnt.Info()
+			if err != nil {
+				return newErrIO(err)
+			}
+			if err := normalizeCopy(fsys, filepath.Join(src, dirEnt.Name()), filepath.Join(dst, dirEnt.Name()), childFi); err != nil {
+				return err
+			}
+		}
+		if err := os.Chmod(dst, 0o755); err != nil { // In case the umask took some bits away.
+			return newErrIO(err)
+		}
+	case fs.ModeSymlink:
+		target, err := fsx.Readlink(fsys, src)
+		if err != nil {
+			return newErrIO(err)
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return newErrIO(err)
+		}
+		return setSymlinkMtime(dst, NormalizedEpoch)
+	case 0:
+		perm := fs.FileMode(0o644)
+		if fi.Mode()&0o111 != 0 {
+			perm = 0o755
+		}
+		if err := copyFile(fsys, src, dst, perm); err != nil {
+			return err
+		}
+	case fs.ModeNamedPipe:
+		return NewErrUnsupportedFileType("pipe", src)
+	case fs.ModeSocket:
+		return NewErrUnsupportedFileType("socket", src)
+	case fs.ModeDevice, fs.ModeCharDevice:
+		return NewErrUnsupportedFileType("device", src)
+	default:
+		return NewErrUnsupportedFileType("irregular", src)
+	}
+	if err := os.Chtimes(dst, NormalizedEpoch, NormalizedEpoch); err != nil {
+		return newErrIO(err)
+	}
+	return nil
+}
+
+func copyFile(fsys fsx.FS, src, dst string, perm fs.FileMode) error {
+	in, err := fsys.Open(src)
+	if err != nil {
+		return newErrIO(err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return newErrIO(err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return newErrIO(err)
+	}
+	if err := out.Close(); err != nil {
+		return newErrIO(err)
+	}
+	if err := os.Chmod(dst, perm); err != nil {
+		return newErrIO(err)
+	}
+	return nil
+}
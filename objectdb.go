@@ -0,0 +1,290 @@
+package main
+
+import (
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+
+	"github.com/warptools/gittreehash/gitconfig"
+)
+
+const ErrObjectFormatMismatch = "gittreehash-error-object-format-mismatch"
+
+// WriteObjects hashes a tree as HashPath does, and stores every blob and tree object in it
+// in the object database of the git repository at gitDir (the ".git" directory, or a bare repository), as loose objects.
+// Afterwards, git can read the tree by its hash: `git ls-tree <hash>` lists it, and `git read-tree <hash>` checks it out.
+//
+// Objects the repository already has as loose objects are skipped (ones only in its packs are written again, harmlessly).
+// Each object is written to a temporary file beside where it belongs, synced, and renamed into place,
+// and then its directory is synced, so a crash leaves either the whole object or none of it.
+//
+// Blobs are read twice, as by PackTree, and the same options can't be used.
+// The algorithm must be the repository's object format (its extensions.objectFormat setting, or sha1 if it has none).
+//
+// Errors:
+//
+//   - gittreehash-error-no-repository -- if gitDir has no objects directory.
+//   - gittreehash-error-object-format-mismatch -- if the algorithm isn't the repository's object format.
+//   - gittreehash-error-unsupported-option -- if any of the options PackTree can't use are set.
+//   - gittreehash-error-concurrent-io -- if a file changes between being hashed and being written.
+//   - gittreehash-error-io -- if an object can't be written.
+//   - gittreehash-error-permission -- if an object can't be written due to permissions.
+//   - gitconfig-error-parse -- if the repository's config can't be parsed.
+//   - gitconfig-error-io -- if the repository's config can't be read.
+//   - any error HashPath may return.
+func WriteObjects(fsys fsx.FS, rootPath, gitDir string, opts Options) ([32]byte, error) {
+	if err := checkObjectOptions(opts, "objects"); err != nil {
+		return [32]byte{}, err
+	}
+	db, err := openObjectDB(gitDir, opts.Algorithm)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	// As in packTree: trees are written as they're hashed, and blobs are read again afterwards.
+	opts.TreeSpillThreshold = -1
+	var blobs []Entry
+	onEntry := opts.OnEntry
+	opts.OnEntry = func(e Entry) {
+		if e.Type == "blob" {
+			blobs = append(blobs, e)
+		}
+		if onEntry != nil {
+			onEntry(e)
+		}
+	}
+	var treeErr error
+	h := newHasher(fsys, opts)
+	h.onTreeBody = func(_ string, body []byte) {
+		if treeErr != nil {
+			return
+		}
+		_, treeErr = db.writeObject("tree", body)
+	}
+	hash, _, err := h.hashSomething(rootPath, nil)
+	if err = unwrapAbort(err); err != nil {
+		return [32]byte{}, err
+	}
+	if treeErr != nil {
+		return [32]byte{}, treeErr
+	}
+
+	for _, e := range blobs {
+		var blobHash [32]byte
+		copy(blobHash[:], e.Hash)
+		if err := db.writeBlob(fsys, e, blobHash); err != nil {
+			return [32]byte{}, err
+		}
+	}
+	return hash, nil
+}
+
+// objectDB is the objects directory of a repository, to which loose objects are written.
+type objectDB struct {
+	dir       string
+	algorithm Algorithm
+	seen      map[[32]byte]struct{} // Objects already written, or found to exist, in this run.
+}
+
+// openObjectDB finds the objects directory of a repository, and checks that its object format is the algorithm's.
+//
+// Errors:
+//
+//   - gittreehash-error-no-repository -- if gitDir has no objects directory.
+//   - gittreehash-error-object-format-mismatch -- if the algorithm isn't the repository's object format.
+//   - gitconfig-error-parse -- if the repository's config can't be parsed.
+//   - gitconfig-error-io -- if the repository's config can't be read.
+func openObjectDB(gitDir string, algorithm Algorithm) (*objectDB, error) {
+	dir := filepath.Join(gitDir, "objects")
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return nil, serum.Error(ErrNoRepository,
+			serum.WithMessageTemplate("{{path}} is not a git repository: it has no objects directory"),
+			serum.WithDetail("path", gitDir),
+		)
+	}
+	format, err := repoObjectFormat(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	want := "sha256"
+	if algorithm == SHA1 {
+		want = "sha1"
+	}
+	if format != want {
+		return nil, serum.Error(ErrObjectFormatMismatch,
+			serum.WithMessageTemplate("the repository at {{path}} has the {{format}} object format, so objects hashed with {{algorithm}} can't be stored in it"),
+			serum.WithDetail("path", gitDir),
+			serum.WithDetail("format", format),
+			serum.WithDetail("algorithm", want),
+		)
+	}
+	return &objectDB{dir: dir, algorithm: algorithm, seen: map[[32]byte]struct{}{}}, nil
+}
+
+// repoObjectFormat returns the object format of a repository, from its config: "sha1" or "sha256" (or whatever else it says).
+//
+// Errors:
+//
+//   - gitconfig-error-parse -- if the repository's config can't be parsed.
+//   - gitconfig-error-io -- if the repository's config can't be read.
+func repoObjectFormat(gitDir string) (string, error) {
+	cfg, err := gitconfig.Load(filepath.Join(gitDir, "config"))
+	if err != nil {
+		return "", err
+	}
+	format, ok := cfg.Get("extensions.objectFormat")
+	if !ok {
+		return "sha1", nil
+	}
+	return strings.ToLower(format), nil
+}
+
+// path returns where the loose object with a hash belongs: a directory named for the first byte of the hash,
+// and a file named for the rest.
+func (db *objectDB) path(hash [32]byte) (dir, name string) {
+	hexHash := hex.EncodeToString(hash[:db.algorithm.Size()])
+	return filepath.Join(db.dir, hexHash[:2]), hexHash[2:]
+}
+
+// write stores an object, unless it's already there, with its preamble and content as written by writeContent.
+// The object is renamed into place only once writeContent has succeeded, and the file is synced;
+// if writeContent fails, its error is returned, and nothing is left behind.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the object can't be written.
+//   - gittreehash-error-permission -- if the object can't be written due to permissions.
+//   - whatever error writeContent returns.
+func (db *objectDB) write(hash [32]byte, writeContent func(w io.Writer) error) error {
+	if _, ok := db.seen[hash]; ok {
+		return nil
+	}
+	dir, name := db.path(hash)
+	final := filepath.Join(dir, name)
+	if _, err := os.Lstat(final); err == nil {
+		db.seen[hash] = struct{}{}
+		return nil
+	}
+	if err := os.Mkdir(dir, 0o755); err == nil {
+		if err := syncDir(db.dir); err != nil {
+			return err
+		}
+	} else if !os.IsExist(err) {
+		return newErrIO(err)
+	}
+	tmp, err := os.CreateTemp(dir, "tmp_obj_*")
+	if err != nil {
+		return newErrIO(err)
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed.
+	zw := zlib.NewWriter(tmp)
+	if err := writeContent(zw); err != nil {
+		tmp.Close()
+		return newErrIO(err) // Passes through the errors writeContent makes itself.
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return newErrIO(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return newErrIO(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return newErrIO(err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o444); err != nil { // Git makes objects read-only, being immutable.
+		return newErrIO(err)
+	}
+	if err := os.Rename(tmp.Name(), final); err != nil {
+		return newErrIO(err)
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	db.seen[hash] = struct{}{}
+	return nil
+}
+
+// writeObject stores an object whose content is at hand, unless it's already there, and returns its hash.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the object can't be written.
+//   - gittreehash-error-permission -- if the object can't be written due to permissions.
+func (db *objectDB) writeObject(objType string, body []byte) ([32]byte, error) {
+	hash := db.algorithm.hashObject(objType, body)
+	err := db.write(hash, func(w io.Writer) error {
+		w.Write(appendObjectPreamble(nil, objType, int64(len(body))))
+		_, err := w.Write(body)
+		return err
+	})
+	return hash, err
+}
+
+// writeBlob reads a file (or symlink) again, and stores it, checking that its content still has the hash it had.
+//
+// Errors:
+//
+//   - gittreehash-error-concurrent-io -- if the file has vanished or changed.
+//   - gittreehash-error-io -- if reading the file, or writing the object, fails.
+//   - gittreehash-error-permission -- if that fails due to permissions.
+func (db *objectDB) writeBlob(fsys fsx.FS, e Entry, hash [32]byte) error {
+	return db.write(hash, func(w io.Writer) error {
+		content, err := openBlob(fsys, e)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		digester := db.algorithm.New()
+		preamble := appendObjectPreamble(nil, "blob", e.Size)
+		digester.Write(preamble)
+		if _, err := w.Write(preamble); err != nil {
+			return err
+		}
+		counted := &countingReader{r: io.TeeReader(content, digester)}
+		if _, err := io.Copy(w, counted); err != nil {
+			return err
+		}
+		var actual [32]byte
+		digester.Sum(actual[:0])
+		if counted.n != e.Size {
+			return NewErrSizeChanged(e.Path, e.Size, counted.n)
+		}
+		if actual != hash {
+			return serum.Errorf(ErrConcurrentIO, "file at %q changed between being hashed and being written", e.Path)
+		}
+		return nil
+	})
+}
+
+// syncDir syncs a directory, so that the entries just renamed into it survive a crash.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the directory can't be synced.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return newErrIO(err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !isSyncUnsupported(err) {
+		return newErrIO(fmt.Errorf("syncing directory %s: %w", dir, err))
+	}
+	return nil
+}
+
+// isSyncUnsupported reports whether syncing failed only because the filesystem or platform can't sync directories.
+func isSyncUnsupported(err error) bool {
+	return errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTSUP)
+}
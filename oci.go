@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const ErrInvalidImage = "gittreehash-error-invalid-image"
+
+const (
+	whiteoutPrefix = ".wh."         // An entry named ".wh.<name>" deletes <name> from the layers beneath.
+	opaqueWhiteout = ".wh..wh..opq" // An entry with this name hides everything beneath its directory in the layers beneath.
+)
+
+// whiteouts collects the whiteout entries of an OCI layer, which delete things from the layers beneath it.
+type whiteouts struct {
+	deleted []string // Paths to remove.
+	opaque  []string // Directories to empty; "" for the root.
+}
+
+// record notes the entry at a (cleaned) path if it's a whiteout, and reports whether it was.
+func (wh *whiteouts) record(pth string) bool {
+	dir, name := path.Split(pth)
+	dir = strings.TrimSuffix(dir, "/")
+	switch {
+	case name == opaqueWhiteout:
+		wh.opaque = append(wh.opaque, dir)
+	case strings.HasPrefix(name, whiteoutPrefix):
+		if target := name[len(whiteoutPrefix):]; target != "" {
+			wh.deleted = append(wh.deleted, path.Join(dir, target))
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// apply deletes what the whiteouts say from a tree assembled from the layers beneath theirs.
+// This must happen before their own layer is laid over the tree, since whiteouts never delete anything from their own layer.
+func (wh *whiteouts) apply(root *vnode) {
+	for _, dir := range wh.opaque {
+		if n := root.lookup(dir); n != nil && n.mode.IsDir() {
+			n.children = map[string]*vnode{}
+		}
+	}
+	for _, pth := range wh.deleted {
+		dir, name := path.Split(pth)
+		if parent := root.lookup(strings.TrimSuffix(dir, "/")); parent != nil && parent.children != nil {
+			delete(parent.children, name)
+		}
+	}
+}
+
+// lookup is get, except that the empty path is the node itself.
+func (n *vnode) lookup(pth string) *vnode {
+	if pth == "" {
+		return n
+	}
+	return n.get(pth)
+}
+
+// overlay lays another tree over this one, as a layer is applied to the filesystem beneath it:
+// directories in both are merged, and anything else in the upper tree replaces what's beneath.
+// Nodes of the upper tree become part of this one, so it mustn't be used independently afterwards.
+func (n *vnode) overlay(upper *vnode) {
+	for name, child := range upper.children {
+		if existing, ok := n.children[name]; ok && existing.mode.IsDir() && child.mode.IsDir() {
+			existing.overlay(child)
+			continue
+		}
+		n.children[name] = child
+	}
+}
+
+// OCIImageHashes are the tree hashes of an image's layers, and of the filesystem they make.
+type OCIImageHashes struct {
+	Layers []OCILayerHash
+	RootFS [32]byte // The tree hash of the filesystem that results from applying every layer in turn, honoring whiteouts.
+}
+
+// OCILayerHash is the tree hash of one layer of an image.
+type OCILayerHash struct {
+	Digest string   // The layer's digest, as the manifest gives it; or for an image saved by `docker save`, its path within the image.
+	Hash   [32]byte // The tree hash of the layer's contents, leaving out its whiteout entries (as HashOCILayer does).
+}
+
+// HashOCIImage hashes each layer of an image on disk, and the root filesystem they make.
+// The image may be an OCI image layout directory (with an index.json), or a directory as extracted from `docker save`
+// (with a manifest.json).
+//
+// If the image's index lists several manifests (as for a multi-platform image), manifestDigest picks one of them;
+// if it's empty, the index (and any index it refers to) must list just one.  For an image saved by `docker save`, manifestDigest must be empty.
+//
+// Layers may be uncompressed, or compressed with any format Compression names.
+// In the root filesystem, whiteout entries delete what's beneath them, and opaque whiteouts empty their directory,
+// as the OCI image spec describes.  Hard links may refer to files in lower layers.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-image -- if the image's index, manifests, or digests aren't as the spec says they should be,
+//     or the manifest to use is ambiguous or missing.
+//   - gittreehash-error-not-found -- if the image's index, a manifest, or a layer is missing.
+//   - any error HashCompressedTar may return, for a layer.
+func HashOCIImage(dir string, manifestDigest string, opts Options) (OCIImageHashes, error) {
+	layers, err := ociLayers(dir, manifestDigest)
+	if err != nil {
+		return OCIImageHashes{}, err
+	}
+	h := newHasher(nil, opts)
+	root := newVdir()
+	var result OCIImageHashes
+	for _, layer := range layers {
+		hash, err := h.applyOCILayer(root, layer.path)
+		if err != nil {
+			return OCIImageHashes{}, unwrapAbort(err)
+		}
+		result.Layers = append(result.Layers, OCILayerHash{layer.digest, hash})
+	}
+	result.RootFS = h.hashVnode(".", root)
+	return result, nil
+}
+
+// applyOCILayer reads a layer, hashes it, and applies it (whiteouts and all) to the root filesystem built so far.
+func (h *hasher) applyOCILayer(root *vnode, pth string) ([32]byte, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		if isVanished(err) {
+			return [32]byte{}, NewErrNotFound(pth)
+		}
+		return [32]byte{}, newErrIO(err)
+	}
+	defer f.Close()
+	d, err := newDecompressor(f, CompressionAuto)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer d.Close()
+	var wh whiteouts
+	layer, err := h.readTar(d, &wh, root)
+	if err != nil {
+		return [32]byte{}, d.explain(err)
+	}
+	hash := h.hashVnode(".", layer)
+	wh.apply(root)
+	root.overlay(layer)
+	return hash, nil
+}
+
+// ociLayer is a layer of an image, located on disk.
+type ociLayer struct {
+	digest string
+	path   string
+}
+
+// ociDescriptor is the part of an OCI content descriptor (as found in indexes and manifests) that's needed here.
+type ociDescriptor struct {
+	Digest string `json:"digest"`
+}
+
+// ociLayers finds the layers of an image, bottom first.  See HashOCIImage for the errors.
+func ociLayers(dir string, manifestDigest string) ([]ociLayer, error) {
+	indexPath := filepath.Join(dir, "index.json")
+	if _, err := os.Stat(indexPath); err != nil && isVanished(err) {
+		if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+			if manifestDigest != "" {
+				return nil, newErrInvalidImage(dir, "an image saved by docker has only one manifest to choose")
+			}
+			return dockerSaveLayers(dir)
+		}
+	}
+	var index struct {
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	if err := readOCIJSON(dir, indexPath, &index); err != nil {
+		return nil, err
+	}
+	manifests := index.Manifests
+	matched := manifestDigest == ""
+	for depth := 0; depth < maxOCIIndexDepth; depth++ {
+		desc, found, err := pickManifest(dir, manifests, manifestDigest)
+		if err != nil {
+			return nil, err
+		}
+		matched = matched || found
+		blob, err := ociBlobPath(dir, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var manifest struct {
+			Manifests []ociDescriptor `json:"manifests"` // If it's an index (of a multi-platform image) rather than a manifest.
+			Layers    []ociDescriptor `json:"layers"`
+		}
+		if err := readOCIJSON(dir, blob, &manifest); err != nil {
+			return nil, err
+		}
+		if manifest.Manifests != nil {
+			manifests = manifest.Manifests
+			continue
+		}
+		if !matched {
+			return nil, newErrInvalidImage(dir, "the image has no manifest "+manifestDigest)
+		}
+		layers := make([]ociLayer, len(manifest.Layers))
+		for i, desc := range manifest.Layers {
+			if layers[i].path, err = ociBlobPath(dir, desc.Digest); err != nil {
+				return nil, err
+			}
+			layers[i].digest = desc.Digest
+		}
+		return layers, nil
+	}
+	return nil, newErrInvalidImage(dir, "indexes are nested more than "+strconv.Itoa(maxOCIIndexDepth)+" deep")
+}
+
+// maxOCIIndexDepth limits how deeply indexes may refer to other indexes, so that a cycle can't go on forever.
+const maxOCIIndexDepth = 8
+
+// pickManifest chooses the manifest (or nested index) with the given digest, reporting that it was found;
+// or failing that, the only one there is.
+func pickManifest(dir string, manifests []ociDescriptor, digest string) (ociDescriptor, bool, error) {
+	for _, desc := range manifests {
+		if digest != "" && desc.Digest == digest {
+			return desc, true, nil
+		}
+	}
+	switch len(manifests) {
+	case 0:
+		return ociDescriptor{}, false, newErrInvalidImage(dir, "an index lists no manifests")
+	case 1:
+		return manifests[0], false, nil
+	}
+	if digest != "" {
+		return ociDescriptor{}, false, newErrInvalidImage(dir, "the image has no manifest "+digest)
+	}
+	return ociDescriptor{}, false, newErrInvalidImage(dir, "an index lists "+strconv.Itoa(len(manifests))+" manifests, so which to use must be given")
+}
+
+// ociDigestPattern is what a digest must look like for it to be safe to use as a path; see the OCI image spec.
+var ociDigestPattern = regexp.MustCompile(`^([a-z0-9]+(?:[+._-][a-z0-9]+)*):([a-zA-Z0-9=_-]+)$`)
+
+// ociBlobPath returns the path of a blob within an image layout, given its digest.
+func ociBlobPath(dir string, digest string) (string, error) {
+	m := ociDigestPattern.FindStringSubmatch(digest)
+	if m == nil {
+		return "", newErrInvalidImage(dir, "the digest "+strconv.Quote(digest)+" is malformed")
+	}
+	return filepath.Join(dir, "blobs", m[1], m[2]), nil
+}
+
+// dockerSaveLayers finds the layers of an image extracted from `docker save`, as listed in its manifest.json.
+func dockerSaveLayers(dir string) ([]ociLayer, error) {
+	var manifests []struct {
+		Layers []string `json:"Layers"`
+	}
+	if err := readOCIJSON(dir, filepath.Join(dir, "manifest.json"), &manifests); err != nil {
+		return nil, err
+	}
+	if len(manifests) != 1 {
+		return nil, newErrInvalidImage(dir, "manifest.json lists "+strconv.Itoa(len(manifests))+" images, rather than one")
+	}
+	layers := make([]ociLayer, len(manifests[0].Layers))
+	for i, pth := range manifests[0].Layers {
+		if _, err := cleanVpath(pth); err != nil {
+			return nil, newErrInvalidImage(dir, "manifest.json lists the layer "+strconv.Quote(pth)+", which is outside the image")
+		}
+		layers[i] = ociLayer{digest: pth, path: filepath.Join(dir, filepath.FromSlash(pth))}
+	}
+	return layers, nil
+}
+
+// readOCIJSON reads and decodes one of an image's JSON files.
+func readOCIJSON(dir string, pth string, v interface{}) error {
+	body, err := os.ReadFile(pth)
+	if err != nil {
+		if isVanished(err) {
+			return NewErrNotFound(pth)
+		}
+		return newErrIO(err)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return newErrInvalidImage(dir, filepath.Base(pth)+" isn't valid: "+err.Error())
+	}
+	return nil
+}
+
+func newErrInvalidImage(dir, reason string) error {
+	return serum.Error(ErrInvalidImage,
+		serum.WithMessageTemplate("image at {{path}} is invalid: {{reason}}"),
+		serum.WithDetail("path", dir),
+		withPathBytes("path", dir),
+		serum.WithDetail("reason", reason),
+	)
+}
+
+// mainOCI implements the oci subcommand, which prints the tree hash of each layer of an image,
+// then of the root filesystem they make.
+func mainOCI(args []string) int {
+	fset := flag.NewFlagSet("oci", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s oci [flags] <image-dir>\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nthe image is an OCI image layout directory, or a directory extracted from `docker save`.\n")
+		fmt.Fprintf(fset.Output(), "prints \"<hash>\\t<layer digest>\" for each layer, bottom first, then \"<hash>\\trootfs\" for the filesystem they make.\n\n")
+		fset.PrintDefaults()
+	}
+	algorithm := fset.String("algorithm", "sha256", "hash function to use, matching git's object format: \"sha256\" or \"sha1\"")
+	manifest := fset.String("manifest", "", "digest of the manifest to use, if the image's index lists several (e.g. for several platforms)")
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return 2
+	}
+	var opts Options
+	switch *algorithm {
+	case "sha256":
+		opts.Algorithm = SHA256
+	case "sha1":
+		opts.Algorithm = SHA1
+	default:
+		fmt.Fprintf(os.Stderr, "unknown algorithm %q\n", *algorithm)
+		return 2
+	}
+
+	hashes, err := HashOCIImage(filepath.Clean(fset.Arg(0)), *manifest, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	size := opts.Algorithm.Size()
+	for _, layer := range hashes.Layers {
+		fmt.Printf("%s\t%s\n", hex.EncodeToString(layer.Hash[:size]), layer.Digest)
+	}
+	fmt.Printf("%s\trootfs\n", hex.EncodeToString(hashes.RootFS[:size]))
+	return 0
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+)
+
+// openFileFS is implemented by filesystems that can open files with flags, as os.OpenFile does.
+// Of ours, only rawDirFS does; on any other filesystem, Options.NoAtime and Options.OpenFlags have no effect.
+type openFileFS interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+}
+
+// openFile opens a file to read its content, with the extra open flags the options ask for, if the filesystem can take them.
+// If O_NOATIME is refused (as it is for files the process doesn't own), the file is opened again without it.
+// Where it can be, the file is opened without blocking (see oNonblock), and then set to block as usual once it's open.
+func (h *hasher) openFile(pth string) (fs.File, error) {
+	flags := h.opts.OpenFlags | oNonblock
+	if h.opts.NoAtime {
+		flags |= oNoatime
+	}
+	ofs, ok := h.fsys.(openFileFS)
+	if flags == 0 || !ok {
+		return h.fsys.Open(pth)
+	}
+	f, err := ofs.OpenFile(pth, os.O_RDONLY|flags, 0)
+	if err != nil && flags&oNoatime != 0 && isNoatimeRefused(err) {
+		f, err = ofs.OpenFile(pth, os.O_RDONLY|flags&^oNoatime, 0)
+	}
+	if err == nil && flags&oNonblock != 0 {
+		clearNonblock(f)
+	}
+	return f, err
+}
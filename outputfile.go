@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+)
+
+// writeFileAtomic replaces a file with the given content, by writing a temporary file beside it and renaming that into place,
+// so that anyone reading the file sees either the old content or the new, never a partial write; and syncing it first,
+// so that a crash can't leave it empty.
+// The file keeps the mode it had; a new one gets the usual mode for a new file (0666, less the umask).
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the file can't be written.
+//   - gittreehash-error-permission -- if the file can't be written due to permissions.
+func writeFileAtomic(filename string, data []byte) error {
+	perm, existing := fs.FileMode(0o666), false
+	if fi, err := os.Stat(filename); err == nil {
+		perm, existing = fi.Mode().Perm(), true
+	}
+	dir := filepath.Dir(filename)
+	tmp, err := createTempBeside(dir, "."+filepath.Base(filename)+".", perm)
+	if err != nil {
+		return newErrIO(err)
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed.
+	if existing {
+		// The umask applied when creating the temporary file may have taken away bits the file had.
+		if err := tmp.Chmod(perm); err != nil {
+			tmp.Close()
+			return newErrIO(err)
+		}
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return newErrIO(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return newErrIO(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return newErrIO(err)
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return newErrIO(err)
+	}
+	return syncDir(dir)
+}
+
+// createTempBeside creates a new file in dir, whose name starts with prefix, with the given permissions (less the umask).
+// Unlike os.CreateTemp, which always uses 0600, this lets a file that's renamed into place have the mode it should.
+func createTempBeside(dir, prefix string, perm fs.FileMode) (*os.File, error) {
+	for tries := 0; ; tries++ {
+		name := filepath.Join(dir, prefix+strconv.FormatInt(time.Now().UnixNano()+int64(tries), 36))
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && tries < 100 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// finishOutputFile puts the output that would have gone to stdout into the --output-file.
+// With verify, a file that already exists is only checked: it's left alone if it holds the same output,
+// and otherwise the difference is reported, and the file still left alone.
+// It returns the process exit code: 2 if verification fails, or as per exitCode if an error occurs.
+func finishOutputFile(filename string, output []byte, verify bool) int {
+	if verify {
+		existing, err := os.ReadFile(filename)
+		switch {
+		case err == nil:
+			if bytes.Equal(existing, output) {
+				return 0
+			}
+			fmt.Fprintf(os.Stderr, "%s holds different output; leaving it unchanged\n", filename)
+			if bytes.Count(existing, []byte{'\n'}) <= 1 && bytes.Count(output, []byte{'\n'}) <= 1 {
+				fmt.Fprintf(os.Stderr, "  it has: %s\n  now:    %s\n", bytes.TrimSuffix(existing, []byte{'\n'}), bytes.TrimSuffix(output, []byte{'\n'}))
+			}
+			return 2
+		case !isVanished(err):
+			err = newErrIO(err)
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			return exitCode(err)
+		}
+		// There's nothing to verify against yet, so the file is written, to be verified next time.
+	}
+	if err := writeFileAtomic(filename, output); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	return 0
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+const ErrUnsupportedOption = "gittreehash-error-unsupported-option"
+
+// Object type numbers, as pack files encode them.
+const (
+	packObjTree = 2
+	packObjBlob = 3
+)
+
+// PackTree hashes a tree as HashPath does, and writes every blob and tree object in it to w, as a git pack file (version 2).
+// Each object appears once, however many times it occurs in the tree; none are deltified.
+// The pack can be given to `git index-pack`, or sent to a remote by `git receive-pack`.
+// With the SHA1 algorithm, it's a pack for an ordinary repository; with SHA256, it's for one with the sha256 object format.
+//
+// Blobs are read twice: once to hash the tree, and again to pack them (trees are packed as they're hashed).
+// Nothing is written to w until every object has been packed, so on error, w is left untouched;
+// meanwhile the pack is assembled in a temporary file.
+//
+// Options that change file content (RespectGitattributesEOL, AutoCRLF, LFS, SymlinksAsText, and NamesOnly) can't be used,
+// nor can AllowPipes, since pipes can't be read twice, nor OnVanished, whose null hashes refer to no object.
+//
+// Errors:
+//
+//   - gittreehash-error-unsupported-option -- if any of the options above are set.
+//   - gittreehash-error-concurrent-io -- if a file changes between being hashed and being packed.
+//   - gittreehash-error-io -- if the temporary file can't be written, or writing to w fails.
+//   - any error HashPath may return.
+func PackTree(fsys fsx.FS, rootPath string, w io.Writer, opts Options) error {
+	_, err := packTree(fsys, rootPath, w, nil, opts)
+	return err
+}
+
+// packTree is PackTree, also returning the hash of the tree,
+// and, if idx isn't nil, writing the pack's index (version 2, as `git index-pack` would make it) to idx after the pack.
+func packTree(fsys fsx.FS, rootPath string, w, idx io.Writer, opts Options) ([32]byte, error) {
+	if err := checkObjectOptions(opts, "a pack"); err != nil {
+		return [32]byte{}, err
+	}
+
+	spool, err := newPackSpool(opts.Algorithm)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer spool.close()
+
+	// Trees are packed as they're hashed, since their bodies are at hand; blobs are only noted, to be read again afterwards.
+	opts.TreeSpillThreshold = -1 // So that every tree body is seen by onTreeBody.
+	var blobs []Entry
+	onEntry := opts.OnEntry
+	opts.OnEntry = func(e Entry) {
+		if e.Type == "blob" {
+			blobs = append(blobs, e)
+		}
+		if onEntry != nil {
+			onEntry(e)
+		}
+	}
+	h := newHasher(fsys, opts)
+	h.onTreeBody = func(_ string, body []byte) {
+		hash := opts.Algorithm.hashObject("tree", body)
+		spool.add(hash, packObjTree, int64(len(body)), bytes.NewReader(body))
+	}
+	hash, _, err := h.hashSomething(rootPath, nil)
+	if err = unwrapAbort(err); err != nil {
+		return [32]byte{}, err
+	}
+	if spool.err != nil {
+		return [32]byte{}, spool.err
+	}
+
+	for _, e := range blobs {
+		var blobHash [32]byte
+		copy(blobHash[:], e.Hash)
+		if spool.has(blobHash) {
+			continue
+		}
+		if err := spool.addBlob(fsys, e, blobHash); err != nil {
+			return [32]byte{}, err
+		}
+	}
+	if err := spool.writeTo(w); err != nil {
+		return [32]byte{}, err
+	}
+	if idx != nil {
+		if err := spool.writeIndex(idx); err != nil {
+			return [32]byte{}, err
+		}
+	}
+	return hash, nil
+}
+
+// checkObjectOptions refuses the options which would make the hashes of a tree differ from its objects' content,
+// or which stop files being read twice; what is the kind of output, for the message.
+//
+// Errors:
+//
+//   - gittreehash-error-unsupported-option -- if any such options are set.
+func checkObjectOptions(opts Options, what string) error {
+	var unsupported []string
+	for _, opt := range []struct {
+		name string
+		set  bool
+	}{
+		{"RespectGitattributesEOL", opts.RespectGitattributesEOL},
+		{"AutoCRLF", opts.AutoCRLF},
+		{"LFS", opts.LFS != LFSContent},
+		{"SymlinksAsText", opts.SymlinksAsText != nil},
+		{"NamesOnly", opts.NamesOnly},
+		{"AllowPipes", opts.AllowPipes},
+		{"OnVanished", opts.OnVanished != nil},
+	} {
+		if opt.set {
+			unsupported = append(unsupported, opt.name)
+		}
+	}
+	if len(unsupported) > 0 {
+		return serum.Error(ErrUnsupportedOption,
+			serum.WithMessageTemplate("can't write {{output}} with the options {{options}}"),
+			serum.WithDetail("output", what),
+			serum.WithDetail("options", strings.Join(unsupported, ", ")),
+		)
+	}
+	return nil
+}
+
+// writePackFile is packTree, writing the pack to a file, and its index beside it
+// (named for the pack, with ".idx" in place of any ".pack" extension), so that git can use the pack as it is.
+// Both files are removed if anything goes wrong.
+func writePackFile(packPath string, fsys fsx.FS, rootPath string, opts Options) ([32]byte, error) {
+	idxPath := strings.TrimSuffix(packPath, ".pack") + ".idx"
+	f, err := os.Create(packPath)
+	if err != nil {
+		return [32]byte{}, newErrIO(err)
+	}
+	idxFile, err := os.Create(idxPath)
+	if err != nil {
+		f.Close()
+		os.Remove(packPath)
+		return [32]byte{}, newErrIO(err)
+	}
+	bw, idxBuf := bufio.NewWriter(f), bufio.NewWriter(idxFile)
+	hash, err := packTree(fsys, rootPath, bw, idxBuf, opts)
+	if err == nil {
+		if err = bw.Flush(); err == nil {
+			err = idxBuf.Flush()
+		}
+		if err != nil {
+			err = newErrIO(err)
+		}
+	}
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = newErrIO(cerr)
+	}
+	if cerr := idxFile.Close(); err == nil && cerr != nil {
+		err = newErrIO(cerr)
+	}
+	if err != nil {
+		os.Remove(packPath)
+		os.Remove(idxPath)
+		return [32]byte{}, err
+	}
+	return hash, nil
+}
+
+// packSpool accumulates the entries of a pack in a temporary file,
+// since the pack's header has to give the number of objects before any of them.
+type packSpool struct {
+	algorithm Algorithm
+	f         *os.File
+	buf       *bufio.Writer
+	zw        *zlib.Writer
+	seen      map[[32]byte]struct{}
+	entries   []packIndexEntry // Every object, in the order they were added, for the index.
+	n         int64            // How many bytes of entries have been written, after the header.
+	checksum  []byte           // The pack's trailing checksum, once it's been written out.
+	err       error            // The first error adding an object, if any; adding more does nothing once there's been one.
+}
+
+// packIndexEntry is what the index records about an object: where its entry starts in the pack, and the CRC-32 of the entry.
+type packIndexEntry struct {
+	hash   [32]byte
+	offset int64
+	crc    uint32
+}
+
+// Write appends to the pack's entries, keeping count of the bytes and the CRC-32 of the entry being added.
+func (p *packSpool) Write(b []byte) (int, error) {
+	n, err := p.buf.Write(b)
+	p.n += int64(n)
+	last := &p.entries[len(p.entries)-1]
+	last.crc = crc32.Update(last.crc, crc32.IEEETable, b[:n])
+	return n, err
+}
+
+// newPackSpool creates the temporary file for a pack.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the temporary file can't be created.
+func newPackSpool(algorithm Algorithm) (*packSpool, error) {
+	f, err := os.CreateTemp("", "gittreehash-pack-*")
+	if err != nil {
+		return nil, newErrIO(err)
+	}
+	buf := bufio.NewWriterSize(f, 1<<20)
+	return &packSpool{algorithm: algorithm, f: f, buf: buf, zw: zlib.NewWriter(buf), seen: map[[32]byte]struct{}{}}, nil
+}
+
+func (p *packSpool) has(hash [32]byte) bool {
+	_, ok := p.seen[hash]
+	return ok
+}
+
+// add appends an object to the pack, unless it's already there.
+func (p *packSpool) add(hash [32]byte, objType byte, size int64, body io.Reader) {
+	if p.err != nil || p.has(hash) {
+		return
+	}
+	p.seen[hash] = struct{}{}
+	p.entries = append(p.entries, packIndexEntry{hash: hash, offset: 12 + p.n}) // The pack's header is 12 bytes.
+	// The header is the type and size, as a little-endian varint whose first byte has only four bits of the size.
+	var header [binary.MaxVarintLen64 + 1]byte
+	header[0] = objType<<4 | byte(size&0x0f)
+	n := 1
+	for size >>= 4; size > 0; size >>= 7 {
+		header[n-1] |= 0x80
+		header[n] = byte(size & 0x7f)
+		n++
+	}
+	if _, err := p.Write(header[:n]); err != nil {
+		p.err = newErrIO(err)
+		return
+	}
+	p.zw.Reset(p)
+	if _, err := io.Copy(p.zw, body); err != nil {
+		p.err = newErrIO(err)
+		return
+	}
+	if err := p.zw.Close(); err != nil {
+		p.err = newErrIO(err)
+	}
+}
+
+// addBlob reads a file (or symlink) again, and appends it to the pack, checking that its content still has the hash it had.
+//
+// Errors:
+//
+//   - gittreehash-error-concurrent-io -- if the file has vanished or changed.
+//   - gittreehash-error-io -- if reading the file, or writing the temporary file, fails.
+//   - gittreehash-error-permission -- if reading the file fails due to permissions.
+func (p *packSpool) addBlob(fsys fsx.FS, e Entry, hash [32]byte) error {
+	content, err := openBlob(fsys, e)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	digester := p.algorithm.New()
+	digester.Write(appendObjectPreamble(nil, "blob", e.Size))
+	counted := &countingReader{r: io.TeeReader(content, digester)}
+	p.add(hash, packObjBlob, e.Size, counted)
+	if p.err != nil {
+		return p.err
+	}
+	var actual [32]byte
+	digester.Sum(actual[:0])
+	if counted.n != e.Size {
+		return NewErrSizeChanged(e.Path, e.Size, counted.n)
+	}
+	if actual != hash {
+		return serum.Errorf(ErrConcurrentIO, "file at %q changed between being hashed and being packed", e.Path)
+	}
+	return nil
+}
+
+// openBlob opens a file again, or reads a symlink's target again, to read the content of a blob entry.
+//
+// Errors:
+//
+//   - gittreehash-error-concurrent-io -- if the file has vanished.
+//   - gittreehash-error-io -- if opening the file, or reading the symlink, fails.
+//   - gittreehash-error-permission -- if that fails due to permissions.
+func openBlob(fsys fsx.FS, e Entry) (io.ReadCloser, error) {
+	if e.Mode&fs.ModeSymlink != 0 {
+		target, err := fsx.Readlink(fsys, e.Path)
+		if err != nil {
+			if isVanished(err) {
+				return nil, NewErrVanished(e.Path)
+			}
+			return nil, newErrIO(err)
+		}
+		return io.NopCloser(strings.NewReader(target)), nil
+	}
+	f, err := fsys.Open(e.Path)
+	if err != nil {
+		if isVanished(err) {
+			return nil, NewErrVanished(e.Path)
+		}
+		return nil, newErrIO(err)
+	}
+	return f, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeTo writes out the whole pack: the header, every object, and the trailing checksum.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if reading the temporary file, or writing to w, fails.
+func (p *packSpool) writeTo(w io.Writer) error {
+	if err := p.buf.Flush(); err != nil {
+		return newErrIO(err)
+	}
+	if _, err := p.f.Seek(0, io.SeekStart); err != nil {
+		return newErrIO(err)
+	}
+	digester := p.algorithm.New()
+	out := io.MultiWriter(w, digester)
+	var header [12]byte
+	copy(header[:], "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(p.seen)))
+	if _, err := out.Write(header[:]); err != nil {
+		return newErrIO(err)
+	}
+	if _, err := io.Copy(out, p.f); err != nil {
+		return newErrIO(err)
+	}
+	p.checksum = digester.Sum(nil)
+	if _, err := w.Write(p.checksum); err != nil {
+		return newErrIO(err)
+	}
+	return nil
+}
+
+// writeIndex writes the index of the pack (version 2), once the pack has been written out:
+// a fan-out table of how many hashes begin with each byte or less, the sorted hashes, their CRC-32s, their offsets
+// (those beyond 2GiB indirectly, through a table of 8-byte offsets), the pack's checksum, and the index's own.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if writing to w fails.
+func (p *packSpool) writeIndex(w io.Writer) error {
+	size := p.algorithm.Size()
+	entries := append([]packIndexEntry(nil), p.entries...)
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].hash[:size], entries[j].hash[:size]) < 0 })
+
+	digester := p.algorithm.New()
+	out := bufio.NewWriter(io.MultiWriter(w, digester))
+	out.Write([]byte{0xff, 't', 'O', 'c', 0, 0, 0, 2})
+	var word [8]byte
+	putUint32 := func(v uint32) {
+		binary.BigEndian.PutUint32(word[:4], v)
+		out.Write(word[:4])
+	}
+	var fanout [256]uint32
+	for _, e := range entries {
+		fanout[e.hash[0]]++
+	}
+	var total uint32
+	for _, count := range fanout {
+		total += count
+		putUint32(total)
+	}
+	for _, e := range entries {
+		out.Write(e.hash[:size])
+	}
+	for _, e := range entries {
+		putUint32(e.crc)
+	}
+	var large []int64
+	for _, e := range entries {
+		if e.offset < 1<<31 {
+			putUint32(uint32(e.offset))
+		} else {
+			putUint32(1<<31 | uint32(len(large)))
+			large = append(large, e.offset)
+		}
+	}
+	for _, offset := range large {
+		binary.BigEndian.PutUint64(word[:], uint64(offset))
+		out.Write(word[:])
+	}
+	out.Write(p.checksum)
+	if err := out.Flush(); err != nil {
+		return newErrIO(err)
+	}
+	if _, err := w.Write(digester.Sum(nil)); err != nil {
+		return newErrIO(err)
+	}
+	return nil
+}
+
+// close removes the temporary file.
+func (p *packSpool) close() {
+	p.f.Close()
+	os.Remove(p.f.Name())
+}
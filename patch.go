@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+const (
+	ErrInvalidPatch  = "gittreehash-error-invalid-patch"
+	ErrPatchConflict = "gittreehash-error-patch-conflict"
+)
+
+// HashPatched computes the hash HashPath would give for a path, if a patch were applied to it first.
+// Nothing is written: the patched files are held in memory, and everything else is read from fsys as usual.
+//
+// The patch is a unified diff, such as `git diff` or `git stash show -p` make, with paths relative to rootPath,
+// and prefixed by one directory (like "a/" and "b/") which is stripped.  Git's extended headers are understood,
+// so the patch can create, delete, and rename files, change their modes, and turn them into symlinks and back.
+// Hunks must apply exactly where they say, with all of their context matching; there's no fuzz.
+// As when git applies a patch, directories left empty by deleting files are removed.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-patch -- if the patch can't be parsed, or has binary or submodule changes, which can't be applied.
+//   - gittreehash-error-patch-conflict -- if the patch doesn't apply: context doesn't match, or a file to be created already exists, or one to be changed doesn't.
+//     The error's "line" detail gives the line of the patch which didn't apply.
+//   - gittreehash-error-io -- if reading a file to patch fails.
+//   - gittreehash-error-permission -- if reading a file to patch fails due to permissions.
+//   - any error HashPath may return.
+func HashPatched(fsys fsx.FS, rootPath string, patch io.Reader, opts Options) ([32]byte, error) {
+	body, err := io.ReadAll(patch)
+	if err != nil {
+		return [32]byte{}, newErrIO(err)
+	}
+	patches, err := parsePatch(string(body))
+	if err != nil {
+		return [32]byte{}, err
+	}
+	pfs := newPatchedFS(fsys)
+	for _, fp := range patches {
+		if err := pfs.apply(rootPath, fp); err != nil {
+			return [32]byte{}, err
+		}
+	}
+	return HashPath(pfs, rootPath, opts)
+}
+
+// filePatch is the part of a patch concerning one file.
+type filePatch struct {
+	line             int    // The line of the patch where this file's part begins.
+	oldPath, newPath string // Relative to the root, with the prefix stripped; oldPath is "" for a file being created, and newPath for one being deleted.
+	oldMode, newMode string // Git's modes, e.g. "100644", where the patch gives them.
+	created, deleted bool
+	copied           bool // The file at oldPath stays, rather than being renamed.
+	binary           bool
+	hunks            []hunk
+
+	git       bool // Whether this began with a "diff --git" line, which may be followed by the ---/+++ lines.
+	fileLines bool // Whether the ---/+++ lines have been seen.
+}
+
+// hunk is one "@@" section of a filePatch.
+type hunk struct {
+	line     int // The line of the patch with the "@@".
+	oldStart int
+	oldLines int
+	body     []hunkLine
+}
+
+type hunkLine struct {
+	op   byte   // ' ' for context, '-' for a removed line, '+' for an added one.
+	text string // Including the newline, unless it's the last line of a file that doesn't end in one.
+	line int    // The line of the patch it's on.
+}
+
+// parsePatch splits a unified diff into what it does to each file.
+// Anything that's not part of a file's diff (such as a commit message) is ignored.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-patch -- if a header or hunk is malformed, or a path is absolute or climbs out with "..".
+func parsePatch(body string) ([]*filePatch, error) {
+	lines := strings.SplitAfter(body, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	var patches []*filePatch
+	var cur *filePatch
+	for i := 0; i < len(lines); i++ {
+		text := strings.TrimSuffix(lines[i], "\n")
+		lineNo := i + 1
+		var err error
+		switch {
+		case strings.HasPrefix(text, "diff --git "):
+			cur = &filePatch{line: lineNo, git: true}
+			cur.oldPath, cur.newPath = splitGitDiffHeader(text[len("diff --git "):])
+			patches = append(patches, cur)
+		case strings.HasPrefix(text, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			if cur == nil || !cur.git || cur.fileLines || len(cur.hunks) > 0 {
+				cur = &filePatch{line: lineNo}
+				patches = append(patches, cur)
+			}
+			cur.fileLines = true
+			if cur.oldPath, err = parsePatchPath(text[len("--- "):], true, lineNo); err != nil {
+				return nil, err
+			}
+			if cur.newPath, err = parsePatchPath(strings.TrimSuffix(lines[i+1][len("+++ "):], "\n"), true, lineNo+1); err != nil {
+				return nil, err
+			}
+			cur.created = cur.created || cur.oldPath == ""
+			cur.deleted = cur.deleted || cur.newPath == ""
+			i++
+		case strings.HasPrefix(text, "@@ "):
+			if cur == nil {
+				return nil, newErrInvalidPatch(lineNo, "a hunk comes before any file's header")
+			}
+			h, n, err := parseHunk(lines[i:], lineNo)
+			if err != nil {
+				return nil, err
+			}
+			cur.hunks = append(cur.hunks, h)
+			i += n - 1
+		case cur == nil || len(cur.hunks) > 0:
+			// Not part of any file's header.
+		case strings.HasPrefix(text, "old mode "):
+			cur.oldMode = text[len("old mode "):]
+		case strings.HasPrefix(text, "new mode "):
+			cur.newMode = text[len("new mode "):]
+		case strings.HasPrefix(text, "deleted file mode "):
+			cur.oldMode, cur.deleted = text[len("deleted file mode "):], true
+		case strings.HasPrefix(text, "new file mode "):
+			cur.newMode, cur.created = text[len("new file mode "):], true
+		case strings.HasPrefix(text, "rename from "), strings.HasPrefix(text, "copy from "):
+			cur.copied = strings.HasPrefix(text, "copy")
+			if cur.oldPath, err = parsePatchPath(text[strings.Index(text, "from ")+len("from "):], false, lineNo); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(text, "rename to "), strings.HasPrefix(text, "copy to "):
+			if cur.newPath, err = parsePatchPath(text[strings.Index(text, "to ")+len("to "):], false, lineNo); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(text, "index "):
+			// "index <old>..<new> <mode>", where the mode is the same before and after.
+			if fields := strings.Fields(text); len(fields) == 3 && cur.oldMode == "" && cur.newMode == "" {
+				cur.oldMode, cur.newMode = fields[2], fields[2]
+			}
+		case strings.HasPrefix(text, "Binary files "), text == "GIT binary patch":
+			cur.binary = true
+		}
+	}
+	for _, fp := range patches {
+		if fp.created {
+			fp.oldPath = ""
+		}
+		if fp.deleted {
+			fp.newPath = ""
+		}
+		if fp.oldPath == "" && fp.newPath == "" {
+			return nil, newErrInvalidPatch(fp.line, "can't tell which file this part of the patch is for")
+		}
+	}
+	return patches, nil
+}
+
+// splitGitDiffHeader finds the paths in the rest of a "diff --git a/<path> b/<path>" line.
+// Since the paths may contain spaces, this is only unambiguous when they're the same, which is when it's needed:
+// otherwise, the ---/+++ or rename lines will give them.  If they can't be found, both are "".
+func splitGitDiffHeader(rest string) (string, string) {
+	if len(rest)%2 == 0 {
+		return "", ""
+	}
+	half := len(rest) / 2
+	a, b := rest[:half], rest[half+1:]
+	i, j := strings.IndexByte(a, '/'), strings.IndexByte(b, '/')
+	if rest[half] != ' ' || i < 0 || j < 0 || a[i:] != b[j:] {
+		return "", ""
+	}
+	pth, err := parsePatchPath(a, true, 0)
+	if err != nil {
+		return "", ""
+	}
+	return pth, pth
+}
+
+// parsePatchPath decodes a path from a patch: unquoting it if git quoted it, and stripping its first directory, if it has a prefix.
+// /dev/null becomes "".
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-patch -- if the quoting is malformed, or the path is absolute or climbs out with "..".
+func parsePatchPath(raw string, prefixed bool, lineNo int) (string, error) {
+	if i := strings.IndexByte(raw, '\t'); i >= 0 && !strings.HasPrefix(raw, "\"") {
+		raw = raw[:i] // Plain diff puts a timestamp after a tab.
+	}
+	if raw == "/dev/null" {
+		return "", nil
+	}
+	if strings.HasPrefix(raw, "\"") {
+		// Git's quoting is C's, which is near enough Go's: the octal escapes it uses for bytes outside ASCII work the same.
+		unquoted, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", newErrInvalidPatch(lineNo, fmt.Sprintf("path %s is badly quoted", raw))
+		}
+		raw = unquoted
+	}
+	if prefixed {
+		i := strings.IndexByte(raw, '/')
+		if i < 0 {
+			return "", newErrInvalidPatch(lineNo, fmt.Sprintf("path %q has no prefix to strip", raw))
+		}
+		raw = raw[i+1:]
+	}
+	pth, err := cleanVpath(raw)
+	if err != nil || strings.HasPrefix(raw, "/") {
+		return "", newErrInvalidPatch(lineNo, fmt.Sprintf("path %q must be relative, and within the tree", raw))
+	}
+	return pth, nil
+}
+
+// parseHunk parses the hunk starting at the first of the lines, returning it, and how many lines it took up.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-patch -- if the "@@" line is malformed, or the hunk has fewer lines than it says.
+func parseHunk(lines []string, lineNo int) (hunk, int, error) {
+	h := hunk{line: lineNo}
+	var newLines int
+	var err error
+	header := strings.Fields(strings.TrimSuffix(lines[0], "\n"))
+	if len(header) < 4 || header[3] != "@@" || !strings.HasPrefix(header[1], "-") || !strings.HasPrefix(header[2], "+") {
+		return hunk{}, 0, newErrInvalidPatch(lineNo, "malformed hunk header")
+	}
+	if h.oldStart, h.oldLines, err = parseHunkRange(header[1][1:]); err == nil {
+		_, newLines, err = parseHunkRange(header[2][1:])
+	}
+	if err != nil {
+		return hunk{}, 0, newErrInvalidPatch(lineNo, "malformed hunk header")
+	}
+	oldLeft, newLeft := h.oldLines, newLines
+	n := 1
+	for ; oldLeft > 0 || newLeft > 0 || (n < len(lines) && strings.HasPrefix(lines[n], "\\")); n++ {
+		if n >= len(lines) {
+			return hunk{}, 0, newErrInvalidPatch(lineNo, "the hunk ends early")
+		}
+		line := lines[n]
+		op := byte(' ')
+		if line != "\n" { // Some editors strip the space from empty context lines.
+			op, line = line[0], line[1:]
+		}
+		switch op {
+		case ' ':
+			oldLeft--
+			newLeft--
+		case '-':
+			oldLeft--
+		case '+':
+			newLeft--
+		case '\\':
+			// "\ No newline at end of file", about the line before.
+			if len(h.body) > 0 {
+				h.body[len(h.body)-1].text = strings.TrimSuffix(h.body[len(h.body)-1].text, "\n")
+			}
+			continue
+		default:
+			return hunk{}, 0, newErrInvalidPatch(lineNo+n, "the hunk ends early")
+		}
+		if oldLeft < 0 || newLeft < 0 {
+			return hunk{}, 0, newErrInvalidPatch(lineNo+n, "the hunk has more lines than its header says")
+		}
+		h.body = append(h.body, hunkLine{op: op, text: line, line: lineNo + n})
+	}
+	return h, n, nil
+}
+
+// parseHunkRange parses one side of a hunk header: "start,count", or just "start" for a count of 1.
+func parseHunkRange(s string) (start, count int, err error) {
+	count = 1
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		if count, err = strconv.Atoi(s[i+1:]); err != nil {
+			return 0, 0, err
+		}
+		s = s[:i]
+	}
+	start, err = strconv.Atoi(s)
+	return start, count, err
+}
+
+// applyHunks applies hunks to content, which they must match exactly.
+// The pth is only for errors.
+//
+// Errors:
+//
+//   - gittreehash-error-patch-conflict -- if a hunk's context or removed lines don't match the content.
+func applyHunks(pth string, content []byte, hunks []hunk) ([]byte, error) {
+	old := strings.SplitAfter(string(content), "\n")
+	if old[len(old)-1] == "" {
+		old = old[:len(old)-1]
+	}
+	var out strings.Builder
+	pos := 0
+	for _, h := range hunks {
+		start := h.oldStart - 1
+		if h.oldLines == 0 {
+			start = h.oldStart // Nothing's removed, so the hunk goes after the line it names.
+		}
+		if start < pos || start > len(old) {
+			return nil, newErrPatchConflict(h.line, pth, fmt.Sprintf("the hunk is for line %d, but the file has %d lines", h.oldStart, len(old)))
+		}
+		for ; pos < start; pos++ {
+			out.WriteString(old[pos])
+		}
+		for _, l := range h.body {
+			if l.op == '+' {
+				out.WriteString(l.text)
+				continue
+			}
+			if pos >= len(old) || old[pos] != l.text {
+				return nil, newErrPatchConflict(l.line, pth, fmt.Sprintf("line %d of the file doesn't match", pos+1))
+			}
+			if l.op == ' ' {
+				out.WriteString(l.text)
+			}
+			pos++
+		}
+	}
+	for ; pos < len(old); pos++ {
+		out.WriteString(old[pos])
+	}
+	return []byte(out.String()), nil
+}
+
+// parseGitMode converts one of git's modes for a file to a FileMode.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-patch -- if the mode is for a submodule, or unknown.
+func parseGitMode(mode string, lineNo int) (fs.FileMode, error) {
+	switch mode {
+	case "100644":
+		return 0o644, nil
+	case "100755":
+		return 0o755, nil
+	case "120000":
+		return fs.ModeSymlink | 0o777, nil
+	case "160000":
+		return 0, newErrInvalidPatch(lineNo, "changes to submodules can't be applied")
+	default:
+		return 0, newErrInvalidPatch(lineNo, fmt.Sprintf("unknown mode %q", mode))
+	}
+}
+
+func newErrInvalidPatch(line int, reason string) error {
+	return serum.Error(ErrInvalidPatch,
+		serum.WithMessageTemplate("patch is invalid at line {{line}}: {{reason}}"),
+		serum.WithDetail("line", strconv.Itoa(line)),
+		serum.WithDetail("reason", reason),
+	)
+}
+
+func newErrPatchConflict(line int, pth, reason string) error {
+	return serum.Error(ErrPatchConflict,
+		serum.WithMessageTemplate("patch doesn't apply to {{path}} at line {{line}}: {{reason}}"),
+		serum.WithDetail("line", strconv.Itoa(line)),
+		serum.WithDetail("path", pth),
+		withPathBytes("path", pth),
+		serum.WithDetail("reason", reason),
+	)
+}
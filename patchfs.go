@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+var (
+	_ fsx.FSSupportingReadlink = (*patchedFS)(nil)
+	_ fs.ReadDirFS             = (*patchedFS)(nil)
+)
+
+// patchedFS is a filesystem as it would be after applying a patch: files the patch creates or changes are held in memory,
+// and everything else is read from the filesystem beneath.
+type patchedFS struct {
+	base    fsx.FS
+	files   map[string]*patchedFile    // Files created or changed, by path.
+	deleted map[string]bool            // Paths deleted (or renamed away), and not since created again.
+	dirs    map[string]bool            // Directories created to hold new files, where there were none.
+	added   map[string]map[string]bool // The names of the files and directories created in each directory.
+	emptied map[string]bool            // Directories that deleting files may have left empty.
+}
+
+type patchedFile struct {
+	content []byte
+	mode    fs.FileMode
+}
+
+func newPatchedFS(base fsx.FS) *patchedFS {
+	return &patchedFS{
+		base:    base,
+		files:   map[string]*patchedFile{},
+		deleted: map[string]bool{},
+		dirs:    map[string]bool{},
+		added:   map[string]map[string]bool{},
+		emptied: map[string]bool{},
+	}
+}
+
+// apply applies one file's part of a patch.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-patch -- if the part is a binary change, or has a mode that can't be applied.
+//   - gittreehash-error-patch-conflict -- if it doesn't apply.
+//   - gittreehash-error-io -- if reading the file fails.
+//   - gittreehash-error-permission -- if reading the file fails due to permissions.
+func (p *patchedFS) apply(root string, fp *filePatch) error {
+	if fp.binary && !(fp.deleted && len(fp.hunks) == 0) {
+		return newErrInvalidPatch(fp.line, "binary changes can't be applied")
+	}
+	var content []byte
+	var mode fs.FileMode
+	if !fp.created {
+		oldPath := filepath.Join(root, filepath.FromSlash(fp.oldPath))
+		var exists bool
+		var err error
+		if content, mode, exists, err = p.current(oldPath); err != nil {
+			return err
+		}
+		if !exists {
+			return newErrPatchConflict(fp.line, oldPath, "the file doesn't exist")
+		}
+		if !fp.binary {
+			if content, err = applyHunks(oldPath, content, fp.hunks); err != nil {
+				return err
+			}
+		}
+		if !fp.copied && fp.oldPath != fp.newPath {
+			p.remove(oldPath)
+		}
+		if fp.deleted {
+			if !fp.binary && len(content) > 0 {
+				return newErrPatchConflict(fp.line, oldPath, "the file to delete has more content than the patch removes")
+			}
+			return nil
+		}
+	} else {
+		var err error
+		if content, err = applyHunks(fp.newPath, nil, fp.hunks); err != nil {
+			return err
+		}
+	}
+
+	newPath := filepath.Join(root, filepath.FromSlash(fp.newPath))
+	if fp.created || fp.oldPath != fp.newPath {
+		if _, _, exists, err := p.current(newPath); err != nil {
+			return err
+		} else if exists {
+			return newErrPatchConflict(fp.line, newPath, "the file already exists")
+		}
+	}
+	switch {
+	case fp.newMode != "":
+		m, err := parseGitMode(fp.newMode, fp.line)
+		if err != nil {
+			return err
+		}
+		if fp.created || m.Type() != mode.Type() || (m&0o111 != 0) != (mode&0o111 != 0) {
+			mode = m // Otherwise keep the file's own permissions, which say the same to git.
+		}
+	case fp.created:
+		return newErrInvalidPatch(fp.line, "no mode is given for a new file")
+	}
+	return p.put(root, newPath, &patchedFile{content: content, mode: mode})
+}
+
+// current returns what's at a path now: its content (or, for a symlink, its target) and mode.
+//
+// Errors:
+//
+//   - gittreehash-error-patch-conflict -- if there's a directory or some special file at the path.
+//   - gittreehash-error-io -- if reading fails.
+//   - gittreehash-error-permission -- if reading fails due to permissions.
+func (p *patchedFS) current(pth string) ([]byte, fs.FileMode, bool, error) {
+	if f, ok := p.files[pth]; ok {
+		return f.content, f.mode, true, nil
+	}
+	fi, err := p.Lstat(pth)
+	switch {
+	case err != nil && isVanished(err):
+		return nil, 0, false, nil
+	case err != nil:
+		return nil, 0, false, newErrIO(err)
+	case fi.Mode().IsRegular():
+		content, err := fsx.ReadFile(p.base, pth)
+		if err != nil {
+			return nil, 0, false, newErrIO(err)
+		}
+		return content, fi.Mode(), true, nil
+	case fi.Mode()&fs.ModeSymlink != 0:
+		target, err := fsx.Readlink(p.base, pth)
+		if err != nil {
+			return nil, 0, false, newErrIO(err)
+		}
+		return []byte(target), fi.Mode(), true, nil
+	default:
+		return nil, 0, false, newErrPatchConflict(0, pth, "there's something other than a file there: "+describeFileInfo(fi))
+	}
+}
+
+// put records a file's new content, creating the directories to hold it if need be.
+//
+// Errors:
+//
+//   - gittreehash-error-patch-conflict -- if something other than a directory is in the way.
+func (p *patchedFS) put(root, pth string, f *patchedFile) error {
+	for dir := filepath.Dir(pth); dir != root && dir != "." && !p.dirs[dir]; dir = filepath.Dir(dir) {
+		fi, err := p.Lstat(dir)
+		if err == nil && fi.IsDir() {
+			break
+		}
+		if err == nil || !isVanished(err) {
+			return newErrPatchConflict(0, pth, "it's beneath "+dir+", which is not a directory")
+		}
+		delete(p.deleted, dir)
+		p.dirs[dir] = true
+		p.addName(dir)
+	}
+	delete(p.deleted, pth)
+	p.files[pth] = f
+	p.addName(pth)
+	return nil
+}
+
+func (p *patchedFS) addName(pth string) {
+	dir := filepath.Dir(pth)
+	if p.added[dir] == nil {
+		p.added[dir] = map[string]bool{}
+	}
+	p.added[dir][filepath.Base(pth)] = true
+}
+
+// remove deletes a file, noting that the directories above it may be left empty.
+func (p *patchedFS) remove(pth string) {
+	delete(p.files, pth)
+	p.deleted[pth] = true
+	for dir := filepath.Dir(pth); dir != "." && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		p.emptied[dir] = true
+	}
+}
+
+func (p *patchedFS) Open(name string) (fs.File, error) {
+	name = filepath.Clean(name)
+	if f, ok := p.files[name]; ok {
+		return &patchedFileHandle{Reader: bytes.NewReader(f.content), fi: f.info(name)}, nil
+	}
+	if p.deleted[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if p.dirs[name] {
+		return &patchedFileHandle{Reader: bytes.NewReader(nil), fi: patchedDirInfo(name)}, nil
+	}
+	return p.base.Open(name)
+}
+
+func (p *patchedFS) Lstat(name string) (fs.FileInfo, error) {
+	name = filepath.Clean(name)
+	if f, ok := p.files[name]; ok {
+		return f.info(name), nil
+	}
+	if p.deleted[name] {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+	}
+	if p.dirs[name] {
+		return patchedDirInfo(name), nil
+	}
+	return fsx.Lstat(p.base, name)
+}
+
+func (p *patchedFS) Readlink(name string) (string, error) {
+	name = filepath.Clean(name)
+	if f, ok := p.files[name]; ok {
+		if f.mode&fs.ModeSymlink == 0 {
+			return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+		}
+		return string(f.content), nil
+	}
+	if p.deleted[name] {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	}
+	return fsx.Readlink(p.base, name)
+}
+
+// ReadDir lists a directory as it is beneath, less what's been deleted, and with what's been created.
+// Directories left empty by deleting files are left out, as git would remove them.
+func (p *patchedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = filepath.Clean(name)
+	ents := map[string]fs.DirEntry{}
+	if !p.dirs[name] {
+		baseEnts, err := fsx.ReadDir(p.base, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ent := range baseEnts {
+			ents[ent.Name()] = ent
+		}
+	}
+	for n := range p.added[name] {
+		fi, err := p.Lstat(filepath.Join(name, n))
+		if err != nil {
+			continue // Created, and then deleted again.
+		}
+		ents[n] = fs.FileInfoToDirEntry(fi)
+	}
+	result := make([]fs.DirEntry, 0, len(ents))
+	for n, ent := range ents {
+		child := filepath.Join(name, n)
+		if p.deleted[child] {
+			continue
+		}
+		if p.emptied[child] && ent.IsDir() {
+			if rest, err := p.ReadDir(child); err == nil && len(rest) == 0 {
+				continue
+			}
+		}
+		result = append(result, ent)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+func (f *patchedFile) info(pth string) fs.FileInfo {
+	return patchedInfo{name: filepath.Base(pth), mode: f.mode, size: int64(len(f.content))}
+}
+
+func patchedDirInfo(pth string) fs.FileInfo {
+	return patchedInfo{name: filepath.Base(pth), mode: fs.ModeDir | 0o755}
+}
+
+// patchedInfo describes a file or directory that exists only in a patchedFS.
+type patchedInfo struct {
+	name string
+	mode fs.FileMode
+	size int64
+}
+
+func (fi patchedInfo) Name() string       { return fi.name }
+func (fi patchedInfo) Size() int64        { return fi.size }
+func (fi patchedInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi patchedInfo) ModTime() time.Time { return time.Time{} }
+func (fi patchedInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi patchedInfo) Sys() any           { return nil }
+
+// patchedFileHandle is an open file from a patchedFS.
+type patchedFileHandle struct {
+	*bytes.Reader
+	fi fs.FileInfo
+}
+
+func (f *patchedFileHandle) Stat() (fs.FileInfo, error) { return f.fi, nil }
+func (f *patchedFileHandle) Close() error               { return nil }
+
+// mainApplyStash implements the apply-stash subcommand, which prints the hash a directory would have, were a patch applied to it.
+func mainApplyStash(args []string) int {
+	fset := flag.NewFlagSet("apply-stash", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s apply-stash --stash-patch=<file> [--base-path=<dir>] [flags]\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nthe patch is a unified diff, as made by `git stash show -p` or `git diff`, with paths relative to the base path.\n")
+		fmt.Fprintf(fset.Output(), "prints the hash the base path would have with the patch applied, without changing anything on disk.\n\n")
+		fset.PrintDefaults()
+	}
+	patchFile := fset.String("stash-patch", "", "the patch to apply (\"-\" for stdin)")
+	basePath := fset.String("base-path", ".", "the directory to apply the patch to")
+	algorithm := fset.String("algorithm", "sha256", "hash function to use, matching git's object format: \"sha256\" or \"sha1\"")
+	var opts Options
+	fset.BoolVar(&opts.IgnoreFileMode, "ignore-filemode", false, "record all regular files as 100644, ignoring executable bits, as git does with core.fileMode=false")
+	fset.BoolVar(&opts.IgnoreDotGit, "ignore-dot-git", false, "leave out anything named .git, at any depth, as git does")
+	fset.Parse(args)
+	if *patchFile == "" || fset.NArg() != 0 {
+		fset.Usage()
+		return 2
+	}
+	switch *algorithm {
+	case "sha256":
+		opts.Algorithm = SHA256
+	case "sha1":
+		opts.Algorithm = SHA1
+	default:
+		fmt.Fprintf(os.Stderr, "unknown algorithm %q\n", *algorithm)
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	if *patchFile != "-" {
+		f, err := os.Open(*patchFile)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				err = NewErrNotFound(*patchFile)
+			} else {
+				err = newErrIO(err)
+			}
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			return exitCode(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	hash, err := HashPatched(rawDirFS("."), filepath.Clean(*basePath), r, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	fmt.Printf("%x\n", hash[:opts.Algorithm.Size()])
+	return 0
+}
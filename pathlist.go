@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+// HashPathList computes the hash of a synthetic tree: the tree at rootPath, holding only the listed paths,
+// and the directories leading to them.  Content is read from the filesystem, just as HashPath reads it.
+//
+// Paths name things in fsys the same way rootPath does, so with rootPath "src", "src/a/b" is the path of the file b in the directory a;
+// this is how `find src` names things.  Every path must be beneath rootPath (or be rootPath itself).
+// A listed directory stands for its whole subtree, as if everything beneath it were listed too;
+// directories that are only implied, by being a parent of something listed, contain just what's listed beneath them.
+// The order of the list doesn't matter, and paths listed more than once (or beneath a listed directory) are harmless.
+// An empty list gives the hash of an empty tree.
+//
+// If opts.Include is set, something is hashed only if it's both listed and admitted by it.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-path -- if a path isn't beneath rootPath.
+//   - gittreehash-error-not-found -- if any paths don't exist; the error lists all of them.
+//   - gittreehash-error-invalid-entry -- if a path is beneath something that isn't a directory (such as a symlink).
+//   - gittreehash-error-io -- if checking a path fails.
+//   - gittreehash-error-permission -- if checking a path fails due to permissions.
+//   - any error HashPath may return.
+func HashPathList(fsys fsx.FS, rootPath string, paths []string, opts Options) ([32]byte, error) {
+	include, err := includePathList(fsys, rootPath, paths)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if prior := opts.Include; prior != nil {
+		opts.Include = func(pth string, isDir bool) bool { return include(pth, isDir) && prior(pth, isDir) }
+	} else {
+		opts.Include = include
+	}
+	return HashPath(fsys, rootPath, opts)
+}
+
+// includePathList returns a function for Options.Include which admits the listed paths, everything beneath any listed directories,
+// and the directories leading to them; see HashPathList for the details.
+// Every path is checked to exist before anything is hashed, so that all the missing ones can be reported at once.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-path -- if a path isn't beneath rootPath.
+//   - gittreehash-error-not-found -- if any paths don't exist.
+//   - gittreehash-error-invalid-entry -- if a path is beneath something that isn't a directory.
+//   - gittreehash-error-io -- if checking a path fails.
+//   - gittreehash-error-permission -- if checking a path fails due to permissions.
+func includePathList(fsys fsx.FS, rootPath string, paths []string) (func(pth string, isDir bool) bool, error) {
+	rootPath = filepath.Clean(rootPath)
+	listed := map[string]bool{}      // Every listed path; true for directories, which bring their whole subtree.
+	implied := map[string]struct{}{} // Directories leading to listed paths.
+	var missing []string
+	wholeRoot := false
+	for _, pth := range paths {
+		pth = filepath.Clean(pth)
+		if _, done := listed[pth]; done {
+			continue
+		}
+		rel, err := filepath.Rel(rootPath, pth)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, serum.Error(ErrInvalidPath,
+				serum.WithMessageTemplate("path {{path}} is not beneath the root, {{root}}"),
+				serum.WithDetail("path", pth),
+				withPathBytes("path", pth),
+				serum.WithDetail("root", rootPath),
+				withPathBytes("root", rootPath),
+			)
+		}
+		fi, err := fsx.Lstat(fsys, pth)
+		if err != nil {
+			if isVanished(err) {
+				missing = append(missing, pth)
+				continue
+			}
+			return nil, newErrIO(err)
+		}
+		listed[pth] = fi.IsDir()
+		if rel == "." {
+			wholeRoot = true
+			continue
+		}
+		// Lstat followed any symlinks among the parents, so check that they're really directories; the hasher won't follow them.
+		for dir := filepath.Dir(pth); dir != rootPath; dir = filepath.Dir(dir) {
+			if _, ok := implied[dir]; ok {
+				break
+			}
+			fi, err := fsx.Lstat(fsys, dir)
+			if err != nil {
+				return nil, newErrIO(err)
+			}
+			if !fi.IsDir() {
+				return nil, newErrInvalidEntry(pth, "it's beneath "+dir+", which is not a directory")
+			}
+			implied[dir] = struct{}{}
+		}
+	}
+	if len(missing) > 0 {
+		return nil, NewErrPathsNotFound(missing)
+	}
+	if wholeRoot {
+		return func(string, bool) bool { return true }, nil
+	}
+	return func(pth string, isDir bool) bool {
+		if _, ok := listed[pth]; ok {
+			return true
+		}
+		if _, ok := implied[pth]; ok && isDir {
+			return true
+		}
+		for dir := filepath.Dir(pth); dir != rootPath && dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+			if listed[dir] {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// readPaths0 reads a list of NUL-terminated paths, as made by `find -print0`.  The last one may lack its terminator.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if reading fails.
+func readPaths0(r io.Reader) ([]string, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, newErrIO(err)
+	}
+	var paths []string
+	for _, pth := range bytes.Split(bytes.TrimSuffix(body, []byte{0}), []byte{0}) {
+		if len(pth) > 0 {
+			paths = append(paths, string(pth))
+		}
+	}
+	return paths, nil
+}
+
+func NewErrPathsNotFound(paths []string) error {
+	return serum.Error(
+		ErrNotFound,
+		serum.WithMessageTemplate("nothing exists at {{count}} of the listed paths: {{paths}}"),
+		serum.WithDetail("count", strconv.Itoa(len(paths))),
+		serum.WithDetail("paths", strings.Join(paths, "\n")),
+	)
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+package main
+
+import (
+	"io/fs"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+)
+
+// oNonblock is the open flag that keeps opening a named pipe from waiting for a writer, where there is one.
+const oNonblock = 0
+
+// clearNonblock does nothing, on this platform.
+func clearNonblock(f fs.File) {}
+
+// pipeTimeoutSupported is true on platforms where readPipeWithTimeout works.
+const pipeTimeoutSupported = false
+
+// readPipeWithTimeout is not supported on this platform.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- always.
+func (h *hasher) readPipeWithTimeout(pth string, timeout time.Duration) ([]byte, error) {
+	return nil, serum.Errorf(ErrIO, "reading pipes with a timeout is not supported on this platform (at path %q)", pth)
+}
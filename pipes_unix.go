@@ -0,0 +1,93 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/warpfork/go-fsx"
+)
+
+// oNonblock is the open flag that keeps opening a named pipe from waiting for a writer.
+// Files are opened with it to read their content, so that one swapped for a pipe since it was stat'ed
+// can't hang hashing before checkSameFile gets to notice.
+const oNonblock = syscall.O_NONBLOCK
+
+// clearNonblock puts a file opened with oNonblock back into blocking mode, if it's from the os package.
+func clearNonblock(f fs.File) {
+	sc, ok := f.(syscall.Conn)
+	if !ok {
+		return
+	}
+	if rc, err := sc.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) { syscall.SetNonblock(int(fd), false) })
+	}
+}
+
+// pipeTimeoutSupported is true on platforms where readPipeWithTimeout works.
+const pipeTimeoutSupported = true
+
+// readPipeWithTimeout reads a named pipe until EOF, giving up if that takes longer than the timeout
+// (including the time spent waiting for a writer to show up, which is where opening a pipe blocks).
+//
+// Errors:
+//
+//   - gittreehash-error-pipe-timeout -- if the timeout elapses.
+//   - gittreehash-error-io -- if opening or reading the pipe fails.
+//   - gittreehash-error-permission -- if opening or reading the pipe fails due to permissions.
+//   - gittreehash-error-concurrent-io -- if the pipe vanishes before it can be opened.
+func (h *hasher) readPipeWithTimeout(pth string, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	type opened struct {
+		f   fsx.File
+		err error
+	}
+	ch := make(chan opened, 1)
+	go func() {
+		f, err := h.fsys.Open(pth)
+		ch <- opened{f, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var f fsx.File
+	select {
+	case o := <-ch:
+		if o.err != nil {
+			if isVanished(o.err) {
+				return nil, NewErrVanished(pth)
+			}
+			return nil, newErrIO(o.err)
+		}
+		f = o.f
+	case <-timer.C:
+		// Unstick the open that's still waiting for a writer, by briefly being a writer ourselves.
+		// Then the goroutine can finish, and we close what it opened.
+		if w, err := fsx.OpenFile(h.fsys, pth, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+			w.Close()
+		}
+		go func() {
+			if o := <-ch; o.f != nil {
+				o.f.Close()
+			}
+		}()
+		return nil, NewErrPipeTimeout(pth, timeout)
+	}
+	defer f.Close()
+	// Files from the os package support deadlines on pipes.  Other filesystems are on their own.
+	if df, ok := f.(interface{ SetReadDeadline(time.Time) error }); ok {
+		df.SetReadDeadline(deadline)
+	}
+	content, err := io.ReadAll(f)
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, NewErrPipeTimeout(pth, timeout)
+		}
+		return nil, newErrIO(err)
+	}
+	return content, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/fs"
+	"sync"
+)
+
+// DefaultPrefetch is how many entries ahead of hashing are prefetched when Options.Prefetch is zero.
+const DefaultPrefetch = 4
+
+// prefetchReadahead is how much of each regular file the kernel is asked to read in ahead of time.
+// Hashing soon catches up with it, and sequential readahead takes over from there.
+const prefetchReadahead = 1 << 20
+
+// prefetch warms up the entries of a directory ahead of their being hashed, so that waiting on the filesystem
+// overlaps with hashing instead of alternating with it: up to Options.Prefetch entries ahead, it fetches each one's
+// FileInfo (which hashing then uses, so this costs no extra requests, on any filesystem), and on the local filesystem,
+// for regular files whose content will be read, asks the kernel to start reading it in.
+//
+// The returned advance function must be called as hashing starts on each entry, in order, to let the prefetcher move on;
+// stop must be called once the directory is done with (and waits for the prefetcher to finish).
+func (h *hasher) prefetch(anc *ancestry, children []treeChild) (advance func(), stop func()) {
+	if h.opts.Prefetch < 0 || len(children) < 2 {
+		return func() {}, func() {}
+	}
+	lead := make(chan struct{}, h.opts.Prefetch)
+	for i := 0; i < h.opts.Prefetch; i++ {
+		lead <- struct{}{}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, child := range children {
+			select {
+			case <-lead:
+			case <-done:
+				return
+			}
+			if h.aborted() != nil {
+				return
+			}
+			h.prefetchOne(anc, child)
+		}
+	}()
+	advance = func() {
+		select {
+		case lead <- struct{}{}:
+		default: // Already as far ahead as it may be.
+		}
+	}
+	stop = func() {
+		close(done)
+		wg.Wait()
+	}
+	return advance, stop
+}
+
+// prefetchOne fetches an entry's FileInfo, and if it's a regular file on the local filesystem that hashing will read,
+// advises the kernel to read in its start.
+// Opening files elsewhere isn't worth it: on a remote filesystem, it's another request rather than a hint.
+// Errors are ignored; hashing will run into them again, and report them properly.
+func (h *hasher) prefetchOne(anc *ancestry, child treeChild) {
+	fi, err := child.dirEnt.Info()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 || h.rate != nil {
+		return
+	}
+	if _, local := h.fsys.(rawDirFS); !local || h.answeredWithoutReading(anc, child.path, fi) {
+		return
+	}
+	h.acquireFile()
+	defer h.releaseFile()
+	f, err := h.openFile(child.path)
+	if err != nil {
+		return
+	}
+	adviseWillNeed(f, prefetchReadahead)
+	f.Close()
+}
+
+// answeredWithoutReading reports whether hashEntry will find a regular file's hash without reading it:
+// from the git index, from another hard link to it already hashed, or from the cache.
+func (h *hasher) answeredWithoutReading(anc *ancestry, pth string, fi fs.FileInfo) bool {
+	lfs, action := h.isLFS(anc, pth), h.eolActionFor(anc, pth)
+	if _, ok := h.indexDigest(anc, pth, fi, lfs, action); ok {
+		return true
+	}
+	if lfs || action != eolAsIs {
+		return false
+	}
+	if key, ok := blobMemoKeyFor(fi); ok {
+		if _, ok := h.memoizedBlob(key); ok {
+			return true
+		}
+	}
+	return h.opts.Cache != nil && !h.opts.CacheRewrite && h.opts.Cache.has(pth, fi)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/fs"
+	"strings"
+)
+
+// PrependPath wraps a hash in synthetic parent trees, giving the hash of a tree which contains
+// the original object at the given slash-separated path and nothing else.
+// For example, with the prefix "a/b", the result is the hash of a tree holding only a tree "a", which holds only "b",
+// which is the original object.  This is how independently hashed subtrees can be placed within a larger virtual tree.
+//
+// The mode is that of the original object (fs.ModeDir for a tree), as found on the filesystem;
+// only Options.Algorithm and Options.IgnoreFileMode affect the result.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-path -- if the prefix contains "..", or is empty.
+func PrependPath(hash [32]byte, mode fs.FileMode, prefix string, opts Options) ([32]byte, error) {
+	prefix, err := cleanVpath(prefix)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	h := newHasher(nil, Options{Algorithm: opts.Algorithm, IgnoreFileMode: opts.IgnoreFileMode})
+	segs := strings.Split(prefix, "/")
+	for i := len(segs) - 1; i >= 0; i-- {
+		buf := getTreeBuffer()
+		h.writeTreeEntry(buf, segs[i], mode, hash)
+		hash = h.hashTreeBody(strings.Join(segs[:i], "/"), buf)
+		putTreeBuffer(buf)
+		mode = fs.ModeDir
+	}
+	return hash, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// progressBar reports how far through hashing we are, via its OnEntry method.
+// The total comes from a counting pass made beforehand, so the percentage is an estimate:
+// the tree may change in between, and entries skipped due to errors are never reached.
+//
+// On a terminal, it draws a bar scaled to the terminal's width, redrawing it in place.
+// Otherwise it falls back to printing a line of plain text now and then.
+type progressBar struct {
+	w     io.Writer
+	tty   bool
+	width int // Columns available.  Only used on a terminal.
+	total int
+	done  int
+	last  time.Time
+}
+
+// These are the least time between updates, so that drawing doesn't slow down hashing.
+const (
+	progressIntervalTTY  = 100 * time.Millisecond
+	progressIntervalText = 2 * time.Second
+)
+
+// newProgressBar sets up a progress bar on the given file (normally stderr).
+// The width is taken from the COLUMNS environment variable if it's set, and otherwise asked of the terminal.
+func newProgressBar(f *os.File, total int) *progressBar {
+	width, tty := terminalWidth(f)
+	if cols, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && cols > 0 {
+		width = cols
+	}
+	if width <= 0 {
+		width = 80
+	}
+	return &progressBar{w: f, tty: tty, width: width, total: total}
+}
+
+func (p *progressBar) OnEntry(Entry) {
+	p.done++
+	interval := progressIntervalText
+	if p.tty {
+		interval = progressIntervalTTY
+	}
+	if now := time.Now(); now.Sub(p.last) >= interval {
+		p.last = now
+		p.draw()
+	}
+}
+
+// Finish draws the final state, and on a terminal, moves to a fresh line so that later output isn't mixed into the bar.
+func (p *progressBar) Finish() {
+	p.draw()
+	if p.tty {
+		fmt.Fprintln(p.w)
+	}
+}
+
+func (p *progressBar) draw() {
+	pct := 100
+	if p.total > 0 && p.done < p.total {
+		pct = p.done * 100 / p.total
+	}
+	if !p.tty {
+		fmt.Fprintf(p.w, "hashed %d of %d entries (%d%%)\n", p.done, p.total, pct)
+		return
+	}
+	counts := fmt.Sprintf(" %3d%% %*d/%d", pct, len(strconv.Itoa(p.total)), p.done, p.total) // Fixed width, so the bar doesn't jitter.
+	barWidth := p.width - len(counts) - 3 // The brackets, and a spare column so the cursor doesn't wrap.
+	if barWidth < 10 {
+		fmt.Fprintf(p.w, "\r%s", counts) // Too narrow for a bar to mean anything.
+		return
+	}
+	filled := barWidth * pct / 100
+	fmt.Fprintf(p.w, "\r[%s%s]%s", strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), counts)
+}
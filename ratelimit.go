@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket, shared by everything reading file content during a hashing run,
+// which holds the total read rate to Options.ReadRate.
+type rateLimiter struct {
+	rate  float64 // Bytes per second.
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst int64) *rateLimiter {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &rateLimiter{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take spends n bytes' worth of tokens, sleeping until the bucket has refilled enough to cover them.
+// The debt is taken on first and then slept off, so concurrent readers queue up fairly behind each other.
+func (l *rateLimiter) take(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// rateLimitedReader reads through a rateLimiter.  Each read is no bigger than the burst size,
+// so that a single large buffer can't make for a long stall followed by a flood.
+type rateLimitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if max := int(r.l.burst); len(p) > max && max > 0 {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	r.l.take(n)
+	return n, err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/warpfork/go-fsx"
+)
+
+var (
+	_ fsx.FSSupportingWrite    = rawDirFS("")
+	_ fsx.FSSupportingReadlink = rawDirFS("")
+	_ fs.ReadDirFS             = rawDirFS("")
+)
+
+// rawDirFS is like osfs.DirFS, but never rejects names that aren't valid UTF-8.
+//
+// Filenames on most unix systems are arbitrary bytes, but the standard library's os.DirFS
+// (which osfs.DirFS uses for Open, and thus for ReadDir) refuses any path that fs.ValidPath doesn't like,
+// and fs.ValidPath requires UTF-8.  That would make trees with e.g. legacy Latin-1 names unhashable.
+// Names are passed through to the operating system exactly as given, so they round-trip byte for byte.
+// Absolute names are used as-is, rather than being taken as relative to the directory.
+type rawDirFS string
+
+func (dir rawDirFS) join(name string) string {
+	if name == "." {
+		return string(dir)
+	}
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return string(dir) + "/" + name
+}
+
+func (dir rawDirFS) Open(name string) (fs.File, error) {
+	return os.Open(dir.join(name))
+}
+
+func (dir rawDirFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(dir.join(name))
+}
+
+func (dir rawDirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(dir.join(name))
+}
+
+func (dir rawDirFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	return os.OpenFile(dir.join(name), flag, perm)
+}
+
+func (dir rawDirFS) Mkdir(name string, perm fs.FileMode) error {
+	return os.Mkdir(dir.join(name), perm)
+}
+
+func (dir rawDirFS) Readlink(name string) (string, error) {
+	return os.Readlink(dir.join(name))
+}
+
+func (dir rawDirFS) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(dir.join(name))
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io/fs"
+)
+
+// dropBehindInterval is how much of a file is read between each advice to the kernel to drop what's been read
+// from the page cache, when Options.DropCache is set.
+const dropBehindInterval = 8 << 20
+
+// dropBehindReader reads a file, advising the kernel to drop each stretch of it from the page cache once it's been read,
+// so that hashing a large file doesn't first push everything else out of the cache.
+type dropBehindReader struct {
+	f       fs.File
+	off     int64 // How much has been read.
+	dropped int64 // How much has been advised away.
+}
+
+func (r *dropBehindReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.off += int64(n)
+	if r.off-r.dropped >= dropBehindInterval {
+		adviseDontNeed(r.f, r.dropped, r.off-r.dropped)
+		r.dropped = r.off
+	}
+	return n, err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const ErrInvalidTree = "gittreehash-error-invalid-tree"
+
+// TreeEntry is one entry decoded from the body of a tree object.
+type TreeEntry struct {
+	Mode string // As written in the tree, e.g. "100644", or "40000" for a directory.
+	Name string
+	Hash []byte
+}
+
+// Type returns the type of object the entry refers to, as git ls-tree describes it.
+func (e TreeEntry) Type() string {
+	switch e.Mode {
+	case "40000":
+		return "tree"
+	case "160000":
+		return "commit"
+	default:
+		return "blob"
+	}
+}
+
+// ParseTreeObject decodes the body of a tree object (everything after the "tree <len>\x00" preamble), as laid out by git:
+// a sequence of "<mode> <name>\x00<hash>" records, with hashes digestLen bytes long (20 for SHA-1, 32 for SHA-256).
+// It's the inverse of how HashPath encodes trees, and is strict: anything git itself wouldn't write is rejected.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-tree -- if an entry's mode isn't octal digits without leading zeros,
+//     or its name is empty, ".", "..", or contains a slash, or its hash is truncated,
+//     or there are bytes after the last entry which don't make up another.
+//   - gittreehash-error-io -- if reading r fails.
+func ParseTreeObject(r io.Reader, digestLen int) ([]TreeEntry, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, newErrIO(err)
+	}
+	return parseTreeEntries(body, digestLen)
+}
+
+// parseTreeBody is ParseTreeObject, for a body already in memory, and hashes of the given algorithm.
+func parseTreeBody(body []byte, algorithm Algorithm) ([]TreeEntry, error) {
+	return parseTreeEntries(body, algorithm.Size())
+}
+
+func parseTreeEntries(body []byte, digestLen int) ([]TreeEntry, error) {
+	var entries []TreeEntry
+	for offset := 0; offset < len(body); {
+		rest := body[offset:]
+		sp := bytes.IndexByte(rest, ' ')
+		if sp < 0 {
+			if len(entries) > 0 {
+				return nil, newErrInvalidTree(offset, fmt.Sprintf("%d bytes of trailing garbage after the last entry", len(rest)))
+			}
+			return nil, newErrInvalidTree(offset, "no space after the mode")
+		}
+		mode := string(rest[:sp])
+		if err := checkTreeMode(mode); err != "" {
+			return nil, newErrInvalidTree(offset, err)
+		}
+		rest = rest[sp+1:]
+		nul := bytes.IndexByte(rest, 0)
+		if nul < 0 {
+			return nil, newErrInvalidTree(offset, "no NUL after the name")
+		}
+		name := string(rest[:nul])
+		switch {
+		case name == "":
+			return nil, newErrInvalidTree(offset, "the name is empty")
+		case name == "." || name == "..":
+			return nil, newErrInvalidTree(offset, fmt.Sprintf("the name is %q", name))
+		case strings.Contains(name, "/"):
+			return nil, newErrInvalidTree(offset, fmt.Sprintf("the name %q contains a slash", name))
+		}
+		rest = rest[nul+1:]
+		if len(rest) < digestLen {
+			return nil, newErrInvalidTree(offset, fmt.Sprintf("truncated hash; expected %d bytes, but only %d remain", digestLen, len(rest)))
+		}
+		entries = append(entries, TreeEntry{Mode: mode, Name: name, Hash: rest[:digestLen]})
+		offset = len(body) - len(rest) + digestLen
+	}
+	return entries, nil
+}
+
+// checkTreeMode returns why a mode isn't one a tree can hold, or "" if it's fine.
+// Any octal number is accepted, as git's own parser does, but not with leading zeros (which git never writes),
+// nor more digits than a file mode has.
+func checkTreeMode(mode string) string {
+	switch {
+	case mode == "":
+		return "the mode is empty"
+	case len(mode) > 6:
+		return fmt.Sprintf("mode %q is too long", mode)
+	case mode[0] == '0':
+		return fmt.Sprintf("mode %q has a leading zero", mode)
+	}
+	if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+		return fmt.Sprintf("mode %q is not octal", mode)
+	}
+	return ""
+}
+
+func newErrInvalidTree(offset int, reason string) error {
+	return serum.Error(ErrInvalidTree,
+		serum.WithMessageTemplate("tree body is invalid at byte {{offset}}: {{reason}}"),
+		serum.WithDetail("offset", strconv.Itoa(offset)),
+		serum.WithDetail("reason", reason),
+	)
+}
+
+// mainReadTree implements the read-tree subcommand, which decodes a hex-encoded tree body (as printed by dump-tree)
+// and prints its entries as git ls-tree would.
+func mainReadTree(args []string) int {
+	fset := flag.NewFlagSet("read-tree", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s read-tree [flags] <hex>\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nthe hex is the body of a tree object, as printed by dump-tree; give \"-\" to read it from stdin.\n")
+		fmt.Fprintf(fset.Output(), "prints \"<mode> <type> <hash>\\t<name>\" for each entry, as git ls-tree does.\n\n")
+		fset.PrintDefaults()
+	}
+	algorithm := fset.String("algorithm", "sha256", "hash function the tree was made with, matching git's object format: \"sha256\" or \"sha1\"")
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return 2
+	}
+	var alg Algorithm
+	switch *algorithm {
+	case "sha256":
+		alg = SHA256
+	case "sha1":
+		alg = SHA1
+	default:
+		fmt.Fprintf(os.Stderr, "unknown algorithm %q\n", *algorithm)
+		return 2
+	}
+
+	encoded := fset.Arg(0)
+	if encoded == "-" {
+		stdin, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			err = newErrIO(err)
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			return exitCode(err)
+		}
+		encoded = string(stdin)
+	}
+	body, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "not valid hex: %s\n", err)
+		return 2
+	}
+	entries, err := parseTreeBody(body, alg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	for _, e := range entries {
+		fmt.Printf("%06s %s %x\t%s\n", e.Mode, e.Type(), e.Hash, e.Name)
+	}
+	return 0
+}
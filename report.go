@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// csvReporter returns an Options.OnEntry callback which writes a CSV row for every entry.
+// A header row is written immediately.
+// Each row is flushed as soon as it's written, so that the output can be consumed incrementally.
+func csvReporter(w io.Writer) func(Entry) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"hash", "mode", "type", "size", "path"})
+	cw.Flush()
+	return func(e Entry) {
+		cw.Write([]string{hex.EncodeToString(e.Hash[:]), e.GitMode, e.Type, strconv.FormatInt(e.Size, 10), e.Path})
+		cw.Flush()
+	}
+}
+
+// jsonLinesEntry is the JSON object jsonLinesReporter writes for each entry.
+type jsonLinesEntry struct {
+	Hash       string `json:"hash"`
+	Mode       string `json:"mode"`
+	Type       string `json:"type"`
+	Size       int64  `json:"size"`
+	Path       string `json:"path"`
+	PathBase64 string `json:"pathBase64,omitempty"` // Only for paths that aren't valid UTF-8, which JSON strings can't carry exactly.
+}
+
+// jsonLinesReporter returns an Options.OnEntry callback which writes a JSON object, on a line of its own, for every entry.
+// As with csvReporter, each line is written as soon as the entry is hashed, so the output can be consumed incrementally.
+// Unlike csvReporter, a failure to write isn't ignored: it's given to onWriteError (as a gittreehash-error-io),
+// which is expected not to return, so that a reader which has gone away (like `jq` given `select(...) | halt`) stops the run.
+func jsonLinesReporter(w io.Writer, onWriteError func(error)) func(Entry) {
+	enc := json.NewEncoder(w) // Encode writes each value in one Write, ending it with a newline.
+	return func(e Entry) {
+		line := jsonLinesEntry{Hash: hex.EncodeToString(e.Hash), Mode: e.GitMode, Type: e.Type, Size: e.Size, Path: e.Path}
+		if !utf8.ValidString(e.Path) {
+			line.PathBase64 = base64.StdEncoding.EncodeToString([]byte(e.Path))
+		}
+		if err := enc.Encode(line); err != nil {
+			onWriteError(newErrIO(err))
+		}
+	}
+}
+
+// templateEntry is what a --template is executed with, for each entry.
+type templateEntry struct {
+	Hash      string // In hex.
+	Path      string
+	Mode      string // As git shows it, e.g. "100644" or "040000".
+	Type      string // Either "blob" or "tree".
+	Size      int64
+	Algorithm string // "sha256" or "sha1".
+}
+
+// templateReporter returns an Options.OnEntry callback which writes a line for every entry, formatted by a text/template.
+// The template is tried out on an empty entry first, so that mistakes (like misspelt fields) are reported now, rather than for every entry.
+// Failures to write are ignored, as they are by csvReporter.
+func templateReporter(w io.Writer, text string, algorithm Algorithm) (func(Entry), error) {
+	tmpl, err := template.New("entry").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, templateEntry{}); err != nil {
+		return nil, err
+	}
+	var line bytes.Buffer
+	return func(e Entry) {
+		line.Reset()
+		tmpl.Execute(&line, templateEntry{hex.EncodeToString(e.Hash), e.Path, e.GitMode, e.Type, e.Size, algorithm.String()})
+		line.WriteByte('\n')
+		w.Write(line.Bytes())
+	}, nil
+}
+
+// treeReporter collects entries, via its OnEntry method, so that once hashing is done
+// they can be drawn as a tree (in the style of the tree command) with an abbreviated hash after each name.
+// Unlike csvReporter, nothing can be written incrementally, since directories are reported after their contents.
+type treeReporter struct {
+	children map[string][]Entry // Keyed by the parent's path.
+	root     Entry              // The root is always reported last, so this is simply the latest entry.
+}
+
+func newTreeReporter() *treeReporter {
+	return &treeReporter{children: map[string][]Entry{}}
+}
+
+func (r *treeReporter) OnEntry(e Entry) {
+	parent := filepath.Dir(e.Path)
+	r.children[parent] = append(r.children[parent], e)
+	r.root = e
+}
+
+// treeGlyphs are the strings used to draw the branches of a tree.
+type treeGlyphs struct {
+	branch, last, pipe, blank string
+}
+
+var (
+	unicodeTreeGlyphs = treeGlyphs{"├── ", "└── ", "│   ", "    "}
+	asciiTreeGlyphs   = treeGlyphs{"|-- ", "`-- ", "|   ", "    "}
+)
+
+// localeGlyphs picks unicode box-drawing characters if the locale says the terminal can display them,
+// and plain ASCII otherwise.  The usual precedence of LC_ALL over LC_CTYPE over LANG applies.
+func localeGlyphs() treeGlyphs {
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if v := os.Getenv(name); v != "" {
+			v = strings.ToLower(v)
+			if strings.Contains(v, "utf-8") || strings.Contains(v, "utf8") {
+				return unicodeTreeGlyphs
+			}
+			return asciiTreeGlyphs
+		}
+	}
+	return asciiTreeGlyphs
+}
+
+// Render draws the tree.  Directories are shown with a trailing slash.
+func (r *treeReporter) Render(w io.Writer, glyphs treeGlyphs) error {
+	if _, err := fmt.Fprintf(w, "%s [%s]\n", r.root.Path, abbrevHash(r.root.Hash)); err != nil {
+		return err
+	}
+	return r.writeChildren(w, glyphs, r.root.Path, "")
+}
+
+func (r *treeReporter) writeChildren(w io.Writer, glyphs treeGlyphs, parent string, indent string) error {
+	var kids []Entry
+	for _, e := range r.children[parent] {
+		if e.Path != parent { // The root may be filed as its own child, if it's ".".
+			kids = append(kids, e)
+		}
+	}
+	// Order as git would, since not every source of entries reports them in that order (tar archives, for instance).
+	sort.SliceStable(kids, func(i, j int) bool {
+		return treeEntrySortKey(filepath.Base(kids[i].Path), kids[i].Type == "tree") < treeEntrySortKey(filepath.Base(kids[j].Path), kids[j].Type == "tree")
+	})
+	for i, e := range kids {
+		branch, continuation := glyphs.branch, glyphs.pipe
+		if i == len(kids)-1 {
+			branch, continuation = glyphs.last, glyphs.blank
+		}
+		name := filepath.Base(e.Path)
+		if e.Type == "tree" {
+			name += "/"
+		}
+		if _, err := fmt.Fprintf(w, "%s%s%s [%s]\n", indent, branch, name, abbrevHash(e.Hash)); err != nil {
+			return err
+		}
+		if e.Type == "tree" {
+			if err := r.writeChildren(w, glyphs, e.Path, indent+continuation); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// abbrevHash returns the first few hex digits of a hash, which is plenty to tell entries apart by eye.
+func abbrevHash(hash []byte) string {
+	const n = 6 // bytes; 12 hex digits.
+	if len(hash) > n {
+		hash = hash[:n]
+	}
+	return hex.EncodeToString(hash)
+}
+
+// goArrayLiteral formats a hash as a Go array literal, e.g. "[32]byte{0x4a, 0x82, ...}",
+// suitable for pasting into Go source.
+func goArrayLiteral(hash []byte) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[%d]byte{", len(hash))
+	for i, b := range hash {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "0x%02x", b)
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+
+	"github.com/warptools/gittreehash/gitattributes"
+)
+
+// gitStatData is the stat information git records for each file in its index, which it uses to decide
+// whether a file may have changed since its content was recorded.  Git truncates every field to 32 bits.
+type gitStatData struct {
+	ctimeSec, ctimeNsec uint32
+	mtimeSec, mtimeNsec uint32
+	ino                 uint32
+	uid, gid            uint32
+	size                uint32
+}
+
+// digestsFromIndex returns a function for Options.GitIndexDigests which answers from the index
+// of the repository containing the starting path.
+//
+// A file's recorded blob id is trusted only if git status would trust it without reading the file:
+// its ctime, mtime, inode number, owner, size, and executable bit all match what the index recorded
+// (as with git's defaults, core.trustctime and core.checkStat), and the entry isn't "racily clean",
+// meaning it wasn't modified in the same second as the index was written, or later.
+// Device numbers aren't compared, as git doesn't by default either.
+//
+// If the repository's object format isn't the given algorithm, the recorded ids are of no use, and nil is returned.
+//
+// Errors:
+//
+//   - gittreehash-error-no-repository -- if the starting path isn't inside a git repository.
+//   - gittreehash-error-io -- if locating the repository fails.
+//   - gittreehash-error-permission -- if locating the repository fails due to permissions.
+//   - gitindex-error-io -- if the index file can't be read.
+//   - gitindex-error-parse -- if the index file isn't valid.
+func digestsFromIndex(startPath string, algorithm Algorithm) (func(pth string, fi fs.FileInfo) ([32]byte, bool), error) {
+	idx, indexFile, hasherPath, err := readIndexFor(startPath)
+	if err != nil {
+		return nil, err
+	}
+	if idx.HashSize != algorithm.Size() {
+		return nil, nil
+	}
+	indexInfo, err := os.Stat(indexFile)
+	if err != nil {
+		return nil, newErrIO(err)
+	}
+	racyFrom := indexInfo.ModTime().Unix()
+
+	type recorded struct {
+		stat       gitStatData
+		executable bool
+		hash       [32]byte
+	}
+	entries := map[string]recorded{}
+	for _, ent := range idx.Entries {
+		if ent.Stage != 0 || ent.SkipWorktree || ent.IntentToAdd || ent.Mode&0o170000 != 0o100000 {
+			continue // Only regular files with settled content are any use.
+		}
+		if int64(ent.MtimeSec) >= racyFrom {
+			continue
+		}
+		pth, ok := hasherPath(ent.Path)
+		if !ok {
+			continue
+		}
+		rec := recorded{
+			stat: gitStatData{
+				ctimeSec: ent.CtimeSec, ctimeNsec: ent.CtimeNsec,
+				mtimeSec: ent.MtimeSec, mtimeNsec: ent.MtimeNsec,
+				ino: ent.Ino,
+				uid: ent.UID, gid: ent.GID,
+				size: ent.Size,
+			},
+			executable: ent.Mode&0o111 != 0,
+		}
+		copy(rec.hash[:], ent.Hash)
+		entries[pth] = rec
+	}
+	return func(pth string, fi fs.FileInfo) ([32]byte, bool) {
+		rec, ok := entries[pth]
+		if !ok {
+			return [32]byte{}, false
+		}
+		stat, ok := gitStatDataFor(fi)
+		if !ok || stat != rec.stat || (fi.Mode()&0o100 != 0) != rec.executable {
+			return [32]byte{}, false
+		}
+		return rec.hash, true
+	}, nil
+}
+
+// indexDigest asks Options.GitIndexDigests for a file's blob id, if git's index would hold the same hash we'd compute.
+// Git records content after its clean filters, so that's only so when we'd be making the same conversions:
+// no filter applies, or it's LFS and we're hashing LFS pointers; and we'd convert line endings as git would.
+func (h *hasher) indexDigest(anc *ancestry, pth string, fi fs.FileInfo, lfs bool, action eolAction) ([32]byte, bool) {
+	if h.opts.GitIndexDigests == nil {
+		return [32]byte{}, false
+	}
+	switch filter := h.attributesFor(anc, pth, false, "filter")["filter"]; {
+	case filter.State == gitattributes.Value && filter.Value == "lfs":
+		if !lfs {
+			return [32]byte{}, false
+		}
+	case filter.State == gitattributes.Value:
+		return [32]byte{}, false // Some other filter, which we can't apply.
+	}
+	if h.gitEOLActionFor(anc, pth) != action {
+		return [32]byte{}, false
+	}
+	return h.opts.GitIndexDigests(pth, fi)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+var (
+	_ fsx.FSSupportingStat = s3FS{}
+	_ fs.ReadDirFS         = s3FS{}
+)
+
+// s3ReadRetries is how many times reading an object may be resumed, from where it left off, after the connection fails.
+const s3ReadRetries = 3
+
+// s3API is the part of the S3 client s3FS uses.
+type s3API interface {
+	ListObjectsV2(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// s3FS is an fsx.FS for the objects in an S3 bucket under a prefix, which it presents as a directory tree:
+// the slashes in keys separate directories, which exist only as long as there are objects within them.
+// Names are relative to the prefix, so "." is the prefix itself.
+//
+// Object stores have no symlinks or permission bits, so s3FS implements Stat but not Lstat or Readlink,
+// and the hasher treats it as it does any plain filesystem: every object is a regular file, recorded as 100644.
+// Objects whose keys end in a slash (the "folder" placeholders some tools create) aren't files;
+// they only make the directory exist, even if it's otherwise empty.
+//
+// Directory listings carry each object's size, so hashing needs only one request per directory, and one per object read.
+// Reads are streamed; if a connection fails partway, the read is resumed with a ranged request,
+// which (like ReadAt's) asks for the same version of the object that was first opened, by its ETag.
+//
+// Failed requests are reported as gittreehash-error-io (or gittreehash-error-permission, if access is denied),
+// with the bucket and key as details.
+type s3FS struct {
+	ctx    context.Context
+	client s3API
+	bucket string
+	prefix string // Empty, or ending with a slash.
+}
+
+// parseS3URL splits an "s3://bucket/prefix" URL into the bucket and the prefix, which is returned either empty or ending with a slash.
+func parseS3URL(s string) (bucket, prefix string, ok bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "s3" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", "", false
+	}
+	prefix = strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return u.Host, prefix, true
+}
+
+// newS3FS returns an s3FS for the objects in a bucket under a prefix.
+// Credentials and the region come from the AWS SDK's default chain (environment variables, shared config files,
+// instance roles, and so on); the region defaults to us-east-1 if none is configured.
+// If endpoint is non-empty, it's the URL of an S3-compatible service (such as MinIO) to use instead of AWS,
+// addressing buckets by path rather than by host name.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the SDK's configuration can't be loaded.
+func newS3FS(ctx context.Context, bucket, prefix, endpoint string) (s3FS, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return s3FS{}, serum.Errorf(ErrIO, "loading AWS configuration: %w", err)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return s3FS{ctx: ctx, client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+// key returns the key of the object a name refers to; or, followed by a slash, the prefix of the objects in the directory it refers to.
+func (s s3FS) key(name string) string {
+	if name == "." {
+		return strings.TrimSuffix(s.prefix, "/")
+	}
+	return s.prefix + name
+}
+
+func (s s3FS) Stat(name string) (fs.FileInfo, error) {
+	if name != "." {
+		out, err := s.client.HeadObject(s.ctx, &s3.HeadObjectInput{Bucket: &s.bucket, Key: aws.String(s.key(name))})
+		if err == nil {
+			return s3FileInfo{name: path.Base(name), size: out.ContentLength, modTime: aws.ToTime(out.LastModified)}, nil
+		}
+		if !isS3NotFound(err) {
+			return nil, s.newErr("Stat", s.key(name), err)
+		}
+	}
+	// Not an object; it's a directory if any objects are within it.  (The root is, so long as the prefix is empty.)
+	if name == "." && s.prefix == "" {
+		return s3FileInfo{name: ".", dir: true}, nil
+	}
+	dirPrefix := s.dirPrefix(name)
+	out, err := s.client.ListObjectsV2(s.ctx, &s3.ListObjectsV2Input{Bucket: &s.bucket, Prefix: &dirPrefix, MaxKeys: 1})
+	if err != nil {
+		return nil, s.newErr("Stat", dirPrefix, err)
+	}
+	if len(out.Contents) == 0 {
+		return nil, &fs.PathError{Op: "Stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return s3FileInfo{name: path.Base(name), dir: true}, nil
+}
+
+func (s s3FS) dirPrefix(name string) string {
+	if name == "." {
+		return s.prefix
+	}
+	return s.prefix + name + "/"
+}
+
+func (s s3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	dirPrefix := s.dirPrefix(name)
+	byName := map[string]fs.DirEntry{}
+	placeholder := false
+	in := &s3.ListObjectsV2Input{Bucket: &s.bucket, Prefix: &dirPrefix, Delimiter: aws.String("/")}
+	for {
+		out, err := s.client.ListObjectsV2(s.ctx, in)
+		if err != nil {
+			return nil, s.newErr("ReadDir", dirPrefix, err)
+		}
+		for _, obj := range out.Contents {
+			entName := strings.TrimPrefix(aws.ToString(obj.Key), dirPrefix)
+			if entName == "" {
+				placeholder = true
+				continue
+			}
+			if ent, ok := byName[entName]; ok && ent.IsDir() {
+				return nil, newErrInvalidEntry(dirPrefix+entName, "it's an object, but other objects are beneath it")
+			}
+			byName[entName] = fs.FileInfoToDirEntry(s3FileInfo{name: entName, size: obj.Size, modTime: aws.ToTime(obj.LastModified)})
+		}
+		for _, common := range out.CommonPrefixes {
+			entName := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(common.Prefix), dirPrefix), "/")
+			if entName == "" {
+				return nil, newErrInvalidEntry(aws.ToString(common.Prefix), "the key contains an empty directory name (two slashes in a row)")
+			}
+			if _, ok := byName[entName]; ok {
+				return nil, newErrInvalidEntry(dirPrefix+entName, "it's an object, but other objects are beneath it")
+			}
+			byName[entName] = fs.FileInfoToDirEntry(s3FileInfo{name: entName, dir: true})
+		}
+		if !out.IsTruncated {
+			break
+		}
+		in.ContinuationToken = out.NextContinuationToken
+	}
+	if len(byName) == 0 && !placeholder && (name != "." || s.prefix != "") {
+		return nil, &fs.PathError{Op: "ReadDir", Path: name, Err: fs.ErrNotExist}
+	}
+	ents := make([]fs.DirEntry, 0, len(byName))
+	for _, ent := range byName {
+		ents = append(ents, ent)
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+	return ents, nil
+}
+
+func (s s3FS) Open(name string) (fs.File, error) {
+	key := s.key(name)
+	out, err := s.client.GetObject(s.ctx, &s3.GetObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, &fs.PathError{Op: "Open", Path: name, Err: fs.ErrNotExist}
+		}
+		return nil, s.newErr("Open", key, err)
+	}
+	return &s3File{
+		s:    s,
+		key:  key,
+		etag: aws.ToString(out.ETag),
+		info: s3FileInfo{name: path.Base(name), size: out.ContentLength, modTime: aws.ToTime(out.LastModified)},
+		body: out.Body,
+	}, nil
+}
+
+// newErr reports a failed request, as gittreehash-error-io, or gittreehash-error-permission if access was denied.
+func (s s3FS) newErr(op, key string, err error) error {
+	code := ErrIO
+	if status, ok := s3Status(err); ok && status == 403 {
+		code = ErrPermission
+	}
+	return serum.Error(code,
+		serum.WithMessageTemplate("s3 request for {{key}} in bucket {{bucket}} failed ({{op}}): {{cause}}"),
+		serum.WithDetail("bucket", s.bucket),
+		serum.WithDetail("key", key),
+		withPathBytes("key", key),
+		serum.WithDetail("op", op),
+		serum.WithDetail("cause", err.Error()),
+		serum.WithCause(err),
+	)
+}
+
+// s3Status returns the HTTP status of a failed request, if there was a response.
+func s3Status(err error) (int, bool) {
+	var resp interface{ HTTPStatusCode() int }
+	if errors.As(err, &resp) {
+		return resp.HTTPStatusCode(), true
+	}
+	return 0, false
+}
+
+func isS3NotFound(err error) bool {
+	status, ok := s3Status(err)
+	return ok && status == 404
+}
+
+// s3File is an object opened for reading.
+type s3File struct {
+	s      s3FS
+	key    string
+	etag   string
+	info   s3FileInfo
+	body   io.ReadCloser
+	offset int64
+	resume int // How many times reading has been resumed.
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *s3File) Read(p []byte) (int, error) {
+	for {
+		n, err := f.body.Read(p)
+		f.offset += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil // The failure will come up again on the next read, and be dealt with then.
+		}
+		if f.resume >= s3ReadRetries || f.offset >= f.info.size {
+			return n, f.s.newErr("Read", f.key, err)
+		}
+		f.resume++
+		f.body.Close()
+		if f.body, err = f.getRange(f.offset, -1); err != nil {
+			f.body = io.NopCloser(strings.NewReader(""))
+			return 0, err
+		}
+	}
+}
+
+// ReadAt reads part of the object with a ranged request, which may be made concurrently with others.
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > f.info.size {
+		end = f.info.size
+	}
+	if end == off {
+		return 0, nil
+	}
+	body, err := f.getRange(off, end)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:end-off])
+	if err != nil {
+		return n, f.s.newErr("ReadAt", f.key, err)
+	}
+	if end-off < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// getRange requests the bytes of the object from start up to end (or, if end is negative, the rest of it),
+// from the same version of the object as was opened.
+func (f *s3File) getRange(start, end int64) (io.ReadCloser, error) {
+	rng := fmt.Sprintf("bytes=%d-", start)
+	if end >= 0 {
+		rng += fmt.Sprint(end - 1)
+	}
+	in := &s3.GetObjectInput{Bucket: &f.s.bucket, Key: &f.key, Range: &rng}
+	if f.etag != "" {
+		in.IfMatch = &f.etag
+	}
+	out, err := f.s.client.GetObject(f.s.ctx, in)
+	if err != nil {
+		if status, ok := s3Status(err); ok && (status == 412 || status == 404) {
+			return nil, serum.Error(ErrConcurrentIO,
+				serum.WithMessageTemplate("object {{key}} in bucket {{bucket}} changed while it was being read"),
+				serum.WithDetail("bucket", f.s.bucket),
+				serum.WithDetail("key", f.key),
+				withPathBytes("key", f.key),
+			)
+		}
+		return nil, f.s.newErr("Read", f.key, err)
+	}
+	return out.Body, nil
+}
+
+func (f *s3File) Close() error {
+	return f.body.Close()
+}
+
+// s3FileInfo describes an object, or a directory made up of the objects with a common prefix.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi s3FileInfo) Name() string       { return fi.name }
+func (fi s3FileInfo) Size() int64        { return fi.size }
+func (fi s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi s3FileInfo) IsDir() bool        { return fi.dir }
+func (fi s3FileInfo) Sys() any           { return nil }
+
+func (fi s3FileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
@@ -0,0 +1,16 @@
+package main
+
+// SeedHash XORs a seed into a hash, so that the same tree gives different hashes for different seeds.
+// That separates hashes made for different purposes (say, different deployment environments) into different namespaces,
+// so one can't be mistaken for another by accident.
+//
+// This is NOT a security primitive, and nothing like an HMAC: anyone who knows the seed, or any one seeded hash
+// along with its unseeded hash, can undo it for every hash with that seed.  It prevents mix-ups, not forgeries.
+//
+// Only as many bytes of the seed as the hash has are used; a shorter seed leaves the rest of the hash as it is.
+func SeedHash(hash [32]byte, seed []byte) [32]byte {
+	for i := 0; i < len(seed) && i < len(hash); i++ {
+		hash[i] ^= seed[i]
+	}
+	return hash
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const ErrSSH = "gittreehash-error-ssh"
+
+var (
+	_ fsx.FSSupportingReadlink = sftpFS{}
+	_ fs.ReadDirFS             = sftpFS{}
+)
+
+// sftpFS is an fsx.FS for a directory tree on a remote host, read over SFTP.
+// Names are passed to the server as given, so relative names are relative to the remote user's starting directory
+// (usually their home directory).
+//
+// Remote files carry no inode numbers, so nothing which depends on them (like detecting directory cycles
+// made by bind mounts, or reading hard links only once) happens for remote trees.
+type sftpFS struct {
+	client *sftp.Client
+}
+
+func (s sftpFS) Open(name string) (fs.File, error) {
+	return s.client.Open(name)
+}
+
+func (s sftpFS) Stat(name string) (fs.FileInfo, error) {
+	return s.client.Stat(name)
+}
+
+func (s sftpFS) Lstat(name string) (fs.FileInfo, error) {
+	return s.client.Lstat(name)
+}
+
+func (s sftpFS) Readlink(name string) (string, error) {
+	return s.client.ReadLink(name)
+}
+
+func (s sftpFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := s.client.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	ents := make([]fs.DirEntry, len(infos))
+	for i, fi := range infos {
+		ents[i] = fs.FileInfoToDirEntry(fi)
+	}
+	return ents, nil
+}
+
+// parseSSHTarget splits an scp-style "user@host:path" into its parts.
+// The user is optional, defaulting to the local user's name; the path is optional, defaulting to ".".
+// A port may be given by bracketing the host, as in "[host]:2222:path".
+func parseSSHTarget(target string) (userName, addr, pth string, ok bool) {
+	if i := strings.LastIndex(target, "@"); i >= 0 && !strings.Contains(target[:i], ":") {
+		userName, target = target[:i], target[i+1:]
+	}
+	host, port := "", "22"
+	if strings.HasPrefix(target, "[") {
+		end := strings.Index(target, "]")
+		if end < 0 {
+			return "", "", "", false
+		}
+		host, target = target[1:end], target[end+1:]
+		if strings.HasPrefix(target, ":") {
+			rest := target[1:]
+			if i := strings.Index(rest, ":"); i > 0 && strings.Trim(rest[:i], "0123456789") == "" {
+				port, target = rest[:i], rest[i:]
+			}
+		}
+	} else {
+		i := strings.Index(target, ":")
+		if i < 0 {
+			return "", "", "", false
+		}
+		host, target = target[:i], target[i:]
+	}
+	if host == "" || !strings.HasPrefix(target, ":") {
+		return "", "", "", false
+	}
+	pth = target[1:]
+	if pth == "" {
+		pth = "."
+	}
+	if userName == "" {
+		if u, err := user.Current(); err == nil {
+			userName = u.Username
+		}
+	}
+	return userName, net.JoinHostPort(host, port), pth, true
+}
+
+// dialSFTP connects to a host over SSH and starts an SFTP session.
+// Credentials are taken from the SSH agent (if SSH_AUTH_SOCK is set) and from any unencrypted ~/.ssh/id_* key files.
+// The host's key must be listed in ~/.ssh/known_hosts.
+// Closing the returned client doesn't close the SSH connection; call the returned function to close both.
+//
+// Errors:
+//
+//   - gittreehash-error-ssh -- if no credentials are found, the host key is unknown, or connecting or authenticating fails.
+func dialSFTP(userName, addr string) (*sftp.Client, func(), error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, nil, newErrSSH(addr, "finding the home directory", err)
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, nil, newErrSSH(addr, "reading known_hosts", err)
+	}
+
+	var auths []ssh.AuthMethod
+	var closers []func() error
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			closers = append(closers, conn.Close)
+		}
+	}
+	var signers []ssh.Signer
+	keyFiles, _ := filepath.Glob(filepath.Join(home, ".ssh", "id_*"))
+	for _, keyFile := range keyFiles {
+		if strings.HasSuffix(keyFile, ".pub") {
+			continue
+		}
+		pem, err := os.ReadFile(keyFile)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			continue // Most likely protected by a passphrase, which is what the agent is for.
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auths = append(auths, ssh.PublicKeys(signers...))
+	}
+	closeAll := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+	if len(auths) == 0 {
+		return nil, nil, newErrSSH(addr, "finding credentials", errors.New("no SSH agent, and no usable ~/.ssh/id_* key files"))
+	}
+
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            userName,
+		Auth:            auths,
+		HostKeyCallback: hostKeys,
+	})
+	if err != nil {
+		closeAll()
+		return nil, nil, newErrSSH(addr, "connecting", err)
+	}
+	closers = append(closers, conn.Close)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		closeAll()
+		return nil, nil, newErrSSH(addr, "starting sftp", err)
+	}
+	return client, func() { client.Close(); closeAll() }, nil
+}
+
+func newErrSSH(addr, doing string, cause error) error {
+	return serum.Error(ErrSSH,
+		serum.WithMessageTemplate("ssh to {{addr}} failed while {{doing}}: {{cause}}"),
+		serum.WithDetail("addr", addr),
+		serum.WithDetail("doing", doing),
+		serum.WithDetail("cause", cause.Error()),
+		serum.WithCause(cause),
+	)
+}
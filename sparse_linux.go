@@ -0,0 +1,99 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// sparseSupported is true on platforms where Options.Sparse has any effect.
+const sparseSupported = true
+
+// Whence values for lseek which find the next data or hole at or after an offset.
+// (The syscall package doesn't name these.)
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// zeros stands in for the content of holes.  It's never written to.
+var zeros [64 << 10]byte
+
+// hashSparse hashes the content of a sparse regular file as a blob, reading only the extents that hold data,
+// and hashing zeros for the holes between them without reading them.
+// The ok result is false if the file has no holes, or the filesystem can't report them,
+// in which case nothing has been read, and the caller should read the file as usual.
+//
+// Errors:
+//
+//   - gittreehash-error-concurrent-io -- if the file's size changes while it's being hashed.
+//   - gittreehash-error-io -- if reading the file fails.
+func (h *hasher) hashSparse(pth string, f fs.File, fi fs.FileInfo, size int64) (hash [32]byte, ok bool, err error) {
+	osf, isOS := f.(*os.File)
+	st, hasStat := fi.Sys().(*syscall.Stat_t)
+	if !isOS || !hasStat || st.Blocks*512 >= size {
+		return [32]byte{}, false, nil // Not a local file, or every byte is allocated, so there are no holes to skip.
+	}
+	if _, err := osf.Seek(0, seekData); err != nil && !errors.Is(err, syscall.ENXIO) {
+		return [32]byte{}, false, nil // EINVAL, most likely: this filesystem doesn't report holes.
+	}
+
+	digester := h.opts.Algorithm.New()
+	var preamble [32]byte
+	digester.Write(appendObjectPreamble(preamble[:0], "blob", size))
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	var covered int64 // Logical bytes hashed so far, whether read or known to be a hole.
+	for covered < size {
+		dataStart, err := osf.Seek(covered, seekData)
+		if errors.Is(err, syscall.ENXIO) || (err == nil && dataStart > size) {
+			dataStart = size // Only a hole remains.
+		} else if err != nil {
+			return [32]byte{}, true, newErrIO(err)
+		}
+		writeZeros(digester, dataStart-covered)
+		covered = dataStart
+		if covered == size {
+			break
+		}
+		dataEnd, err := osf.Seek(dataStart, seekHole)
+		if err != nil {
+			return [32]byte{}, true, newErrIO(err)
+		}
+		if dataEnd > size {
+			dataEnd = size
+		}
+		n, err := io.CopyBuffer(digester, io.NewSectionReader(osf, dataStart, dataEnd-dataStart), *bufp)
+		covered += n
+		if err != nil {
+			return [32]byte{}, true, newErrIO(err)
+		}
+		if n < dataEnd-dataStart {
+			return [32]byte{}, true, NewErrSizeChanged(pth, size, covered) // Truncated under us.
+		}
+	}
+	after, err := osf.Stat()
+	if err != nil {
+		return [32]byte{}, true, newErrIO(err)
+	}
+	if after.Size() != size {
+		return [32]byte{}, true, NewErrSizeChanged(pth, size, after.Size())
+	}
+	digester.Sum(hash[:0])
+	return hash, true, nil
+}
+
+func writeZeros(w io.Writer, n int64) {
+	for n > 0 {
+		chunk := zeros[:]
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		w.Write(chunk)
+		n -= int64(len(chunk))
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"io/fs"
+)
+
+// sparseSupported is true on platforms where Options.Sparse has any effect.
+const sparseSupported = false
+
+// hashSparse would hash a file while skipping its holes, but that's not supported on this platform,
+// so it always reports that the caller should read the file as usual.
+func (h *hasher) hashSparse(pth string, f fs.File, fi fs.FileInfo, size int64) (hash [32]byte, ok bool, err error) {
+	return [32]byte{}, false, nil
+}
@@ -0,0 +1,26 @@
+//go:build linux || openbsd
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// gitStatDataFor extracts the stat information git records in its index, if the filesystem that produced the FileInfo exposes it.
+func gitStatDataFor(fi fs.FileInfo) (gitStatData, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil {
+		return gitStatData{}, false
+	}
+	return gitStatData{
+		ctimeSec:  uint32(st.Ctim.Sec),
+		ctimeNsec: uint32(st.Ctim.Nsec),
+		mtimeSec:  uint32(st.Mtim.Sec),
+		mtimeNsec: uint32(st.Mtim.Nsec),
+		ino:       uint32(st.Ino),
+		uid:       st.Uid,
+		gid:       st.Gid,
+		size:      uint32(st.Size),
+	}, true
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || openbsd || darwin || freebsd || netbsd)
+
+package main
+
+import (
+	"io/fs"
+)
+
+// gitStatDataFor extracts the stat information git records in its index, if the filesystem that produced the FileInfo exposes it.
+// On this platform, that information is never available.
+func gitStatDataFor(fi fs.FileInfo) (gitStatData, bool) {
+	return gitStatData{}, false
+}
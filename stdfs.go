@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+)
+
+// HashFS is like HashPath, but for a plain fs.FS, which has no notion of symlinks.
+// Everything is hashed as whatever the filesystem's Stat says it is, so on a filesystem like os.DirFS,
+// symlinks are followed, and recorded as what they point to.
+// The filesystem needn't implement fs.StatFS or fs.ReadDirFS; files are opened to stat them if need be.
+//
+// Errors:
+//
+//   - any error HashPath may return.
+func HashFS(fsys fs.FS, pth string, opts Options) ([32]byte, error) {
+	return HashPath(stdFS{fsys}, pth, opts)
+}
+
+// stdFS adapts a plain fs.FS for hashing, by taking Stat's view of every file,
+// even where the filesystem could tell us more (as os.DirFS's directory entries can, about symlinks).
+// It deliberately doesn't implement Readlink, so nothing is ever hashed as a symlink.
+type stdFS struct {
+	fsys fs.FS
+}
+
+func (s stdFS) Open(name string) (fs.File, error) {
+	return s.fsys.Open(name)
+}
+
+func (s stdFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(s.fsys, name)
+}
+
+func (s stdFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	ents, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	for i, ent := range ents {
+		if ent.Type()&fs.ModeSymlink != 0 {
+			ents[i] = stdDirEntry{ent, s, path.Join(name, ent.Name())}
+		}
+	}
+	return ents, nil
+}
+
+// stdDirEntry is a directory entry for a symlink, described instead as what Stat says it points to.
+type stdDirEntry struct {
+	fs.DirEntry
+	s   stdFS
+	pth string
+}
+
+func (e stdDirEntry) Info() (fs.FileInfo, error) {
+	return e.s.Stat(e.pth)
+}
+
+func (e stdDirEntry) Type() fs.FileMode {
+	if fi, err := e.Info(); err == nil {
+		return fi.Mode().Type()
+	}
+	return e.DirEntry.Type()
+}
+
+func (e stdDirEntry) IsDir() bool {
+	return e.Type().IsDir()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/warptools/gittreehash/gitindex"
+)
+
+// hashTextSymlink hashes a regular file as if it were a symlink whose target is the file's content.
+// See Options.SymlinksAsText.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if reading the file fails.
+//   - gittreehash-error-permission -- if reading the file fails due to permissions.
+//   - gittreehash-error-concurrent-io -- if the file changes while it's being read.
+func (h *hasher) hashTextSymlink(pth string, fi fs.FileInfo) ([32]byte, fs.FileMode, error) {
+	mode := fs.ModeSymlink | fi.Mode().Perm()
+	h.acquireFile()
+	defer h.releaseFile()
+	f, err := h.openFile(pth)
+	if err != nil {
+		if isVanished(err) {
+			return [32]byte{}, mode, NewErrVanished(pth)
+		}
+		return [32]byte{}, mode, newErrIO(err)
+	}
+	defer f.Close()
+	if err := checkSameFile(pth, fi, f); err != nil {
+		return [32]byte{}, mode, err
+	}
+	target, err := io.ReadAll(f)
+	if err != nil {
+		return [32]byte{}, mode, newErrIO(err)
+	}
+	if int64(len(target)) != fi.Size() {
+		return [32]byte{}, mode, NewErrSizeChanged(pth, fi.Size(), int64(len(target)))
+	}
+	hash := h.hashBlobBytes(target)
+	h.emit(pth, hash, mode, int64(len(target)))
+	return hash, mode, nil
+}
+
+// symlinksAsTextFromList reads a file listing paths (one per line, relative to root)
+// which should be treated as symlinks stored as text, and returns a function for Options.SymlinksAsText.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the list can't be read.
+func symlinksAsTextFromList(listPath, root string) (func(string) bool, error) {
+	f, err := os.Open(listPath)
+	if err != nil {
+		return nil, newErrIO(err)
+	}
+	defer f.Close()
+	set := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		set[filepath.Join(root, filepath.FromSlash(line))] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, newErrIO(err)
+	}
+	return func(pth string) bool { _, ok := set[pth]; return ok }, nil
+}
+
+// symlinksAsTextFromIndex reads a git index, and returns a function for Options.SymlinksAsText
+// which selects every path the index records as a symlink.
+// The root should be the directory corresponding to the root of the index's working tree.
+//
+// Errors:
+//
+//   - gitindex-error-io -- if the index can't be read.
+//   - gitindex-error-parse -- if the index isn't valid.
+func symlinksAsTextFromIndex(indexPath, root string) (func(string) bool, error) {
+	idx, err := gitindex.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]struct{}{}
+	for _, ent := range idx.Entries {
+		if ent.Mode&0o170000 == 0o120000 {
+			set[filepath.Join(root, filepath.FromSlash(ent.Path))] = struct{}{}
+		}
+	}
+	return func(pth string) bool { _, ok := set[pth]; return ok }, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+
+	"github.com/warptools/gittreehash/gitconfig"
+)
+
+const (
+	ErrInvalidRefName = "gittreehash-error-invalid-ref-name"
+	ErrTagExists      = "gittreehash-error-tag-exists"
+)
+
+// Release describes the tag TagRelease makes, and the commit it points to.
+type Release struct {
+	Tag     string    // The tag's name, without "refs/tags/".  Any "{tree}" in it is replaced with the hex hash of the tree.
+	Tagger  string    // The tagger (and the commit's author and committer), as "Name <email>".
+	Date    time.Time // The date of the tag and the commit; the time zone is kept.
+	Message string    // The message of the tag and the commit.  Any "{tree}" in it is replaced, as in Tag.
+	Force   bool      // Replace the tag if it exists, rather than failing.
+}
+
+// TagRelease hashes a directory, and records it in the git repository at gitDir as a release:
+// every object in the tree is stored, as by WriteObjects, along with a commit of the tree (with no parent),
+// and an annotated tag object pointing to that commit, which the tag's ref is then set to.
+// It returns the hash of the tree, and the id of the tag object.
+//
+// The ref is written as a loose ref file, atomically; repositories which keep refs in a reftable aren't supported.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-ref-name -- if the tag's name isn't one git allows.
+//   - gittreehash-error-tag-exists -- if the tag exists already, and Release.Force isn't set.
+//   - gittreehash-error-unsupported-option -- if the repository keeps refs in a reftable.
+//   - any error WriteObjects may return.
+func TagRelease(fsys fsx.FS, dir, gitDir string, release Release, opts Options) (tree, tag [32]byte, err error) {
+	size := opts.Algorithm.Size()
+	if err := checkRefName(strings.ReplaceAll(release.Tag, "{tree}", strings.Repeat("0", 2*size))); err != nil {
+		return tree, tag, err
+	}
+	cfg, err := gitconfig.Load(filepath.Join(gitDir, "config"))
+	if err != nil {
+		return tree, tag, err
+	}
+	if refStorage, ok := cfg.Get("extensions.refStorage"); ok && !strings.EqualFold(refStorage, "files") {
+		return tree, tag, serum.Error(ErrUnsupportedOption,
+			serum.WithMessageTemplate("the repository at {{path}} keeps refs in a {{refStorage}}, where tags can't be written"),
+			serum.WithDetail("path", gitDir),
+			serum.WithDetail("refStorage", refStorage),
+		)
+	}
+
+	if tree, err = WriteObjects(fsys, dir, gitDir, opts); err != nil {
+		return tree, tag, err
+	}
+	treeHex := hex.EncodeToString(tree[:size])
+	name := strings.ReplaceAll(release.Tag, "{tree}", treeHex)
+	ref := "refs/tags/" + name
+	refPath := filepath.Join(gitDir, filepath.FromSlash(ref))
+	if !release.Force {
+		exists, err := refExists(gitDir, refPath, ref)
+		if err != nil {
+			return tree, tag, err
+		}
+		if exists {
+			return tree, tag, serum.Error(ErrTagExists,
+				serum.WithMessageTemplate("the repository at {{path}} already has the tag {{tag}}"),
+				serum.WithDetail("path", gitDir),
+				serum.WithDetail("tag", name),
+			)
+		}
+	}
+
+	db, err := openObjectDB(gitDir, opts.Algorithm)
+	if err != nil {
+		return tree, tag, err
+	}
+	message := withFinalNewline(strings.ReplaceAll(release.Message, "{tree}", treeHex))
+	commit, err := db.writeObject("commit", commitBody(tree[:size], Commit{Author: release.Tagger, Date: release.Date, Message: message}))
+	if err != nil {
+		return tree, tag, err
+	}
+	tag, err = db.writeObject("tag", []byte(fmt.Sprintf("object %x\ntype commit\ntag %s\ntagger %s\n\n%s", commit[:size], name, gitSignature(release.Tagger, release.Date), message)))
+	if err != nil {
+		return tree, tag, err
+	}
+	if err := os.MkdirAll(filepath.Dir(refPath), 0o755); err != nil {
+		return tree, tag, newErrIO(err)
+	}
+	if err := writeFileAtomic(refPath, []byte(hex.EncodeToString(tag[:size])+"\n")); err != nil {
+		return tree, tag, err
+	}
+	return tree, tag, nil
+}
+
+// refExists reports whether a repository has a ref, either as a loose ref file, or in its packed-refs file.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the packed-refs file can't be read.
+func refExists(gitDir, refPath, ref string) (bool, error) {
+	if _, err := os.Lstat(refPath); err == nil {
+		return true, nil
+	}
+	f, err := os.Open(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		if isVanished(err) {
+			return false, nil
+		}
+		return false, newErrIO(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines are "<id> <ref>", apart from comments, and "^<id>" lines giving what the tag before them peels to.
+		if _, name, ok := strings.Cut(scanner.Text(), " "); ok && name == ref {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, newErrIO(err)
+	}
+	return false, nil
+}
+
+// checkRefName checks a ref name (the part after "refs/tags/") against the rules of `git check-ref-format`.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-ref-name -- if git wouldn't allow the name.
+func checkRefName(name string) error {
+	invalid := func(why string) error {
+		return serum.Error(ErrInvalidRefName,
+			serum.WithMessageTemplate("{{name}} can't be the name of a tag: {{reason}}"),
+			serum.WithDetail("name", name),
+			serum.WithDetail("reason", why),
+		)
+	}
+	switch {
+	case name == "" || name == "@":
+		return invalid("it's reserved")
+	case strings.HasSuffix(name, "/") || strings.HasSuffix(name, "."):
+		return invalid("it can't end with a slash or a dot")
+	case strings.Contains(name, "..") || strings.Contains(name, "@{"):
+		return invalid(`it can't contain ".." or "@{"`)
+	case strings.HasPrefix(name, "-"):
+		return invalid("it can't begin with a dash")
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 0x20 || c == 0x7f || bytes.IndexByte([]byte(" ~^:?*[\\"), c) >= 0 {
+			return invalid(`it can't contain spaces, control characters, or any of ~^:?*[\`)
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return invalid(`no part of it can be empty, begin with a dot, or end with ".lock"`)
+		}
+	}
+	return nil
+}
+
+// mainTagRelease implements the tag-release subcommand, which hashes a directory, and stores it in a repository as a tagged release.
+func mainTagRelease(args []string) int {
+	fset := flag.NewFlagSet("tag-release", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s tag-release --dir=<path> --tag=<name> --git-dir=<path> [flags]\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nstores every object in the directory's tree in the repository, with a commit of the tree and an annotated tag of that commit,\n")
+		fmt.Fprintf(fset.Output(), "so the tag names exactly that content.  \"{tree}\" in the tag's name is replaced with the tree's hash.\n")
+		fmt.Fprintf(fset.Output(), "prints the hash of the tree.\n\n")
+		fset.PrintDefaults()
+	}
+	dir := fset.String("dir", "", "the directory to release")
+	tagName := fset.String("tag", "", "the name of the tag to create, like \"v1.0\" or \"release-{tree}\"")
+	gitDir := fset.String("git-dir", "", "the repository's \".git\" directory (or a bare repository)")
+	algorithm := fset.String("algorithm", "", "hash function to use: \"sha256\" or \"sha1\" (default: the repository's object format, which it must be)")
+	tagger := fset.String("tagger", "gittreehash <gittreehash@localhost>", "the tagger, and the commit's author and committer, as \"Name <email>\"")
+	date := fset.String("date", "", "the date of the tag and commit, in RFC 3339 format, like \"2006-01-02T15:04:05Z\" (default: now)")
+	message := fset.String("message", "", "the message of the tag and commit (default: \"Release <tag>\")")
+	force := fset.Bool("force", false, "replace the tag if it exists")
+	ignoreDotGit := fset.Bool("ignore-dot-git", false, "leave out anything named .git, at any depth, as git does")
+	fset.Parse(args)
+	if fset.NArg() != 0 || *dir == "" || *tagName == "" || *gitDir == "" {
+		fset.Usage()
+		return 2
+	}
+	opts := Options{IgnoreDotGit: *ignoreDotGit}
+	if *algorithm == "" {
+		format, err := repoObjectFormat(*gitDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			return exitCode(err)
+		}
+		*algorithm = format
+	}
+	switch *algorithm {
+	case "sha256":
+		opts.Algorithm = SHA256
+	case "sha1":
+		opts.Algorithm = SHA1
+	default:
+		fmt.Fprintf(os.Stderr, "unknown algorithm %q\n", *algorithm)
+		return 2
+	}
+	release := Release{Tag: *tagName, Tagger: *tagger, Date: time.Now(), Message: *message, Force: *force}
+	if *date != "" {
+		d, err := time.Parse(time.RFC3339, *date)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--date must be in RFC 3339 format, like \"2006-01-02T15:04:05Z\"\n")
+			return 2
+		}
+		release.Date = d
+	}
+	if release.Message == "" {
+		release.Message = "Release " + *tagName
+	}
+
+	tree, _, err := TagRelease(rawDirFS("."), filepath.Clean(*dir), *gitDir, release, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	fmt.Printf("%s\n", hex.EncodeToString(tree[:opts.Algorithm.Size()]))
+	return 0
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+// HashTar computes the tree hash of the contents of a tar stream.
+// The hash is the same as HashPath would give for the directory the archive was made from
+// (or will be extracted into), so long as the archive records everything git would see:
+// this is what the --tar flag uses, so e.g. `tar -C dir -c . | gittreehash --tar=-`
+// prints the same hash as `gittreehash dir`.
+//
+// Hard links are hashed as copies of the file they link to.  Entries for directories are optional.
+// Long names and link targets, in either the PAX or the GNU format, are read as the names they stand for.
+// Since file content is hashed as it streams past, and only hashes are kept, nothing needs buffering,
+// however large the archive.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if reading the stream fails.
+//   - gittreehash-error-invalid-path -- if the archive contains a path that escapes its root.
+//   - gittreehash-error-unsupported-file-type -- if the archive contains device nodes, etc.
+//   - any error returned by Options.ErrorHandler.
+func HashTar(tarReader io.Reader, opts Options) ([32]byte, error) {
+	h := newHasher(nil, opts)
+	return h.hashTar(tarReader, nil)
+}
+
+// hashTarInput hashes the tar archive at a path, or on stdin if the path is "-", decompressing it if need be.
+//
+// Errors:
+//
+//   - gittreehash-error-not-found -- if there's no file at the path.
+//   - gittreehash-error-io -- if the file can't be opened.
+//   - gittreehash-error-permission -- if the file can't be opened due to permissions.
+//   - any error HashCompressedTar may return.
+func hashTarInput(pth string, compression Compression, opts Options) ([32]byte, error) {
+	if pth == "-" {
+		return HashCompressedTar(os.Stdin, compression, opts)
+	}
+	f, err := os.Open(pth)
+	if err != nil {
+		if isVanished(err) {
+			return [32]byte{}, NewErrNotFound(pth)
+		}
+		return [32]byte{}, newErrIO(err)
+	}
+	defer f.Close()
+	return HashCompressedTar(f, compression, opts)
+}
+
+// HashOCILayer computes the tree hash of the contents of an OCI image layer (a gzipped tar stream).
+//
+// OCI whiteout files (those named with a ".wh." prefix) mark deletions of content from lower layers;
+// they're not part of the layer's own content, so they're left out of the tree.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if reading or decompressing the stream fails.
+//   - gittreehash-error-invalid-path -- if the archive contains a path that escapes its root.
+//   - gittreehash-error-unsupported-file-type -- if the archive contains device nodes, etc.
+//   - any error returned by Options.ErrorHandler.
+func HashOCILayer(tarGzReader io.Reader, opts Options) ([32]byte, error) {
+	zr, err := gzip.NewReader(tarGzReader)
+	if err != nil {
+		return [32]byte{}, serum.Errorf(ErrIO, "reading layer: %w", err)
+	}
+	defer zr.Close()
+	h := newHasher(nil, opts)
+	return h.hashTar(zr, &whiteouts{})
+}
+
+// hashTar reads a tar stream and hashes the tree it describes.  See readTar for the errors.
+func (h *hasher) hashTar(r io.Reader, wh *whiteouts) ([32]byte, error) {
+	root, err := h.readTar(r, wh, nil)
+	if err != nil {
+		if aborted, ok := err.(abortError); ok {
+			err = aborted.error
+		}
+		return [32]byte{}, err
+	}
+	return h.hashVnode(".", root), nil
+}
+
+// readTar reads a tar stream into a vnode tree, hashing blobs as it goes.
+// Entries are left out as the filtering options say; see excludedFromArchive.
+// If wh is non-nil, the stream is an OCI layer: whiteout entries are left out of the tree, and recorded in wh instead.
+// Hard links to files that aren't earlier in the stream are looked for in lower, if it's non-nil
+// (as a layer's hard links may refer to files in the layers beneath it).
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if reading the stream fails.
+//   - gittreehash-error-invalid-path -- if the archive contains a path that escapes its root.
+//   - gittreehash-error-unsupported-file-type -- if the archive contains device nodes, etc.
+//   - any error returned by Options.ErrorHandler (wrapped in abortError).
+func (h *hasher) readTar(r io.Reader, wh *whiteouts, lower *vnode) (*vnode, error) {
+	root := newVdir()
+	aside := newVdir() // Files the filtering options leave out, which later hard links may still refer to.
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return root, nil
+		}
+		if err != nil {
+			return nil, serum.Errorf(ErrIO, "reading tar: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		pth, err := cleanVpath(hdr.Name)
+		if err != nil {
+			if hdr.Typeflag == tar.TypeDir && strings.Trim(hdr.Name, "./") == "" {
+				continue // An entry for the root directory itself.  Nothing to record.
+			}
+			return nil, err
+		}
+		pth = h.treeName(pth) // Normalizing whole paths is equivalent to normalizing each name, since slashes are never combined.
+		if wh != nil && wh.record(pth) {
+			continue
+		}
+		mode := fs.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			hash, size, err := h.hashBlobStream(pth, tr, hdr.Size)
+			if err != nil {
+				return nil, err
+			}
+			if h.excludedFromArchive(pth, mode, size) {
+				aside.put(pth, &vnode{mode: mode, hash: hash, size: size})
+				continue
+			}
+			root.put(pth, &vnode{mode: mode, hash: hash, size: size})
+			h.emit(pth, hash, mode, size)
+		case tar.TypeLink:
+			target, err := cleanVpath(hdr.Linkname)
+			if err != nil {
+				return nil, err
+			}
+			target = h.treeName(target)
+			linked := root.get(target)
+			if linked == nil {
+				linked = aside.get(target)
+			}
+			if linked == nil && lower != nil {
+				linked = lower.get(target)
+			}
+			if linked == nil || linked.mode.IsDir() {
+				return nil, serum.Errorf(ErrIO, "tar entry %q is a hard link to %q, which is not a file earlier in the archive", hdr.Name, hdr.Linkname)
+			}
+			if h.excludedFromArchive(pth, linked.mode, linked.size) {
+				continue
+			}
+			copied := *linked
+			root.put(pth, &copied)
+			h.emit(pth, copied.hash, copied.mode, copied.size)
+		case tar.TypeSymlink:
+			if h.excludedFromArchive(pth, fs.ModeSymlink|mode, 0) {
+				continue
+			}
+			hash := h.hashBlobBytes([]byte(hdr.Linkname))
+			root.put(pth, &vnode{mode: fs.ModeSymlink | mode, hash: hash, size: int64(len(hdr.Linkname))})
+			h.emit(pth, hash, fs.ModeSymlink|mode, int64(len(hdr.Linkname)))
+		case tar.TypeDir:
+			if h.excludedFromArchive(pth, fs.ModeDir, 0) {
+				continue
+			}
+			root.put(pth, newVdir())
+		default:
+			typ := "irregular"
+			switch hdr.Typeflag {
+			case tar.TypeChar, tar.TypeBlock:
+				typ = "device"
+			case tar.TypeFifo:
+				typ = "pipe"
+			}
+			if err := h.handleChildError(pth, NewErrUnsupportedFileType(typ, pth)); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// hashBlobStream hashes content from a stream of known length as a blob.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if reading fails, or the stream is shorter or longer than claimed.
+func (h *hasher) hashBlobStream(pth string, r io.Reader, claimedSize int64) ([32]byte, int64, error) {
+	hash, contentSize, err := h.hashObjectStream("blob", claimedSize, r)
+	if err != nil {
+		return [32]byte{}, 0, err
+	}
+	if contentSize != claimedSize {
+		return [32]byte{}, 0, serum.Errorf(ErrIO, "expected %d bytes but read %d bytes at path %q", claimedSize, contentSize, pth)
+	}
+	return hash, claimedSize, nil
+}
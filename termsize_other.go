@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"os"
+)
+
+// terminalWidth returns the width of the terminal a file refers to, in columns.
+// On this platform, there's no way to tell, so it always reports that the file isn't a terminal.
+func terminalWidth(f *os.File) (width int, ok bool) {
+	return 0, false
+}
@@ -25,8 +25,2090 @@ mkdir _test
 echo
 
 rm -rf _test/.git
-go run gittreehash.go _test/a_dir/other_file
-go run gittreehash.go _test/a_dir
-go run gittreehash.go _test/a_file
-go run gittreehash.go _test/a_symlink
-go run gittreehash.go _test
+go run . _test/a_dir/other_file
+go run . _test/a_dir
+go run . _test/a_file
+go run . _test/a_symlink
+go run . _test
+[ "$(go run . --concurrency=8 _test)" == "$(go run . _test)" ] || { echo "FAIL: --concurrency changed the hash"; exit 1; }
+tar -C _test -cf - . | go run . --tar=- # should match the line above: HashTar gives the same hash as the directory.
+
+# A symlink given as the starting path is resolved if it points to a directory, and hashed as a symlink otherwise.
+mkdir _test/links
+ln -s ../a_dir _test/links/to_dir
+ln -s ../a_file _test/links/to_file
+ln -s nowhere _test/links/dangling
+go run . _test/links/to_dir # should match _test/a_dir, above.
+go run . --no-resolve-root _test/links/to_dir
+go run . _test/links/to_file
+go run . _test/links/dangling
+
+# --audit notices changes made during hashing.  The pipes make the timing deterministic:
+# the change happens after the first pipe is read, and the second pipe holds hashing up until it's done.
+mkdir _test/audit
+echo x > _test/audit/0_file
+mkfifo _test/audit/a_pipe _test/audit/b_pipe
+(echo hi > _test/audit/a_pipe; echo more >> _test/audit/0_file; echo bye > _test/audit/b_pipe) &
+go build -o _test/gittreehash . # Not 'go run', so that compiling doesn't eat into the pipe timeout.
+if _test/gittreehash --audit --read-pipes _test/audit; then
+	echo "FAIL: --audit did not notice a change"
+	exit 1
+fi
+
+# A starting path (or archive) that doesn't exist is reported as not-found, with the path, and exits 4, whatever the mode.
+for args in "" --tracked-only --count --pipe-to-git --no-resolve-root --concurrency=4 --tar= --zip=; do
+	case "$args" in
+	--tar=|--zip=) args="$args"_test/nonexistent ;;
+	*) args="$args _test/nonexistent" ;;
+	esac
+	code=0; out="$(_test/gittreehash $args 2>&1 | tr -d '\n')" || code=$?
+	[ "$code" == 4 ] && grep -q '"code":"gittreehash-error-not-found"' <<< "$out" && grep -q '"details":{"path":"_test/nonexistent"}' <<< "$out" || { echo "FAIL: $args exited $code, not 4 with the path: $out"; exit 1; }
+done
+
+# An entry deleted after its directory was listed is reported as concurrent-io, not a generic IO error.
+mkdir _test/vanish
+mkfifo _test/vanish/a_pipe
+echo x > _test/vanish/z_file
+(exec 3> _test/vanish/a_pipe; rm _test/vanish/z_file; echo hi >&3) & # Reading the pipe can't finish until the deletion is done.
+if _test/gittreehash --read-pipes _test/vanish 2> _test/vanish.err; then
+	echo "FAIL: deleting an entry mid-walk went unnoticed"
+	exit 1
+fi
+grep -q '"gittreehash-error-concurrent-io"' _test/vanish.err || { echo "FAIL: mid-walk deletion misclassified: $(cat _test/vanish.err)"; exit 1; }
+
+# Hard links are only read once, but hash the same as independent copies would.
+mkdir -p _test/linked/a
+echo "linked content" > _test/linked/a/file
+cp -al _test/linked/a _test/linked/b
+cp -r _test/linked _test/copied
+[ "$(_test/gittreehash _test/linked)" == "$(_test/gittreehash _test/copied)" ] || { echo "FAIL: hard links hash differently from copies"; exit 1; }
+_test/gittreehash --stats _test/linked 2>&1 >/dev/null | grep -q "hardlink_hits=1" || { echo "FAIL: hard link was read again"; exit 1; }
+
+# The diff subcommand lists what was added, deleted, and modified between two trees.
+mkdir -p _test/diff/old/sub _test/diff/new/sub
+echo same > _test/diff/old/kept; echo same > _test/diff/new/kept
+echo old > _test/diff/old/sub/changed; echo new > _test/diff/new/sub/changed
+echo gone > _test/diff/old/removed; echo here > _test/diff/new/added
+_test/gittreehash diff _test/diff/old _test/diff/new > _test/diff.out && { echo "FAIL: diff of differing trees exited 0"; exit 1; }
+[ "$(cat _test/diff.out)" == "$(printf 'A\tadded\nD\tremoved\nM\tsub\nM\tsub/changed')" ] || { echo "FAIL: unexpected diff output: $(cat _test/diff.out)"; exit 1; }
+_test/gittreehash diff _test/diff/old _test/diff/old || { echo "FAIL: diff of identical trees exited nonzero"; exit 1; }
+# The roots themselves are compared too: two files that differ are a modification at ".", and the same file is no change at all.
+_test/gittreehash diff _test/diff/old/sub/changed _test/diff/new/sub/changed > _test/diff.out && { echo "FAIL: diff of differing file roots exited 0"; exit 1; }
+[ "$(cat _test/diff.out)" == "$(printf 'M\t.')" ] || { echo "FAIL: unexpected diff output for differing file roots: $(cat _test/diff.out)"; exit 1; }
+[ "$(_test/gittreehash diff _test/diff/old/kept _test/diff/new/kept)" == "" ] || { echo "FAIL: diff of identical file roots printed something"; exit 1; }
+# diff --json gives each change's kind, and the hashes and modes on each side, sorted by path, including nested changes of every kind.
+mkdir -p _test/diffkinds/old/sub/deep _test/diffkinds/old/todir _test/diffkinds/old/gone _test/diffkinds/new/sub/deep _test/diffkinds/new/tofile _test/diffkinds/new/new
+for side in old new; do echo same > _test/diffkinds/$side/sub/deep/kept; echo $side > _test/diffkinds/$side/sub/deep/changed; echo x > _test/diffkinds/$side/sub/deep/exec; done
+chmod +x _test/diffkinds/new/sub/deep/exec
+ln -s kept _test/diffkinds/old/sub/deep/link; echo kept > _test/diffkinds/new/sub/deep/link
+echo in > _test/diffkinds/old/todir/in; echo file > _test/diffkinds/new/todir
+echo file > _test/diffkinds/old/tofile; echo in > _test/diffkinds/new/tofile/in
+echo gone > _test/diffkinds/old/gone/g; echo new > _test/diffkinds/new/new/n
+_test/gittreehash diff --json _test/diffkinds/old _test/diffkinds/new > _test/diffkinds.out && { echo "FAIL: diff --json of differing trees exited 0"; exit 1; }
+want="gone removed
+gone/g removed
+new added
+new/n added
+sub modified
+sub/deep modified
+sub/deep/changed modified
+sub/deep/exec mode-changed
+sub/deep/link type-changed
+todir type-changed
+todir/in removed
+tofile type-changed
+tofile/in added"
+[ "$(sed 's/^{"path":"\([^"]*\)","kind":"\([^"]*\)".*/\1 \2/' _test/diffkinds.out)" == "$want" ] || { echo "FAIL: unexpected diff --json kinds: $(cat _test/diffkinds.out)"; exit 1; }
+grep -q '^{"path":"new/n","kind":"added","newHash":"[0-9a-f]\{64\}","newMode":"100644"}$' _test/diffkinds.out || { echo "FAIL: diff --json gave an added file the wrong fields"; exit 1; }
+grep -q '^{"path":"sub/deep/exec","kind":"mode-changed","oldHash":"\([0-9a-f]\{64\}\)","newHash":"\1","oldMode":"100644","newMode":"100755"}$' _test/diffkinds.out || { echo "FAIL: diff --json gave a mode change the wrong fields"; exit 1; }
+# Changes to the roots themselves are at ".": a file modified, a file gaining an executable bit, and a file replaced by a directory, and back.
+cat _test/diffkinds/new/sub/deep/exec > _test/diffkinds/exec-root; cp -p _test/diffkinds/new/sub/deep/exec _test/diffkinds/exec-root-x
+for old_new_want in "old/sub/deep/changed new/sub/deep/changed . modified" \
+		"exec-root exec-root-x . mode-changed" \
+		"old/tofile new/tofile . type-changed|in added" \
+		"new/tofile old/tofile . type-changed|in removed"; do
+	read -r old new want <<< "$old_new_want"
+	out="$(_test/gittreehash diff --json "_test/diffkinds/$old" "_test/diffkinds/$new" 2>/dev/null)" && { echo "FAIL: diff --json of differing roots $old and $new exited 0"; exit 1; }
+	[ "$(sed 's/^{"path":"\([^"]*\)","kind":"\([^"]*\)".*/\1 \2/' <<< "$out" | paste -sd '|')" == "$want" ] || { echo "FAIL: unexpected diff --json kinds for roots $old and $new: $out"; exit 1; }
+done
+# The other --diff-formats: name-status (the default, also with -z, as git gives it), and stat, counting only files and symlinks.
+want="$(printf 'D\tgone\nD\tgone/g\nA\tnew\nA\tnew/n\nM\tsub\nM\tsub/deep\nM\tsub/deep/changed\nM\tsub/deep/exec\nT\tsub/deep/link\nT\ttodir\nD\ttodir/in\nT\ttofile\nA\ttofile/in')"
+[ "$(_test/gittreehash diff --diff-format=name-status _test/diffkinds/old _test/diffkinds/new 2>/dev/null)" == "$want" ] || { echo "FAIL: unexpected diff --diff-format=name-status output"; exit 1; }
+[ "$(_test/gittreehash diff -z _test/diffkinds/old _test/diffkinds/new 2>/dev/null | tr '\0' '|')" == "$(tr '\t\n' '||' <<< "$want")" ] || { echo "FAIL: unexpected diff -z output"; exit 1; }
+[ "$(_test/gittreehash diff --diff-format=stat _test/diffkinds/old _test/diffkinds/new 2>/dev/null)" == "2 added, 2 removed, 5 modified" ] || { echo "FAIL: unexpected diff --diff-format=stat output"; exit 1; }
+[ "$(_test/gittreehash diff --diff-format=stat _test/diffkinds/old _test/diffkinds/old)" == "0 added, 0 removed, 0 modified" ] || { echo "FAIL: unexpected diff --diff-format=stat output for identical trees"; exit 1; }
+[ "$(_test/gittreehash diff --diff-format=json _test/diffkinds/old _test/diffkinds/new 2>/dev/null)" == "$(cat _test/diffkinds.out)" ] || { echo "FAIL: --json differs from --diff-format=json"; exit 1; }
+blob() { git hash-object --stdin <<< "$1"; }
+want='{"path":"added","kind":"added","newHash":"'$(blob here)'","newMode":"100644"}
+{"path":"removed","kind":"removed","oldHash":"'$(blob gone)'","oldMode":"100644"}
+{"path":"sub","kind":"modified","oldHash":"'$(_test/gittreehash --algorithm=sha1 _test/diff/old/sub)'","newHash":"'$(_test/gittreehash --algorithm=sha1 _test/diff/new/sub)'","oldMode":"40000","newMode":"40000"}
+{"path":"sub/changed","kind":"modified","oldHash":"'$(blob old)'","newHash":"'$(blob new)'","oldMode":"100644","newMode":"100644"}'
+[ "$(_test/gittreehash diff --algorithm=sha1 --diff-format=json _test/diff/old _test/diff/new)" == "$want" ] || { echo "FAIL: unexpected diff --diff-format=json output: $(_test/gittreehash diff --algorithm=sha1 --diff-format=json _test/diff/old _test/diff/new)"; exit 1; }
+# And in full, for changes of every kind, including each change of kind.
+tree() { _test/gittreehash --algorithm=sha1 "_test/diffkinds/$1"; }
+want='{"path":"gone","kind":"removed","oldHash":"'$(tree old/gone)'","oldMode":"40000"}
+{"path":"gone/g","kind":"removed","oldHash":"'$(blob gone)'","oldMode":"100644"}
+{"path":"new","kind":"added","newHash":"'$(tree new/new)'","newMode":"40000"}
+{"path":"new/n","kind":"added","newHash":"'$(blob new)'","newMode":"100644"}
+{"path":"sub","kind":"modified","oldHash":"'$(tree old/sub)'","newHash":"'$(tree new/sub)'","oldMode":"40000","newMode":"40000"}
+{"path":"sub/deep","kind":"modified","oldHash":"'$(tree old/sub/deep)'","newHash":"'$(tree new/sub/deep)'","oldMode":"40000","newMode":"40000"}
+{"path":"sub/deep/changed","kind":"modified","oldHash":"'$(blob old)'","newHash":"'$(blob new)'","oldMode":"100644","newMode":"100644"}
+{"path":"sub/deep/exec","kind":"mode-changed","oldHash":"'$(blob x)'","newHash":"'$(blob x)'","oldMode":"100644","newMode":"100755"}
+{"path":"sub/deep/link","kind":"type-changed","oldHash":"'$(printf kept | git hash-object --stdin)'","newHash":"'$(blob kept)'","oldMode":"120000","newMode":"100644"}
+{"path":"todir","kind":"type-changed","oldHash":"'$(tree old/todir)'","newHash":"'$(blob file)'","oldMode":"40000","newMode":"100644"}
+{"path":"todir/in","kind":"removed","oldHash":"'$(blob in)'","oldMode":"100644"}
+{"path":"tofile","kind":"type-changed","oldHash":"'$(blob file)'","newHash":"'$(tree new/tofile)'","oldMode":"100644","newMode":"40000"}
+{"path":"tofile/in","kind":"added","newHash":"'$(blob in)'","newMode":"100644"}'
+[ "$(_test/gittreehash diff --algorithm=sha1 --json _test/diffkinds/old _test/diffkinds/new 2>/dev/null)" == "$want" ] || { echo "FAIL: unexpected diff --json output: $(_test/gittreehash diff --algorithm=sha1 --json _test/diffkinds/old _test/diffkinds/new 2>/dev/null)"; exit 1; }
+# Changes to the roots are in every format: as "." in name-status, and counted by stat if they're files.
+[ "$(_test/gittreehash diff _test/diffkinds/old/tofile _test/diffkinds/new/tofile)" == "$(printf 'T\t.\nA\tin')" ] || { echo "FAIL: unexpected name-status output for a root changed from a file to a directory"; exit 1; }
+[ "$(_test/gittreehash diff --diff-format=stat _test/diffkinds/old/tofile _test/diffkinds/new/tofile)" == "1 added, 0 removed, 1 modified" ] || { echo "FAIL: unexpected stat output for a root changed from a file to a directory"; exit 1; }
+[ "$(_test/gittreehash diff --diff-format=stat _test/diffkinds/exec-root _test/diffkinds/exec-root-x 2>/dev/null)" == "0 added, 0 removed, 1 modified" ] || { echo "FAIL: unexpected stat output for a root whose mode changed"; exit 1; }
+code=0; _test/gittreehash diff -z --diff-format=stat _test/diffkinds/old _test/diffkinds/new > /dev/null 2>&1 || code=$?
+[ "$code" == 2 ] || { echo "FAIL: diff -z --diff-format=stat exited $code, not 2"; exit 1; }
+# --count counts what would be hashed, from the directory listings, without reading anything.
+[ "$(_test/gittreehash --count _test/diff/old)" == "files=3 dirs=2 symlinks=0" ] || { echo "FAIL: unexpected --count output: $(_test/gittreehash --count _test/diff/old)"; exit 1; }
+# diff --tar compares an archive with a directory, noting entries that differ only in mode.
+mkdir -p _test/difftar/sub && echo a > _test/difftar/sub/file && echo b > _test/difftar/run && chmod 755 _test/difftar/run
+tar -C _test/difftar -czf _test/difftar.tgz .
+_test/gittreehash diff --tar _test/difftar.tgz _test/difftar || { echo "FAIL: diff --tar of a matching archive exited nonzero"; exit 1; }
+tar -C _test/difftar -cf _test/difftar-nodirs.tar sub/file run
+_test/gittreehash diff --tar _test/difftar-nodirs.tar _test/difftar || { echo "FAIL: diff --tar of an archive without directory entries exited nonzero"; exit 1; }
+echo changed > _test/difftar/sub/file
+_test/gittreehash diff --tar _test/difftar.tgz _test/difftar > _test/difftar.out && { echo "FAIL: diff --tar of differing content exited 0"; exit 1; }
+[ "$(cat _test/difftar.out)" == "$(printf 'M\tsub\nM\tsub/file')" ] || { echo "FAIL: unexpected diff --tar output: $(cat _test/difftar.out)"; exit 1; }
+echo a > _test/difftar/sub/file && chmod 644 _test/difftar/run
+_test/gittreehash diff --tar _test/difftar.tgz _test/difftar > _test/difftar.out 2> _test/difftar.err && { echo "FAIL: diff --tar of differing modes exited 0"; exit 1; }
+[ "$(cat _test/difftar.out)" == "$(printf 'M\trun')" ] || { echo "FAIL: unexpected diff --tar output for a mode change: $(cat _test/difftar.out)"; exit 1; }
+grep -q "run differs only in mode: 100755 in _test/difftar.tgz, 100644 in _test/difftar" _test/difftar.err || { echo "FAIL: diff --tar didn't note the mode change: $(cat _test/difftar.err)"; exit 1; }
+_test/gittreehash diff --tar --ignore-filemode _test/difftar.tgz _test/difftar || { echo "FAIL: diff --tar --ignore-filemode exited nonzero for a mode change"; exit 1; }
+
+# --cache skips reading files whose stat identity is unchanged, and never changes the hash.
+# (Timestamps are set in the past, since files modified around when the cache is saved aren't trusted.)
+mkdir -p _test/cached/sub
+for f in one two sub/three; do echo "$f" > _test/cached/$f; done
+touch -d '1 hour ago' _test/cached/one _test/cached/two _test/cached/sub/three
+cache_stats() { _test/gittreehash --stats --cache=_test/cache "$@" _test/cached 2>&1 >/dev/null | grep -o 'cache_hits=[0-9]*'; }
+[ "$(cache_stats)" == "cache_hits=0" ] || { echo "FAIL: cold cache had hits"; exit 1; }
+[ "$(cache_stats)" == "cache_hits=3" ] || { echo "FAIL: warm cache missed"; exit 1; }
+echo "changed" > _test/cached/two
+touch -d '2 hours ago' _test/cached/two
+[ "$(cache_stats)" == "cache_hits=2" ] || { echo "FAIL: stale cache entry was used"; exit 1; }
+[ "$(_test/gittreehash --cache=_test/cache _test/cached)" == "$(_test/gittreehash _test/cached)" ] || { echo "FAIL: cached hash differs"; exit 1; }
+[ "$(cache_stats --cache-rewrite)" == "cache_hits=0" ] || { echo "FAIL: --cache-rewrite used the cache"; exit 1; }
+printf 'x' | dd of=_test/cache bs=1 seek=30 conv=notrunc 2>/dev/null
+_test/gittreehash --cache=_test/cache _test/cached 2>&1 >/dev/null | grep -q "gittreehash-error-cache-corrupt" || { echo "FAIL: corrupt cache not warned about"; exit 1; }
+[ "$(cache_stats)" == "cache_hits=3" ] || { echo "FAIL: corrupt cache was not replaced"; exit 1; }
+
+# Unsupported file types halt by default, or with --fail-on-unknown; --fail-on-unknown=false leaves them out.
+mkdir -p _test/unknown
+echo "plain" > _test/unknown/plain
+cp -r _test/unknown _test/unknown-clean
+mkfifo _test/unknown/fifo
+_test/gittreehash _test/unknown >/dev/null 2>&1 && { echo "FAIL: a fifo was hashed by default"; exit 1; }
+_test/gittreehash --fail-on-unknown _test/unknown >/dev/null 2>&1 && { echo "FAIL: a fifo was hashed with --fail-on-unknown"; exit 1; }
+[ "$(_test/gittreehash --fail-on-unknown=false _test/unknown 2>/dev/null)" == "$(_test/gittreehash _test/unknown-clean)" ] || { echo "FAIL: --fail-on-unknown=false didn't leave out the fifo"; exit 1; }
+
+# --allow-pipes reads a named pipe until its writer closes it, hashing what was written as a regular file's content.
+# It waits for a writer for as long as it takes (--pipe-timeout is only for --read-pipes), so a writer that's a second late is waited for.
+rm -rf _test/allowpipes _test/allowpipes-file && mkdir -p _test/allowpipes _test/allowpipes-file
+echo "plain" > _test/allowpipes/plain; cp _test/allowpipes/plain _test/allowpipes-file/; printf 'piped\n' > _test/allowpipes-file/fifo
+mkfifo _test/allowpipes/fifo
+(sleep 1; printf 'piped\n' > _test/allowpipes/fifo) &
+hash="$(_test/gittreehash --allow-pipes --pipe-timeout=100ms _test/allowpipes)" || { echo "FAIL: --allow-pipes failed"; exit 1; }
+wait
+[ "$hash" == "$(_test/gittreehash _test/allowpipes-file)" ] || { echo "FAIL: --allow-pipes didn't hash the pipe's content as a file"; exit 1; }
+# With --read-pipes, the same late writer is given up on.
+(timeout 2 sh -c 'sleep 1; printf "piped\n" > _test/allowpipes/fifo' || true) &
+code=0; out="$(_test/gittreehash --read-pipes --pipe-timeout=100ms _test/allowpipes 2>&1 | tr -d '\n')" || code=$?
+wait
+[ "$code" == 9 ] && grep -q '"code":"gittreehash-error-pipe-timeout"' <<< "$out" || { echo "FAIL: --read-pipes with a late writer exited $code: $out"; exit 1; }
+
+# Identical subtrees and empty files are only hashed once, which --stats reports, without changing any hashes.
+mkdir -p _test/dedup/one/sub _test/dedup/two/sub
+for d in one two; do echo "same" > _test/dedup/$d/sub/file; : > _test/dedup/$d/empty; done
+_test/gittreehash --stats _test/dedup 2>&1 >/dev/null | grep -q "blobs=4 unique_blobs=2 trees=5 unique_trees=3" || { echo "FAIL: unexpected dedup stats: $(_test/gittreehash --stats _test/dedup 2>&1 >/dev/null)"; exit 1; }
+[ "$(_test/gittreehash _test/dedup/one)" == "$(_test/gittreehash _test/dedup/two)" ] || { echo "FAIL: identical subtrees hash differently"; exit 1; }
+
+# --histogram prints, after the hash, a fixed-width table counting the regular files hashed by size, with each bucket's lower bound
+# included and its upper bound not: so 1023 bytes is under 1KB, and 1024 and 10240 bytes start the next buckets.
+# Symlinks and directories aren't counted; files in subdirectories are.
+rm -rf _test/histogram && mkdir -p _test/histogram/sub
+: > _test/histogram/empty; ln -s empty _test/histogram/link
+for size in 1023 1024 10239 10240 102400 1048575 1048576 10485760; do truncate -s "$size" "_test/histogram/$size"; done
+mv _test/histogram/10240 _test/histogram/sub/
+[ "$(_test/gittreehash --histogram _test/histogram)" == "$(_test/gittreehash _test/histogram)
+<1KB:                2 files
+1KB-10KB:            2 files
+10KB-100KB:          1 files
+100KB-1MB:           2 files
+1MB-10MB:            1 files
+10MB-100MB:          1 files
+100MB-1GB:           0 files
+>=1GB:               0 files" ] || { echo "FAIL: --histogram printed the wrong table: $(_test/gittreehash --histogram _test/histogram)"; exit 1; }
+
+# --benchmark hashes the path repeatedly, timing each run then summarizing, with the usual output.
+out="$(_test/gittreehash --benchmark=3 _test/dedup 2>&1 >/dev/null)"
+[ "$(grep -c "^run [1-3]/3: .* MB/s, .* files/s, .* allocs/file, .* KB/file$" <<< "$out")" == 3 ] || { echo "FAIL: --benchmark didn't report each run: $out"; exit 1; }
+grep -q "^latency: min=.* max=.* avg=.* p99=" <<< "$out" || { echo "FAIL: --benchmark didn't summarize the runs: $out"; exit 1; }
+[ "$(_test/gittreehash --benchmark=2 _test/dedup 2>/dev/null)" == "$(_test/gittreehash _test/dedup)" ] || { echo "FAIL: --benchmark changed the output"; exit 1; }
+# It also reports the heap allocations per file, which the pooled copy and tree buffers keep to a few small ones:
+# a buffer allocated for each file would be hundreds of KB of them.
+mkdir -p _test/allocs/sub
+for i in $(seq 1000); do echo $i > _test/allocs/$i; done
+for i in $(seq 200); do echo "sub $i" > _test/allocs/sub/$i; done
+for flags in "" --concurrency=1 --mmap; do
+	out="$(_test/gittreehash --benchmark=3 $flags _test/allocs 2>&1 >/dev/null)"
+	awk '/^run / { for (i = 2; i <= NF; i++) { if ($i ~ /^allocs\/file/ && $(i-1) + 0 > 40) exit 1; if ($i ~ /^KB\/file/ && $(i-1) + 0 > 16) exit 1 } }' <<< "$out" ||
+		{ echo "FAIL: hashing small files with '$flags' allocated more than expected per file: $out"; exit 1; }
+done
+# Flags that can't be used together, or that mean nothing without another, are refused with exit code 2, saying which.
+while IFS='|' read -r args message; do
+	code=0; out="$(_test/gittreehash $args 2>&1)" || code=$?
+	[ "$code" == 2 ] && [ "$out" == "$message" ] || { echo "FAIL: $args exited $code, saying: $out"; exit 1; }
+done <<-EOT
+	--stdin-tar _test/dedup|--tar can't be used with a path, --zip, --count, --tracked-only, --reuse-git, --progress, --hash-names-only, or --respect-export-ignore
+	--zip=x --count|--zip can't be used with a path, --count, --tracked-only, --reuse-git, --progress, --hash-names-only, or --respect-export-ignore
+	--format=tree --var=x _test/dedup|--format=tree can't be used with --report-format, --verbose, --template, --go-array, or --var
+	--pipe-to-git --lfs=pointers _test/dedup|--pipe-to-git can't be used with --tar, --zip, --respect-gitattributes-eol, --lfs=pointers, --symlinks-as-text, --symlinks-as-text-from-index, or --hash-names-only
+	--report-collisions --zip=x|--report-collisions can't be used with --tar or --zip
+	--git-dir=x _test/dedup|--git-dir requires --write
+	--update _test/dedup|--update requires --assert-unchanged
+EOT
+# (Flags with their default values aren't counted as given.)
+[ "$(_test/gittreehash --format=hex --var= --lfs=content _test/dedup)" == "$(_test/gittreehash _test/dedup)" ] || { echo "FAIL: flags given their defaults were refused"; exit 1; }
+code=0; _test/gittreehash --benchmark=2 --progress _test/dedup > /dev/null 2>&1 || code=$?
+[ "$code" == 2 ] || { echo "FAIL: --benchmark with --progress exited $code, not 2"; exit 1; }
+
+# --prepend-path gives the hash the same content would have if it were found at that path within otherwise empty directories.
+mkdir -p _test/prepended/outer
+cp -r _test/dedup/one _test/prepended/outer/inner
+[ "$(_test/gittreehash --prepend-path=outer/inner _test/dedup/one)" == "$(_test/gittreehash _test/prepended)" ] || { echo "FAIL: --prepend-path hash differs from the equivalent tree"; exit 1; }
+
+# Memory-mapping files gives the same hashes as reading them.
+[ "$(_test/gittreehash --mmap --mmap-threshold=1 _test/dedup)" == "$(_test/gittreehash _test/dedup)" ] || { echo "FAIL: --mmap changes the hash"; exit 1; }
+
+# chain-verify re-hashes each recorded path, and checks that the records are in time order.
+one="$(_test/gittreehash _test/dedup/one)"
+two="$(_test/gittreehash --algorithm=sha1 _test/dedup/two)"
+printf '[{"timestamp":"2024-01-01T00:00:00Z","path":"_test/dedup/one","hash":"%s"},{"timestamp":"2024-01-02T00:00:00Z","path":"_test/dedup/two","hash":"%s"}]' "$one" "$two" > _test/chain.json
+_test/gittreehash chain-verify --chain=_test/chain.json > /dev/null || { echo "FAIL: valid chain rejected"; exit 1; }
+sed 's/2024-01-02/2023-01-02/' _test/chain.json > _test/chain-unordered.json
+{ _test/gittreehash chain-verify --chain=_test/chain-unordered.json || true; } | grep -q "^out of order" || { echo "FAIL: out-of-order chain accepted"; exit 1; }
+sed 's|_test/dedup/two|_test/unknown-clean|' _test/chain.json > _test/chain-wrong.json
+{ _test/gittreehash chain-verify --chain=_test/chain-wrong.json || true; } | grep -q "^differs" || { echo "FAIL: chain with a wrong hash accepted"; exit 1; }
+
+# --sparse skips reading holes, but the hash is the same as reading every byte.  (Linux only.)
+if [ "$(uname)" == "Linux" ]; then
+	mkdir -p _test/sparse
+	truncate -s 20M _test/sparse/all-hole
+	truncate -s 20M _test/sparse/data-in-middle
+	printf 'data' | dd of=_test/sparse/data-in-middle bs=1 seek=10000000 conv=notrunc 2>/dev/null
+	echo "tail" >> _test/sparse/data-in-middle
+	[ "$(_test/gittreehash --sparse _test/sparse)" == "$(_test/gittreehash _test/sparse)" ] || { echo "FAIL: --sparse changes the hash"; exit 1; }
+fi
+
+# --normalize-output hashes a copy with normalized mtimes and permissions, which hashes the same as the original.
+[ "$(_test/gittreehash --normalize-output=_test/normalized _test/dedup)" == "$(_test/gittreehash _test/dedup)" ] || { echo "FAIL: --normalize-output changes the hash"; exit 1; }
+[ -z "$(find _test/normalized -newermt '1970-01-02')" ] || { echo "FAIL: --normalize-output left mtimes unnormalized"; exit 1; }
+
+# --drop-cache is only advice to the kernel, and doesn't change any hashes.
+[ "$(_test/gittreehash --drop-cache _test/dedup)" == "$(_test/gittreehash _test/dedup)" ] || { echo "FAIL: --drop-cache changes the hash"; exit 1; }
+
+# --noatime leaves access times alone (Linux only), and where the kernel won't allow it, files are read as usual.
+if [ "$(uname)" == "Linux" ]; then
+	mkdir -p _test/noatime
+	echo "content" > _test/noatime/file
+	touch -a -d '2000-01-01' _test/noatime/file
+	atime=$(stat -c %X _test/noatime/file)
+	noatime_hash="$(_test/gittreehash --noatime _test/noatime)"
+	[ "$(stat -c %X _test/noatime/file)" == "$atime" ] || { echo "FAIL: --noatime updated an access time"; exit 1; }
+	[ "$noatime_hash" == "$(_test/gittreehash _test/noatime)" ] || { echo "FAIL: --noatime changes the hash"; exit 1; }
+	# O_NOATIME is refused for files owned by someone else, which root can arrange by dropping privileges.
+	if [ "$(id -u)" == 0 ] && command -v setpriv > /dev/null; then
+		other=$(mktemp -d)
+		cp _test/gittreehash "$other/"
+		cp -r _test/noatime "$other/tree"
+		chmod -R a+rX "$other"
+		[ "$(setpriv --reuid=65534 --regid=65534 --clear-groups "$other/gittreehash" --noatime "$other/tree")" == "$noatime_hash" ] || { echo "FAIL: --noatime didn't fall back for files owned by someone else"; exit 1; }
+		rm -rf "$other"
+	fi
+fi
+
+# Pathologically deep trees halt cleanly at the depth limit, and hash fine when the limit allows.
+deep=_test/deep
+for i in $(seq 600); do deep="$deep/d"; done
+mkdir -p "$deep"
+echo "bottom" > "$deep/file"
+{ _test/gittreehash _test/deep 2>&1 || true; } | grep -q "gittreehash-error-too-deep" || { echo "FAIL: a tree deeper than --max-depth wasn't refused"; exit 1; }
+_test/gittreehash --max-depth=1000 _test/deep > /dev/null || { echo "FAIL: a deep tree within --max-depth failed"; exit 1; }
+
+# read-tree decodes a tree body as printed by dump-tree, and lists it just as git ls-tree does.
+mkdir -p _test/readtree/sub
+echo "plain" > _test/readtree/plain
+echo "#!/bin/sh" > _test/readtree/exec
+chmod +x _test/readtree/exec
+echo "nested" > _test/readtree/sub/nested
+ln -s plain _test/readtree/link
+git --git-dir=_test/readtree.git init -q --object-format=sha256
+git --git-dir=_test/readtree.git --work-tree=_test/readtree add .
+want="$(git --git-dir=_test/readtree.git ls-tree "$(git --git-dir=_test/readtree.git write-tree)")"
+[ "$(_test/gittreehash dump-tree _test/readtree | _test/gittreehash read-tree -)" == "$want" ] || { echo "FAIL: read-tree disagrees with git ls-tree"; exit 1; }
+# It's strict: each of these corruptions of a valid entry ("100644 a" and a SHA-1 hash) is rejected, with the reason.
+h=$(printf '11%.0s' $(seq 20))
+[ "$(_test/gittreehash read-tree --algorithm=sha1 "313030363434206100$h" | tr -d ' ')" == "100644blob$h	a" ] || { echo "FAIL: read-tree rejected a valid entry"; exit 1; }
+while IFS='|' read -r body reason; do
+	{ _test/gittreehash read-tree --algorithm=sha1 "$body" 2>&1 || true; } | grep -q "$reason" || { echo "FAIL: read-tree didn't reject $body for: $reason"; exit 1; }
+done <<-EOT
+	313030363934206100$h|is not octal
+	303430303030206100$h|has a leading zero
+	206100$h|the mode is empty
+	31303036343420612f6200$h|contains a slash
+	313030363434202e2e00$h|the name is [^e]
+	3130303634342000$h|the name is empty
+	313030363434206100${h:2}|truncated hash
+	313030363434206100${h}ff|trailing garbage
+	3130303634342061${h}|no NUL after the name
+EOT
+
+# Nor does any corruption make it crash: each of these random mutations of a real tree body (bytes flipped, favoring the ones
+# that delimit fields, or ranges deleted, inserted, truncated, or repeated) either decodes, or is rejected as an invalid tree.
+body="$(_test/gittreehash dump-tree _test/readtree)"
+awk -v body="$body" 'BEGIN {
+	srand(146)
+	split("00 20 2f 2e 30 31 34 37 38 ff", special, " ")
+	n = length(body) / 2
+	for (i = 0; i < n; i++) orig[i] = substr(body, 2 * i + 1, 2)
+	for (m = 0; m < 400; m++) {
+		len = n; for (i = 0; i < n; i++) b[i] = orig[i]
+		for (k = int(rand() * 3); k >= 0; k--) {
+			pos = int(rand() * len); span = 1 + int(rand() * 40); if (pos + span > len) span = len - pos
+			op = int(rand() * 5)
+			if (op == 0) b[pos] = rand() < 0.5 ? special[1 + int(rand() * 10)] : sprintf("%02x", int(rand() * 256))
+			else if (op == 1) { for (i = pos; i + span < len; i++) b[i] = b[i + span]; len -= span }
+			else if (op == 2) { for (i = len - 1; i >= pos; i--) b[i + span] = b[i]; for (i = pos; i < pos + span; i++) b[i] = special[1 + int(rand() * 10)]; len += span }
+			else if (op == 3) len = pos
+			else { for (i = len - 1; i >= pos; i--) b[i + span] = b[i]; len += span }
+		}
+		s = ""; for (i = 0; i < len; i++) s = s b[i]
+		print s
+	}
+}' > _test/readtree.mutants
+while read -r mutant; do
+	code=0; out="$(_test/gittreehash read-tree "$mutant" 2>&1)" || code=$?
+	[ "$code" == 0 ] || grep -q '"gittreehash-error-invalid-tree"' <<< "$out" || { echo "FAIL: read-tree exited $code on the corrupt body $mutant: $out"; exit 1; }
+done < _test/readtree.mutants
+
+# And decoding what HashPath encoded is lossless: for random trees (of odd names, and every kind of entry),
+# what dump-tree prints, decoded by read-tree and encoded again by git mktree, has the hash of the directory.
+RANDOM=146
+names=(a b. .c d-e "f g" "h é" 0 1.0 ü~ "j  k" l_m n@o)
+for t in $(seq 20); do
+	dir=_test/roundtrip/$t
+	mkdir -p "$dir"
+	for i in $(seq $((RANDOM % 8 + 1))); do
+		sub="$dir"
+		if [ $((RANDOM % 3)) == 0 ]; then
+			sub="$dir/${names[RANDOM % ${#names[@]}]}"
+			if [ -e "$sub" ] || [ -L "$sub" ]; then [ -d "$sub" ] && [ ! -L "$sub" ] || continue; else mkdir "$sub"; fi
+		fi
+		name="$sub/${names[RANDOM % ${#names[@]}]}"
+		[ ! -e "$name" ] && [ ! -L "$name" ] || continue
+		case $((RANDOM % 4)) in
+		0) echo "$RANDOM" > "$name" ;;
+		1) echo "$RANDOM" > "$name"; chmod +x "$name" ;;
+		2) ln -s "target $RANDOM" "$name" ;;
+		3) mkdir "$name"; echo "$RANDOM" > "$name/inner" ;;
+		esac
+	done
+	while IFS= read -r -d '' sub; do
+		decoded="$(_test/gittreehash dump-tree "$sub" | _test/gittreehash read-tree -)"
+		[ "$(git --git-dir=_test/readtree.git mktree --missing <<< "$decoded")" == "$(_test/gittreehash "$sub")" ] || { echo "FAIL: $sub didn't survive dump-tree, read-tree, and git mktree"; exit 1; }
+	done < <(find "$dir" -type d -print0)
+done
+
+# However many files are hashed at once, the number held open is bounded, and reaching the bound means waiting, not failing.
+mkdir -p _test/many
+for i in $(seq 300); do echo "$i" > "_test/many/$i"; done
+[ "$(_test/gittreehash --concurrency=64 --max-open-files=1 _test/many)" == "$(_test/gittreehash _test/many)" ] || { echo "FAIL: --max-open-files changes the hash"; exit 1; }
+[ "$(_test/gittreehash --concurrency=64 --parallel-io=2 _test/many)" == "$(_test/gittreehash _test/many)" ] || { echo "FAIL: --parallel-io changes the hash"; exit 1; }
+( ulimit -n 48; _test/gittreehash --concurrency=256 _test/many > /dev/null ) || { echo "FAIL: hashing with a low open file limit failed"; exit 1; }
+
+# Concurrent hashing is deterministic, and free of data races: a build with the race detector hashes a tree of
+# many small files, nested directories, duplicates, hard links, and symlinks, concurrently, and gets just what a serial run does,
+# entry for entry.  (The race detector needs cgo.)
+if [ "$(go env CGO_ENABLED)" == 1 ]; then
+	go build -race -o _test/gittreehash-race .
+	mkdir -p _test/racetree
+	for d in $(seq 8); do
+		mkdir -p _test/racetree/$d/sub
+		for f in $(seq 40); do echo "$((f % 7))" > _test/racetree/$d/$f; echo "$d $f" > _test/racetree/$d/sub/$f; done
+		: > _test/racetree/$d/empty; ln -sf ../1/1 _test/racetree/$d/link; ln -f _test/racetree/1/2 _test/racetree/$d/hard; chmod +x _test/racetree/$d/3
+	done
+	want="$(_test/gittreehash --concurrency=1 --report-format=jsonlines _test/racetree | sort)"
+	for i in 1 2 3; do
+		got="$(GORACE="halt_on_error=1" _test/gittreehash-race --concurrency=16 --report-format=jsonlines _test/racetree | sort)" || { echo "FAIL: hashing concurrently under the race detector failed"; exit 1; }
+		[ "$got" == "$want" ] || { echo "FAIL: hashing concurrently gave different entries from hashing serially"; exit 1; }
+	done
+fi
+
+# --hash-names-only ignores content, but not names or structure.
+mkdir -p _test/names/sub
+echo "one" > _test/names/sub/file
+before="$(_test/gittreehash --hash-names-only _test/names)"
+echo "two" > _test/names/sub/file
+[ "$(_test/gittreehash --hash-names-only _test/names)" == "$before" ] || { echo "FAIL: --hash-names-only changed with content"; exit 1; }
+mv _test/names/sub/file _test/names/sub/renamed
+[ "$(_test/gittreehash --hash-names-only _test/names)" != "$before" ] || { echo "FAIL: --hash-names-only didn't change with a rename"; exit 1; }
+
+# --lfs=pointers hashes each file that .gitattributes gives filter=lfs as the pointer git-lfs stores for it, whether it's found
+# smudged (as its content) or not (as the pointer itself): either way, the tree is the one git makes of the pointers, and
+# each file's blob is what git hash-object makes of its pointer.  --lfs=content, the default, hashes the files as they're found.
+rm -rf _test/lfs-smudged _test/lfs-pointers _test/lfs.git && mkdir -p _test/lfs-smudged/sub _test/lfs-pointers/sub
+printf '*.bin filter=lfs diff=lfs merge=lfs -text\n' > _test/lfs-smudged/.gitattributes
+head -c 300000 /dev/urandom > _test/lfs-smudged/big.bin; echo "tiny" > _test/lfs-smudged/sub/small.bin; echo "plain" > _test/lfs-smudged/sub/plain.txt
+cp -a _test/lfs-smudged/. _test/lfs-pointers/
+for f in big.bin sub/small.bin; do
+	printf 'version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n' "$(sha256sum < _test/lfs-smudged/$f | cut -c1-64)" "$(stat -c %s _test/lfs-smudged/$f)" > _test/lfs-pointers/$f
+	if command -v git-lfs > /dev/null; then
+		[ "$(git lfs pointer --file=_test/lfs-smudged/$f 2>/dev/null)" == "$(cat _test/lfs-pointers/$f)" ] || { echo "FAIL: the pointer made for $f isn't git lfs's"; exit 1; }
+	fi
+done
+git init -q --bare --object-format=sha1 _test/lfs.git
+want="$(git --git-dir=_test/lfs.git --work-tree=_test/lfs-pointers add -A && git --git-dir=_test/lfs.git write-tree)"
+for d in smudged pointers; do
+	[ "$(_test/gittreehash --algorithm=sha1 --lfs=pointers _test/lfs-$d)" == "$want" ] || { echo "FAIL: --lfs=pointers of the $d files isn't git's tree of the pointers"; exit 1; }
+	for f in big.bin sub/small.bin sub/plain.txt; do
+		got="$(_test/gittreehash --algorithm=sha1 --lfs=pointers --report-format=csv _test/lfs-$d | grep ",_test/lfs-$d/$f$" | cut -d, -f1)"
+		[ "$got" == "$(git --git-dir=_test/lfs.git hash-object _test/lfs-pointers/$f)" ] || { echo "FAIL: --lfs=pointers hashed the $d $f as $got, not as git hash-object does its pointer"; exit 1; }
+	done
+done
+[ "$(_test/gittreehash --algorithm=sha1 _test/lfs-pointers)" == "$want" ] || { echo "FAIL: the pointers aren't hashed as they are by default"; exit 1; }
+[ "$(_test/gittreehash --lfs=content _test/lfs-smudged)" != "$(_test/gittreehash --lfs=pointers _test/lfs-smudged)" ] || { echo "FAIL: --lfs=content hashed the smudged files as pointers"; exit 1; }
+
+# --limit-rate holds reading to about the given rate, without changing the hash.
+mkdir -p _test/rate
+head -c 2000000 /dev/urandom > _test/rate/data
+start=$(date +%s%N)
+[ "$(_test/gittreehash --limit-rate=1000000 --limit-rate-burst=65536 _test/rate)" == "$(_test/gittreehash _test/rate)" ] || { echo "FAIL: --limit-rate changes the hash"; exit 1; }
+elapsed_ms=$(( ($(date +%s%N) - start) / 1000000 ))
+[ "$elapsed_ms" -ge 1700 ] && [ "$elapsed_ms" -le 4000 ] || { echo "FAIL: reading 2MB at 1MB/s took ${elapsed_ms}ms"; exit 1; }
+
+# --pprof serves profiles while hashing; --cpuprofile and --memprofile are written on exit, even after an interrupt.
+_test/gittreehash --limit-rate=1000000 --limit-rate-burst=65536 --pprof=127.0.0.1:0 --cpuprofile=_test/cpu.prof --memprofile=_test/mem.prof _test/rate > /dev/null 2> _test/pprof.log &
+pid=$!
+for _ in $(seq 50); do grep -q "^pprof: serving on" _test/pprof.log && break; sleep 0.02; done
+addr=$(sed -n 's|^pprof: serving on \(http://[^ ]*\)|\1|p' _test/pprof.log)
+curl -sf "${addr}heap?debug=1" | grep "heap profile" > /dev/null || { echo "FAIL: --pprof didn't serve a heap profile"; exit 1; }
+wait "$pid"
+[ -s _test/cpu.prof ] && [ -s _test/mem.prof ] || { echo "FAIL: --cpuprofile or --memprofile weren't written"; exit 1; }
+rm _test/cpu.prof _test/mem.prof
+_test/gittreehash --limit-rate=1000000 --limit-rate-burst=65536 --cpuprofile=_test/cpu.prof --memprofile=_test/mem.prof _test/rate > /dev/null 2>&1 &
+pid=$!
+sleep 0.3
+kill -INT "$pid"
+wait "$pid" || true
+[ -s _test/cpu.prof ] && [ -s _test/mem.prof ] || { echo "FAIL: profiles weren't written on interrupt"; exit 1; }
+
+# --symlinks-as-text hashes the listed files as symlinks whose targets are their content, which is how git checks symlinks out
+# with core.symlinks=false (as on Windows), so such a checkout hashes as one with real symlinks, and as git's tree does.
+# --symlinks-as-text-from-index finds the same files from the index, which still records them as symlinks.
+rm -rf _test/symreal _test/symtext && mkdir -p _test/symreal/sub/dir
+(cd _test/symreal
+	{
+		git init -q --object-format=sha1 . && git config user.email t@t && git config user.name t
+		echo "a" > a; echo "b" > sub/dir/b; ln -s a to-file; ln -s sub/dir to-dir; ln -s ../../nowhere sub/dangling; ln -s "../a" sub/dir/up
+		git add . && git commit -qm symlinks
+	} >&2
+)
+git -c core.symlinks=false clone -q _test/symreal _test/symtext
+[ -f _test/symtext/to-dir ] && [ ! -L _test/symtext/to-dir ] || { echo "FAIL: git checked out a symlink as a symlink with core.symlinks=false"; exit 1; }
+want="$(git -C _test/symreal rev-parse 'HEAD^{tree}')"
+[ "$(_test/gittreehash --algorithm=sha1 --ignore-dot-git _test/symreal)" == "$want" ] || { echo "FAIL: the real symlinks don't hash as git's tree"; exit 1; }
+git -C _test/symreal ls-files -s | awk '$1 == 120000 { print $4 }' > _test/symtext.list
+[ "$(_test/gittreehash --algorithm=sha1 --ignore-dot-git --symlinks-as-text=_test/symtext.list _test/symtext)" == "$want" ] || { echo "FAIL: --symlinks-as-text doesn't hash the text symlinks as the real ones"; exit 1; }
+[ "$(_test/gittreehash --algorithm=sha1 --ignore-dot-git --symlinks-as-text-from-index=_test/symtext/.git/index _test/symtext)" == "$want" ] || { echo "FAIL: --symlinks-as-text-from-index doesn't hash the text symlinks as the real ones"; exit 1; }
+[ "$(_test/gittreehash --algorithm=sha1 --ignore-dot-git _test/symtext)" != "$want" ] || { echo "FAIL: the text symlinks hash as real ones without --symlinks-as-text"; exit 1; }
+[ "$(_test/gittreehash --algorithm=sha1 --symlinks-as-text=_test/symtext.list --report-format=csv _test/symtext | grep ',_test/symtext/to-dir$')" == "$(_test/gittreehash --algorithm=sha1 --report-format=csv _test/symreal | grep ',_test/symreal/to-dir$' | sed 's|symreal|symtext|')" ] || { echo "FAIL: --symlinks-as-text doesn't report a text symlink as the real one"; exit 1; }
+
+# --gitconfig applies the settings in a git config file (and the files it includes) that affect hashing, as git would.
+mkdir -p _test/gitconfig/tree
+printf 'one\r\ntwo\r\n' > _test/gitconfig/tree/crlf.txt
+echo "#!/bin/sh" > _test/gitconfig/tree/exec.sh
+chmod +x _test/gitconfig/tree/exec.sh
+printf '[core]\n\tfileMode = false\n[include]\n\tpath = included\n' > _test/gitconfig/config
+printf '[core]\n\tautocrlf = input ; a comment\n' > _test/gitconfig/included
+git --git-dir=_test/gitconfig.git init -q --object-format=sha256
+git --git-dir=_test/gitconfig.git config core.fileMode false
+git --git-dir=_test/gitconfig.git config core.autocrlf input
+git --git-dir=_test/gitconfig.git --work-tree=_test/gitconfig/tree add . 2>/dev/null
+[ "$(_test/gittreehash --gitconfig=_test/gitconfig/config _test/gitconfig/tree)" == "$(git --git-dir=_test/gitconfig.git write-tree)" ] || { echo "FAIL: --gitconfig doesn't match git"; exit 1; }
+
+# Tree bodies spilled to disk hash the same as those kept in memory, and the temporary files are cleaned up.
+mkdir -p _test/spill-tmp
+[ "$(TMPDIR=_test/spill-tmp _test/gittreehash --tree-spill-threshold=1 _test/many)" == "$(_test/gittreehash _test/many)" ] || { echo "FAIL: spilling tree bodies changes the hash"; exit 1; }
+[ -z "$(ls -A _test/spill-tmp)" ] || { echo "FAIL: spilled tree bodies left temporary files behind"; exit 1; }
+
+# --seed XORs a value into the root hash; seeding with zeros changes nothing.
+plain="$(_test/gittreehash _test/dedup)"
+[ "$(_test/gittreehash --seed="$(printf '0%.0s' $(seq 64))" _test/dedup)" == "$plain" ] || { echo "FAIL: a zero --seed changed the hash"; exit 1; }
+seeded="$(_test/gittreehash --seed="ff$(printf '0%.0s' $(seq 62))" _test/dedup)"
+[ "${seeded:2}" == "${plain:2}" ] && [ "${seeded:0:2}" != "${plain:0:2}" ] || { echo "FAIL: --seed didn't XOR into the hash"; exit 1; }
+
+# --tar hashes an archive as the tree it extracts to, including long names (in PAX and GNU form), hard links, symlinks, and exec bits.
+long="$(printf 'long%.0s' $(seq 40))"
+mkdir -p "_test/tarsrc/$long/sub"
+echo "deep" > "_test/tarsrc/$long/sub/$long.txt"
+echo "#!/bin/sh" > _test/tarsrc/run.sh
+chmod +x _test/tarsrc/run.sh
+ln _test/tarsrc/run.sh _test/tarsrc/hardlink.sh
+ln -s "$long/sub/$long.txt" _test/tarsrc/to-long
+ln -s "$long" "_test/tarsrc/$long-link"
+for format in pax gnu; do
+	tar -C _test/tarsrc --format=$format -cf _test/tarsrc.$format.tar .
+	mkdir -p _test/tarout.$format
+	tar -C _test/tarout.$format -xf _test/tarsrc.$format.tar
+	[ "$(_test/gittreehash --tar=_test/tarsrc.$format.tar)" == "$(_test/gittreehash _test/tarout.$format)" ] || { echo "FAIL: --tar of a $format archive doesn't match its extracted tree"; exit 1; }
+	[ "$(_test/gittreehash --tar=- < _test/tarsrc.$format.tar)" == "$(_test/gittreehash _test/tarout.$format)" ] || { echo "FAIL: --tar=- of a $format archive doesn't match its extracted tree"; exit 1; }
+done
+
+# --zip hashes an archive as the tree it extracts to, and rejects archives that name a path twice, or that climb out of the root.
+mkdir -p _test/zipsrc/dir _test/zipout
+echo "#!/bin/sh" > _test/zipsrc/dir/run.sh
+chmod +x _test/zipsrc/dir/run.sh
+echo "plain" > _test/zipsrc/plain.txt
+ln -s dir/run.sh _test/zipsrc/link
+( cd _test/zipsrc && zip -qry ../src.zip . )
+( cd _test/zipout && unzip -q ../src.zip )
+[ "$(_test/gittreehash --zip=_test/src.zip)" == "$(_test/gittreehash _test/zipout)" ] || { echo "FAIL: --zip doesn't match the extracted tree"; exit 1; }
+mkdir -p _test/zipbad
+echo "one" > _test/zipbad/dupA
+echo "two" > _test/zipbad/dupB
+mkdir -p _test/zipbad/xx
+echo "three" > _test/zipbad/xx/file
+( cd _test/zipbad && zip -q0 ../dup.zip dupA dupB && zip -q0 ../slip.zip xx/file )
+LC_ALL=C sed -i 's|dupB|dupA|g' _test/dup.zip
+LC_ALL=C sed -i 's|xx/file|../file|g' _test/slip.zip
+{ _test/gittreehash --zip=_test/dup.zip 2>&1 || true; } | grep -q "gittreehash-error-invalid-entry" || { echo "FAIL: --zip accepted a duplicate entry"; exit 1; }
+{ _test/gittreehash --zip=_test/slip.zip 2>&1 || true; } | grep -q "gittreehash-error-invalid-path" || { echo "FAIL: --zip accepted a path that climbs out of the root"; exit 1; }
+# The filtering options apply to archives as they do to directories: --tar, --stdin-tar, and --zip each give what hashing the extracted tree does.
+mkdir -p _test/archfilter/d/.git _test/archfilter/e
+( cd _test/archfilter
+	echo cfg > d/.git/config; echo gitfile > e/.git; echo x > small; echo bigger-content > big; echo t > keep.tmp
+	ln -s big link.tmp; ln big hard
+	tar -cf ../archfilter.tar . && zip -qry ../archfilter.zip . )
+filters="--exclude-suffix=.tmp --min-size=3 --ignore-dot-git"
+want="$(_test/gittreehash $filters _test/archfilter)"
+[ "$want" != "$(_test/gittreehash _test/archfilter)" ] || { echo "FAIL: the filtering options changed nothing"; exit 1; }
+[ "$(_test/gittreehash $filters --tar=_test/archfilter.tar)" == "$want" ] || { echo "FAIL: --tar ignored the filtering options"; exit 1; }
+[ "$(_test/gittreehash $filters --stdin-tar < _test/archfilter.tar)" == "$want" ] || { echo "FAIL: --stdin-tar ignored the filtering options"; exit 1; }
+[ "$(_test/gittreehash $filters --zip=_test/archfilter.zip)" == "$want" ] || { echo "FAIL: --zip ignored the filtering options"; exit 1; }
+code=0; _test/gittreehash --respect-export-ignore --tar=_test/archfilter.tar > /dev/null 2>&1 || code=$?
+[ "$code" == 2 ] || { echo "FAIL: --tar with --respect-export-ignore exited $code, not 2"; exit 1; }
+
+# --respect-export-ignore leaves out what .gitattributes marks export-ignore, matching paths with git's wildmatch rules.
+# Each of these patterns is put in a .gitattributes beside a file at the path, which is left out just if the pattern matches it
+# (or a directory it's in).  Most are from git's own wildmatch tests; git archive leaves out the same files.
+rm -rf _test/wildmatch && mkdir _test/wildmatch
+n=0
+while IFS='|' read -r pattern pth want; do
+	n=$((n+1)); d=_test/wildmatch/$n
+	mkdir -p "$d/$(dirname -- "$pth")" && echo x > "$d/$pth" && printf '%s export-ignore\n' "$pattern" > "$d/.gitattributes"
+	got=0; _test/gittreehash --respect-export-ignore --report-format=csv "$d" | grep -xF -- "$(_test/gittreehash "$d/$pth"),100644,blob,2,$d/$pth" > /dev/null || got=1 # Not -q, which could stop reading while gittreehash is still writing.
+	[ "$got" == "$want" ] || { echo "FAIL: export-ignore pattern '$pattern' $([ "$want" == 1 ] && echo "didn't leave out" || echo "left out") $pth"; exit 1; }
+done <<'CASES'
+/foo|foo|1
+/bar|foo|0
+/???|foo|1
+/??|foo|0
+/*|foo|1
+/f*|foo|1
+/*f|foo|0
+/*foo*|foo|1
+/*ob*a*r*|foobar|1
+/*ab|aaaaaaabababab|1
+/foo\*|foo*|1
+/foo\*bar|foobar|0
+/*[al]?|ball|1
+/[ten]|ten|0
+/**[!te]|ten|1
+/**[!ten]|ten|0
+/t[a-g]n|ten|1
+/t[!a-g]n|ten|0
+/t[!a-g]n|ton|1
+/t[^a-g]n|ton|1
+/a[]]b|a]b|1
+/a[]-]b|a-b|1
+/a[]-]b|a]b|1
+/a[]-]b|aab|0
+/a[]a-]b|aab|1
+/]|]|1
+/foo*bar|foo/baz/bar|0
+/foo**bar|foo/baz/bar|0
+/foo?bar|foo/bar|0
+/foo[/]bar|foo/bar|0
+/f[^eiu][^eiu][^eiu][^eiu][^eiu]r|foo/bar|0
+/f[^eiu][^eiu][^eiu][^eiu][^eiu]r|foo-bar|1
+/**/foo|foo|1
+/**/foo|XXX/foo|1
+/**/foo|bar/baz/foo|1
+/*/foo|bar/baz/foo|0
+/**/bar/*|deep/foo/bar/baz|1
+/**/bar/**|deep/foo/bar/baz/x|1
+/**/bar/*|deep/foo/bar|0
+/*/bar/**|deep/foo/bar/baz/x|0
+/**/bar/*/*|deep/foo/bar/baz/x|1
+/foo/**/bar|foo/bar|1
+/foo/**/bar|foo/x/y/bar|1
+/foo/**/**/bar|foo/b/a/z/bar|1
+/foo/**/**/bar|foo/bar|1
+/*/*/*|foo/bba/arr|1
+/*/*/*|foo/bb/aa/rr|1
+/*X*i|abcXdefXghi|1
+/*/*X*/*/*i|ab/cXd/efXg/hi|1
+/**/*X*/**/*i|ab/cXd/efXg/hi|1
+/a[c-c]st|acrt|0
+/a[c-c]rt|acrt|1
+/[a-c[:digit:]x-z]|5|1
+/[a-c[:digit:]x-z]|d|0
+/[[:alpha:]][[:digit:]][[:upper:]]|a1B|1
+/[[:digit:][:upper:][:space:]]|A|1
+/[[:digit:][:upper:][:space:]]|a|0
+/[[:nope:]]*|nope|0
+/x[[:punct:]]|x%|1
+/[[:xdigit:]][[:xdigit:]]|fF|1
+/[[:xdigit:]]|g|0
+/[![:lower:]]|A|1
+/[![:lower:]]|a|0
+/a[[:blank:]]b|a b|1
+/[[:ab]|:|1
+/[[:alnum:]_]*|_x1|1
+/-*-*-*-*-*-*-12-*-*-*-m-*-*-*|-adobe-courier-bold-o-normal--12-120-75-75-m-70-iso8859-1|1
+/-*-*-*-*-*-*-12-*-*-*-m-*-*-*|-adobe-courier-bold-o-normal--12-120-75-75-X-70-iso8859-1|0
+/**/*a*b*g*n*t|abcd/abcdefg/abcdefghijk/abcdefghijklmnop.txt|1
+/**/*a*b*g*n*t|abcd/abcdefg/abcdefghijk/abcdefghijklmnop.txtz|0
+/[A-Z]*|abc|0
+/[\!]|!|1
+/\[ab]|[ab]|1
+/[[]ab]|[ab]|1
+*.c|src/deep/a.c|1
+*.c|src/deep/a.h|0
+deep|src/deep/a.c|1
+build/|build/x|1
+build/|src/build|0
+src/*.c|src/deep/a.c|0
+src/**/*.c|src/deep/a.c|1
+CASES
+
+# --go-array prints the hash as a Go array literal of its bytes, and --var as a declaration of a variable holding it,
+# both as gofmt would format them.
+for alg in sha1 sha256; do
+	hex="$(_test/gittreehash --algorithm=$alg _test/dedup)"
+	literal="[$((${#hex} / 2))]byte{$(sed 's/../0x&, /g; s/, $//' <<< "$hex")}"
+	[ "$(_test/gittreehash --algorithm=$alg --go-array _test/dedup)" == "$literal" ] || { echo "FAIL: --go-array ($alg) printed $(_test/gittreehash --algorithm=$alg --go-array _test/dedup), not $literal"; exit 1; }
+	for flags in --var=treeHash "--var=treeHash --go-array"; do
+		[ "$(_test/gittreehash --algorithm=$alg $flags _test/dedup)" == "var treeHash = $literal" ] || { echo "FAIL: '$flags' ($alg) printed $(_test/gittreehash --algorithm=$alg $flags _test/dedup)"; exit 1; }
+	done
+	printf 'package x\n\n%s\n' "$(_test/gittreehash --algorithm=$alg --var=treeHash _test/dedup)" > _test/goarray.go
+	[ -z "$(gofmt -l _test/goarray.go)" ] || { echo "FAIL: --var ($alg) didn't print what gofmt would"; exit 1; }
+done
+[ "$(_test/gittreehash --go-array --seed="$(_test/gittreehash _test/dedup)" _test/dedup)" == "[32]byte{$(printf '0x00, %.0s' $(seq 31))0x00}" ] || { echo "FAIL: --go-array didn't print the seeded hash"; exit 1; }
+
+# --template formats a line per entry; this one reproduces the CSV report's rows.
+[ "$(_test/gittreehash --template='{{.Hash}},{{.Mode}},{{.Type}},{{.Size}},{{.Path}}' _test/dedup)" == "$(_test/gittreehash --report-format=csv _test/dedup | tail -n +2)" ] || { echo "FAIL: --template doesn't match --report-format=csv"; exit 1; }
+[ "$(_test/gittreehash --algorithm=sha1 --template='{{.Algorithm}}' _test/dedup | sort -u)" == "sha1" ] || { echo "FAIL: --template's .Algorithm is wrong"; exit 1; }
+{ _test/gittreehash --template='{{.Nope}}' _test/dedup 2>&1 || true; } | grep -q "bad --template" || { echo "FAIL: --template accepted an unknown field"; exit 1; }
+
+# --emit-null-hash records a file that vanishes after its directory is listed with an all-zeros hash, rather than failing.
+# Reading the first file slowly leaves time to delete the second before it's looked at.
+mkdir -p _test/nullhash
+head -c 1500000 /dev/zero > _test/nullhash/a_slow
+nullhash_run() {
+	echo "soon gone" > _test/nullhash/z_gone
+	( sleep 0.5; rm _test/nullhash/z_gone ) &
+	_test/gittreehash --concurrency=1 --prefetch=-1 --limit-rate=1000000 --limit-rate-burst=65536 "$@" _test/nullhash
+	wait
+}
+{ nullhash_run 2>&1 || true; } | grep -q "gittreehash-error-concurrent-io" || { echo "FAIL: a vanished file wasn't an error"; exit 1; }
+vanished="$(nullhash_run --emit-null-hash 2> _test/nullhash.log)"
+grep -q "z_gone.*vanished" _test/nullhash.log || { echo "FAIL: --emit-null-hash didn't warn about the vanished file"; exit 1; }
+git --git-dir=_test/nullhash.git init -q --object-format=sha256
+slow_blob="$(git --git-dir=_test/nullhash.git hash-object _test/nullhash/a_slow)"
+expected="$(printf '100644 blob %s\ta_slow\n100644 blob %s\tz_gone\n' "$slow_blob" "$(printf '0%.0s' $(seq 64))" | git --git-dir=_test/nullhash.git mktree --missing)"
+[ "$vanished" == "$expected" ] || { echo "FAIL: --emit-null-hash didn't record the vanished file with a null hash"; exit 1; }
+
+# --tar decompresses gzip, zstd, bzip2, and xz archives, recognizing them by their magic bytes, or as --compression says.
+plain="$(_test/gittreehash --tar=_test/tarsrc.pax.tar)"
+for compressor in gzip zstd bzip2 xz; do
+	command -v $compressor > /dev/null || continue
+	$compressor -c < _test/tarsrc.pax.tar > _test/tarsrc.pax.tar.$compressor
+	[ "$(_test/gittreehash --tar=_test/tarsrc.pax.tar.$compressor)" == "$plain" ] || { echo "FAIL: --tar of a $compressor archive doesn't match the uncompressed archive"; exit 1; }
+	[ "$(_test/gittreehash --tar=- --compression=$compressor < _test/tarsrc.pax.tar.$compressor)" == "$plain" ] || { echo "FAIL: --compression=$compressor doesn't match the uncompressed archive"; exit 1; }
+done
+# A corrupt archive is told apart from a problem reading it.
+head -c 400 _test/tarsrc.pax.tar.gzip > _test/truncated.tar.gz
+{ _test/gittreehash --tar=_test/truncated.tar.gz 2>&1 || true; } | grep -q '"layer"' || { echo "FAIL: a truncated archive wasn't reported as a decompression failure"; exit 1; }
+
+# oci hashes each layer of an image, and the filesystem they make, where whiteouts delete what's beneath them
+# and opaque whiteouts empty their directory (but never touch their own layer, whatever order its entries come in).
+mkdir -p _test/oci/l1/a _test/oci/l1/b _test/oci/l1/d/sub _test/oci/l2/a _test/oci/l2/b _test/oci/l3/c _test/oci/image/blobs/sha256 _test/oci/want/a _test/oci/want/b _test/oci/want/c
+for f in l1/a/file1 l1/a/file2 l1/b/x l1/c l1/d/sub/y l1/keep l2/b/new l2/e l3/c/z; do echo "$f" > "_test/oci/$f"; done
+touch _test/oci/l2/.wh.c _test/oci/l2/a/.wh.file1 _test/oci/l2/b/.wh..wh..opq _test/oci/l3/.wh.d
+tar -C _test/oci/l1 -cf _test/oci/l1.tar .
+tar -C _test/oci/l2 -cf _test/oci/l2.tar .wh.c a/.wh.file1 b/new b/.wh..wh..opq e
+tar -C _test/oci/l3 -cf - .wh.d c/z | gzip > _test/oci/l3.tar.gz
+oci_blob() { # Stores a file as a blob of the image, and prints its digest.
+	local sum
+	sum=$(sha256sum "$1" | cut -d' ' -f1)
+	cp "$1" "_test/oci/image/blobs/sha256/$sum"
+	echo "sha256:$sum"
+}
+l1=$(oci_blob _test/oci/l1.tar); l2=$(oci_blob _test/oci/l2.tar); l3=$(oci_blob _test/oci/l3.tar.gz)
+printf '{"schemaVersion":2,"layers":[{"digest":"%s"},{"digest":"%s"},{"digest":"%s"}]}' "$l1" "$l2" "$l3" > _test/oci/manifest.json
+manifest=$(oci_blob _test/oci/manifest.json)
+printf '{"schemaVersion":2,"manifests":[{"digest":"%s"}]}' "$manifest" > _test/oci/image/index.json
+cp _test/oci/l1/a/file2 _test/oci/want/a/
+cp _test/oci/l2/b/new _test/oci/l2/e _test/oci/want/b/ && mv _test/oci/want/b/e _test/oci/want/
+cp _test/oci/l3/c/z _test/oci/want/c/
+cp _test/oci/l1/keep _test/oci/want/
+mkdir -p _test/oci/l2-contents/b _test/oci/l3-contents/c
+cp _test/oci/l2/b/new _test/oci/l2-contents/b/ && cp _test/oci/l2/e _test/oci/l2-contents/
+cp _test/oci/l3/c/z _test/oci/l3-contents/c/
+expected="$(_test/gittreehash _test/oci/l1)	$l1
+$(_test/gittreehash _test/oci/l2-contents)	$l2
+$(_test/gittreehash _test/oci/l3-contents)	$l3
+$(_test/gittreehash _test/oci/want)	rootfs"
+[ "$(_test/gittreehash oci _test/oci/image)" == "$expected" ] || { echo "FAIL: oci hashes are wrong"; _test/gittreehash oci _test/oci/image; echo "expected:"; echo "$expected"; exit 1; }
+# With two manifests, which to use must be given.
+printf '{"schemaVersion":2,"layers":[{"digest":"%s"}]}' "$l1" > _test/oci/manifest-l1.json
+manifest_l1=$(oci_blob _test/oci/manifest-l1.json)
+printf '{"schemaVersion":2,"manifests":[{"digest":"%s"},{"digest":"%s"}]}' "$manifest" "$manifest_l1" > _test/oci/image/index.json
+{ _test/gittreehash oci _test/oci/image 2>&1 || true; } | grep -q "gittreehash-error-invalid-image" || { echo "FAIL: oci didn't refuse an ambiguous index"; exit 1; }
+[ "$(_test/gittreehash oci --manifest="$manifest_l1" _test/oci/image | tail -n 1)" == "$(_test/gittreehash _test/oci/l1)	rootfs" ] || { echo "FAIL: oci --manifest didn't pick the manifest"; exit 1; }
+# An image saved by docker lists its layers' paths in manifest.json.
+mkdir -p _test/oci/saved
+cp _test/oci/l1.tar _test/oci/l2.tar _test/oci/l3.tar.gz _test/oci/saved/
+echo '[{"Layers":["l1.tar","l2.tar","l3.tar.gz"]}]' > _test/oci/saved/manifest.json
+[ "$(_test/gittreehash oci _test/oci/saved | tail -n 1)" == "$(_test/gittreehash _test/oci/want)	rootfs" ] || { echo "FAIL: oci of a docker-saved image is wrong"; exit 1; }
+
+# --report-format=jsonlines writes a JSON object per entry, matching the CSV report.
+_test/gittreehash --report-format=jsonlines _test/dedup > _test/report.jsonl
+[ "$(wc -l < _test/report.jsonl)" == "$(_test/gittreehash --report-format=csv _test/dedup | tail -n +2 | wc -l)" ] || { echo "FAIL: --report-format=jsonlines has the wrong number of lines"; exit 1; }
+[ "$(tail -n 1 _test/report.jsonl)" == "{\"hash\":\"$(_test/gittreehash _test/dedup)\",\"mode\":\"040000\",\"type\":\"tree\",\"size\":$(_test/gittreehash --report-format=csv _test/dedup | tail -n 1 | cut -d, -f4),\"path\":\"_test/dedup\"}" ] || { echo "FAIL: --report-format=jsonlines reported the root wrongly"; exit 1; }
+# --output is the same as --report-format, and --verbose reports entries as CSV unless another format is picked.
+[ "$(_test/gittreehash --verbose --output=jsonlines _test/dedup)" == "$(cat _test/report.jsonl)" ] || { echo "FAIL: --verbose --output=jsonlines differs from --report-format=jsonlines"; exit 1; }
+[ "$(_test/gittreehash --verbose _test/dedup)" == "$(_test/gittreehash --report-format=csv _test/dedup)" ] || { echo "FAIL: --verbose differs from --report-format=csv"; exit 1; }
+if command -v jq > /dev/null; then
+	[ "$(_test/gittreehash --verbose --output=jsonlines _test/dedup | jq -r 'select(.type == "tree") | .path' | tail -n 1)" == "_test/dedup" ] || { echo "FAIL: jq can't read --output=jsonlines"; exit 1; }
+fi
+# A failure to write a line stops the run with an IO error, rather than going on to print nothing more.
+code=0; out="$(_test/gittreehash --output=jsonlines _test/dedup 2>&1 > /dev/full | tr -d '\n')" || code=$?
+[ "$code" == 9 ] && grep -q '"code":"gittreehash-error-io"' <<< "$out" || { echo "FAIL: --output=jsonlines to a full device exited $code: $out"; exit 1; }
+
+# --pack writes every object into a pack file that git accepts, and from which git can rebuild the tree.
+for alg in sha1 sha256; do
+	git --git-dir=_test/pack-$alg.git init -q --object-format=$alg
+	packed="$(_test/gittreehash --algorithm=$alg --pack=_test/tree-$alg.pack _test/zipsrc)"
+	[ "$packed" == "$(_test/gittreehash --algorithm=$alg _test/zipsrc)" ] || { echo "FAIL: --pack changes the hash"; exit 1; }
+	git --git-dir=_test/pack-$alg.git index-pack --stdin --strict < _test/tree-$alg.pack > /dev/null || { echo "FAIL: git rejected the $alg pack"; exit 1; }
+	git --git-dir=_test/pack-$alg.git fsck --no-dangling --strict > /dev/null || { echo "FAIL: git fsck found problems in the $alg pack"; exit 1; }
+	git --git-dir=_test/pack-$alg.git verify-pack _test/tree-$alg.idx || { echo "FAIL: git rejected the index written beside the $alg pack"; exit 1; }
+	cmp -s _test/tree-$alg.idx _test/pack-$alg.git/objects/pack/pack-*.idx || { echo "FAIL: the index written beside the $alg pack differs from git's"; exit 1; }
+	rm -rf _test/pack-$alg-out && mkdir _test/pack-$alg-out
+	git --git-dir=_test/pack-$alg.git --work-tree=_test/pack-$alg-out read-tree "$packed"
+	git --git-dir=_test/pack-$alg.git --work-tree=_test/pack-$alg-out checkout-index -a
+	[ "$(_test/gittreehash --algorithm=$alg _test/pack-$alg-out)" == "$packed" ] || { echo "FAIL: the tree checked out from the $alg pack is different"; exit 1; }
+done
+# With the index beside it, a pack can be copied into a repository as it is.
+rm -rf _test/packout && git init -q _test/packout
+packed="$(_test/gittreehash --algorithm=sha1 --pack-out=_test/packout/.git/objects/pack/pack-tree.pack _test/zipsrc)"
+[ "$(git -C _test/packout cat-file -t "$packed")" == "tree" ] || { echo "FAIL: git doesn't see the tree in a pack written by --pack-out"; exit 1; }
+git -C _test/packout fsck --no-dangling --strict > /dev/null 2>&1 || { echo "FAIL: git fsck found problems in a pack written by --pack-out"; exit 1; }
+
+# --write stores every object as a loose object in a repository, which git can then read the tree from, and which passes fsck.
+for alg in sha1 sha256; do
+	rm -rf _test/write-$alg && git init -q --object-format=$alg _test/write-$alg
+	written="$(_test/gittreehash --algorithm=$alg --write --git-dir=_test/write-$alg/.git _test/zipsrc)"
+	[ "$written" == "$(_test/gittreehash --algorithm=$alg _test/zipsrc)" ] || { echo "FAIL: --write changes the hash"; exit 1; }
+	[ "$(git -C _test/write-$alg cat-file -t "$written")" == "tree" ] || { echo "FAIL: git doesn't see the $alg tree written by --write"; exit 1; }
+	[ "$(git -C _test/write-$alg ls-tree -r --name-only "$written")" == "$(cd _test/zipsrc && find . ! -type d | sed 's|^\./||' | LC_ALL=C sort)" ] || { echo "FAIL: git ls-tree doesn't list what --write wrote"; exit 1; }
+	git -C _test/write-$alg fsck --no-dangling --strict > /dev/null 2>&1 || { echo "FAIL: git fsck found problems in the objects written by --write ($alg)"; exit 1; }
+	[ "$(_test/gittreehash --algorithm=$alg --write --git-dir=_test/write-$alg/.git _test/zipsrc)" == "$written" ] || { echo "FAIL: --write into a repository that has the objects already fails"; exit 1; }
+	[ -z "$(find _test/write-$alg/.git/objects -name 'tmp_obj_*')" ] || { echo "FAIL: --write left temporary files behind"; exit 1; }
+done
+{ _test/gittreehash --algorithm=sha256 --write --git-dir=_test/write-sha1/.git _test/zipsrc 2>&1 || true; } | grep -q "object-format-mismatch" || { echo "FAIL: --write doesn't refuse a repository of the other object format"; exit 1; }
+
+# --paths0-as-tree hashes exactly the listed paths, implying the directories that lead to them, whatever their order.
+mkdir -p _test/pathlist/a/deep/er _test/pathlist/b _test/pathlist/c
+echo one > _test/pathlist/a/deep/er/one; echo two > _test/pathlist/a/deep/two; echo three > _test/pathlist/b/three
+echo four > _test/pathlist/b/four; echo five > _test/pathlist/c/five; echo top > _test/pathlist/top; ln -s top _test/pathlist/link
+rm -rf _test/pathlist-expect && mkdir _test/pathlist-expect
+(cd _test/pathlist && cp -a --parents a/deep/er/one b link ../pathlist-expect/)
+expect="$(_test/gittreehash _test/pathlist-expect)"
+listed="$(printf '_test/pathlist/link\0_test/pathlist/b\0_test/pathlist/a/deep/er/one\0_test/pathlist/b/four\0' | _test/gittreehash --paths0-as-tree _test/pathlist)"
+[ "$listed" == "$expect" ] || { echo "FAIL: --paths0-as-tree doesn't hash exactly the listed paths"; exit 1; }
+listed="$(printf './a/deep/er/one\0link\0b\0link' | (cd _test/pathlist && ../gittreehash --paths0-as-tree))"
+[ "$listed" == "$expect" ] || { echo "FAIL: --paths0-as-tree depends on the order of the list"; exit 1; }
+[ "$(find _test/pathlist -print0 | _test/gittreehash --paths0-as-tree _test/pathlist)" == "$(_test/gittreehash _test/pathlist)" ] || { echo "FAIL: --paths0-as-tree with everything listed differs from hashing the directory"; exit 1; }
+mkdir _test/pathlist-empty
+[ "$(_test/gittreehash --paths0-as-tree _test/pathlist < /dev/null)" == "$(_test/gittreehash _test/pathlist-empty)" ] || { echo "FAIL: --paths0-as-tree with an empty list isn't an empty tree"; exit 1; }
+missing="$({ printf '_test/pathlist/top\0_test/pathlist/nope\0_test/pathlist/a/gone\0' | _test/gittreehash --paths0-as-tree _test/pathlist 2>&1 || true; })"
+echo "$missing" | grep -q "gittreehash-error-not-found" && echo "$missing" | grep -q "pathlist/nope" && echo "$missing" | grep -q "pathlist/a/gone" || { echo "FAIL: --paths0-as-tree doesn't list the missing paths: $missing"; exit 1; }
+{ printf '_test/pathlist/../a_file\0' | _test/gittreehash --paths0-as-tree _test/pathlist 2>&1 || true; } | grep -q "gittreehash-error-invalid-path" || { echo "FAIL: --paths0-as-tree accepted a path outside the root"; exit 1; }
+ln -s a _test/pathlist/alink
+{ printf '_test/pathlist/alink/deep/two\0' | _test/gittreehash --paths0-as-tree _test/pathlist 2>&1 || true; } | grep -q "gittreehash-error-invalid-entry" || { echo "FAIL: --paths0-as-tree accepted a path beneath a symlink"; exit 1; }
+
+# from-manifest predicts the hash of the tree a manifest describes; putting the tree on disk by hand gives the same hash.
+mkdir -p _test/manifest/build
+echo "#!/bin/sh" > _test/manifest/build/tool; chmod 755 _test/manifest/build/tool; echo "data" > _test/manifest/build/data
+cat > _test/manifest/m.json <<'EOM'
+{"entries": [
+	{"path": "usr/bin/tool", "source": "build/tool"},
+	{"path": "usr/share/tool/data", "source": "build/data", "mode": "100755"},
+	{"path": "etc/tool.conf", "content": "verbose = true\n"},
+	{"path": "usr/bin/t", "symlink": "tool"},
+	{"path": "README", "content": "", "mode": "0600"}
+]}
+EOM
+mkdir -p _test/manifest-out/usr/bin _test/manifest-out/usr/share/tool _test/manifest-out/etc
+cp -p _test/manifest/build/tool _test/manifest-out/usr/bin/tool; cp _test/manifest/build/data _test/manifest-out/usr/share/tool/data; chmod 755 _test/manifest-out/usr/share/tool/data
+printf 'verbose = true\n' > _test/manifest-out/etc/tool.conf; ln -s tool _test/manifest-out/usr/bin/t; : > _test/manifest-out/README
+for alg in sha256 sha1; do
+	[ "$(_test/gittreehash from-manifest --algorithm=$alg _test/manifest/m.json)" == "$(_test/gittreehash --algorithm=$alg _test/manifest-out)" ] || { echo "FAIL: from-manifest ($alg) differs from the tree put on disk"; exit 1; }
+done
+[ "$(cd _test/manifest && ../gittreehash from-manifest - < m.json)" == "$(_test/gittreehash _test/manifest-out)" ] || { echo "FAIL: from-manifest from stdin differs"; exit 1; }
+manifestErr() { printf '%s\n' "$1" > _test/manifest/bad.json; { _test/gittreehash from-manifest _test/manifest/bad.json 2>&1 || true; }; }
+manifestErr '{"entries": [
+	{"path": "a", "content": "x"},
+	{"path": "a", "content": "y"}]}' | grep -q 'invalid at line 3: .*already given on line 2' || { echo "FAIL: from-manifest accepted a duplicate path"; exit 1; }
+manifestErr '{"entries": [
+	{"path": "a", "content": "x"},
+
+	{"path": "b", "content": "x", "mode": "rwx"}]}' | grep -q 'invalid at line 4: .*mode' || { echo "FAIL: from-manifest accepted a bad mode"; exit 1; }
+manifestErr '{"entries": [{"path": "a", "source": "nonexistent"}]}' | grep -q 'invalid at line 1: .*nonexistent.*exist' || { echo "FAIL: from-manifest accepted a missing source file"; exit 1; }
+manifestErr '{"entries": [
+	{"path": "a/b", "content": "x"},
+	{"path": "a", "symlink": "x"}]}' | grep -q 'invalid at line 3: .*must be a directory' || { echo "FAIL: from-manifest accepted a file above another"; exit 1; }
+manifestErr '{"entries": [
+	{"path": "../a", "content": "x"}]}' | grep -q 'invalid at line 2: .*within the tree' || { echo "FAIL: from-manifest accepted a path outside the tree"; exit 1; }
+manifestErr '{"entries": [
+	{"path": "a", "contents": "x"}]}' | grep -q 'invalid at line 2: .*unknown field' || { echo "FAIL: from-manifest accepted an unknown field"; exit 1; }
+
+# from-manifest assembles each directory with a TreeBuilder; its trees match what git mktree makes of the same entries,
+# in both object formats, including git's sort order, where a directory sorts as if its name ended with a slash.
+cat > _test/manifest/mktree.json <<'EOM'
+{"entries": [
+	{"path": "a/x", "content": "in a dir\n"},
+	{"path": "a.b", "content": "dot\n"},
+	{"path": "a-", "content": "dash\n"},
+	{"path": "a0", "content": "#!/bin/sh\n", "mode": "100755"},
+	{"path": "l", "symlink": "a.b"}
+]}
+EOM
+for alg in sha256 sha1; do
+	rm -rf _test/mktree && git init -q --object-format=$alg _test/mktree
+	blob() { printf "$1" | git -C _test/mktree hash-object -w --stdin; }
+	sub="$(printf '100644 blob %s\tx\n' "$(blob 'in a dir\n')" | git -C _test/mktree mktree)"
+	want="$(printf '040000 tree %s\ta\n100644 blob %s\ta.b\n100644 blob %s\ta-\n100755 blob %s\ta0\n120000 blob %s\tl\n' \
+		"$sub" "$(blob 'dot\n')" "$(blob 'dash\n')" "$(blob '#!/bin/sh\n')" "$(printf a.b | git -C _test/mktree hash-object -w --stdin)" | git -C _test/mktree mktree)"
+	[ "$(_test/gittreehash from-manifest --algorithm=$alg _test/manifest/mktree.json)" == "$want" ] || { echo "FAIL: from-manifest ($alg) differs from git mktree"; exit 1; }
+done
+
+# apply-stash predicts the hash of a directory with a stash applied, without touching the directory.
+rm -rf _test/stash && mkdir -p _test/stash/gone _test/stash/src
+(cd _test/stash
+	{
+		git init -q . && git config user.email t@t && git config user.name t
+		printf 'one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\n' > src/lines; echo "bye" > gone/file; echo "moving" > old-name
+		printf 'no newline' > src/nonl; echo "script" > run; ln -s src/lines link
+		git add . && git commit -qm base
+		printf 'one\nTWO\nthree\nfour\nfive\nsix\nseven\neight\nnine\n' > src/lines; rm -r gone; git mv old-name new-name
+		printf 'still no newline' > src/nonl; chmod +x run; rm link; ln -s src/nonl link
+		mkdir -p brand/new; echo "fresh" > brand/new/file; git add -A
+	} >&2
+)
+stashed="$(_test/gittreehash --ignore-dot-git _test/stash)"
+(cd _test/stash && git stash -q && git stash show -p > ../stash.patch)
+base="$(_test/gittreehash --ignore-dot-git _test/stash)"
+[ "$base" != "$stashed" ] || { echo "FAIL: stashing changed nothing"; exit 1; }
+[ "$(_test/gittreehash apply-stash --ignore-dot-git --stash-patch=_test/stash.patch --base-path=_test/stash)" == "$stashed" ] || { echo "FAIL: apply-stash doesn't give the hash of the stashed tree"; exit 1; }
+[ "$(_test/gittreehash --ignore-dot-git _test/stash)" == "$base" ] || { echo "FAIL: apply-stash changed the directory"; exit 1; }
+[ "$(cd _test/stash && git diff --stat stash@{0} HEAD | wc -l)" -gt 0 ] || { echo "FAIL: the stash is empty"; exit 1; }
+echo "changed" > _test/stash/src/lines
+{ _test/gittreehash apply-stash --stash-patch=_test/stash.patch --base-path=_test/stash 2>&1 || true; } | grep -q "gittreehash-error-patch-conflict" || { echo "FAIL: apply-stash applied a patch that doesn't fit"; exit 1; }
+
+# --verify-with-git has git write-tree hash a clean working tree too, and fails if the hashes differ.
+rm -rf _test/verify && mkdir -p _test/verify/sub/deeper
+(cd _test/verify
+	{
+		git init -q --object-format=sha1 . && git config user.email t@t && git config user.name t
+		echo "a" > a; echo "b" > sub/b; echo "c" > sub/deeper/c; printf '#!/bin/sh\n' > sub/run; chmod +x sub/run; ln -s a link
+		git add . && git commit -qm verify
+	} >&2
+)
+for alg in sha1 sha256; do
+	_test/gittreehash --algorithm=$alg --ignore-dot-git --verify-with-git _test/verify 2>&1 >/dev/null | grep -qx "MATCH" || { echo "FAIL: --verify-with-git ($alg) doesn't match git"; exit 1; }
+done
+_test/gittreehash --verify-with-git _test/verify/sub 2>&1 >/dev/null | grep -qx "MATCH" || { echo "FAIL: --verify-with-git doesn't match git for a subdirectory"; exit 1; }
+_test/gittreehash --verify-with-git _test/verify 2>&1 >/dev/null | grep -q "not verified with git: .*--ignore-dot-git" || { echo "FAIL: --verify-with-git compared a tree including .git"; exit 1; }
+echo "untracked" > _test/verify/sub/new
+_test/gittreehash --verify-with-git _test/verify/sub 2>&1 >/dev/null | grep -q "not verified with git: there are uncommitted changes" || { echo "FAIL: --verify-with-git compared a dirty tree"; exit 1; }
+rm _test/verify/sub/new
+# With core.fileMode off, git sees nothing uncommitted about an exec bit, but records the file as it was.
+(cd _test/verify && git config core.fileMode false && chmod +x a)
+out="$(_test/gittreehash --algorithm=sha1 --ignore-dot-git --verify-with-git _test/verify 2>&1 >/dev/null)" && { echo "FAIL: --verify-with-git didn't fail on a mismatch"; exit 1; }
+echo "$out" | grep -q "^MISMATCH: got [0-9a-f]\{40\}, want $(cd _test/verify && git write-tree)$" || { echo "FAIL: --verify-with-git didn't report the mismatch: $out"; exit 1; }
+
+# --compare-with-git has git hash the same files through a temporary index, leaving the repository's own index and objects alone.
+if command -v git > /dev/null; then
+	rm -rf _test/compare && mkdir -p _test/compare/sub && git init -q _test/compare
+	echo "a" > _test/compare/a; echo "b" > _test/compare/sub/b; printf '#!/bin/sh\n' > _test/compare/sub/run; chmod +x _test/compare/sub/run; ln -s ../a _test/compare/sub/link
+	(cd _test/compare && git add -A && git -c user.email=t@t -c user.name=t commit -qm compare)
+	index="$(cksum < _test/compare/.git/index)"; objects="$(find _test/compare/.git/objects -type f | wc -l)"
+	for alg in sha1 sha256; do
+		out="$(_test/gittreehash --algorithm=$alg --ignore-dot-git --compare-with-git --strict _test/compare 2>&1 >/dev/null)" || { echo "FAIL: --compare-with-git ($alg) failed on a clean checkout: $out"; exit 1; }
+		[ -z "$out" ] || { echo "FAIL: --compare-with-git ($alg) warned about a clean checkout: $out"; exit 1; }
+	done
+	_test/gittreehash --compare-with-git --strict _test/compare/sub > /dev/null || { echo "FAIL: --compare-with-git failed for a subdirectory"; exit 1; }
+	[ "$(cksum < _test/compare/.git/index)" == "$index" ] || { echo "FAIL: --compare-with-git changed the repository's index"; exit 1; }
+	[ "$(find _test/compare/.git/objects -type f | wc -l)" == "$objects" ] || { echo "FAIL: --compare-with-git wrote objects into the repository"; exit 1; }
+	# With core.fileMode off, git records a newly added file as not executable, whatever its exec bit.
+	(cd _test/compare && git config core.fileMode false && chmod +x a)
+	_test/gittreehash --ignore-dot-git --compare-with-git _test/compare 2>&1 >/dev/null | grep -q "^WARNING: git hashes the same files differently" || { echo "FAIL: --compare-with-git didn't warn of a difference"; exit 1; }
+	_test/gittreehash --ignore-dot-git --compare-with-git _test/compare > /dev/null 2>&1 || { echo "FAIL: --compare-with-git without --strict failed on a difference"; exit 1; }
+	code=0; _test/gittreehash --ignore-dot-git --compare-with-git --strict _test/compare > /dev/null 2>&1 || code=$?
+	[ "$code" == 2 ] || { echo "FAIL: --compare-with-git --strict exited $code, not 2, on a difference"; exit 1; }
+	mkdir _test/compare/empty
+	_test/gittreehash --ignore-dot-git --compare-with-git --strict _test/compare 2>&1 >/dev/null | grep -q "not compared with git: there are empty directories" || { echo "FAIL: --compare-with-git compared a tree with an empty directory"; exit 1; }
+	rmdir _test/compare/empty; echo "new" > _test/compare/sub/new
+	_test/gittreehash --compare-with-git --strict _test/compare/sub 2>&1 >/dev/null | grep -q "not compared with git: there are uncommitted changes" || { echo "FAIL: --compare-with-git compared a dirty checkout"; exit 1; }
+	code=0; _test/gittreehash --strict _test/compare/sub > /dev/null 2>&1 || code=$?
+	[ "$code" == 2 ] || { echo "FAIL: --strict without --compare-with-git exited $code, not 2"; exit 1; }
+fi
+
+# git-tree rehashes a tree straight from a repository's objects: matching git's own id in the repository's format,
+# and in the other format, the id the same tree has in a repository of that format.
+rm -rf _test/gittree-src && mkdir -p _test/gittree-src/dir/sub _test/gittree-src/same
+echo "a" > _test/gittree-src/a; echo "a" > _test/gittree-src/same/a; head -c 300000 /dev/urandom > _test/gittree-src/dir/big
+printf '#!/bin/sh\n' > _test/gittree-src/dir/run; chmod +x _test/gittree-src/dir/run; ln -s ../a _test/gittree-src/dir/sub/link
+for alg in sha1 sha256; do
+	git init -q --object-format=$alg _test/gittree-$alg
+	git --git-dir=_test/gittree-$alg/.git --work-tree=_test/gittree-src add -A
+	git -C _test/gittree-$alg -c user.email=t@t -c user.name=t commit -qm tree
+done
+for alg in sha1 sha256; do
+	for repo in sha1 sha256; do
+		[ "$(_test/gittreehash git-tree --algorithm=$alg _test/gittree-$repo HEAD)" == "$(git -C _test/gittree-$alg rev-parse 'HEAD^{tree}')" ] || { echo "FAIL: git-tree ($alg) from a $repo repository differs from git's id"; exit 1; }
+	done
+	[ "$(_test/gittreehash git-tree --algorithm=$alg _test/gittree-sha1 HEAD:dir)" == "$(git -C _test/gittree-$alg rev-parse HEAD:dir)" ] || { echo "FAIL: git-tree ($alg) of a subdirectory differs"; exit 1; }
+	[ "$(_test/gittreehash git-tree --algorithm=$alg _test/gittree-sha1 HEAD:dir/big)" == "$(_test/gittreehash --algorithm=$alg _test/gittree-src/dir/big)" ] || { echo "FAIL: git-tree ($alg) of a blob differs"; exit 1; }
+done
+[ "$(_test/gittreehash git-tree _test/gittree-sha1 HEAD)" == "$(_test/gittreehash _test/gittree-src)" ] || { echo "FAIL: git-tree differs from hashing the directory"; exit 1; }
+code=0; _test/gittreehash git-tree _test/gittree-sha1 HEAD:nonexistent 2>/dev/null || code=$?
+[ "$code" == 4 ] || { echo "FAIL: git-tree of a missing object exited $code, not 4"; exit 1; }
+
+# diff-index compares a directory with a git index.  An index written with index.skipHash, as feature.manyFiles
+# has git >= 2.40 do, has a zeroed trailer instead of a checksum, in either object format; the format is then told from its entries.
+for alg in sha1 sha256; do
+	size=20; [ $alg == sha1 ] || size=32
+	{ head -c -$size _test/gittree-$alg/.git/index; head -c $size /dev/zero; } > _test/gittree-$alg.skiphash
+	for index in _test/gittree-$alg/.git/index _test/gittree-$alg.skiphash; do
+		out="$(_test/gittreehash diff-index --index=$index _test/gittree-src 2>&1)" || { echo "FAIL: diff-index with $index failed on a clean tree: $out"; exit 1; }
+	done
+done
+# A v4 index whose path prefix length is out of range, or whose varint encoding of it overflows or runs on, is rejected as unparseable.
+for strip in 01 fefefefefefefeff00 80fefefefefefefefe7f ffffffffffffffffffff7f; do
+	hex="444952430000000400000001$(printf '0%.0s' $(seq 48))000081a4$(printf '0%.0s' $(seq 24))$(printf 'ab%.0s' $(seq 20))0001${strip}6100"
+	{ xxd -r -p <<< "$hex"; xxd -r -p <<< "$hex" | sha1sum | cut -d' ' -f1 | xxd -r -p; } > _test/evil.index
+	code=0; out="$(_test/gittreehash diff-index --index=_test/evil.index _test/gittree-src 2>&1)" || code=$?
+	[ "$code" == 9 ] && grep -q '"gitindex-error-parse"' <<< "$out" || { echo "FAIL: diff-index exited $code on a v4 index stripping $strip: $out"; exit 1; }
+done
+
+# ls-index lists an index just as git ls-files does, for indexes git wrote in every version and object format: with conflict stages,
+# assume-unchanged and skip-worktree bits, intent-to-add entries, and the TREE, REUC, UNTR, EOIE, and IEOT extensions;
+# and a sparse index, whose directories are entries, and which has an sdir extension.
+for alg in sha1 sha256; do
+	rm -rf _test/lsindex && git init -q --object-format=$alg _test/lsindex
+	(cd _test/lsindex
+		{
+			git config user.email t@t && git config user.name t
+			mkdir -p src/deep docs; echo a > a; echo b > b; echo c > c; echo s > src/s; echo d > src/deep/d; echo x > docs/x; chmod +x src/s; ln -s a link
+			git add -A && git commit -qm base
+			git checkout -qb other && echo other > b && echo other > c && git commit -qam other
+			git checkout -q - && echo ours > b && echo ours > c && git commit -qam ours
+			git merge other || true
+			git checkout --theirs b && git add b
+			git update-index --assume-unchanged a
+			git update-index --untracked-cache
+			git -c index.recordEndOfIndexEntries=true -c index.recordOffsetTable=true -c index.threads=2 status
+		} > /dev/null 2>&1
+	)
+	for ext in TREE REUC UNTR EOIE IEOT; do
+		grep -q $ext _test/lsindex/.git/index || { echo "FAIL: git ($alg) didn't write the $ext extension to check"; exit 1; }
+	done
+	for version in 2 3 4; do
+		git -C _test/lsindex -c index.recordEndOfIndexEntries=true update-index --index-version $version
+		[ "$(git -C _test/lsindex ls-files -s -v)" == "$(_test/gittreehash ls-index -v --index=_test/lsindex/.git/index)" ] || { echo "FAIL: ls-index of an index v$version ($alg) differs from git ls-files"; exit 1; }
+	done
+	(cd _test/lsindex && echo new > new && git add -N new && git sparse-checkout set --no-cone docs) > /dev/null 2>&1
+	grep -q '^S ' <(git -C _test/lsindex ls-files -t) || { echo "FAIL: sparse-checkout ($alg) left no skip-worktree entries to check"; exit 1; }
+	for version in 3 4; do
+		git -C _test/lsindex update-index --index-version $version
+		[ "$(git -C _test/lsindex ls-files -s -v)" == "$(_test/gittreehash ls-index -v --index=_test/lsindex/.git/index)" ] || { echo "FAIL: ls-index of an index v$version ($alg) with extended flags differs from git ls-files"; exit 1; }
+	done
+	(cd _test/lsindex && git reset -q --hard && git sparse-checkout set --cone --sparse-index src/deep) > /dev/null 2>&1
+	grep -q "^040000 " <(_test/gittreehash ls-index --index=_test/lsindex/.git/index) || { echo "FAIL: the sparse index ($alg) has no directory entries to check"; exit 1; }
+	[ "$(git -C _test/lsindex ls-files --sparse -s -v)" == "$(_test/gittreehash ls-index -v --index=_test/lsindex/.git/index)" ] || { echo "FAIL: ls-index of a sparse index ($alg) differs from git ls-files"; exit 1; }
+done
+
+# verify-against-git compares a directory with a committed tree, listing where they differ, in either object format.
+for alg in sha1 sha256; do
+	out="$(_test/gittreehash verify-against-git _test/gittree-$alg HEAD _test/gittree-src)" || { echo "FAIL: verify-against-git ($alg) of a matching directory failed: $out"; exit 1; }
+	[ -z "$out" ] || { echo "FAIL: verify-against-git ($alg) of a matching directory printed: $out"; exit 1; }
+done
+_test/gittreehash verify-against-git _test/gittree-sha1 HEAD:dir _test/gittree-src/dir || { echo "FAIL: verify-against-git of a subdirectory failed"; exit 1; }
+rm -rf _test/verifygit && cp -a _test/gittree-src _test/verifygit
+echo "changed" > _test/verifygit/a; chmod -x _test/verifygit/dir/run; ln -sfn ../same/a _test/verifygit/dir/sub/link
+rm _test/verifygit/same/a; ln -s ../a _test/verifygit/same/a; echo "new" > _test/verifygit/new; rm _test/verifygit/dir/big
+code=0; out="$(_test/gittreehash verify-against-git _test/gittree-sha256 HEAD _test/verifygit)" || code=$?
+[ "$code" == 1 ] || { echo "FAIL: verify-against-git of a differing directory exited $code, not 1"; exit 1; }
+want="$(printf 'M\ta\nM\tdir\nD\tdir/big\nM\tdir/run\nM\tdir/sub\nM\tdir/sub/link\nA\tnew\nM\tsame\nT\tsame/a')"
+[ "$out" == "$want" ] || { echo "FAIL: verify-against-git listed the wrong differences: $out"; exit 1; }
+code=0; _test/gittreehash verify-against-git _test/gittree-sha1 HEAD:nonexistent _test/gittree-src 2>/dev/null || code=$?
+[ "$code" == 4 ] || { echo "FAIL: verify-against-git of a missing tree exited $code, not 4"; exit 1; }
+
+# --output-file writes the output to a file instead of stdout; --verify-output-file checks it against the file instead.
+[ -z "$(_test/gittreehash --output-file=_test/out.hash _test/gittree-src)" ] || { echo "FAIL: --output-file also wrote to stdout"; exit 1; }
+[ "$(cat _test/out.hash)" == "$(_test/gittreehash _test/gittree-src)" ] || { echo "FAIL: --output-file wrote something other than the hash"; exit 1; }
+[ -z "$(ls -A _test | grep '^\.out\.hash')" ] || { echo "FAIL: --output-file left a temporary file behind"; exit 1; }
+_test/gittreehash --output-file=_test/out.hash --verify-output-file _test/gittree-src || { echo "FAIL: --verify-output-file failed on a matching file"; exit 1; }
+code=0; _test/gittreehash --output-file=_test/out.hash --verify-output-file _test/gittree-src/dir 2>/dev/null || code=$?
+[ "$code" == 2 ] || { echo "FAIL: --verify-output-file exited $code, not 2, on a differing file"; exit 1; }
+[ "$(cat _test/out.hash)" == "$(_test/gittreehash _test/gittree-src)" ] || { echo "FAIL: --verify-output-file replaced a differing file"; exit 1; }
+_test/gittreehash --output-file=_test/out-new.hash --verify-output-file _test/gittree-src/dir || { echo "FAIL: --verify-output-file failed without an existing file"; exit 1; }
+[ "$(cat _test/out-new.hash)" == "$(_test/gittreehash _test/gittree-src/dir)" ] || { echo "FAIL: --verify-output-file didn't write a missing file"; exit 1; }
+# A new output file gets the usual mode (0666 less the umask), not a temporary file's 0600; an existing one keeps its mode.
+( umask 022; _test/gittreehash --output-file=_test/out-mode.hash _test/gittree-src )
+[ "$(stat -c %a _test/out-mode.hash)" == 644 ] || { echo "FAIL: --output-file made a new file with mode $(stat -c %a _test/out-mode.hash), not 644"; exit 1; }
+chmod 640 _test/out-mode.hash
+( umask 077; _test/gittreehash --output-file=_test/out-mode.hash _test/gittree-src/dir )
+[ "$(stat -c %a _test/out-mode.hash)" == 640 ] || { echo "FAIL: --output-file changed an existing file's mode to $(stat -c %a _test/out-mode.hash)"; exit 1; }
+_test/gittreehash --output-file=_test/out.hash _test/nonexistent 2>/dev/null && { echo "FAIL: --output-file of a missing path exited 0"; exit 1; }
+[ "$(cat _test/out.hash)" == "$(_test/gittreehash _test/gittree-src)" ] || { echo "FAIL: a failed hash replaced the --output-file"; exit 1; }
+
+# --assert-unchanged checks the hash against one stored by --update, with the algorithm and options it was made with.
+rm -rf _test/assert && cp -a _test/gittree-src _test/assert && rm -f _test/assert.hash
+code=0; _test/gittreehash --assert-unchanged=_test/assert.hash _test/assert > /dev/null 2> _test/assert.err || code=$?
+[ "$code" == 2 ] && grep -q "doesn't exist, so there's no stored hash" _test/assert.err || { echo "FAIL: --assert-unchanged without a stored hash exited $code: $(cat _test/assert.err)"; exit 1; }
+[ "$(_test/gittreehash --assert-unchanged=_test/assert.hash --update --ignore-dot-git --algorithm=sha1 _test/assert)" == "$(_test/gittreehash --algorithm=sha1 _test/assert)" ] || { echo "FAIL: --assert-unchanged --update changed the output"; exit 1; }
+[ "$(grep -v '^#' _test/assert.hash)" == "$(printf 'algorithm sha1\noptions --ignore-dot-git\nhash %s' "$(_test/gittreehash --algorithm=sha1 _test/assert)")" ] || { echo "FAIL: --update stored: $(cat _test/assert.hash)"; exit 1; }
+_test/gittreehash --assert-unchanged=_test/assert.hash --ignore-dot-git --algorithm=sha1 _test/assert > /dev/null || { echo "FAIL: --assert-unchanged failed on an unchanged tree"; exit 1; }
+code=0; _test/gittreehash --assert-unchanged=_test/assert.hash --algorithm=sha1 _test/assert > /dev/null 2> _test/assert.err || code=$?
+[ "$code" == 2 ] && grep -q "made differently" _test/assert.err && grep -q "stored with:   --algorithm=sha1 --ignore-dot-git$" _test/assert.err || { echo "FAIL: --assert-unchanged with other options exited $code: $(cat _test/assert.err)"; exit 1; }
+code=0; _test/gittreehash --assert-unchanged=_test/assert.hash --ignore-dot-git _test/assert > /dev/null 2> _test/assert.err || code=$?
+[ "$code" == 2 ] && grep -q "this run uses: --algorithm=sha256 --ignore-dot-git$" _test/assert.err || { echo "FAIL: --assert-unchanged with another algorithm exited $code: $(cat _test/assert.err)"; exit 1; }
+echo "changed" > _test/assert/a
+code=0; _test/gittreehash --assert-unchanged=_test/assert.hash --ignore-dot-git --algorithm=sha1 _test/assert > /dev/null 2> _test/assert.err || code=$?
+[ "$code" == 2 ] && grep -q "the tree has changed" _test/assert.err || { echo "FAIL: --assert-unchanged of a changed tree exited $code: $(cat _test/assert.err)"; exit 1; }
+_test/gittreehash --assert-unchanged=_test/assert.hash --update --ignore-dot-git --algorithm=sha1 _test/assert > /dev/null
+_test/gittreehash --assert-unchanged=_test/assert.hash --ignore-dot-git --algorithm=sha1 _test/assert > /dev/null || { echo "FAIL: --assert-unchanged failed after --update"; exit 1; }
+echo "garbage" > _test/assert.hash
+{ _test/gittreehash --assert-unchanged=_test/assert.hash _test/assert 2>&1 || true; } | grep -q "gittreehash-error-invalid-stored-hash" || { echo "FAIL: --assert-unchanged accepted a malformed file"; exit 1; }
+
+# merge-trees hashes two directories' union, as if one were copied over the other: directories in both are merged,
+# and anything else in both, but different, is a conflict, which --conflict=take-a or take-b resolves (keeping a whole directory, if need be).
+mkdir -p _test/merge/a/both _test/merge/a/dir-in-a _test/merge/b/both
+( cd _test/merge
+	echo same > a/same; echo same > b/same; echo a > a/both/only-a; echo b > b/both/only-b
+	echo a > a/differs; echo b > b/differs; echo in > a/dir-in-a/in; echo file > b/dir-in-a )
+rm -rf _test/merge/want && cp -r _test/merge/b _test/merge/want && rm _test/merge/want/dir-in-a && cp -r _test/merge/a/. _test/merge/want
+[ "$(_test/gittreehash merge-trees --conflict=take-a _test/merge/a _test/merge/b)" == "$(_test/gittreehash _test/merge/want)" ] || { echo "FAIL: merge-trees --conflict=take-a doesn't match copying a over b"; exit 1; }
+rm -rf _test/merge/want && cp -r _test/merge/a _test/merge/want && rm -r _test/merge/want/dir-in-a && cp -r _test/merge/b/. _test/merge/want
+[ "$(_test/gittreehash merge-trees --conflict=take-b _test/merge/a _test/merge/b)" == "$(_test/gittreehash _test/merge/want)" ] || { echo "FAIL: merge-trees --conflict=take-b doesn't match copying b over a"; exit 1; }
+{ _test/gittreehash merge-trees _test/merge/a _test/merge/b 2>&1 || true; } | grep -q '"code":"gittreehash-error-merge-conflict"' || { echo "FAIL: merge-trees didn't refuse a conflict by default"; exit 1; }
+rm _test/merge/b/differs
+{ _test/gittreehash merge-trees _test/merge/a _test/merge/b 2>&1 || true; } | tr -d '\n' | grep -q '"code":"gittreehash-error-merge-conflict".*"path":"dir-in-a"' || { echo "FAIL: merge-trees didn't refuse a directory in one tree where the other has a file"; exit 1; }
+rm _test/merge/b/dir-in-a
+[ "$(_test/gittreehash merge-trees _test/merge/a _test/merge/b)" == "$(_test/gittreehash merge-trees --conflict=take-b _test/merge/a _test/merge/b)" ] || { echo "FAIL: merge-trees without conflicts depends on --conflict"; exit 1; }
+[ "$(_test/gittreehash merge-trees _test/merge/a _test/merge/a)" == "$(_test/gittreehash _test/merge/a)" ] || { echo "FAIL: merge-trees of a tree with itself isn't the tree"; exit 1; }
+
+# --fs-plugin hashes a path within a filesystem provided by a Go plugin: here one serving a local directory, given by --fs-plugin-config.
+# A plugin written for another version of the interface is refused.  (Plugins need cgo, and aren't supported everywhere.)
+if [ "$(go env CGO_ENABLED)" == 1 ] && [ "$(go env GOOS)" == linux ]; then
+	mkdir -p _test/fsplugin/v1 _test/fsplugin/v0 _test/fsplugin/stdlib _test/fsplugin/tree/sub
+	echo "a" > _test/fsplugin/tree/sub/a; ln -s sub/a _test/fsplugin/tree/link
+	for abi in v1 v0; do
+		cat > _test/fsplugin/$abi/main.go <<-EOF
+			package main
+
+			import (
+				"github.com/warpfork/go-fsx"
+				"github.com/warpfork/go-fsx/osfs"
+			)
+
+			var FSPluginABI = "gittreehash-fs-plugin-$abi"
+
+			func NewFS(config string) (fsx.FS, error) { return osfs.DirFS(config), nil }
+		EOF
+		go build -buildmode=plugin -o _test/fsplugin-$abi.so ./_test/fsplugin/$abi
+	done
+	[ "$(_test/gittreehash --fs-plugin=_test/fsplugin-v1.so --fs-plugin-config=_test/fsplugin/tree)" == "$(_test/gittreehash _test/fsplugin/tree)" ] || { echo "FAIL: --fs-plugin hashed the tree differently"; exit 1; }
+	[ "$(_test/gittreehash --fs-plugin=_test/fsplugin-v1.so --fs-plugin-config=_test/fsplugin/tree sub)" == "$(_test/gittreehash _test/fsplugin/tree/sub)" ] || { echo "FAIL: --fs-plugin hashed a subdirectory differently"; exit 1; }
+	# A plugin whose filesystem is only an fs.FS, like os.DirFS, is hashed as HashFS hashes it: symlinks are taken as what they point to.
+	cat > _test/fsplugin/stdlib/main.go <<-EOF
+		package main
+
+		import (
+			"os"
+
+			"github.com/warpfork/go-fsx"
+		)
+
+		var FSPluginABI = "gittreehash-fs-plugin-v1"
+
+		func NewFS(config string) (fsx.FS, error) { return os.DirFS(config), nil }
+	EOF
+	go build -buildmode=plugin -o _test/fsplugin-stdlib.so ./_test/fsplugin/stdlib
+	[ "$(_test/gittreehash --fs-plugin=_test/fsplugin-stdlib.so --fs-plugin-config=_test/fsplugin/tree sub)" == "$(_test/gittreehash _test/fsplugin/tree/sub)" ] || { echo "FAIL: an fs.FS plugin hashed a directory differently"; exit 1; }
+	rm -rf _test/fsplugin/followed && cp -rL _test/fsplugin/tree _test/fsplugin/followed
+	[ "$(_test/gittreehash --fs-plugin=_test/fsplugin-stdlib.so --fs-plugin-config=_test/fsplugin/tree)" == "$(_test/gittreehash _test/fsplugin/followed)" ] || { echo "FAIL: an fs.FS plugin didn't follow a symlink"; exit 1; }
+	{ _test/gittreehash --fs-plugin=_test/fsplugin-v0.so --fs-plugin-config=_test/fsplugin/tree 2>&1 || true; } | grep -q "gittreehash-fs-plugin-v0.*, but this gittreehash needs" || { echo "FAIL: --fs-plugin accepted a plugin for another version of the interface"; exit 1; }
+	code=0; _test/gittreehash --fs-plugin=_test/nonexistent.so > /dev/null 2>&1 || code=$?
+	[ "$code" == 9 ] || { echo "FAIL: --fs-plugin of a missing plugin exited $code, not 9"; exit 1; }
+fi
+code=0; _test/gittreehash --fs-plugin-config=x > /dev/null 2>&1 || code=$?
+[ "$code" == 2 ] || { echo "FAIL: --fs-plugin-config without --fs-plugin exited $code, not 2"; exit 1; }
+
+# The checks below use a shim filesystem, loaded with --fs-plugin, which serves a local directory but misbehaves as its config says.
+# (Like --fs-plugin itself, they're skipped where plugins can't be built.)
+if [ "$(go env CGO_ENABLED)" == 1 ] && [ "$(go env GOOS)" == linux ]; then
+mkdir -p _test/shimfs
+cat > _test/shimfs/main.go <<'GO'
+// A filesystem plugin for --fs-plugin that serves a local directory (or a synthetic tree), misbehaving as its config says.
+// The config is comma-separated settings:
+//
+//	dir=<path>     the directory to serve
+//	deep=<n>       instead, serve n nested directories, each named d, with a file named file at the bottom holding "bottom\n"
+//	wide=<n>       instead, serve a directory of n empty files, named by number
+//	latency=<dur>  delay every Open, ReadDir, Lstat, Readlink, and DirEntry.Info by this long, as a remote filesystem would
+//	swap=<a>:<b>   open b (without waiting, if it's a pipe) when asked to open a, as if a were swapped for b after being listed
+//	alias=<a>:<b>  serve the directory b in place of the placeholder a, as if a were a symlink to b that the filesystem follows itself
+//	delete=<a>     list a, but then find neither it nor anything under it, as if it were deleted just after being listed
+//	notdir=<a>     list the directory a, but then find nothing under it, as if it were replaced by a file just after being listed
+//	truncate=<a>   empty the file a in the directory served by dir= just after opening it, as if it were truncated while it's read
+//	irregular=<a>  report the symlink a as an irregular file, as Windows does some reparse points, but let it be read as a symlink
+//	grow=<a>:<n>   append a byte to the file a in the directory served by dir= just after opening it, the first n times, as if it were being written
+//	fail=<a>:<e>   fail to open or list a, or anything under it, with the errno e (EACCES, EPERM, or EIO), as if it couldn't be read
+//	log=<path>     append a line to this file for every operation, giving its kind and path, to count them
+//	peak=<path>    write to this file the most files and directories that have been open (or being opened or listed) at once
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing/fstest"
+	"time"
+
+	"github.com/warpfork/go-fsx"
+	"github.com/warpfork/go-fsx/osfs"
+)
+
+var FSPluginABI = "gittreehash-fs-plugin-v1"
+
+type shimFS struct {
+	under     fs.FS
+	dir       string
+	latency   time.Duration
+	swaps     map[string]string
+	aliases   map[string]string
+	gone      map[string]error
+	truncates map[string]bool
+	irregular map[string]bool
+	fails     map[string]error
+
+	growMu sync.Mutex
+	grows  map[string]int
+
+	logMu sync.Mutex
+	log   *os.File
+
+	peakMu         sync.Mutex
+	peakPath       string
+	held, peakHeld int
+}
+
+func NewFS(config string) (fsx.FS, error) {
+	s := &shimFS{swaps: map[string]string{}, aliases: map[string]string{}, gone: map[string]error{}, truncates: map[string]bool{}, irregular: map[string]bool{}, grows: map[string]int{}, fails: map[string]error{}}
+	for _, setting := range strings.Split(config, ",") {
+		k, v, _ := strings.Cut(setting, "=")
+		var err error
+		switch k {
+		case "dir":
+			s.under, s.dir = osfs.DirFS(v), v
+		case "deep":
+			var n int
+			n, err = strconv.Atoi(v)
+			s.under = deepFS{n}
+		case "wide":
+			var n int
+			n, err = strconv.Atoi(v)
+			s.under = wideFS{n}
+		case "latency":
+			s.latency, err = time.ParseDuration(v)
+		case "swap":
+			a, b, _ := strings.Cut(v, ":")
+			s.swaps[a] = b
+		case "alias":
+			a, b, _ := strings.Cut(v, ":")
+			s.aliases[a] = b
+		case "delete":
+			s.gone[v] = syscall.ENOENT
+		case "notdir":
+			s.gone[v+"/"] = syscall.ENOTDIR
+		case "truncate":
+			s.truncates[v] = true
+		case "irregular":
+			s.irregular[v] = true
+		case "grow":
+			a, n, _ := strings.Cut(v, ":")
+			s.grows[a], err = strconv.Atoi(n)
+		case "fail":
+			a, e, _ := strings.Cut(v, ":")
+			switch e {
+			case "EACCES":
+				s.fails[a] = syscall.EACCES
+			case "EPERM":
+				s.fails[a] = syscall.EPERM
+			case "EIO":
+				s.fails[a] = syscall.EIO
+			default:
+				err = fmt.Errorf("unknown errno %q", e)
+			}
+		case "log":
+			s.log, err = os.OpenFile(v, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		case "peak":
+			s.peakPath = v
+		default:
+			err = fmt.Errorf("unknown setting %q", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.under == nil {
+		return nil, errors.New("no dir=, deep=, or wide= setting")
+	}
+	return s, nil
+}
+
+// op is called at the start of every operation.
+func (s *shimFS) op(kind, name string) {
+	time.Sleep(s.latency)
+	if s.log != nil {
+		s.logMu.Lock()
+		fmt.Fprintf(s.log, "%s\t%s\n", kind, name)
+		s.logMu.Unlock()
+	}
+}
+
+// check returns the error for a path that's been deleted or replaced since its directory was listed, if it has.
+func (s *shimFS) check(op, name string) error {
+	for prefix, err := range s.gone {
+		if name == prefix || strings.HasPrefix(name, strings.TrimSuffix(prefix, "/")+"/") {
+			return &fs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// failure returns the error for a path that's set to fail to be opened or listed, if it is.
+func (s *shimFS) failure(op, name string) error {
+	for prefix, err := range s.fails {
+		if name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return &fs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// resolve rewrites a path through the aliases, until none of them applies to it any more (or it's clearly going round in circles).
+func (s *shimFS) resolve(name string) string {
+	for i := 0; i < 1000; i++ {
+		changed := false
+		for a, b := range s.aliases {
+			if name == a || strings.HasPrefix(name, a+"/") {
+				name, changed = b+name[len(a):], true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return name
+}
+
+// hold counts a file or directory as open (from when it starts being opened or listed), by delta, keeping track of the peak.
+func (s *shimFS) hold(delta int) {
+	if s.peakPath == "" {
+		return
+	}
+	s.peakMu.Lock()
+	defer s.peakMu.Unlock()
+	s.held += delta
+	if s.held > s.peakHeld {
+		s.peakHeld = s.held
+		os.WriteFile(s.peakPath, []byte(strconv.Itoa(s.peakHeld)), 0o644)
+	}
+}
+
+// heldFile is a file counted by hold until it's closed.
+type heldFile struct {
+	fs.File
+	s *shimFS
+}
+
+func (f heldFile) Close() error {
+	f.s.hold(-1)
+	return f.File.Close()
+}
+
+func (s *shimFS) Open(name string) (fs.File, error) {
+	s.hold(1)
+	f, err := s.open(name)
+	if err != nil || s.peakPath == "" {
+		s.hold(-1)
+		return f, err
+	}
+	return heldFile{f, s}, nil
+}
+
+func (s *shimFS) open(name string) (fs.File, error) {
+	s.op("open", name)
+	if err := s.check("open", name); err != nil {
+		return nil, err
+	}
+	if err := s.failure("open", name); err != nil {
+		return nil, err
+	}
+	name = s.resolve(name)
+	if other, ok := s.swaps[name]; ok {
+		return fsx.OpenFile(s.under, other, fsx.O_RDONLY|syscall.O_NONBLOCK, 0)
+	}
+	f, err := s.under.Open(name)
+	if err == nil && s.truncates[name] {
+		err = os.Truncate(s.dir+"/"+name, 0)
+	}
+	if err == nil && s.growing(name) {
+		var g *os.File
+		if g, err = os.OpenFile(s.dir+"/"+name, os.O_WRONLY|os.O_APPEND, 0); err == nil {
+			_, err = g.WriteString("+")
+			g.Close()
+		}
+	}
+	return f, err
+}
+
+// growing reports whether the file at a path should grow as it's opened this time, counting down its grow= setting.
+func (s *shimFS) growing(name string) bool {
+	s.growMu.Lock()
+	defer s.growMu.Unlock()
+	if s.grows[name] == 0 {
+		return false
+	}
+	s.grows[name]--
+	return true
+}
+
+func (s *shimFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	s.hold(1)
+	defer s.hold(-1)
+	s.op("readdir", name)
+	if err := s.check("readdir", name); err != nil {
+		return nil, err
+	}
+	if err := s.failure("readdir", name); err != nil {
+		return nil, err
+	}
+	ents, err := fs.ReadDir(s.under, s.resolve(name))
+	for i, ent := range ents {
+		ents[i] = shimDirEntry{ent, s, name}
+	}
+	return ents, err
+}
+
+func (s *shimFS) Lstat(name string) (fs.FileInfo, error) {
+	s.op("lstat", name)
+	if err := s.check("lstat", name); err != nil {
+		return nil, err
+	}
+	fi, err := fsx.Lstat(s.under, s.resolve(name))
+	if err == nil && s.irregular[name] {
+		fi = irregularInfo{fi}
+	}
+	return fi, err
+}
+
+func (s *shimFS) Readlink(name string) (string, error) {
+	s.op("readlink", name)
+	if err := s.check("readlink", name); err != nil {
+		return "", err
+	}
+	return fsx.Readlink(s.under, s.resolve(name))
+}
+
+type shimDirEntry struct {
+	fs.DirEntry
+	s   *shimFS
+	dir string
+}
+
+func (e shimDirEntry) Type() fs.FileMode {
+	if e.s.irregular[path.Join(e.dir, e.Name())] {
+		return fs.ModeIrregular
+	}
+	return e.DirEntry.Type()
+}
+
+func (e shimDirEntry) Info() (fs.FileInfo, error) {
+	e.s.op("lstat", e.dir+"/"+e.Name())
+	name := path.Join(e.dir, e.Name())
+	if err := e.s.check("lstat", name); err != nil {
+		return nil, err
+	}
+	if e.s.irregular[name] {
+		fi, err := e.DirEntry.Info()
+		if err == nil {
+			fi = irregularInfo{fi}
+		}
+		return fi, err
+	}
+	if e.s.resolve(name) != name {
+		return fsx.Lstat(e.s.under, e.s.resolve(name))
+	}
+	return e.DirEntry.Info()
+}
+
+// irregularInfo is the FileInfo of irregular=<a>: a symlink's, but with the type reported as irregular.
+type irregularInfo struct{ fs.FileInfo }
+
+func (fi irregularInfo) Mode() fs.FileMode { return fi.FileInfo.Mode()&^fs.ModeType | fs.ModeIrregular }
+
+// deepFS is the synthetic tree of deep=<n>.  Its directories and its file are made from those in deepParts.
+type deepFS struct{ n int }
+
+var deepParts = fstest.MapFS{"d": {Mode: fs.ModeDir | 0o755}, "file": {Data: []byte("bottom\n"), Mode: 0o644}}
+
+// part returns the name of what's in deepParts at a path, or "." for the root.
+func (d deepFS) part(name string) (string, error) {
+	if name == "." {
+		return ".", nil
+	}
+	segs := strings.Split(name, "/")
+	for _, seg := range segs[:len(segs)-1] {
+		if seg != "d" {
+			return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	last := segs[len(segs)-1]
+	if (last == "d" && len(segs) <= d.n) || (last == "file" && len(segs) == d.n+1) {
+		return last, nil
+	}
+	return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (d deepFS) Open(name string) (fs.File, error) {
+	part, err := d.part(name)
+	if err != nil {
+		return nil, err
+	}
+	return deepParts.Open(part)
+}
+
+func (d deepFS) Lstat(name string) (fs.FileInfo, error) {
+	part, err := d.part(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(deepParts, part)
+}
+
+func (d deepFS) Readlink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func (d deepFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	part, err := d.part(name)
+	if err != nil {
+		return nil, err
+	}
+	if part == "file" {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	child := "d"
+	if name != "." && strings.Count(name, "/")+1 == d.n {
+		child = "file"
+	}
+	fi, err := fs.Stat(deepParts, child)
+	return []fs.DirEntry{fs.FileInfoToDirEntry(fi)}, err
+}
+
+// wideFS is the synthetic directory of wide=<n>: its files, named by number, are all empty.
+type wideFS struct{ n int }
+
+var wideFile = fstest.MapFS{"empty": {Mode: 0o644}}
+
+// namedInfo is the empty file's FileInfo, under another name.
+type namedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi namedInfo) Name() string { return fi.name }
+
+// part returns the name of what's in wideFile at a path, or "." for the root.
+func (w wideFS) part(name string) (string, error) {
+	if name == "." {
+		return ".", nil
+	}
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < w.n && name == fmt.Sprintf("%08d", i) {
+		return "empty", nil
+	}
+	return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (w wideFS) Open(name string) (fs.File, error) {
+	part, err := w.part(name)
+	if err != nil {
+		return nil, err
+	}
+	return wideFile.Open(part)
+}
+
+func (w wideFS) Lstat(name string) (fs.FileInfo, error) {
+	part, err := w.part(name)
+	if err != nil {
+		return nil, err
+	}
+	if part == "." {
+		return fs.Stat(wideFile, ".")
+	}
+	fi, err := fs.Stat(wideFile, part)
+	return namedInfo{fi, name}, err
+}
+
+func (w wideFS) Readlink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func (w wideFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	fi, err := fs.Stat(wideFile, "empty")
+	ents := make([]fs.DirEntry, w.n)
+	for i := range ents {
+		ents[i] = fs.FileInfoToDirEntry(namedInfo{fi, fmt.Sprintf("%08d", i)})
+	}
+	return ents, err
+}
+GO
+go build -buildmode=plugin -o _test/shimfs.so ./_test/shimfs
+shim() { local config="$1"; shift; _test/gittreehash --fs-plugin=_test/shimfs.so --fs-plugin-config="$config" "$@"; }
+
+# Prefetching overlaps waiting on a slow filesystem with hashing: with a millisecond's latency on every operation,
+# the files of a wide directory are hashed markedly faster than with --prefetch=-1.
+mkdir -p _test/latency
+for i in $(seq 200); do echo $i > _test/latency/$i; done
+[ "$(shim dir=_test/latency,latency=1ms)" == "$(_test/gittreehash _test/latency)" ] || { echo "FAIL: the latency shim hashed the tree differently"; exit 1; }
+best_files_per_sec() { awk '/^run / { for (i = 2; i <= NF; i++) if ($i ~ /^files\/s/ && $(i-1) + 0 > best) best = $(i-1) + 0 } END { print best }'; }
+with="$(shim dir=_test/latency,latency=1ms --benchmark=3 2>&1 >/dev/null | best_files_per_sec)"
+without="$(shim dir=_test/latency,latency=1ms --benchmark=3 --prefetch=-1 2>&1 >/dev/null | best_files_per_sec)"
+echo "latency shim benchmark: $with files/s with prefetching, $without files/s without"
+awk -v with="$with" -v without="$without" 'BEGIN { exit !(with > without * 1.3) }' || { echo "FAIL: prefetching didn't speed up hashing over a slow filesystem: $with files/s, against $without files/s without"; exit 1; }
+
+# Hashing a directory's entries takes one metadata call (a Lstat, or a DirEntry's Info) for each, not two,
+# and one more call per file, to open it: so the operations on a wide directory, counted by the shim, are two per file.
+mkdir -p _test/counted
+for i in $(seq 1000); do echo $i > _test/counted/$i; done
+rm -f _test/counted.log
+[ "$(shim dir=_test/counted,log=_test/counted.log)" == "$(_test/gittreehash _test/counted)" ] || { echo "FAIL: the counting shim hashed the tree differently"; exit 1; }
+lstats="$(grep -c '^lstat' _test/counted.log)"; opens="$(grep -c '^open' _test/counted.log)"
+echo "counting shim: $lstats metadata calls and $opens opens for 1000 files"
+[ "$lstats" -le 1002 ] && [ "$opens" -le 1002 ] || { echo "FAIL: hashing 1000 files took $lstats metadata calls and $opens opens, not about one of each per file"; exit 1; }
+
+# By default, at most a quarter of the open file limit is spent on files being hashed, however many are hashed at once.
+rm -f _test/peak
+( ulimit -n 64; shim dir=_test/latency,latency=1ms,peak=_test/peak --concurrency=64 > /dev/null )
+[ "$(cat _test/peak)" == 16 ] || { echo "FAIL: with an open file limit of 64, $(cat _test/peak) files were open at once, not 16"; exit 1; }
+
+# A synthetic tree 50,000 directories deep halts cleanly at the depth limit, quickly and without crashing.
+# Within a raised limit, deep trees hash fine, and as the same tree on disk does (checked at 600 deep, as deep as paths on disk allow);
+# but the limit can't usefully be raised to 50,000: each level holds its whole path while it's being hashed, so memory grows
+# with the square of the depth, to gigabytes at 50,000 levels (which is why there's a limit at all).
+shim deep=600 > /dev/null 2>&1 && { echo "FAIL: a synthetic tree deeper than --max-depth wasn't refused"; exit 1; }
+[ "$(shim deep=600 --max-depth=1000)" == "$(_test/gittreehash --max-depth=1000 _test/deep)" ] || { echo "FAIL: the synthetic deep tree hashed differently from the one on disk"; exit 1; }
+{ timeout 60 _test/gittreehash --fs-plugin=_test/shimfs.so --fs-plugin-config=deep=50000 2>&1 || true; } | grep -q "gittreehash-error-too-deep" || { echo "FAIL: a tree 50,000 deep wasn't refused cleanly"; exit 1; }
+shim deep=5000 --max-depth=5001 | grep -q '^[0-9a-f]\{64\}$' || { echo "FAIL: a tree 5,000 deep didn't hash within a raised --max-depth"; exit 1; }
+
+# Hashing concurrently overlaps waiting on the filesystem too: over the slow shim, many small files in several directories
+# hash markedly faster with --concurrency=8 than serially (and the same, of course).
+[ "$(shim dir=_test/racetree,latency=1ms --concurrency=8)" == "$(_test/gittreehash _test/racetree)" ] || { echo "FAIL: hashing concurrently over the latency shim differs"; exit 1; }
+serial="$(shim dir=_test/racetree,latency=1ms --benchmark=2 --prefetch=-1 2>&1 >/dev/null | best_files_per_sec)"
+concurrent="$(shim dir=_test/racetree,latency=1ms --benchmark=2 --prefetch=-1 --concurrency=8 2>&1 >/dev/null | best_files_per_sec)"
+echo "concurrency benchmark: $concurrent files/s with --concurrency=8, $serial files/s serially"
+awk -v c="$concurrent" -v s="$serial" 'BEGIN { exit !(c > s * 2) }' || { echo "FAIL: --concurrency=8 didn't speed up hashing over a slow filesystem: $concurrent files/s, against $serial files/s serially"; exit 1; }
+
+# A file that's opened as something other than what it was listed as, whether another file or a named pipe,
+# is a concurrent change, reported as such (rather than hashed, or waited on forever).
+mkdir -p _test/swapped
+echo a > _test/swapped/a; echo b > _test/swapped/b; mkfifo _test/swapped/p.fifo
+for other in b p.fifo; do
+	{ timeout 10 _test/gittreehash --fs-plugin=_test/shimfs.so --fs-plugin-config=dir=_test/swapped,swap=a:$other --exclude-suffix=.fifo 2>&1 || true; } | grep -q "gittreehash-error-concurrent-io" || { echo "FAIL: a file swapped for $other between listing and opening wasn't reported"; exit 1; }
+done
+# The same goes for the local filesystem, where a file is repeatedly swapped for a named pipe while it's hashed: hashing never hangs.
+# (The big files before it give the swap time to happen between prefetching its FileInfo and opening it.)
+mkdir -p _test/fifoswap
+for i in 1 2 3 4; do head -c 20000000 /dev/zero > _test/fifoswap/$i; done
+mkfifo _test/fifoswap.fifo; echo file > _test/fifoswap.file
+( while true; do ln -f _test/fifoswap.fifo _test/fifoswap/5; ln -f _test/fifoswap.file _test/fifoswap/5; done ) &
+swapper=$!
+for i in $(seq 20); do
+	code=0; timeout 5 _test/gittreehash _test/fifoswap > /dev/null 2>&1 || code=$?
+	[ "$code" != 124 ] || { echo "FAIL: hashing hung on a file swapped for a named pipe"; kill $swapper; exit 1; }
+done
+kill $swapper; wait $swapper || true
+
+# A filesystem that follows links by itself can present a directory inside itself, which would be hashed forever;
+# coming back to a directory that's already being hashed is caught, and reported along with where the cycle goes back to.
+# That's so whether the directory contains itself, or two directories each contain the other.
+mkdir -p _test/cycles/self/loop _test/cycles/x/to-y _test/cycles/y/to-x
+echo file > _test/cycles/self/file; echo x > _test/cycles/x/file; echo y > _test/cycles/y/file
+out="$(shim dir=_test/cycles,alias=self/loop:self 2>&1 | tr -d '\n' || true)"
+grep -q '"code":"gittreehash-error-symlink-cycle"' <<< "$out" || { echo "FAIL: a directory containing itself wasn't reported as a cycle: $out"; exit 1; }
+grep -q '"path":"self/loop"' <<< "$out" && grep -q '"ancestor":"self"' <<< "$out" || { echo "FAIL: a directory containing itself was reported without the cycle: $out"; exit 1; }
+out="$(shim dir=_test/cycles,alias=x/to-y:y,alias=y/to-x:x 2>&1 | tr -d '\n' || true)"
+grep -q '"code":"gittreehash-error-symlink-cycle"' <<< "$out" || { echo "FAIL: two directories containing each other weren't reported as a cycle: $out"; exit 1; }
+grep -q '"path":"x/to-y/to-x"' <<< "$out" && grep -q '"ancestor":"x"' <<< "$out" || { echo "FAIL: two directories containing each other were reported without the cycle: $out"; exit 1; }
+# The same directory turning up twice, but not inside itself, isn't a cycle: it's hashed as copies of it would be.
+cp -r _test/cycles _test/uncycled; rm -r _test/uncycled/x/to-y _test/uncycled/y/to-x
+cp -r _test/uncycled/self _test/uncycled/x/to-y; cp -r _test/uncycled/x _test/uncycled/y/to-x
+[ "$(shim dir=_test/cycles,alias=x/to-y:self,alias=y/to-x:x)" == "$(_test/gittreehash _test/uncycled)" ] || { echo "FAIL: a directory presented twice, not inside itself, wasn't hashed as copies of it"; exit 1; }
+
+# A filesystem can report a symlink as an irregular file, as Windows does some reparse points; if it can be read as a symlink,
+# it's hashed (and counted) as one.  And --symlinks-as-text applies to a plugin's filesystem as to the local one.
+want="$(_test/gittreehash --algorithm=sha1 --ignore-dot-git _test/symreal)"
+[ "$(shim dir=_test/symreal,irregular=to-dir,irregular=sub/dangling --algorithm=sha1 --ignore-dot-git)" == "$want" ] || { echo "FAIL: symlinks reported as irregular files weren't hashed as symlinks"; exit 1; }
+[ "$(shim dir=_test/symreal,irregular=to-dir,irregular=sub/dangling --ignore-dot-git --count)" == "$(_test/gittreehash --ignore-dot-git --count _test/symreal)" ] || { echo "FAIL: symlinks reported as irregular files weren't counted as symlinks"; exit 1; }
+[ "$(shim dir=_test/symtext --algorithm=sha1 --ignore-dot-git --symlinks-as-text=_test/symtext.list)" == "$want" ] || { echo "FAIL: --symlinks-as-text over a plugin's filesystem doesn't hash the text symlinks as the real ones"; exit 1; }
+
+# Whatever's deleted between being listed and being read, whether a file, a symlink, or a directory,
+# or whatever's under a directory replaced by a file, is a concurrent change, reported with the directory and entry it was listed as.
+mkdir -p _test/deleted/sub
+echo a > _test/deleted/f; ln -s f _test/deleted/l; echo b > _test/deleted/sub/file
+for flags in "" --concurrency=1 --prefetch=-1; do
+	for setting in delete=f:.:f delete=l:.:l delete=sub:.:sub notdir=sub:sub:file; do
+		IFS=: read -r gone parent entry <<< "$setting"
+		out="$(shim dir=_test/deleted,$gone $flags 2>&1 | tr -d '\n' || true)"
+		grep -q '"code":"gittreehash-error-concurrent-io".*"parent":"'"$parent"'","entry":"'"$entry"'"' <<< "$out" ||
+			{ echo "FAIL: with $gone and '$flags', the vanished entry wasn't reported as a concurrent change in $parent: $out"; exit 1; }
+	done
+done
+# --emit-null-hash stands in for it instead, as it does on the local filesystem.
+shim dir=_test/deleted,delete=f --emit-null-hash > /dev/null 2> _test/deleted.log || { echo "FAIL: --emit-null-hash failed on a vanished file: $(cat _test/deleted.log)"; exit 1; }
+grep -q '"f" vanished' _test/deleted.log || { echo "FAIL: --emit-null-hash didn't warn about the vanished file"; exit 1; }
+
+# A directory of five million entries makes a tree body of about 240MB, which --tree-spill-threshold keeps out of memory.
+# The listing itself has to be held, so the peak memory use (sampled until the process exits; the body's assembled and hashed last)
+# is compared with that of keeping the body in memory, and must be lower by at least most of the body's size.
+peak_rss_kb() {
+	"$@" > _test/wide.out 2>&1 &
+	local pid=$! peak=0 v
+	while v="$(awk '/^VmHWM/ { print $2 }' /proc/$pid/status 2>/dev/null)" && [ -n "$v" ]; do peak=$v; sleep 0.1; done
+	wait $pid || { echo "FAIL: $* failed: $(cat _test/wide.out)"; exit 1; }
+	echo $peak
+}
+spilled="$(peak_rss_kb _test/gittreehash --fs-plugin=_test/shimfs.so --fs-plugin-config=wide=5000000 --tree-spill-threshold=1048576)"
+spilled_hash="$(cat _test/wide.out)"
+unspilled="$(peak_rss_kb _test/gittreehash --fs-plugin=_test/shimfs.so --fs-plugin-config=wide=5000000 --tree-spill-threshold=-1)"
+[ "$spilled_hash" == "$(cat _test/wide.out)" ] || { echo "FAIL: spilling a five-million-entry tree body changed its hash"; exit 1; }
+echo "five million entries: peak ${spilled}kB spilling the tree body, ${unspilled}kB not"
+[ $((unspilled - spilled)) -gt 200000 ] || { echo "FAIL: spilling a 240MB tree body only saved $((unspilled - spilled))kB at the peak"; exit 1; }
+
+# A file truncated while it's mapped for --mmap faults when the pages past its new end are touched; that's reported as a change, not a crash.
+# (Without --mmap, it's simply read short.)
+mkdir -p _test/truncated
+for flags in "--mmap --mmap-threshold=1" ""; do
+	head -c 1000000 /dev/urandom > _test/truncated/big
+	out="$(shim dir=_test/truncated,truncate=big $flags 2>&1 || true)"
+	grep -q "gittreehash-error-concurrent-io" <<< "$out" || { echo "FAIL: a file truncated while hashing it with '$flags' wasn't reported as changed: $out"; exit 1; }
+	! grep -q "^panic\|SIGBUS\|fatal error" <<< "$out" || { echo "FAIL: a file truncated while hashing it with '$flags' crashed: $out"; exit 1; }
+done
+
+# --reread-changed hashes a file again when it changes size while it's read, as many times as it says, counting each in --stats.
+# This file grows a byte on each of its first three reads, so with three or more rereads it's hashed as it finally is,
+# and with fewer, hashing fails with the sizes seen on the last try: listed at 10 bytes, but read as 11.
+mkdir -p _test/growing
+for n in 3 5; do
+	echo "content" > _test/growing/log
+	hash="$(shim dir=_test/growing,grow=log:3 --reread-changed=$n --stats 2> _test/growing.stats)" || { echo "FAIL: --reread-changed=$n didn't outlast a file growing on three reads: $(cat _test/growing.stats)"; exit 1; }
+	grep -q "^rereads=3 " _test/growing.stats || { echo "FAIL: --reread-changed=$n didn't count three rereads: $(cat _test/growing.stats)"; exit 1; }
+	[ "$hash" == "$(_test/gittreehash _test/growing)" ] || { echo "FAIL: --reread-changed=$n didn't hash the file as it finally was"; exit 1; }
+done
+echo "content" > _test/growing/log
+code=0; out="$(shim dir=_test/growing,grow=log:3 --reread-changed=2 2>&1 | tr -d '\n')" || code=$?
+[ "$code" == 9 ] && grep -q '"code":"gittreehash-error-concurrent-io"' <<< "$out" && grep -q '"expectedSize":"10","actualSize":"11"' <<< "$out" || { echo "FAIL: --reread-changed=2 exited $code, not with the sizes of the last try: $out"; exit 1; }
+
+# --skip-permission-errors omits files and directories that can't be opened or listed for EACCES or EPERM, noting each on stderr,
+# and the hash is then that of the tree without them; without it, or for any other error, hashing halts.
+# (This runs as root here, so permissions are denied by the shim rather than by chmod.)
+rm -rf _test/denied _test/denied-without-file _test/denied-without-dir
+mkdir -p _test/denied/locked/inner _test/denied/open
+echo "a" > _test/denied/a; echo "secret" > _test/denied/secret; echo "x" > _test/denied/locked/inner/x; echo "ok" > _test/denied/open/ok
+cp -r _test/denied _test/denied-without-file; rm _test/denied-without-file/secret
+cp -r _test/denied _test/denied-without-dir; rm -r _test/denied-without-dir/locked
+code=0; out="$(shim dir=_test/denied,fail=secret:EACCES 2>&1 | tr -d '\n')" || code=$?
+[ "$code" == 9 ] && grep -q '"code":"gittreehash-error-permission"' <<< "$out" || { echo "FAIL: an unreadable file without --skip-permission-errors exited $code: $out"; exit 1; }
+for errno in EACCES EPERM; do
+	err="$(shim dir=_test/denied,fail=secret:$errno --skip-permission-errors 2>&1 >/dev/null)"
+	[ "$(shim dir=_test/denied,fail=secret:$errno --skip-permission-errors 2>/dev/null)" == "$(_test/gittreehash _test/denied-without-file)" ] || { echo "FAIL: --skip-permission-errors didn't omit a file failing with $errno"; exit 1; }
+	grep -q '^skipping "secret": ' <<< "$err" || { echo "FAIL: --skip-permission-errors didn't note the file failing with $errno: $err"; exit 1; }
+done
+! shim dir=_test/denied,fail=secret:EACCES --skip-permission-errors --report-format=csv 2>/dev/null | grep -q ',secret$' || { echo "FAIL: --skip-permission-errors reported the omitted file"; exit 1; }
+err="$(shim dir=_test/denied,fail=locked:EACCES --skip-permission-errors 2>&1 >/dev/null)"
+[ "$(shim dir=_test/denied,fail=locked:EACCES --skip-permission-errors 2>/dev/null)" == "$(_test/gittreehash _test/denied-without-dir)" ] || { echo "FAIL: --skip-permission-errors didn't omit a directory that can't be listed"; exit 1; }
+grep -q '^skipping "locked": ' <<< "$err" || { echo "FAIL: --skip-permission-errors didn't note the directory that can't be listed: $err"; exit 1; }
+code=0; out="$(shim dir=_test/denied,fail=secret:EIO --skip-permission-errors 2>&1 | tr -d '\n')" || code=$?
+[ "$code" == 9 ] && grep -q '"code":"gittreehash-error-io"' <<< "$out" || { echo "FAIL: --skip-permission-errors didn't halt on an IO error, exiting $code: $out"; exit 1; }
+fi
+
+# --remote hashes the objects under a prefix in S3, here served by a minimal in-memory fake of the S3 API.
+# Listings are split into pages of two, so that continuing a listing is tested too.
+if command -v python3 > /dev/null; then
+	mkdir -p _test/s3/bucket/pre/fix/dir/sub _test/s3/bucket/other
+	echo "a" > _test/s3/bucket/pre/fix/a; echo "b" > _test/s3/bucket/pre/fix/dir/b; echo "c" > _test/s3/bucket/pre/fix/dir/sub/c
+	head -c 300000 /dev/urandom > _test/s3/bucket/pre/fix/dir/big; echo "x" > _test/s3/bucket/other/x
+	cat > _test/s3fake.py <<'PYTHON'
+import hashlib, http.server, os, sys, urllib.parse
+from xml.sax.saxutils import escape
+root = sys.argv[1]
+def objects(bucket):
+	base = os.path.join(root, bucket)
+	for d, _, files in os.walk(base):
+		for f in files:
+			yield os.path.relpath(os.path.join(d, f), base)
+class Handler(http.server.BaseHTTPRequestHandler):
+	def log_message(self, *args): pass
+	def object(self):
+		u = urllib.parse.urlparse(self.path)
+		bucket, _, key = u.path.lstrip("/").partition("/")
+		return bucket, urllib.parse.unquote(key), urllib.parse.parse_qs(u.query)
+	def send_object(self, body_wanted):
+		bucket, key, _ = self.object()
+		p = os.path.join(root, bucket, key)
+		if not key or not os.path.isfile(p):
+			self.send_response(404); self.send_header("Content-Length", "0"); self.end_headers(); return
+		data = open(p, "rb").read()
+		etag = '"%s"' % hashlib.md5(data).hexdigest()
+		if self.headers.get("If-Match") not in (None, etag):
+			self.send_response(412); self.send_header("Content-Length", "0"); self.end_headers(); return
+		status, rng = 200, self.headers.get("Range")
+		if rng:
+			start, _, end = rng[len("bytes="):].partition("-")
+			data, status = data[int(start):int(end) + 1 if end else None], 206
+		self.send_response(status)
+		self.send_header("Content-Length", str(len(data))); self.send_header("ETag", etag)
+		self.send_header("Last-Modified", "Thu, 01 Jan 2020 00:00:00 GMT"); self.end_headers()
+		if body_wanted: self.wfile.write(data)
+	def do_HEAD(self): self.send_object(False)
+	def do_GET(self):
+		bucket, key, q = self.object()
+		if key: return self.send_object(True)
+		prefix, delim = q.get("prefix", [""])[0], q.get("delimiter", [""])[0]
+		items = set()
+		for k in objects(bucket):
+			if not k.startswith(prefix): continue
+			rest = k[len(prefix):]
+			items.add(("p", prefix + rest[:rest.index(delim) + 1]) if delim and delim in rest else ("k", k))
+		items = sorted(items, key=lambda i: i[1])
+		start = int(q.get("continuation-token", ["0"])[0])
+		page = items[start:start + min(2, int(q.get("max-keys", ["1000"])[0]))]
+		more = start + len(page) < len(items)
+		xml = ['<?xml version="1.0" encoding="UTF-8"?><ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">']
+		xml.append("<Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><IsTruncated>%s</IsTruncated>" % (bucket, escape(prefix), len(page), str(more).lower()))
+		if more: xml.append("<NextContinuationToken>%d</NextContinuationToken>" % (start + len(page)))
+		for kind, name in page:
+			if kind == "p":
+				xml.append("<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>" % escape(name))
+			else:
+				size = os.path.getsize(os.path.join(root, bucket, name))
+				xml.append("<Contents><Key>%s</Key><LastModified>2020-01-01T00:00:00.000Z</LastModified><Size>%d</Size></Contents>" % (escape(name), size))
+		xml.append("</ListBucketResult>")
+		body = "".join(xml).encode()
+		self.send_response(200); self.send_header("Content-Type", "application/xml"); self.send_header("Content-Length", str(len(body))); self.end_headers()
+		self.wfile.write(body)
+server = http.server.ThreadingHTTPServer(("127.0.0.1", 0), Handler)
+open(sys.argv[2], "w").write(str(server.server_address[1]))
+server.serve_forever()
+PYTHON
+	python3 _test/s3fake.py _test/s3 _test/s3fake.port & s3pid=$!
+	for i in $(seq 50); do [ -s _test/s3fake.port ] && break; sleep 0.1; done
+	s3() { AWS_ACCESS_KEY_ID=test AWS_SECRET_ACCESS_KEY=test AWS_REGION=us-east-1 AWS_EC2_METADATA_DISABLED=true AWS_CONFIG_FILE=/dev/null AWS_SHARED_CREDENTIALS_FILE=/dev/null \
+		_test/gittreehash --s3-endpoint="http://127.0.0.1:$(cat _test/s3fake.port)" "$@"; }
+	[ "$(s3 --remote=s3://bucket/pre/fix)" == "$(_test/gittreehash _test/s3/bucket/pre/fix)" ] || { echo "FAIL: --remote differs from hashing the same files locally"; kill $s3pid; exit 1; }
+	[ "$(s3 --remote=s3://bucket/pre/fix/ --concurrency=4)" == "$(_test/gittreehash _test/s3/bucket/pre/fix)" ] || { echo "FAIL: --remote with --concurrency differs"; kill $s3pid; exit 1; }
+	[ "$(s3 --remote=s3://bucket)" == "$(_test/gittreehash _test/s3/bucket)" ] || { echo "FAIL: --remote of a whole bucket differs"; kill $s3pid; exit 1; }
+	code=0; s3 --remote=s3://bucket/nonexistent 2>/dev/null || code=$?
+	[ "$code" == 4 ] || { echo "FAIL: --remote of a missing prefix exited $code, not 4"; kill $s3pid; exit 1; }
+	kill $s3pid; wait $s3pid || true
+	# With the server gone, the failed request is reported as an IO error naming the key.
+	out="$(s3 --remote=s3://bucket/pre/fix 2>&1)" && { echo "FAIL: --remote without a server exited 0"; exit 1; }
+	echo "$out" | grep -q '"code":"gittreehash-error-io"' && echo "$out" | grep -q '"key"' || { echo "FAIL: --remote without a server didn't report an IO error with the key: $out"; exit 1; }
+fi
+
+# --ssh hashes a directory on another host over SFTP, here served on loopback by a minimal SSH server built on pkg/sftp,
+# which generates a host key and a client key, and writes them to known_hosts and id_ed25519 in a HOME of its own.
+mkdir -p _test/sftpserver _test/sshhome
+cat > _test/sftpserver/main.go <<'GO'
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func main() {
+	home := os.Getenv("HOME")
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		panic(err)
+	}
+	clientPub, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	if err != nil {
+		panic(err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		panic(err)
+	}
+	config := &ssh.ServerConfig{PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+			return nil, nil
+		}
+		return nil, errors.New("unknown key")
+	}}
+	config.AddHostKey(hostSigner)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll(home+"/.ssh", 0o700); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(home+"/.ssh/id_ed25519", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		panic(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(ln.Addr().String())}, hostSigner.PublicKey())
+	if err := os.WriteFile(home+"/.ssh/known_hosts", []byte(line+"\n"), 0o600); err != nil {
+		panic(err)
+	}
+	fmt.Println(ln.Addr().(*net.TCPAddr).Port)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			panic(err)
+		}
+		go serve(conn, config)
+	}
+}
+
+// serve answers requests for the sftp subsystem on each session of a connection, and refuses everything else.
+func serve(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only sessions are served")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range chReqs {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						defer ch.Close()
+						server, err := sftp.NewServer(ch)
+						if err != nil {
+							return
+						}
+						server.Serve()
+					}()
+				}
+			}
+		}()
+	}
+}
+GO
+go build -o _test/sftpserver/sftpserver ./_test/sftpserver
+HOME="$PWD/_test/sshhome" _test/sftpserver/sftpserver > _test/sftpserver.port &
+sftppid=$!
+for i in $(seq 100); do [ -s _test/sftpserver.port ] && break; sleep 0.1; done
+sshtree() { HOME="$PWD/_test/sshhome" SSH_AUTH_SOCK= _test/gittreehash "$@"; }
+port="$(cat _test/sftpserver.port)"
+[ "$(sshtree --ssh="me@[127.0.0.1]:$port:$PWD/_test/gittree-src")" == "$(_test/gittreehash _test/gittree-src)" ] || { echo "FAIL: --ssh differs from hashing the same directory locally"; kill $sftppid; exit 1; }
+[ "$(sshtree --ssh="me@[127.0.0.1]:$port:_test/gittree-src" --concurrency=4)" == "$(_test/gittreehash _test/gittree-src)" ] || { echo "FAIL: --ssh of a relative path with --concurrency differs"; kill $sftppid; exit 1; }
+[ "$(sshtree --ssh="me@[127.0.0.1]:$port:_test/gittree-src" --report-format=csv)" == "$(_test/gittreehash --report-format=csv _test/gittree-src)" ] || { echo "FAIL: --ssh reports different entries"; kill $sftppid; exit 1; }
+code=0; sshtree --ssh="me@[127.0.0.1]:$port:$PWD/_test/nonexistent" 2>/dev/null || code=$?
+[ "$code" == 4 ] || { echo "FAIL: --ssh of a missing path exited $code, not 4"; kill $sftppid; exit 1; }
+# A host whose key isn't in known_hosts is refused.
+cp _test/sshhome/.ssh/known_hosts _test/sshhome/known_hosts.saved && : > _test/sshhome/.ssh/known_hosts
+code=0; out="$(sshtree --ssh="me@[127.0.0.1]:$port:$PWD/_test/gittree-src" 2>&1 | tr -d '\n')" || code=$?
+mv _test/sshhome/known_hosts.saved _test/sshhome/.ssh/known_hosts
+[ "$code" != 0 ] && grep -q '"code":"gittreehash-error-ssh"' <<< "$out" || { echo "FAIL: --ssh to a host with an unknown key exited $code: $out"; kill $sftppid; exit 1; }
+kill $sftppid; wait $sftppid || true
+
+# bundle reads a tree from a git bundle file, with no repository, resolving deltas between objects.
+for alg in sha1 sha256; do
+	seq 1 20000 > _test/gittree-src/dir/lines
+	git --git-dir=_test/gittree-$alg/.git --work-tree=_test/gittree-src add -A
+	git -C _test/gittree-$alg -c user.email=t@t -c user.name=t commit -qm lines
+	sed -i 's/^5$/five/' _test/gittree-src/dir/lines
+	git --git-dir=_test/gittree-$alg/.git --work-tree=_test/gittree-src add -A
+	git -C _test/gittree-$alg -c user.email=t@t -c user.name=t commit -qm edit
+	git -C _test/gittree-$alg -c user.email=t@t -c user.name=t tag -a v1 -m v1 HEAD~1
+	git -C _test/gittree-$alg bundle create -q ../bundle-$alg.bundle --all
+	git -C _test/gittree-$alg bundle create -q ../bundle-$alg-thin.bundle HEAD~1..HEAD
+done
+for alg in sha1 sha256; do
+	for repo in sha1 sha256; do
+		[ "$(_test/gittreehash bundle --algorithm=$alg _test/bundle-$repo.bundle HEAD)" == "$(git -C _test/gittree-$alg rev-parse 'HEAD^{tree}')" ] || { echo "FAIL: bundle ($alg) from a $repo bundle differs from git's id"; exit 1; }
+		[ "$(_test/gittreehash bundle --algorithm=$alg _test/bundle-$repo.bundle v1)" == "$(git -C _test/gittree-$alg rev-parse 'v1^{tree}')" ] || { echo "FAIL: bundle ($alg) of a tag from a $repo bundle differs from git's id"; exit 1; }
+	done
+done
+[ "$(_test/gittreehash bundle _test/bundle-sha1.bundle HEAD)" == "$(_test/gittreehash _test/gittree-src)" ] || { echo "FAIL: bundle differs from hashing the directory"; exit 1; }
+code=0; _test/gittreehash bundle _test/bundle-sha1-thin.bundle HEAD 2>/dev/null || code=$?
+[ "$code" == 4 ] || { echo "FAIL: bundle missing its prerequisites exited $code, not 4"; exit 1; }
+code=0; _test/gittreehash bundle _test/bundle-sha1.bundle nonexistent 2>/dev/null || code=$?
+[ "$code" == 4 ] || { echo "FAIL: bundle of a missing ref exited $code, not 4"; exit 1; }
+head -c 1000 _test/bundle-sha1.bundle > _test/bundle-truncated.bundle
+{ _test/gittreehash bundle _test/bundle-truncated.bundle HEAD 2>&1 || true; } | grep -q "gittreehash-error-invalid-bundle" || { echo "FAIL: a truncated bundle wasn't reported as invalid"; exit 1; }
+
+# --exclude-suffix leaves out files ending with any of the suffixes, but not directories.
+rm -rf _test/suffix _test/suffix-expect && mkdir -p _test/suffix/out.tmp _test/suffix-expect/out.tmp
+echo keep > _test/suffix/a.txt; echo keep > _test/suffix-expect/a.txt
+echo keep > _test/suffix/out.tmp/b; echo keep > _test/suffix-expect/out.tmp/b
+echo junk > _test/suffix/a.txt.tmp; echo junk > _test/suffix/c.part; ln -s a.txt _test/suffix/link.part
+[ "$(_test/gittreehash --exclude-suffix=.tmp --exclude-suffix=.part _test/suffix)" == "$(_test/gittreehash _test/suffix-expect)" ] || { echo "FAIL: --exclude-suffix doesn't leave out exactly the files with those suffixes"; exit 1; }
+
+# --fast-import-out writes a stream from which git fast-import makes a commit whose tree has the same hash.
+rm -rf _test/fastimport _test/fastimport-repo && mkdir -p _test/fastimport/sub/deeper
+echo one > _test/fastimport/one; echo one > _test/fastimport/sub/same; printf 'x' > _test/fastimport/sub/deeper/'"quoted'
+echo run > _test/fastimport/sub/run; chmod +x _test/fastimport/sub/run; ln -s sub/run _test/fastimport/link; echo sp > '_test/fastimport/with space'
+git init -q _test/fastimport-repo
+hash="$(_test/gittreehash --algorithm=sha1 --fast-import-out=- --fast-import-ref=refs/heads/snap --fast-import-date=2020-01-02T03:04:05+02:00 --fast-import-message=msg _test/fastimport 2>&1 >/dev/null)"
+_test/gittreehash --algorithm=sha1 --fast-import-out=- --fast-import-ref=refs/heads/snap --fast-import-date=2020-01-02T03:04:05+02:00 --fast-import-message=msg _test/fastimport 2>/dev/null | git -C _test/fastimport-repo fast-import --quiet
+[ "$hash" == "$(_test/gittreehash --algorithm=sha1 _test/fastimport)" ] || { echo "FAIL: --fast-import-out=- doesn't print the hash to stderr"; exit 1; }
+[ "$(git -C _test/fastimport-repo rev-parse 'snap^{tree}')" == "$hash" ] || { echo "FAIL: the commit made from the --fast-import-out stream has a different tree"; exit 1; }
+[ "$(git -C _test/fastimport-repo log -1 --format='%an|%ad|%s' --date=iso-strict snap)" == "gittreehash|2020-01-02T03:04:05+02:00|msg" ] || { echo "FAIL: the commit made from the --fast-import-out stream has the wrong metadata"; exit 1; }
+git -C _test/fastimport-repo fsck --no-dangling --strict > /dev/null 2>&1 || { echo "FAIL: git fsck found problems after importing the --fast-import-out stream"; exit 1; }
+mkdir _test/fastimport/empty
+{ _test/gittreehash --fast-import-out=_test/fastimport.stream _test/fastimport 2>&1 || true; } | grep -q "empty directory" || { echo "FAIL: --fast-import-out doesn't refuse an empty directory"; exit 1; }
+[ ! -e _test/fastimport.stream ] || { echo "FAIL: --fast-import-out left a file behind after failing"; exit 1; }
+
+# --unicode-normalization records names in NFC or NFD, so copies of a tree made on systems which normalize differently hash the same.
+# "f" sorts between the decomposed é (which starts with e) and the composed one, so the entries are reordered too.
+# Paths are still reported as found.
+nfc="$(printf '\xc3\xa9')"; nfd="$(printf 'e\xcc\x81')"
+rm -rf _test/unicode-nfc _test/unicode-nfd _test/unicode-both
+for form in nfc nfd; do
+	name="${!form}"
+	mkdir -p "_test/unicode-$form/caf$name"
+	echo 1 > "_test/unicode-$form/$name"; echo 2 > "_test/unicode-$form/f"; echo 3 > "_test/unicode-$form/caf$name/$name"
+done
+[ "$(_test/gittreehash _test/unicode-nfc)" != "$(_test/gittreehash _test/unicode-nfd)" ] || { echo "FAIL: NFC and NFD names hash the same without --unicode-normalization"; exit 1; }
+rm -rf _test/unicode-git && git init -q _test/unicode-git
+git --git-dir=_test/unicode-git/.git --work-tree=_test/unicode-nfd -c core.precomposeunicode=false add -A
+[ "$(git -C _test/unicode-git write-tree)" == "$(_test/gittreehash --algorithm=sha1 --unicode-normalization=none _test/unicode-nfd)" ] || { echo "FAIL: --unicode-normalization=none differs from git"; exit 1; }
+for form in nfc nfd; do
+	for from in nfc nfd; do
+		[ "$(_test/gittreehash --unicode-normalization=$form _test/unicode-$from)" == "$(_test/gittreehash _test/unicode-$form)" ] || { echo "FAIL: --unicode-normalization=$form of the $from tree differs from the $form tree"; exit 1; }
+	done
+done
+_test/gittreehash --unicode-normalization=nfc --report-format=csv _test/unicode-nfd | grep ",_test/unicode-nfd/caf$nfd/$nfd\$" > /dev/null || { echo "FAIL: --unicode-normalization changed a reported path"; exit 1; }
+# Two names in a directory which are the same once normalized can't both be recorded.
+mkdir -p _test/unicode-both && echo 1 > "_test/unicode-both/$nfc" && echo 2 > "_test/unicode-both/$nfd"
+_test/gittreehash _test/unicode-both > /dev/null || { echo "FAIL: names which differ only in normalization can't be hashed without --unicode-normalization"; exit 1; }
+for form in nfc nfd; do
+	code=0; out="$(_test/gittreehash --unicode-normalization=$form _test/unicode-both 2>&1 | tr -d '\n')" || code=$?
+	[ "$code" == 9 ] && grep -q '"code":"gittreehash-error-name-collision"' <<< "$out" && grep -q "\"path\":\"_test/unicode-both\",\"name1\":\"$nfd\",\"name2\":\"$nfc\"" <<< "$out" || { echo "FAIL: --unicode-normalization=$form of colliding names exited $code: $out"; exit 1; }
+done
+
+# --case-fold records names in lower case, so differently capitalized copies hash the same; collisions are skipped with a warning.
+rm -rf _test/casefold-a _test/casefold-b && mkdir -p _test/casefold-a/Sub _test/casefold-b/sub
+echo x > _test/casefold-a/Sub/README.md; echo x > _test/casefold-b/sub/readme.md
+echo y > _test/casefold-a/B; echo y > _test/casefold-b/b; echo z > _test/casefold-a/a
+echo z > _test/casefold-b/A; echo other > _test/casefold-b/a # A sorts first, so it's kept.
+[ "$(_test/gittreehash --case-fold _test/casefold-a)" != "$(_test/gittreehash _test/casefold-a)" ] || { echo "FAIL: --case-fold makes no difference"; exit 1; }
+[ "$(_test/gittreehash --case-fold _test/casefold-a 2>/dev/null)" == "$(_test/gittreehash --case-fold _test/casefold-b 2>/dev/null)" ] || { echo "FAIL: --case-fold doesn't make differently capitalized trees hash the same"; exit 1; }
+_test/gittreehash --case-fold _test/casefold-b 2>&1 >/dev/null | grep -q "warning: skipping \"_test/casefold-b/a\"" || { echo "FAIL: --case-fold doesn't warn about names that collide"; exit 1; }
+
+# tag-release stores a directory in a repository, with a commit of its tree and an annotated tag of that commit.
+for alg in sha1 sha256; do
+	rm -rf _test/release-$alg && git init -q --object-format=$alg _test/release-$alg
+	tree="$(_test/gittreehash tag-release --dir=_test/zipsrc --tag='release-{tree}' --git-dir=_test/release-$alg/.git --date=2020-01-02T03:04:05Z)"
+	[ "$tree" == "$(_test/gittreehash --algorithm=$alg _test/zipsrc)" ] || { echo "FAIL: tag-release ($alg) printed the wrong hash"; exit 1; }
+	[ "$(git -C _test/release-$alg cat-file -t "release-$tree")" == "tag" ] || { echo "FAIL: tag-release ($alg) didn't make an annotated tag"; exit 1; }
+	[ "$(git -C _test/release-$alg rev-parse "release-$tree^{tree}")" == "$tree" ] || { echo "FAIL: the tag made by tag-release ($alg) doesn't lead to the tree"; exit 1; }
+	[ "$(git -C _test/release-$alg log -1 --format=%s "release-$tree")" == "Release release-$tree" ] || { echo "FAIL: the commit made by tag-release ($alg) has the wrong message"; exit 1; }
+	git -C _test/release-$alg fsck --no-dangling --strict > /dev/null 2>&1 || { echo "FAIL: git fsck found problems after tag-release ($alg)"; exit 1; }
+done
+{ _test/gittreehash tag-release --dir=_test/zipsrc --tag='release-{tree}' --git-dir=_test/release-sha1/.git 2>&1 || true; } | grep -q "gittreehash-error-tag-exists" || { echo "FAIL: tag-release replaced a tag without --force"; exit 1; }
+_test/gittreehash tag-release --force --dir=_test/zipsrc --tag='release-{tree}' --git-dir=_test/release-sha1/.git --message=again > /dev/null || { echo "FAIL: tag-release --force failed"; exit 1; }
+{ _test/gittreehash tag-release --dir=_test/zipsrc --tag='bad..name' --git-dir=_test/release-sha1/.git 2>&1 || true; } | grep -q "gittreehash-error-invalid-ref-name" || { echo "FAIL: tag-release accepted a tag name git doesn't allow"; exit 1; }
+
+# --commit also prints the id of a commit of the tree, which is what git commit-tree makes, given the same identity and dates.
+rm -rf _test/commit-repo && git init -q _test/commit-repo
+tree="$(git -C _test/commit-repo --work-tree=../zipsrc add -A && git -C _test/commit-repo write-tree)"
+[ "$tree" == "$(_test/gittreehash --algorithm=sha1 _test/zipsrc)" ] || { echo "FAIL: the tree for --commit differs from git's"; exit 1; }
+first="$(GIT_AUTHOR_NAME='A U Thor' GIT_AUTHOR_EMAIL=a@example.com GIT_AUTHOR_DATE='1577934245 +0530' GIT_COMMITTER_NAME='A U Thor' GIT_COMMITTER_EMAIL=a@example.com GIT_COMMITTER_DATE='1577934245 +0530' git -C _test/commit-repo commit-tree -m 'first' "$tree")"
+second="$(GIT_AUTHOR_NAME='A U Thor' GIT_AUTHOR_EMAIL=a@example.com GIT_AUTHOR_DATE='1577934245 -0800' GIT_COMMITTER_NAME='A U Thor' GIT_COMMITTER_EMAIL=a@example.com GIT_COMMITTER_DATE='1577934245 -0800' git -C _test/commit-repo commit-tree -p "$first" -m 'second' "$tree")"
+[ "$(_test/gittreehash --algorithm=sha1 --commit --author='A U Thor <a@example.com>' --date=2020-01-02T08:34:05+05:30 --commit-message=first _test/zipsrc)" == "$tree
+$first" ] || { echo "FAIL: --commit differs from git commit-tree"; exit 1; }
+[ "$(_test/gittreehash --algorithm=sha1 --commit --author='A U Thor <a@example.com>' --date=2020-01-01T19:04:05-08:00 --parent="$first" --commit-message=second _test/zipsrc | tail -n 1)" == "$second" ] || { echo "FAIL: --commit with --parent and a negative time zone differs from git commit-tree"; exit 1; }
+
+# --report-collisions warns about entries with the same hash but different content, and not about copies.
+rm -rf _test/collide && mkdir -p _test/collide/a _test/collide/b
+for i in $(seq 40); do echo "$i" > "_test/collide/a/$i"; echo "$i" > "_test/collide/b/$i"; done
+[ -z "$(_test/gittreehash --report-collisions _test/collide 2>&1 >/dev/null)" ] || { echo "FAIL: --report-collisions warned about copies"; exit 1; }
+warnings="$(_test/gittreehash --report-collisions --collision-prefix=1 _test/collide 2>&1 >/dev/null)"
+grep -q "^warning: hash collision: \"_test/collide/a/" <<< "$warnings" || { echo "FAIL: --report-collisions didn't warn about hashes with the same prefix"; exit 1; }
+[ "$(_test/gittreehash --report-collisions --collision-prefix=1 _test/collide 2>/dev/null)" == "$(_test/gittreehash _test/collide)" ] || { echo "FAIL: --report-collisions changes the hash"; exit 1; }
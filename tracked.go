@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/gittreehash/gitindex"
+)
+
+const ErrNoRepository = "gittreehash-error-no-repository"
+
+// findGitDir looks for the git repository containing a path, checking the path itself and then each of its parents.
+// It returns the root of the working tree, and the git directory (which is usually the ".git" directory in the root,
+// but may be elsewhere if ".git" is a file pointing to it, as it is for linked worktrees and submodules).
+// Both are absolute.
+//
+// Errors:
+//
+//   - gittreehash-error-no-repository -- if no parent contains a ".git".
+//   - gittreehash-error-io -- if a ".git" file can't be read.
+//   - gittreehash-error-permission -- if a ".git" file can't be read due to permissions.
+func findGitDir(pth string) (root, gitDir string, err error) {
+	abs, err := filepath.Abs(pth)
+	if err != nil {
+		return "", "", newErrIO(err)
+	}
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		dotGit := filepath.Join(dir, ".git")
+		fi, err := os.Stat(dotGit)
+		switch {
+		case err == nil && fi.IsDir():
+			return dir, dotGit, nil
+		case err == nil:
+			body, err := os.ReadFile(dotGit)
+			if err != nil {
+				return "", "", newErrIO(err)
+			}
+			body = bytes.TrimSpace(body)
+			if !bytes.HasPrefix(body, []byte("gitdir:")) {
+				break // Not something git would recognize either; keep looking.
+			}
+			gitDir := strings.TrimSpace(string(body[len("gitdir:"):]))
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			return dir, gitDir, nil
+		case !errors.Is(err, fs.ErrNotExist):
+			return "", "", newErrIO(err)
+		}
+		if dir == filepath.Dir(dir) {
+			return "", "", serum.Error(ErrNoRepository,
+				serum.WithMessageTemplate("no git repository found containing {{path}}"),
+				serum.WithDetail("path", pth),
+				withPathBytes("path", pth),
+			)
+		}
+	}
+}
+
+// readIndexFor reads the index of the repository containing the starting path.
+// Along with the index, it returns the index file's path (for its timestamp),
+// and a function which converts the path of an index entry into the path the hasher would find it at,
+// or returns false if the entry isn't under the starting path.
+//
+// Errors:
+//
+//   - gittreehash-error-no-repository -- if the starting path isn't inside a git repository.
+//   - gittreehash-error-io -- if locating the repository fails.
+//   - gittreehash-error-permission -- if locating the repository fails due to permissions.
+//   - gitindex-error-io -- if the index file can't be read.
+//   - gitindex-error-parse -- if the index file isn't valid.
+func readIndexFor(startPath string) (*gitindex.Index, string, func(entPath string) (string, bool), error) {
+	root, gitDir, err := findGitDir(startPath)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	indexFile := filepath.Join(gitDir, "index")
+	idx, err := gitindex.ReadFile(indexFile)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	abs, err := filepath.Abs(startPath)
+	if err != nil {
+		return nil, "", nil, newErrIO(err)
+	}
+	prefix, err := filepath.Rel(root, abs)
+	if err != nil {
+		return nil, "", nil, newErrIO(err)
+	}
+	prefix = filepath.ToSlash(prefix)
+	// Index paths are relative to the root of the working tree, but the hasher's are relative to where it was started.
+	hasherPath := func(entPath string) (string, bool) {
+		if prefix != "." {
+			if !strings.HasPrefix(entPath, prefix+"/") {
+				return "", false
+			}
+			entPath = entPath[len(prefix)+1:]
+		}
+		return filepath.Join(startPath, filepath.FromSlash(entPath)), true
+	}
+	return idx, indexFile, hasherPath, nil
+}
+
+// trackedFromIndex returns a function for Options.Include which admits only the paths tracked in the index
+// of the repository containing the starting path, and the directories leading to them.
+// Entries marked skip-worktree (by sparse-checkout) are not admitted, since they're not meant to be in the working tree.
+//
+// Errors:
+//
+//   - gittreehash-error-no-repository -- if the starting path isn't inside a git repository.
+//   - gittreehash-error-io -- if locating the repository fails.
+//   - gittreehash-error-permission -- if locating the repository fails due to permissions.
+//   - gitindex-error-io -- if the index file can't be read.
+//   - gitindex-error-parse -- if the index file isn't valid.
+func trackedFromIndex(startPath string) (func(pth string, isDir bool) bool, error) {
+	idx, _, hasherPath, err := readIndexFor(startPath)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]struct{}{}
+	dirs := map[string]struct{}{}
+	for _, ent := range idx.Entries {
+		if ent.SkipWorktree {
+			continue
+		}
+		pth, ok := hasherPath(ent.Path)
+		if !ok {
+			continue
+		}
+		files[pth] = struct{}{}
+		for d := filepath.Dir(pth); d != startPath && d != "."; d = filepath.Dir(d) {
+			dirs[d] = struct{}{}
+		}
+	}
+	return func(pth string, isDir bool) bool {
+		if _, ok := files[pth]; ok {
+			return true // Includes submodules, which are recorded like files but are directories.
+		}
+		if !isDir {
+			return false
+		}
+		_, ok := dirs[pth]
+		return ok
+	}, nil
+}
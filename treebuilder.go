@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const ErrInvalidEntry = "gittreehash-error-invalid-entry"
+
+// TreeBuilder assembles a single tree object from entries given one at a time, in any order,
+// and hashes it as git would.  Where HashPath reads a tree from a filesystem, TreeBuilder is for making one up:
+// blobs are given as their content, and subtrees as their hash (perhaps from another TreeBuilder).
+//
+// Only Options.Algorithm and Options.IgnoreFileMode affect the result.
+// Content is hashed exactly as given: no filters, EOL conversion, or LFS pointers are applied.
+//
+// Problems with entries (bad names, duplicate names, or unsupported modes) aren't reported as they're added,
+// but by Finish.
+type TreeBuilder struct {
+	h       *hasher
+	entries []builderEntry
+	names   map[string]struct{}
+	err     error // The first problem with an entry, if any.
+}
+
+type builderEntry struct {
+	name string
+	mode fs.FileMode
+	hash [32]byte
+}
+
+// NewTreeBuilder returns an empty TreeBuilder.
+func NewTreeBuilder(opts Options) *TreeBuilder {
+	return &TreeBuilder{h: newHasher(nil, opts), names: map[string]struct{}{}}
+}
+
+// AddBlob adds a file to the tree.  The mode must be either a regular file's mode, whose executable bits are kept
+// (as with HashPath, git only records whether there are any), or fs.ModeSymlink, in which case the content is the link's target.
+func (b *TreeBuilder) AddBlob(name string, content []byte, mode fs.FileMode) {
+	switch mode.Type() {
+	case 0, fs.ModeSymlink:
+	default:
+		b.fail(newErrInvalidEntry(name, "mode "+mode.String()+" is neither a regular file nor a symlink"))
+		return
+	}
+	b.add(name, mode, b.h.hashBlobBytes(content))
+}
+
+// AddTree adds a subtree to the tree, given its hash.
+// The hash isn't checked; it's recorded as given, trimmed to the algorithm's length.
+func (b *TreeBuilder) AddTree(name string, hash [32]byte) {
+	b.add(name, fs.ModeDir, hash)
+}
+
+func (b *TreeBuilder) add(name string, mode fs.FileMode, hash [32]byte) {
+	switch {
+	case name == "", name == ".", name == "..":
+		b.fail(newErrInvalidEntry(name, "the name is not allowed in a tree"))
+		return
+	case strings.ContainsAny(name, "/\x00"):
+		b.fail(newErrInvalidEntry(name, "the name contains a slash or NUL"))
+		return
+	}
+	if _, exists := b.names[name]; exists {
+		b.fail(newErrInvalidEntry(name, "the name was already added"))
+		return
+	}
+	b.names[name] = struct{}{}
+	b.entries = append(b.entries, builderEntry{name, mode, hash})
+}
+
+func (b *TreeBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Finish sorts the entries into the order git requires, and returns the hash of the tree object.
+// The builder may go on being used afterwards; each call to Finish hashes all the entries added so far.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-entry -- if any entry had an empty name, or ".", or "..", or a name containing "/" or NUL;
+//     or if a name was added twice; or if AddBlob was given a mode other than a regular file's or a symlink's.
+func (b *TreeBuilder) Finish() ([32]byte, error) {
+	if b.err != nil {
+		return [32]byte{}, b.err
+	}
+	sort.Slice(b.entries, func(i, j int) bool {
+		return treeEntrySortKey(b.entries[i].name, b.entries[i].mode.IsDir()) < treeEntrySortKey(b.entries[j].name, b.entries[j].mode.IsDir())
+	})
+	buf := getTreeBuffer()
+	defer putTreeBuffer(buf)
+	for _, e := range b.entries {
+		b.h.writeTreeEntry(buf, e.name, e.mode, e.hash)
+	}
+	return b.h.hashTreeBody("", buf), nil
+}
+
+func newErrInvalidEntry(name, reason string) error {
+	return serum.Error(ErrInvalidEntry,
+		serum.WithMessageTemplate("tree entry {{name}} is invalid: {{reason}}"),
+		serum.WithDetail("name", name),
+		withPathBytes("name", name),
+		serum.WithDetail("reason", reason),
+	)
+}
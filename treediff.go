@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+// TreeDiff describes the differences between two TreeNodes.
+// Each slice is sorted by path.
+type TreeDiff struct {
+	Added    []TreeDiffEntry // In the new tree only.  OldHash is nil.
+	Removed  []TreeDiffEntry // In the old tree only.  NewHash is nil.
+	Modified []TreeDiffEntry // In both trees, with different hashes or modes.
+}
+
+// TreeDiffEntry is a single path in a TreeDiff.
+type TreeDiffEntry struct {
+	Path    string
+	OldHash []byte
+	NewHash []byte
+	OldMode string // As written in the tree, e.g. "100644".  Empty when OldHash is nil.
+	NewMode string // Likewise, for the new tree.
+}
+
+// ModeOnly reports whether the entry is modified only in its mode, such as by gaining an executable bit,
+// or by a symlink becoming a file holding its target.
+func (e TreeDiffEntry) ModeOnly() bool {
+	return e.OldHash != nil && e.NewHash != nil && bytes.Equal(e.OldHash, e.NewHash) && e.OldMode != e.NewMode
+}
+
+// TypeChanged reports whether the entry is in both trees, but as different kinds of thing:
+// a file on one side and a symlink or directory on the other, say.  (An executable file is still a file.)
+func (e TreeDiffEntry) TypeChanged() bool {
+	return e.OldMode != "" && e.NewMode != "" && gitModeKind(e.OldMode) != gitModeKind(e.NewMode)
+}
+
+// gitModeKind returns the kind of thing a mode written in a tree describes: "tree", "symlink", "commit", or "file".
+func gitModeKind(mode string) string {
+	switch strings.TrimPrefix(mode, "0") {
+	case "40000":
+		return "tree"
+	case "120000":
+		return "symlink"
+	case "160000":
+		return "commit"
+	default:
+		return "file"
+	}
+}
+
+// Empty reports whether the diff contains no differences at all.
+func (d TreeDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// CompareTrees returns the differences between an old tree and a new one.
+// Paths are slash-separated and relative to the roots.  The roots themselves are compared first:
+// if they're the same, nothing else is looked at; if either isn't a directory, and they differ, the root is reported as modified,
+// at the path ".", and everything in whichever is a directory is added or removed.
+// (When both are directories, the root isn't reported, being implied by whatever in it differs.)
+// Both trees are hashed first, if they haven't been yet; after that, only directories whose hashes differ are looked into.
+//
+// An entry whose mode changes is modified too, even if its content doesn't.
+// When a file changes, each directory containing it is reported as modified too, since their hashes change with it.
+// Likewise, when a directory is added or removed, so is everything inside it.
+//
+// Errors:
+//
+//   - any error TreeNode.Hash may return.
+func CompareTrees(a, b *TreeNode) (TreeDiff, error) {
+	var d TreeDiff
+	for _, tree := range []*TreeNode{a, b} {
+		if _, err := tree.Hash(); err != nil {
+			return TreeDiff{}, err
+		}
+	}
+	oldHash, newHash := a.hashBytes(), b.hashBytes()
+	oldMode, newMode := a.gitMode(), b.gitMode()
+	if bytes.Equal(oldHash, newHash) && oldMode == newMode {
+		return d, nil
+	}
+	if !a.isDir || !b.isDir {
+		d.Modified = append(d.Modified, TreeDiffEntry{Path: ".", OldHash: oldHash, NewHash: newHash, OldMode: oldMode, NewMode: newMode})
+	}
+	if err := d.compareChildren("", a, b); err != nil {
+		return TreeDiff{}, err
+	}
+	for _, entries := range [][]TreeDiffEntry{d.Added, d.Removed, d.Modified} {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	}
+	return d, nil
+}
+
+// compareChildren adds the differences between the children of two hashed nodes,
+// either of which may have none, to the diff.
+func (d *TreeDiff) compareChildren(prefix string, a, b *TreeNode) error {
+	aChildren, err := a.Children()
+	if err != nil {
+		return err
+	}
+	bChildren, err := b.Children()
+	if err != nil {
+		return err
+	}
+	inB := make(map[string]*TreeNode, len(bChildren))
+	for _, child := range bChildren {
+		inB[child.name] = child
+	}
+	inA := make(map[string]bool, len(aChildren))
+	for _, oldChild := range aChildren {
+		inA[oldChild.name] = true
+		pth := prefix + oldChild.name
+		newChild, ok := inB[oldChild.name]
+		if !ok {
+			if err := d.addAll(&d.Removed, pth, oldChild); err != nil {
+				return err
+			}
+			continue
+		}
+		oldHash, newHash := oldChild.hashBytes(), newChild.hashBytes()
+		oldMode, newMode := oldChild.gitMode(), newChild.gitMode()
+		if bytes.Equal(oldHash, newHash) && oldMode == newMode {
+			continue
+		}
+		d.Modified = append(d.Modified, TreeDiffEntry{Path: pth, OldHash: oldHash, NewHash: newHash, OldMode: oldMode, NewMode: newMode})
+		if err := d.compareChildren(pth+"/", oldChild, newChild); err != nil {
+			return err
+		}
+	}
+	for _, newChild := range bChildren {
+		if !inA[newChild.name] {
+			if err := d.addAll(&d.Added, prefix+newChild.name, newChild); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addAll adds a hashed node, and everything beneath it, to one side of the diff.
+func (d *TreeDiff) addAll(entries *[]TreeDiffEntry, pth string, n *TreeNode) error {
+	e := TreeDiffEntry{Path: pth}
+	if entries == &d.Removed {
+		e.OldHash, e.OldMode = n.hashBytes(), n.gitMode()
+	} else {
+		e.NewHash, e.NewMode = n.hashBytes(), n.gitMode()
+	}
+	*entries = append(*entries, e)
+	children, err := n.Children()
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := d.addAll(entries, pth+"/"+child.name, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChangeKind is the kind of difference a Change describes.
+type ChangeKind uint8
+
+const (
+	Added       ChangeKind = iota // Only in the new tree.
+	Removed                       // Only in the old tree.
+	Modified                      // In both, as the same kind of thing, but with different content (and perhaps mode).
+	TypeChanged                   // In both, but as different kinds of thing: a file in one, and a symlink or directory in the other, say.
+	ModeChanged                   // In both, with the same content, but a different mode, such as an executable bit.
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	case TypeChanged:
+		return "type-changed"
+	case ModeChanged:
+		return "mode-changed"
+	default:
+		return fmt.Sprintf("ChangeKind(%d)", uint8(k))
+	}
+}
+
+// Change is a single path that differs between two trees, as listed by Diff.
+type Change struct {
+	Path    string // Slash-separated, relative to the roots.
+	Kind    ChangeKind
+	OldHash []byte // The digest in the old tree; nil if the path was added.
+	NewHash []byte // The digest in the new tree; nil if the path was removed.
+	OldMode string // As written in the old tree, e.g. "100644"; empty if the path was added.
+	NewMode string // Likewise, for the new tree; empty if the path was removed.
+}
+
+// DiffOptions configures Diff.
+type DiffOptions struct {
+	Options Options // How to hash either side that's read from its filesystem.  Both sides must use the same Options.Algorithm.
+
+	// Trees already made (and perhaps already hashed, or partly walked), to use instead of reading the old or new side's path,
+	// whose filesystem and path are then ignored.  Nothing of them that's already known is read again.
+	Old, New *TreeNode
+}
+
+// Diff returns the differences between the tree at pthA in fsysA (the old side) and the tree at pthB in fsysB (the new side),
+// sorted by path, as CompareTrees finds them: only directories whose hashes differ are looked into,
+// a directory containing anything that changed is itself Modified, and everything in a directory that's added or removed
+// (or that replaces, or is replaced by, something else) is Added or Removed in turn.
+// Where either root isn't a directory, and the roots differ, the change to the root itself is listed at the path ".".
+//
+// Errors:
+//
+//   - gittreehash-error-unsupported-option -- if the two sides use different algorithms.
+//   - any error NewTreeNode or CompareTrees may return.
+func Diff(fsysA fsx.FS, pthA string, fsysB fsx.FS, pthB string, opts DiffOptions) ([]Change, error) {
+	trees := [2]*TreeNode{opts.Old, opts.New}
+	for i, side := range []struct {
+		fsys fsx.FS
+		pth  string
+	}{{fsysA, pthA}, {fsysB, pthB}} {
+		if trees[i] != nil {
+			continue
+		}
+		tree, err := NewTreeNode(side.fsys, side.pth, opts.Options)
+		if err != nil {
+			return nil, err
+		}
+		trees[i] = tree
+	}
+	if trees[0].h.opts.Algorithm != trees[1].h.opts.Algorithm {
+		return nil, serum.Error(ErrUnsupportedOption,
+			serum.WithMessageTemplate("can't compare a tree hashed with {{old}} with one hashed with {{new}}"),
+			serum.WithDetail("old", trees[0].h.opts.Algorithm.String()),
+			serum.WithDetail("new", trees[1].h.opts.Algorithm.String()),
+		)
+	}
+	d, err := CompareTrees(trees[0], trees[1])
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]Change, 0, len(d.Added)+len(d.Removed)+len(d.Modified))
+	for _, group := range []struct {
+		kind    ChangeKind
+		entries []TreeDiffEntry
+	}{{Added, d.Added}, {Removed, d.Removed}, {Modified, d.Modified}} {
+		for _, e := range group.entries {
+			c := Change{Path: e.Path, Kind: group.kind, OldHash: e.OldHash, NewHash: e.NewHash, OldMode: e.OldMode, NewMode: e.NewMode}
+			switch {
+			case group.kind != Modified:
+			case e.TypeChanged():
+				c.Kind = TypeChanged
+			case e.ModeOnly():
+				c.Kind = ModeChanged
+			}
+			changes = append(changes, c)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// diffJSONLine is the JSON object diff --json writes for each change.
+type diffJSONLine struct {
+	Path    string `json:"path"`
+	Kind    string `json:"kind"`
+	OldHash string `json:"oldHash,omitempty"`
+	NewHash string `json:"newHash,omitempty"`
+	OldMode string `json:"oldMode,omitempty"`
+	NewMode string `json:"newMode,omitempty"`
+}
+
+// mainDiff implements the diff subcommand, which hashes two directories (or, with --tar, a tar archive and a directory)
+// and prints the paths where they differ.
+// It returns the process exit code: 0 if nothing differs, 1 if anything does, or as per exitCode if an error occurs.
+func mainDiff(args []string) int {
+	fset := flag.NewFlagSet("diff", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s diff [flags] <old path> <new path>\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "       %s diff [flags] --tar <archive> <dir>\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nby default, prints \"A\\t<path>\", \"D\\t<path>\", \"M\\t<path>\", or \"T\\t<path>\" for each entry that's added, deleted, modified,\nor changed from one kind of thing to another (a file to a symlink or a directory, say), as git diff --name-status does,\nincluding the directories containing modified entries.\n")
+		fmt.Fprintf(fset.Output(), "entries whose content is the same, but whose mode differs, are also noted on stderr.\n\n")
+		fset.PrintDefaults()
+	}
+	algorithm := fset.String("algorithm", "sha256", "hash function to use, matching git's object format: \"sha256\" or \"sha1\"")
+	tarMode := fset.Bool("tar", false, "the old path is a tar archive (compressed or not; \"-\" for stdin), to compare with the directory it was made from or extracted to")
+	var opts Options
+	fset.BoolVar(&opts.IgnoreFileMode, "ignore-filemode", false, "record all regular files as 100644 on both sides, ignoring executable bits (which archives don't always keep)")
+	fset.BoolVar(&opts.IgnoreDotGit, "ignore-dot-git", false, "leave out anything named .git, at any depth, on both sides")
+	diffFormat := fset.String("diff-format", "name-status", "how to print the changes: \"name-status\", a line for each, as above;\n\"json\", a JSON object for each, on a line of its own, with its path, its kind (\"added\", \"removed\", \"modified\", \"type-changed\", or \"mode-changed\"), and the hash and mode on each side it's on;\nor \"stat\", only a line counting the files and symlinks added, removed, and modified (not the directories containing them)")
+	jsonOutput := fset.Bool("json", false, "the same as --diff-format=json")
+	nulTerminated := fset.Bool("z", false, "with --diff-format=name-status, separate the status from the path, and end each path, with a NUL rather than a tab and a newline, as git diff --name-status -z does")
+	fset.Parse(args)
+	if fset.NArg() != 2 {
+		fset.Usage()
+		return 2
+	}
+	if *jsonOutput {
+		*diffFormat = "json"
+	}
+	switch *diffFormat {
+	case "name-status":
+	case "json", "stat":
+		if *nulTerminated {
+			fmt.Fprintf(os.Stderr, "-z can only be used with --diff-format=name-status\n")
+			return 2
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown diff format %q\n", *diffFormat)
+		return 2
+	}
+	switch *algorithm {
+	case "sha256":
+		opts.Algorithm = SHA256
+	case "sha1":
+		opts.Algorithm = SHA1
+	default:
+		fmt.Fprintf(os.Stderr, "unknown algorithm %q\n", *algorithm)
+		return 2
+	}
+
+	var trees [2]*TreeNode
+	if *tarMode {
+		tree, err := newTarTreeNodeFromPath(fset.Arg(0), opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			return exitCode(err)
+		}
+		trees[0] = tree
+	}
+	for i := range trees {
+		if trees[i] != nil {
+			continue
+		}
+		tree, err := NewTreeNode(rawDirFS("."), filepath.Clean(fset.Arg(i)), opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+			return exitCode(err)
+		}
+		trees[i] = tree
+	}
+	changes, err := Diff(nil, "", nil, "", DiffOptions{Options: opts, Old: trees[0], New: trees[1]})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	if err := writeChanges(os.Stdout, changes, *diffFormat, *nulTerminated); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	execBitsDiffer := false
+	for _, c := range changes {
+		if c.Kind == ModeChanged {
+			fmt.Fprintf(os.Stderr, "note: %s differs only in mode: %s in %s, %s in %s\n", c.Path, c.OldMode, fset.Arg(0), c.NewMode, fset.Arg(1))
+			execBitsDiffer = execBitsDiffer || (strings.HasPrefix(c.OldMode, "100") && strings.HasPrefix(c.NewMode, "100"))
+		}
+	}
+	if execBitsDiffer {
+		fmt.Fprintf(os.Stderr, "note: with --ignore-filemode, executable bits are ignored on both sides\n")
+	}
+	if len(changes) != 0 {
+		return 1
+	}
+	return 0
+}
+
+// writeChanges prints a list of changes in one of the formats of diff --diff-format: "name-status", "json", or "stat".
+// With nulTerminated, name-status output separates the status from the path, and ends each path, with a NUL.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if writing fails.
+func writeChanges(w io.Writer, changes []Change, format string, nulTerminated bool) error {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case "name-status":
+		sep, end := "\t", "\n"
+		if nulTerminated {
+			sep, end = "\x00", "\x00"
+		}
+		for _, c := range changes {
+			status := "M"
+			switch c.Kind {
+			case Added:
+				status = "A"
+			case Removed:
+				status = "D"
+			case TypeChanged:
+				status = "T"
+			}
+			bw.WriteString(status + sep + c.Path + end)
+		}
+	case "json":
+		enc := json.NewEncoder(bw)
+		for _, c := range changes {
+			enc.Encode(diffJSONLine{Path: c.Path, Kind: c.Kind.String(), OldHash: hex.EncodeToString(c.OldHash), NewHash: hex.EncodeToString(c.NewHash), OldMode: c.OldMode, NewMode: c.NewMode})
+		}
+	case "stat":
+		var added, removed, modified int
+		for _, c := range changes {
+			if (c.OldMode == "" || gitModeKind(c.OldMode) == "tree") && (c.NewMode == "" || gitModeKind(c.NewMode) == "tree") {
+				continue // A directory: what's in it is counted instead.
+			}
+			switch c.Kind {
+			case Added:
+				added++
+			case Removed:
+				removed++
+			default:
+				modified++
+			}
+		}
+		fmt.Fprintf(bw, "%d added, %d removed, %d modified\n", added, removed, modified)
+	}
+	if err := bw.Flush(); err != nil {
+		return newErrIO(err)
+	}
+	return nil
+}
+
+// newTarTreeNodeFromPath reads the tar archive at a path, or on stdin if the path is "-", with NewTarTreeNode.
+//
+// Errors:
+//
+//   - gittreehash-error-not-found -- if there's no file at the path.
+//   - gittreehash-error-io -- if the file can't be opened.
+//   - gittreehash-error-permission -- if the file can't be opened due to permissions.
+//   - any error NewTarTreeNode may return.
+func newTarTreeNodeFromPath(pth string, opts Options) (*TreeNode, error) {
+	if pth == "-" {
+		return NewTarTreeNode(os.Stdin, CompressionAuto, opts)
+	}
+	f, err := os.Open(pth)
+	if err != nil {
+		if isVanished(err) {
+			return nil, NewErrNotFound(pth)
+		}
+		return nil, newErrIO(err)
+	}
+	defer f.Close()
+	return NewTarTreeNode(f, CompressionAuto, opts)
+}
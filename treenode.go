@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+
+	"github.com/serum-errors/go-serum"
+	"github.com/warpfork/go-fsx"
+)
+
+const ErrNotATree = "gittreehash-error-not-a-tree"
+
+var _ io.WriterTo = (*TreeNode)(nil)
+
+// TreeNode is an entry in a tree on a filesystem, which is read and hashed lazily, only as it's asked about.
+// Listing a directory's children reads just that directory; hashing a node hashes everything beneath it.
+// Both results are kept, so walking a tree that's been hashed (via Children, and each child's Hash)
+// doesn't touch the filesystem again.
+//
+// All the nodes of a tree share the Options given to NewTreeNode, including Stats and the OnEntry callback.
+// Children are hashed one at a time, whatever Options.Concurrency says, and Options.Audit is ignored.
+// A TreeNode isn't safe for concurrent use.
+type TreeNode struct {
+	h     *hasher
+	name  string      // As recorded in the parent's tree.  Empty for the root.
+	path  string      // As given to the filesystem.
+	anc   *ancestry   // Of the directory containing this node; nil for the root.
+	ent   fs.DirEntry // From the parent's listing; nil for the root.
+	isDir bool
+
+	listed   bool
+	children []*TreeNode
+	listErr  error
+
+	hashed  bool
+	hash    [32]byte
+	mode    fs.FileMode // As written into the parent's tree.
+	hashErr error       // Possibly an abortError, if the ErrorHandler has already seen it.
+	skipped bool        // The ErrorHandler chose to leave this out of its parent's tree.
+
+	git   *gitObjectReader // For a tree in a git repository, what reads it; nil for one on a filesystem.
+	gitID string           // For a tree in a git repository, the hex id of the object.
+}
+
+// NewTreeNode returns the root of the tree at the given path.  Nothing beyond the root itself is read yet.
+//
+// Errors:
+//
+//   - gittreehash-error-not-found -- if there's nothing at the path.
+//   - gittreehash-error-io -- if the path can't be inspected.
+//   - gittreehash-error-permission -- if the path can't be inspected due to permissions.
+func NewTreeNode(fsys fsx.FS, pth string, opts Options) (*TreeNode, error) {
+	fi, err := fsx.Lstat(fsys, pth)
+	if err != nil {
+		if isVanished(err) {
+			return nil, NewErrNotFound(pth)
+		}
+		return nil, newErrIO(err)
+	}
+	return &TreeNode{h: newHasher(fsys, opts), path: pth, isDir: fi.IsDir()}, nil
+}
+
+// NewTarTreeNode reads a tar stream, which may be compressed (as for HashCompressedTar), and returns the root of the tree it describes.
+// Unlike NewTreeNode, this reads and hashes everything at once, since a stream can't be revisited;
+// the nodes hold only hashes, and Path returns slash-separated paths within the archive.
+// Options.IgnoreDotGit leaves out anything named .git, as it would from a directory, so the two can be compared alike.
+//
+// Errors:
+//
+//   - any error HashCompressedTar may return.
+func NewTarTreeNode(r io.Reader, compression Compression, opts Options) (*TreeNode, error) {
+	d, err := newDecompressor(r, compression)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	h := newHasher(nil, opts)
+	root, err := h.readTar(d, nil, nil)
+	if err != nil {
+		return nil, d.explain(unwrapAbort(err))
+	}
+	return h.vnodeTreeNode("", ".", root), nil
+}
+
+// vnodeTreeNode converts a vnode tree into TreeNodes which are already listed and hashed, hashing its directories on the way.
+func (h *hasher) vnodeTreeNode(name, pth string, vn *vnode) *TreeNode {
+	n := &TreeNode{h: h, name: name, path: pth, isDir: vn.mode.IsDir(), listed: true, hashed: true, mode: vn.mode}
+	if !n.isDir {
+		n.hash = vn.hash
+		return n
+	}
+	names := make([]string, 0, len(vn.children))
+	for childName := range vn.children {
+		if h.opts.IgnoreDotGit && childName == ".git" {
+			continue
+		}
+		names = append(names, childName)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return treeEntrySortKey(names[i], vn.children[names[i]].mode.IsDir()) < treeEntrySortKey(names[j], vn.children[names[j]].mode.IsDir())
+	})
+	buf := getTreeBuffer()
+	defer putTreeBuffer(buf)
+	for _, childName := range names {
+		child := h.vnodeTreeNode(childName, path.Join(pth, childName), vn.children[childName])
+		n.children = append(n.children, child)
+		h.writeTreeEntry(buf, childName, child.mode, child.hash)
+	}
+	bodyLen := buf.Len()
+	n.hash = h.hashTreeBody(pth, buf)
+	h.emit(pth, n.hash, n.mode, int64(bodyLen))
+	return n
+}
+
+// Name returns the name of the node, as it's recorded in its parent's tree.  The root's name is empty.
+func (n *TreeNode) Name() string { return n.name }
+
+// Path returns the path of the node on the filesystem.
+func (n *TreeNode) Path() string { return n.path }
+
+// IsDir reports whether the node is a directory (as of when its parent was listed).
+func (n *TreeNode) IsDir() bool { return n.isDir }
+
+// Children lists the entries of a directory, in the order they appear in its tree object.
+// Anything that isn't a directory has no children.
+//
+// Once the directory has been hashed, any entries the ErrorHandler chose to skip are left out.
+//
+// Errors:
+//
+//   - gittreehash-error-concurrent-io -- if the directory vanishes, or is no longer a directory.
+//   - gittreehash-error-not-found -- if the directory is the root, and it's gone.
+//   - any error HashPath may return for a directory, other than from hashing its contents.
+func (n *TreeNode) Children() ([]*TreeNode, error) {
+	if !n.isDir {
+		return nil, nil
+	}
+	if !n.listed {
+		n.listed = true
+		n.children, n.listErr = n.list()
+	}
+	if n.listErr != nil {
+		return nil, unwrapAbort(n.listErr)
+	}
+	children := make([]*TreeNode, 0, len(n.children))
+	for _, child := range n.children {
+		if !child.skipped {
+			children = append(children, child)
+		}
+	}
+	return children, nil
+}
+
+func (n *TreeNode) list() ([]*TreeNode, error) {
+	if n.git != nil {
+		return n.listGit()
+	}
+	h := n.h
+	var fi fs.FileInfo
+	var err error
+	if n.ent != nil {
+		fi, err = n.ent.Info()
+	} else {
+		fi, err = fsx.Lstat(h.fsys, n.path)
+	}
+	if err != nil {
+		if isVanished(err) {
+			if n.anc == nil {
+				return nil, NewErrNotFound(n.path)
+			}
+			return nil, NewErrVanished(n.path)
+		}
+		return nil, newErrIO(err)
+	}
+	if !fi.IsDir() {
+		return nil, NewErrFileChanged(n.path, "a directory", describeFileInfo(fi))
+	}
+	n.mode = fi.Mode()
+	anc, entries, err := h.listTree(n.anc, n.path, fi)
+	if err != nil {
+		return nil, err
+	}
+	children := make([]*TreeNode, len(entries))
+	for i, ent := range entries {
+		children[i] = &TreeNode{h: h, name: ent.name, path: ent.path, anc: anc, ent: ent.dirEnt, isDir: ent.dirEnt.IsDir()}
+	}
+	return children, nil
+}
+
+// Hash returns the hash of the node: a tree hash for a directory, or a blob hash for anything else.
+// The first call hashes everything beneath the node; later calls return the same result.
+//
+// Errors:
+//
+//   - any error HashPath may return.
+func (n *TreeNode) Hash() ([32]byte, error) {
+	if err := n.ensureHashed(); err != nil {
+		return [32]byte{}, unwrapAbort(err)
+	}
+	return n.hash, nil
+}
+
+// hashBytes returns the node's hash, trimmed to the algorithm's length, once it's been hashed.
+func (n *TreeNode) hashBytes() []byte {
+	return append([]byte(nil), n.hash[:n.h.opts.Algorithm.Size()]...)
+}
+
+// gitMode returns the node's mode as it's written in its parent's tree, once it's been hashed.
+func (n *TreeNode) gitMode() string {
+	if n.isDir {
+		return n.h.gitMode(fs.ModeDir) // A root node's mode isn't recorded, not being in any tree.
+	}
+	return n.h.gitMode(n.mode)
+}
+
+func (n *TreeNode) ensureHashed() error {
+	if !n.hashed {
+		n.hashed = true
+		if n.isDir {
+			n.hash, n.hashErr = n.hashTree()
+		} else if n.ent != nil {
+			n.hash, n.mode, n.hashErr = n.h.hashChild(treeChild{n.name, n.path, n.ent}, n.anc)
+		} else {
+			n.hash, n.mode, n.hashErr = n.h.hashSomething(n.path, n.anc)
+		}
+	}
+	return n.hashErr
+}
+
+func (n *TreeNode) hashTree() ([32]byte, error) {
+	h := n.h
+	buf := getTreeBuffer()
+	defer putTreeBuffer(buf)
+	if err := n.writeBody(buf); err != nil {
+		return [32]byte{}, err
+	}
+	bodyLen := buf.Len()
+	hash := h.hashTreeBody(n.path, buf)
+	h.emit(n.path, hash, n.mode, int64(bodyLen))
+	return hash, nil
+}
+
+// writeBody hashes each child, if that's not been done yet, and writes its entry into the tree body.
+// Children that fail are offered to the ErrorHandler, and left out if it says so.
+func (n *TreeNode) writeBody(buf *bytes.Buffer) error {
+	if _, err := n.Children(); err != nil {
+		return err
+	}
+	h := n.h
+	for _, child := range n.children {
+		if child.skipped {
+			continue
+		}
+		if err := child.ensureHashed(); err != nil {
+			if err := h.handleChildError(child.path, err); err != nil {
+				return err
+			}
+			child.skipped = true
+			continue
+		}
+		h.writeTreeEntry(buf, child.name, child.mode, child.hash)
+	}
+	return nil
+}
+
+// WriteTo writes the body of a directory's tree object (that is, everything after the "tree <len>\x00" preamble),
+// hashing its children first if that's not been done yet.
+//
+// Errors:
+//
+//   - gittreehash-error-not-a-tree -- if the node isn't a directory.
+//   - any error Hash may return.
+//   - any error returned by the writer.
+func (n *TreeNode) WriteTo(w io.Writer) (int64, error) {
+	if !n.isDir {
+		return 0, serum.Error(ErrNotATree,
+			serum.WithMessageTemplate("{{path}} is not a directory, so has no tree body"),
+			serum.WithDetail("path", n.path),
+			withPathBytes("path", n.path),
+		)
+	}
+	if err := n.ensureHashed(); err != nil {
+		return 0, unwrapAbort(err)
+	}
+	buf := getTreeBuffer()
+	defer putTreeBuffer(buf)
+	if err := n.writeBody(buf); err != nil {
+		return 0, unwrapAbort(err)
+	}
+	return buf.WriteTo(w)
+}
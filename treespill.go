@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// DefaultTreeSpillThreshold is the tree body size beyond which bodies are spilled to disk when Options.TreeSpillThreshold is zero.
+const DefaultTreeSpillThreshold = 64 << 20
+
+// treeSpill is the part of a large tree body that's been moved out of memory into a temporary file.
+type treeSpill struct {
+	f    *os.File
+	size int64
+}
+
+// spillTreeBody moves the tree body accumulated in buf out to a temporary file, once it's grown past Options.TreeSpillThreshold,
+// creating the file the first time.  The caller must close the spill (if one's returned) on every path.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the temporary file can't be created or written.
+func (h *hasher) spillTreeBody(spill *treeSpill, buf *bytes.Buffer) (*treeSpill, error) {
+	if h.opts.TreeSpillThreshold < 0 || int64(buf.Len()) <= h.opts.TreeSpillThreshold {
+		return spill, nil
+	}
+	if spill == nil {
+		f, err := os.CreateTemp("", "gittreehash-tree-*")
+		if err != nil {
+			return nil, newErrIO(err)
+		}
+		spill = &treeSpill{f: f}
+	}
+	n, err := buf.WriteTo(spill.f)
+	spill.size += n
+	if err != nil {
+		return spill, newErrIO(err)
+	}
+	return spill, nil
+}
+
+// hashSpilledTree hashes a tree whose body is in a spill file, followed by whatever remains in buf,
+// streaming the file back rather than reading it into memory.  It returns the hash and the body's length.
+// Spilled bodies aren't memoized, nor given to onTreeBody.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if the temporary file can't be written or read back.
+func (h *hasher) hashSpilledTree(spill *treeSpill, buf *bytes.Buffer) ([32]byte, int64, error) {
+	if _, err := spill.f.Seek(0, io.SeekStart); err != nil {
+		return [32]byte{}, 0, newErrIO(err)
+	}
+	size := spill.size + int64(buf.Len())
+	hash, n, err := h.hashObjectStream("tree", size, io.MultiReader(spill.f, buf))
+	if err != nil {
+		return [32]byte{}, 0, err
+	}
+	if n != size {
+		return [32]byte{}, 0, newErrIO(io.ErrUnexpectedEOF)
+	}
+	return hash, size, nil
+}
+
+// close removes the spill's temporary file.
+func (spill *treeSpill) close() {
+	spill.f.Close()
+	os.Remove(spill.f.Name())
+}
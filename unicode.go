@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/serum-errors/go-serum"
+	"golang.org/x/text/unicode/norm"
+)
+
+const ErrNameCollision = "gittreehash-error-name-collision"
+
+// UnicodeNormalization selects how filenames are normalized before being recorded in trees.
+// See Options.UnicodeNormalization.
+type UnicodeNormalization uint8
+
+const (
+	NormalizeNone UnicodeNormalization = iota // Record names exactly as the filesystem reports them.
+	NormalizeNFC                              // Record names in Unicode Normalization Form C (composed), as Linux and Windows tools usually produce them.
+	NormalizeNFD                              // Record names in Unicode Normalization Form D (decomposed), as older macOS filesystems store them.
+)
+
+// treeName returns the name to record in a tree for a directory entry, applying any normalization that's enabled:
+// unicode normalization first, and then case folding.
+// Bytes that aren't valid UTF-8 are left as they are.
+func (h *hasher) treeName(name string) string {
+	switch h.opts.UnicodeNormalization {
+	case NormalizeNFC:
+		name = norm.NFC.String(name)
+	case NormalizeNFD:
+		name = norm.NFD.String(name)
+	}
+	if h.opts.CaseFold {
+		name = lowerPreservingInvalid(name)
+	}
+	return name
+}
+
+// lowerPreservingInvalid maps each letter to lower case, as strings.ToLower does,
+// but leaves bytes that aren't valid UTF-8 as they are, rather than replacing them.
+func lowerPreservingInvalid(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size <= 1 {
+			b.WriteByte(s[i])
+		} else {
+			b.WriteRune(unicode.ToLower(r))
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// NewErrNameCollision reports two entries in one directory whose names are the same after normalization
+// (unicode normalization, or case folding), which a tree can't record.
+func NewErrNameCollision(dir, name1, name2 string) error {
+	return serum.Error(
+		ErrNameCollision,
+		serum.WithMessageTemplate("names {{name1}} and {{name2}} in {{path}} are the same after normalization"),
+		serum.WithDetail("path", dir),
+		withPathBytes("path", dir),
+		serum.WithDetail("name1", name1),
+		withPathBytes("name1", name1),
+		serum.WithDetail("name2", name2),
+		withPathBytes("name2", name2),
+	)
+}
+
+// SkipNameCollisions is an ErrorHandler which omits the later of two entries whose names are the same after normalization
+// (noting each on stderr), keeping the one whose name as found sorts first, and halts on any other kind of error.
+// This is what a case-insensitive filesystem would show, were the files copied onto one.
+// A nil error is passed through, so this can be applied after another handler.
+func SkipNameCollisions(pth string, err error) error {
+	if serum.Code(err) != ErrNameCollision {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "warning: skipping %q: %s\n", pth, err)
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io/fs"
+
+	"github.com/serum-errors/go-serum"
+)
+
+// isVanishedEntry reports whether an error is the one NewErrVanished gives for the path.
+func isVanishedEntry(err error, pth string) bool {
+	return serum.Code(err) == ErrConcurrentIO && serum.Detail(err, "entry") != "" && serum.Detail(err, "path") == pth
+}
+
+// nullHashVanished stands in for an entry which vanished after its directory was listed, as Options.OnVanished asks:
+// it's recorded with an all-zeros hash, and as whatever the listing said it was (with no exec bits, for a file).
+func (h *hasher) nullHashVanished(child treeChild) ([32]byte, fs.FileMode) {
+	mode := fs.FileMode(0o644)
+	switch typ := child.dirEnt.Type(); {
+	case typ.IsDir():
+		mode = fs.ModeDir
+	case typ&fs.ModeSymlink != 0:
+		mode = fs.ModeSymlink
+	}
+	h.mu.Lock()
+	h.opts.OnVanished(child.path)
+	h.mu.Unlock()
+	return [32]byte{}, mode
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/serum-errors/go-serum"
+)
+
+// VerifyAgainstGit compares a directory with a tree committed in a git repository (the tree-ish is anything git can resolve to a tree,
+// like "HEAD", "v1.0", or "main:some/dir"), returning the differences as CompareTrees does, with the repository's tree as the old side.
+//
+// The directory is hashed with the repository's object format, whatever Options.Algorithm says, so that its hashes are git's ids;
+// then the repository's trees are read, with `git cat-file --batch`, only where those differ.
+// A matching subtree is never read at all, so checking a large checkout that's nearly right costs little more than hashing it.
+//
+// Options that change what's hashed, like IgnoreDotGit, apply to the directory only: git's trees are taken exactly as they are,
+// so IgnoreFileMode (which would give them different ids) isn't allowed.
+//
+// Errors:
+//
+//   - gittreehash-error-unsupported-option -- if Options.IgnoreFileMode is set.
+//   - gittreehash-error-not-found -- if the repository has no object the tree-ish names, or it's not a tree.
+//   - gittreehash-error-unsupported-file-type -- if a differing tree in the repository has a submodule.
+//   - gittreehash-error-git -- if git can't be run, or fails, or its output isn't as expected.
+//   - gittreehash-error-invalid-tree -- if a tree in the repository can't be parsed.
+//   - any error HashPath may return, for the directory.
+func VerifyAgainstGit(repoPath, treeish, dir string, opts Options) (TreeDiff, error) {
+	if opts.IgnoreFileMode {
+		return TreeDiff{}, serum.Error(ErrUnsupportedOption,
+			serum.WithMessageTemplate("can't compare with a repository's trees with the options {{options}}"),
+			serum.WithDetail("options", "IgnoreFileMode"),
+		)
+	}
+	g, err := startGitObjectReader(repoPath, opts)
+	if err != nil {
+		return TreeDiff{}, err
+	}
+	defer g.close()
+	opts.Algorithm = g.repoAlgorithm
+	g.h = newHasher(nil, opts)
+
+	id, objType, size, err := g.requestPeeled(treeish)
+	if err != nil {
+		return TreeDiff{}, err
+	}
+	if _, err := io.Copy(io.Discard, io.LimitReader(g.r, size+1)); err != nil {
+		return TreeDiff{}, newErrGit(err, nil)
+	}
+	if objType != "tree" {
+		return TreeDiff{}, serum.Error(ErrNotFound,
+			serum.WithMessageTemplate("{{object}} is a {{type}}, not a tree"),
+			serum.WithDetail("object", treeish),
+			serum.WithDetail("type", objType),
+		)
+	}
+	old := &TreeNode{h: g.h, path: ".", isDir: true, hashed: true, mode: fs.ModeDir, git: g, gitID: id}
+	if _, err := hex.Decode(old.hash[:], []byte(id)); err != nil {
+		return TreeDiff{}, newErrGit(fmt.Errorf("unexpected object id %q from git cat-file", id), nil)
+	}
+
+	cur, err := NewTreeNode(rawDirFS("."), dir, opts)
+	if err != nil {
+		return TreeDiff{}, err
+	}
+	return CompareTrees(old, cur)
+}
+
+// listGit lists the entries of a tree in a git repository, each of which is already hashed, being given its id by the tree.
+//
+// Errors:
+//
+//   - gittreehash-error-unsupported-file-type -- if the tree has a submodule.
+//   - gittreehash-error-not-found -- if the repository doesn't have the tree.
+//   - gittreehash-error-git -- if git's output isn't as expected.
+//   - gittreehash-error-invalid-tree -- if the tree can't be parsed.
+func (n *TreeNode) listGit() ([]*TreeNode, error) {
+	id, objType, size, err := n.git.request(n.gitID)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, size+1)
+	if _, err := io.ReadFull(n.git.r, body); err != nil {
+		return nil, newErrGit(fmt.Errorf("reading tree %s from git cat-file: %w", id, err), nil)
+	}
+	if objType != "tree" {
+		return nil, newErrGit(fmt.Errorf("%s is a %s, not a tree", id, objType), nil)
+	}
+	entries, err := parseTreeBody(body[:size], n.git.repoAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	children := make([]*TreeNode, 0, len(entries))
+	for _, e := range entries {
+		childPath := path.Join(n.path, e.Name)
+		if e.Type() == "commit" {
+			return nil, NewErrUnsupportedFileType("submodule", childPath)
+		}
+		mode, err := gitModeToFileMode(e.Mode)
+		if err != nil {
+			return nil, err
+		}
+		child := &TreeNode{h: n.h, name: e.Name, path: childPath, isDir: mode.IsDir(), hashed: true, mode: mode, git: n.git, gitID: hex.EncodeToString(e.Hash)}
+		copy(child.hash[:], e.Hash)
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// mainVerifyAgainstGit implements the verify-against-git subcommand, which compares a directory with a tree in a git repository,
+// and prints the paths where they differ.
+// It returns the process exit code: 0 if the directory matches, 1 if it doesn't, or as per exitCode if an error occurs.
+func mainVerifyAgainstGit(args []string) int {
+	fset := flag.NewFlagSet("verify-against-git", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s verify-against-git [flags] <repo-path> <tree-ish> <dir>\n", os.Args[0])
+		fmt.Fprintf(fset.Output(), "\nchecks that the directory exactly matches the tree-ish (like \"HEAD\", \"v1.0\", or \"main:some/dir\"), using the repository's object format.\n")
+		fmt.Fprintf(fset.Output(), "prints \"A\\t<path>\" for what's only in the directory, \"D\\t<path>\" for what's only in the tree,\n")
+		fmt.Fprintf(fset.Output(), "\"T\\t<path>\" where one has a file, symlink, or directory and the other a different kind of thing,\n")
+		fmt.Fprintf(fset.Output(), "and \"M\\t<path>\" where the content, symlink target, or mode differs, including the directories containing any of those.\n")
+		fmt.Fprintf(fset.Output(), "exits 0 if they match, 1 if they don't.\n\n")
+		fset.PrintDefaults()
+	}
+	var opts Options
+	fset.BoolVar(&opts.IgnoreDotGit, "ignore-dot-git", true, "leave out anything named .git in the directory, at any depth, as git does")
+	fset.BoolVar(&opts.RespectGitattributesEOL, "respect-gitattributes-eol", false, "apply the text and eol attributes from .gitattributes files in the directory, converting CRLF to LF as git would")
+	fset.Parse(args)
+	if fset.NArg() != 3 {
+		fset.Usage()
+		return 2
+	}
+
+	d, err := VerifyAgainstGit(fset.Arg(0), fset.Arg(1), filepath.Clean(fset.Arg(2)), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", serum.ToJSONString(err))
+		return exitCode(err)
+	}
+	var lines []string
+	for _, e := range d.Added {
+		lines = append(lines, "A\t"+e.Path)
+	}
+	for _, e := range d.Removed {
+		lines = append(lines, "D\t"+e.Path)
+	}
+	for _, e := range d.Modified {
+		if e.TypeChanged() {
+			lines = append(lines, "T\t"+e.Path)
+		} else {
+			lines = append(lines, "M\t"+e.Path)
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	if !d.Empty() {
+		return 1
+	}
+	return 0
+}
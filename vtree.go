@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+const ErrInvalidPath = "gittreehash-error-invalid-path"
+
+// vnode is a node in a tree that's assembled in memory, rather than read from a filesystem.
+// This is used when the source of the content is sequential (like a tar stream) or synthetic,
+// and so can't be walked in the sorted order that tree hashing requires.
+//
+// Blobs are hashed as soon as they're added, so only hashes (not content) are held in memory.
+type vnode struct {
+	mode     fs.FileMode // fs.ModeDir, fs.ModeSymlink, or zero plus permission bits for regular files.
+	hash     [32]byte    // For blobs.  Directories are hashed when the whole tree is hashed.
+	size     int64       // For blobs, the length of the content.
+	children map[string]*vnode
+}
+
+func newVdir() *vnode {
+	return &vnode{mode: fs.ModeDir, children: map[string]*vnode{}}
+}
+
+// cleanVpath normalizes a slash-separated path for use in a vnode tree.
+// Leading slashes and "./" are dropped; paths which would escape the root are rejected.
+//
+// Errors:
+//
+//   - gittreehash-error-invalid-path -- if the path escapes the root, or is empty.
+func cleanVpath(pth string) (string, error) {
+	cleaned := path.Clean("/" + pth)
+	if strings.Contains(pth, "..") {
+		// Clean would quietly turn "a/../../b" into "/b"; we'd rather refuse anything that tries to climb out.
+		for _, seg := range strings.Split(pth, "/") {
+			if seg == ".." {
+				return "", serum.Error(ErrInvalidPath,
+					serum.WithMessageTemplate("path {{path}} contains \"..\", which is not allowed"),
+					serum.WithDetail("path", pth),
+					withPathBytes("path", pth),
+				)
+			}
+		}
+	}
+	cleaned = strings.TrimPrefix(cleaned, "/")
+	if cleaned == "" {
+		return "", serum.Error(ErrInvalidPath,
+			serum.WithMessageTemplate("path {{path}} refers to the root itself"),
+			serum.WithDetail("path", pth),
+			withPathBytes("path", pth),
+		)
+	}
+	return cleaned, nil
+}
+
+// mkdirAll returns the directory at the given (cleaned) path, creating it and any parents as necessary.
+// An existing non-directory in the way is replaced, as extracting an archive would do.
+func (n *vnode) mkdirAll(pth string) *vnode {
+	if pth == "" || pth == "." {
+		return n
+	}
+	cur := n
+	for _, seg := range strings.Split(pth, "/") {
+		next, ok := cur.children[seg]
+		if !ok || !next.mode.IsDir() {
+			next = newVdir()
+			cur.children[seg] = next
+		}
+		cur = next
+	}
+	return cur
+}
+
+// put places a node at the given (cleaned) path, creating parent directories as necessary
+// and replacing anything already there.
+// If both the existing node and the new one are directories, the existing one is kept,
+// so that a directory entry appearing after its contents doesn't erase them.
+func (n *vnode) put(pth string, child *vnode) {
+	dir, name := path.Split(pth)
+	parent := n.mkdirAll(strings.TrimSuffix(dir, "/"))
+	if existing, ok := parent.children[name]; ok && existing.mode.IsDir() && child.mode.IsDir() {
+		existing.mode = child.mode
+		return
+	}
+	parent.children[name] = child
+}
+
+// get returns the node at the given (cleaned) path, or nil if there's nothing there.
+func (n *vnode) get(pth string) *vnode {
+	cur := n
+	for _, seg := range strings.Split(pth, "/") {
+		if cur.children == nil {
+			return nil
+		}
+		cur = cur.children[seg]
+		if cur == nil {
+			return nil
+		}
+	}
+	return cur
+}
+
+// hashVnode computes the hash of a vnode, recursively hashing the trees beneath it.
+// The pth parameter is only used for reporting to Options.OnEntry; blobs were already reported when added.
+func (h *hasher) hashVnode(pth string, n *vnode) [32]byte {
+	if !n.mode.IsDir() {
+		return n.hash
+	}
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return treeEntrySortKey(names[i], n.children[names[i]].mode.IsDir()) < treeEntrySortKey(names[j], n.children[names[j]].mode.IsDir())
+	})
+	buf := getTreeBuffer()
+	defer putTreeBuffer(buf)
+	for _, name := range names {
+		child := n.children[name]
+		hash := h.hashVnode(path.Join(pth, name), child)
+		h.writeTreeEntry(buf, name, child.mode, hash)
+	}
+	bodyLen := buf.Len()
+	hash := h.hashTreeBody(pth, buf)
+	h.emit(pth, hash, n.mode, int64(bodyLen))
+	return hash
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+)
+
+// HashZip computes the tree hash of the contents of a zip archive: the hash HashPath would give for the directory it extracts to.
+//
+// Entries are taken from the archive's central directory, in whatever order they're listed there.
+// Where the archive was made on unix, the modes it recorded give exec bits, and identify symlinks (whose content is their target);
+// otherwise everything is a regular file with no exec bits.  Names ending in a slash are directories, and entries for directories are optional.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if reading the archive fails, or it's not a valid zip archive.
+//   - gittreehash-error-invalid-path -- if the archive contains a path that escapes its root.
+//   - gittreehash-error-invalid-entry -- if the archive contains the same path twice, or a path beneath a file.
+//   - gittreehash-error-unsupported-file-type -- if the archive contains device nodes, etc.
+//   - any error returned by Options.ErrorHandler.
+func HashZip(r io.ReaderAt, size int64, opts Options) ([32]byte, error) {
+	h := newHasher(nil, opts)
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return [32]byte{}, serum.Errorf(ErrIO, "reading zip: %w", err)
+	}
+	root, err := h.readZip(zr)
+	if err != nil {
+		return [32]byte{}, unwrapAbort(err)
+	}
+	return h.hashVnode(".", root), nil
+}
+
+// hashZipFile hashes the zip archive at a path.
+//
+// Errors:
+//
+//   - gittreehash-error-not-found -- if there's no file at the path.
+//   - gittreehash-error-io -- if the file can't be opened.
+//   - gittreehash-error-permission -- if the file can't be opened due to permissions.
+//   - any error HashZip may return.
+func hashZipFile(pth string, opts Options) ([32]byte, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		if isVanished(err) {
+			return [32]byte{}, NewErrNotFound(pth)
+		}
+		return [32]byte{}, newErrIO(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return [32]byte{}, newErrIO(err)
+	}
+	return HashZip(f, fi.Size(), opts)
+}
+
+// readZip reads a zip archive into a vnode tree, hashing blobs as it goes.
+// Entries are left out as the filtering options say; see excludedFromArchive.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if reading an entry fails.
+//   - gittreehash-error-invalid-path -- if the archive contains a path that escapes its root.
+//   - gittreehash-error-invalid-entry -- if the archive contains the same path twice, or a path beneath a file.
+//   - gittreehash-error-unsupported-file-type -- if the archive contains device nodes, etc.
+//   - any error returned by Options.ErrorHandler (wrapped in abortError).
+func (h *hasher) readZip(zr *zip.Reader) (*vnode, error) {
+	root := newVdir()
+	seen := map[string]bool{} // Every path with an entry of its own; true for directories.
+	for _, f := range zr.File {
+		isDir := strings.HasSuffix(f.Name, "/") || f.Mode().IsDir()
+		pth, err := cleanVpath(f.Name)
+		if err != nil {
+			if isDir && strings.Trim(f.Name, "./") == "" {
+				continue // An entry for the root directory itself.  Nothing to record.
+			}
+			return nil, err
+		}
+		pth = h.treeName(pth)
+		if _, dup := seen[pth]; dup {
+			return nil, newErrInvalidEntry(pth, "the archive contains it more than once")
+		}
+		for dir := parentVpath(pth); dir != ""; dir = parentVpath(dir) {
+			if wasDir, ok := seen[dir]; ok && !wasDir {
+				return nil, newErrInvalidEntry(pth, "it's beneath "+dir+", which is not a directory")
+			}
+		}
+		if existing := root.get(pth); existing != nil && !isDir {
+			return nil, newErrInvalidEntry(pth, "it's not a directory, but other entries are beneath it")
+		}
+		seen[pth] = isDir
+
+		mode := f.Mode()
+		switch {
+		case isDir && h.excludedFromArchive(pth, fs.ModeDir, 0):
+		case !isDir && h.excludedFromArchive(pth, mode, int64(f.UncompressedSize64)):
+		case isDir:
+			root.put(pth, newVdir())
+		case mode.Type() == 0:
+			hash, size, err := h.hashZipEntry(pth, f)
+			if err != nil {
+				return nil, err
+			}
+			root.put(pth, &vnode{mode: mode.Perm(), hash: hash, size: size})
+			h.emit(pth, hash, mode.Perm(), size)
+		case mode.Type() == fs.ModeSymlink:
+			hash, size, err := h.hashZipEntry(pth, f)
+			if err != nil {
+				return nil, err
+			}
+			mode = fs.ModeSymlink | mode.Perm()
+			root.put(pth, &vnode{mode: mode, hash: hash, size: size})
+			h.emit(pth, hash, mode, size)
+		default:
+			typ := "irregular"
+			switch mode.Type() {
+			case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+				typ = "device"
+			case fs.ModeNamedPipe:
+				typ = "pipe"
+			case fs.ModeSocket:
+				typ = "socket"
+			}
+			if err := h.handleChildError(pth, NewErrUnsupportedFileType(typ, pth)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return root, nil
+}
+
+// hashZipEntry decompresses and hashes the content of a zip entry as a blob.
+//
+// Errors:
+//
+//   - gittreehash-error-io -- if decompressing fails, or the content doesn't match its recorded size or checksum.
+func (h *hasher) hashZipEntry(pth string, f *zip.File) ([32]byte, int64, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return [32]byte{}, 0, serum.Errorf(ErrIO, "reading zip entry %q: %w", f.Name, err)
+	}
+	defer rc.Close()
+	return h.hashBlobStream(pth, rc, int64(f.UncompressedSize64)) // Reads to the end, which is when the checksum is checked.
+}
+
+// parentVpath returns the directory containing a (cleaned) vnode path, or "" for something at the root.
+func parentVpath(pth string) string {
+	if i := strings.LastIndexByte(pth, '/'); i >= 0 {
+		return pth[:i]
+	}
+	return ""
+}